@@ -0,0 +1,7 @@
+package main
+
+import "proj/internal/datanode"
+
+func main() {
+	datanode.Main()
+}
@@ -3,13 +3,16 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
-	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
 	pb "proj/Services"
+	"proj/dfs"
 	"strings"
 
 	"google.golang.org/grpc"
@@ -55,12 +58,11 @@ func main() {
 	md := metadata.Pairs("client-ip", "localhost", "client-port", "12345")
 	ctx := metadata.NewOutgoingContext(context.Background(), md)
 
-	masterConn, err := grpc.Dial(masterAddress, grpc.WithInsecure())
+	dfsClient, err := dfs.Dial(masterAddress)
 	if err != nil {
 		log.Fatalf("Cannot Dial Masternode %v", err)
 	}
-	defer masterConn.Close()
-	masterClient := pb.NewFileServiceClient(masterConn)
+	defer dfsClient.Close()
 
 	for {
 		fmt.Print("Please enter u to Upload, d to Download, e to Exit\n")
@@ -73,10 +75,10 @@ func main() {
 
 		switch command {
 		case "u":
-			uploadFile(ctx, masterClient)
+			uploadFile(ctx, dfsClient)
 
 		case "d":
-			downloadFile(ctx, masterClient)
+			downloadFile(ctx, dfsClient)
 
 		case "e":
 			fmt.Println("Shutting down client...")
@@ -88,9 +90,25 @@ func main() {
 	}
 }
 
-const chunkSize = 1024 * 1024 // 1MB
+// progressWriter prints a progress bar as bytes pass through it
+type progressWriter struct {
+	label   string
+	written int64
+	total   int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	if p.total <= 0 {
+		fmt.Printf("\r%s: %d bytes", p.label, p.written)
+		return len(b), nil
+	}
+	progress := float64(p.written) / float64(p.total) * 100
+	fmt.Printf("\r%s: [%-50s] %.2f%%", p.label, strings.Repeat("=", int(progress/2)), progress)
+	return len(b), nil
+}
 
-func uploadFile(ctx context.Context, masterClient pb.FileServiceClient) {
+func uploadFile(ctx context.Context, dfsClient *dfs.Client) {
 	var filePath string
 	fmt.Print("Enter file path: ")
 	fmt.Scanln(&filePath)
@@ -99,82 +117,64 @@ func uploadFile(ctx context.Context, masterClient pb.FileServiceClient) {
 	splittedFile := strings.Split(filePath, "/")
 	fileName := splittedFile[len(splittedFile)-1]
 
-	// Read file content
-	fileData, err := os.ReadFile(filePath)
+	// Open the local file, it is streamed rather than read into memory
+	file, err := os.Open(filePath)
 	if err != nil {
 		log.Fatalf("Error reading file: %v", err)
 	}
-	totalSize := len(fileData)
-
-	// Request upload destination from master
-	response, err := masterClient.HandleUploadFile(ctx, &pb.HandleUploadFileRequest{})
+	defer file.Close()
+	info, err := file.Stat()
 	if err != nil {
-		log.Fatalf("Failed to get upload details: %v", err)
+		log.Fatalf("Error reading file: %v", err)
 	}
-	dataNodeAddr := fmt.Sprintf("%s:%d", response.IpAddress, response.PortNumber)
-	fmt.Println("Uploading to:", dataNodeAddr)
+	totalSize := info.Size()
 
-	// Connect to the DataNode
-	dataConn, err := grpc.Dial(dataNodeAddr, grpc.WithInsecure(), grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(1024*1024*100)))
+	// Skip the upload when the cluster already holds these bytes under this name
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		log.Fatalf("Error reading file: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		log.Fatalf("Error reading file: %v", err)
+	}
+	matches, err := dfsClient.FindByChecksum(ctx, hex.EncodeToString(hash.Sum(nil)))
 	if err != nil {
-		log.Fatalf("Could not connect to DataNode: %v", err)
+		log.Printf("Checksum lookup failed, uploading anyway: %v", err)
+	}
+	for _, match := range matches {
+		if match.FileName == fileName {
+			fmt.Printf("%s is already stored with the same content, skipping upload\n", fileName)
+			return
+		}
 	}
-	defer dataConn.Close()
-	dataClient := pb.NewFileServiceClient(dataConn)
 
-	// STEP 1: Begin upload session
-	_, err = dataClient.BeginUploadFile(ctx, &pb.FileUploadRequest{FileName: fileName})
+	// STEP 1: Begin upload session on the DataNode chosen by the master
+	writer, err := dfsClient.Create(ctx, fileName, dfs.WithSize(totalSize))
 	if err != nil {
 		log.Fatalf("BeginUpload failed: %v", err)
 	}
 	fmt.Printf("Started upload for %s (%d bytes)\n", fileName, totalSize)
 
 	// STEP 2: Upload file in chunks with progress indicator
-	for offset := 0; offset < totalSize; offset += chunkSize {
-		end := offset + chunkSize
-		if end > totalSize {
-			end = totalSize
-		}
-		chunk := fileData[offset:end]
-
-		_, err = dataClient.UpdateUploadFile(ctx, &pb.FileUploadRequest{
-			FileName:    fileName,
-			FileContent: chunk,
-		})
-		if err != nil {
-			log.Fatalf("UpdateUpload failed at offset %d: %v", offset, err)
-		}
-
-		// Print progress indicator
-		progress := float64(end) / float64(totalSize) * 100
-		fmt.Printf("\rUploading: [%-50s] %.2f%%", strings.Repeat("=", int(progress/2)), progress)
+	progress := &progressWriter{label: "Uploading", total: totalSize}
+	if _, err := io.Copy(writer, io.TeeReader(file, progress)); err != nil {
+		log.Fatalf("UpdateUpload failed: %v", err)
 	}
 	fmt.Println("\nUpload complete. Finalizing upload session...")
 
 	// STEP 3: End upload session
-	uploadResponse, err := dataClient.EndUploadFile(ctx, &pb.FileUploadRequest{
-		FileName: fileName,
-	})
-	if err != nil {
+	if err := writer.Close(); err != nil {
 		log.Fatalf("EndUpload failed: %v", err)
 	}
-	fmt.Println("Upload response:", uploadResponse.Message)
+	fmt.Println("Upload response: Upload complete")
 }
 
 // Download file from the distributed system
-func downloadFile(ctx context.Context, masterClient pb.FileServiceClient) {
+func downloadFile(ctx context.Context, dfsClient *dfs.Client) {
 	var fileName string
 	fmt.Print("Enter file name (without extension): ")
 	fmt.Scanln(&fileName)
 
-	// Request file locations from master
-	response, err := masterClient.HandleDownloadFile(ctx, &pb.HandleDownloadFileRequest{
-		FileName: fileName,
-	})
-	if err != nil {
-		log.Fatalf("Download request failed: %v", err)
-	}
-
 	// Ensure download directory exists
 	if _, err := os.Stat(downloadDir); os.IsNotExist(err) {
 		if err := os.Mkdir(downloadDir, 0755); err != nil {
@@ -182,37 +182,28 @@ func downloadFile(ctx context.Context, masterClient pb.FileServiceClient) {
 		}
 	}
 
-	// Select a random DataNode
-	availableNodes := len(response.IpAddress)
-	if availableNodes == 0 {
-		log.Fatal("No available DataNodes for download")
-	}
-
-	selectedIndex := rand.Intn(availableNodes)
-	dataNodeAddr := fmt.Sprintf("%s:%d", response.IpAddress[selectedIndex], response.PortNumbers[selectedIndex])
-	fmt.Println("Downloading from:", dataNodeAddr)
-
-	// Connect to DataNode
-	dataConn, err := grpc.Dial(dataNodeAddr, grpc.WithInsecure(), grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(1024*1024*100)))
+	// Stream the file from one of its replicas
+	reader, err := dfsClient.Open(ctx, fileName)
 	if err != nil {
-		log.Fatalf("Could not connect to DataNode: %v", err)
+		log.Fatalf("Download failed: %v", err)
 	}
-	defer dataConn.Close()
-	dataClient := pb.NewFileServiceClient(dataConn)
+	defer reader.Close()
 
-	// Request file download
-	downloadResponse, err := dataClient.DownloadFile(ctx, &pb.FileDownloadRequest{
-		FileName: fileName,
-	})
+	// Save downloaded file, nested names keep their directories
+	filePath := filepath.Join(downloadDir, filepath.FromSlash(fileName))
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		log.Fatalf("Failed to create download directory: %v", err)
+	}
+	file, err := os.Create(filePath)
 	if err != nil {
-		log.Fatalf("Download failed: %v", err)
+		log.Fatalf("Failed to save downloaded file: %v", err)
 	}
+	defer file.Close()
 
-	// Save downloaded file
-	filePath := filepath.Join(downloadDir, fileName)
-	if err := os.WriteFile(filePath, downloadResponse.FileContent, 0644); err != nil {
-		log.Fatalf("Failed to save downloaded file: %v", err)
+	progress := &progressWriter{label: "Downloading"}
+	if _, err := io.Copy(io.MultiWriter(file, progress), reader); err != nil {
+		log.Fatalf("Download failed: %v", err)
 	}
-	fmt.Printf("Download successful. File saved at: %s\n", filePath)
+	fmt.Printf("\nDownload successful. File saved at: %s\n", filePath)
 
 }
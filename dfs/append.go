@@ -0,0 +1,39 @@
+package dfs
+
+import (
+	"context"
+	"io"
+	pb "proj/Services"
+)
+
+/*
+Append returns a writer adding to the end of the stored fileName, so a
+growing file such as a log is sent a piece at a time instead of whole. The
+master sends it to a DataNode holding the file, which appends to a copy and
+swaps it in on Close; the other replicas are then replaced by copies of the
+new content. WithSize declares the bytes appended, WithContentEncoding must
+match the file's; plain data may be appended to a gzip file, the DataNode
+compresses it. Close fails with Aborted when the file was replaced or
+appended to by someone else meanwhile, the append can then be retried.
+*/
+func (c *Client) Append(ctx context.Context, fileName string, opts ...CreateOption) (io.WriteCloser, error) {
+	request := &pb.PrepareUploadRequest{FileName: fileName}
+	for _, opt := range opts {
+		opt(request)
+	}
+	request.Append = true
+	ctx, targets, err := c.startUpload(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, addr := range targets {
+		writer, err := openWriter(ctx, c, addr, fileName, request.FileSize, request.ContentEncoding != "", true)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return writer, nil
+	}
+	return nil, lastErr
+}
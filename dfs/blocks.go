@@ -0,0 +1,395 @@
+package dfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	pb "proj/Services"
+	"proj/internal/erasure"
+	"slices"
+	"strconv"
+)
+
+/*
+createBlocks starts the upload of a file stored in blocks, see WithBlockSize.
+The master names each block and where to store it; a file no larger than a
+block is stored whole, its targets taken as those of a single block.
+*/
+func (c *Client) createBlocks(ctx context.Context, request *pb.PrepareUploadRequest) (*BlockWriter, error) {
+	info, err := c.info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !info.has("blocks") {
+		return nil, errors.New("the master doesn't support storing files in blocks, upgrade it")
+	}
+	if request.FileSize <= 0 {
+		return nil, errors.New("a file stored in blocks needs its size, see WithSize")
+	}
+	response, err := c.prepareUpload(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get upload details: %v", err)
+	}
+	blocks := response.Blocks
+	if len(blocks) == 0 {
+		blocks = []*pb.UploadBlock{{FileName: request.FileName, Length: request.FileSize, Targets: response.Targets}}
+	}
+	writer := &BlockWriter{ctx: uploadContext(ctx, request, response.UploadToken), c: c, blocks: blocks}
+	for _, block := range blocks {
+		writer.erasureCoded = writer.erasureCoded || block.Parity > 0
+	}
+	return writer, nil
+}
+
+/*
+BlockWriter uploads a file stored in blocks. Each block is written to the
+first of its targets accepting it and committed once it holds its bytes;
+the master commits the file with its last block. Exactly the size declared
+with WithSize must be written.
+
+For an erasure-6-3 file the writer computes the parity of each stripe of up
+to six blocks as they are written and uploads its three parity blocks after
+them, holding three blocks' worth of parity in memory.
+*/
+type BlockWriter struct {
+	ctx    context.Context
+	c      *Client
+	blocks []*pb.UploadBlock // blocks not committed yet, the first one being written
+	// writer of the first block and the bytes written to it
+	current *Writer
+	written int64
+	closed  bool
+	// the master planned parity blocks, parity holds those of the stripe
+	// being written and shard is the index in it of the block written
+	erasureCoded bool
+	parity       [][]byte
+	shard        int
+}
+
+// Write implements io.Writer, committing each block as it fills.
+func (w *BlockWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrClosed
+	}
+	n := 0
+	for len(p) > 0 {
+		if len(w.blocks) == 0 {
+			return n, errors.New("write past the size declared with WithSize")
+		}
+		block := w.blocks[0]
+		if w.current == nil {
+			writer, err := w.openBlock(block)
+			if err != nil {
+				return n, err
+			}
+			w.current = writer
+			// a stripe's first block is its longest
+			if w.erasureCoded && w.parity == nil {
+				w.parity = make([][]byte, erasure.ParityShards)
+				for i := range w.parity {
+					w.parity[i] = make([]byte, block.Length)
+				}
+				w.shard = 0
+			}
+		}
+		written, err := w.current.Write(p[:min(int64(len(p)), block.Length-w.written)])
+		if w.parity != nil {
+			erasure.AddData(w.parity, w.shard, int(w.written), p[:written])
+		}
+		n += written
+		w.written += int64(written)
+		if err != nil {
+			return n, err
+		}
+		p = p[written:]
+		if w.written == block.Length {
+			err := w.current.Close()
+			w.current, w.written = nil, 0
+			if err != nil {
+				return n, fmt.Errorf("block at offset %d: %v", block.Offset, err)
+			}
+			w.blocks = w.blocks[1:]
+			w.shard++
+			if err := w.writeParity(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// writeParity uploads the parity blocks next in line once the data blocks of their stripe are written
+func (w *BlockWriter) writeParity() error {
+	if len(w.blocks) == 0 || w.blocks[0].Parity == 0 {
+		return nil
+	}
+	for len(w.blocks) > 0 && w.blocks[0].Parity > 0 {
+		block := w.blocks[0]
+		writer, err := w.openBlock(block)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(w.parity[block.Parity-1][:block.Length]); err != nil {
+			writer.Abort()
+			return fmt.Errorf("parity block %d at offset %d: %v", block.Parity, block.Offset, err)
+		}
+		if err := writer.Close(); err != nil {
+			return fmt.Errorf("parity block %d at offset %d: %v", block.Parity, block.Offset, err)
+		}
+		w.blocks = w.blocks[1:]
+	}
+	w.parity = nil
+	return nil
+}
+
+// openBlock begins the upload of block on the first of its targets that accepts it
+func (w *BlockWriter) openBlock(block *pb.UploadBlock) (*Writer, error) {
+	lastErr := fmt.Errorf("no upload targets for the block at offset %d", block.Offset)
+	for _, addr := range targetAddresses(block.Targets) {
+		writer, err := openWriter(w.ctx, w.c, addr, block.FileName, block.Length, false, false)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return writer, nil
+	}
+	return nil, lastErr
+}
+
+// Close checks the declared size was written, the file is then committed.
+func (w *BlockWriter) Close() error {
+	if w.closed {
+		return ErrClosed
+	}
+	if len(w.blocks) > 0 {
+		missing := -w.written
+		for _, block := range w.blocks {
+			if block.Parity == 0 {
+				missing += block.Length
+			}
+		}
+		w.Abort()
+		return fmt.Errorf("%d bytes short of the size declared with WithSize", missing)
+	}
+	w.closed = true
+	return nil
+}
+
+// Abort gives up the upload, the file isn't stored. The master deletes the
+// blocks already committed once the upload token expires.
+func (w *BlockWriter) Abort() error {
+	if w.closed {
+		return ErrClosed
+	}
+	w.closed = true
+	if w.current == nil {
+		return nil
+	}
+	return w.current.Abort()
+}
+
+/*
+blockReader reads a range of a file stored in blocks, block after block,
+each from the first of its replicas that serves it. A block read whole is
+verified against its checksum, like a file. A block of an erasure-6-3 file
+none of whose replicas serves it is decoded from six other blocks of its
+stripe.
+*/
+type blockReader struct {
+	ctx    context.Context
+	c      *Client
+	blocks []*pb.ReadBlock
+	// next offset to read and the end of the range
+	offset, end int64
+	current     io.ReadCloser
+	// end of the current block's part of the range
+	currentEnd int64
+}
+
+func newBlockReader(ctx context.Context, c *Client, blocks []*pb.ReadBlock, offset, length int64) *blockReader {
+	var end int64
+	for _, block := range blocks {
+		if block.Parity == 0 {
+			end = max(end, block.Offset+block.Length)
+		}
+	}
+	if length > 0 {
+		end = min(end, offset+length)
+	}
+	return &blockReader{ctx: ctx, c: c, blocks: blocks, offset: offset, end: end}
+}
+
+func (r *blockReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.offset >= r.end {
+				return 0, io.EOF
+			}
+			if err := r.openBlock(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.current.Read(p)
+		r.offset += int64(n)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if r.offset < r.currentEnd {
+				return n, io.ErrUnexpectedEOF
+			}
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		return n, err
+	}
+}
+
+// openBlock starts reading the block holding offset
+func (r *blockReader) openBlock() error {
+	var block *pb.ReadBlock
+	for _, candidate := range r.blocks {
+		if candidate.Parity == 0 && candidate.Offset <= r.offset && r.offset < candidate.Offset+candidate.Length {
+			block = candidate
+			break
+		}
+	}
+	if block == nil {
+		return fmt.Errorf("no block holds offset %d", r.offset)
+	}
+	from := r.offset - block.Offset
+	r.currentEnd = min(block.Offset+block.Length, r.end)
+	// the whole block is read as a file, which verifies it
+	length := r.currentEnd - r.offset
+	if from == 0 && length == block.Length {
+		length = 0
+	}
+
+	lastErr := fmt.Errorf("no available DataNodes for the block at offset %d", block.Offset)
+	for _, replica := range block.Replicas {
+		if !replica.Alive || replica.Corrupt {
+			continue
+		}
+		addr := net.JoinHostPort(replica.IpAddress, strconv.Itoa(int(replica.PortNumber)))
+		reader, err := openReader(r.ctx, r.c, addr, block.FileName, from, length, false)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		r.current = reader
+		return nil
+	}
+	for _, stripe := range readStripes(r.blocks) {
+		if !slices.Contains(stripe[:], block) {
+			continue
+		}
+		content, err := r.decode(stripe, block)
+		if err != nil {
+			return fmt.Errorf("%v, decoding it from its stripe failed: %v", lastErr, err)
+		}
+		r.current = io.NopCloser(bytes.NewReader(content[from : r.currentEnd-block.Offset]))
+		return nil
+	}
+	return lastErr
+}
+
+// readStripes splits the blocks of an erasure-6-3 file into its stripes, indexed as shards, nil for the data blocks a short last stripe lacks
+func readStripes(blocks []*pb.ReadBlock) [][erasure.Shards]*pb.ReadBlock {
+	var all [][erasure.Shards]*pb.ReadBlock
+	data := erasure.DataShards
+	for _, block := range blocks {
+		if block.Parity > 0 {
+			if len(all) > 0 {
+				all[len(all)-1][erasure.DataShards+int(block.Parity)-1] = block
+			}
+			// the next data block starts a stripe
+			data = erasure.DataShards
+			continue
+		}
+		if data == erasure.DataShards {
+			all = append(all, [erasure.Shards]*pb.ReadBlock{})
+			data = 0
+		}
+		all[len(all)-1][data] = block
+		data++
+	}
+	return all
+}
+
+// decode rebuilds block from six other blocks of its stripe, each read whole and verified
+func (r *blockReader) decode(stripe [erasure.Shards]*pb.ReadBlock, block *pb.ReadBlock) ([]byte, error) {
+	// the other blocks are padded with zeros to the length of the first
+	shardBytes := stripe[0].Length
+	shards := make([][]byte, erasure.Shards)
+	have := 0
+	for i, other := range stripe[:erasure.DataShards] {
+		if other == nil {
+			shards[i] = make([]byte, shardBytes)
+			have++
+		}
+	}
+	var lastErr error
+	for i, other := range stripe {
+		if other == nil || other == block || have == erasure.DataShards {
+			continue
+		}
+		content, err := r.readBlock(other)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		shards[i] = append(content, make([]byte, shardBytes-int64(len(content)))...)
+		have++
+	}
+	if have < erasure.DataShards {
+		return nil, fmt.Errorf("%d blocks of the stripe readable, %d needed: %v", have, erasure.DataShards, lastErr)
+	}
+	if err := erasure.Reconstruct(shards); err != nil {
+		return nil, err
+	}
+	for i, other := range stripe {
+		if other == block {
+			return shards[i][:block.Length], nil
+		}
+	}
+	return nil, errors.New("the block isn't in its stripe")
+}
+
+// readBlock reads a block whole from the first of its replicas that serves it
+func (r *blockReader) readBlock(block *pb.ReadBlock) ([]byte, error) {
+	lastErr := fmt.Errorf("no available DataNodes for the block at offset %d", block.Offset)
+	for _, replica := range block.Replicas {
+		if !replica.Alive || replica.Corrupt {
+			continue
+		}
+		addr := net.JoinHostPort(replica.IpAddress, strconv.Itoa(int(replica.PortNumber)))
+		reader, err := openReader(r.ctx, r.c, addr, block.FileName, 0, 0, false)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		content, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if int64(len(content)) != block.Length {
+			lastErr = fmt.Errorf("block at offset %d has %d bytes instead of %d", block.Offset, len(content), block.Length)
+			continue
+		}
+		return content, nil
+	}
+	return nil, lastErr
+}
+
+func (r *blockReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package dfs
+
+import (
+	"context"
+	"fmt"
+	pb "proj/Services"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// APIVersion is the version of the RPC API this SDK speaks. Every call
+// carries it as "dfs-api-version" metadata.
+const APIVersion = 2
+
+// serverInfo is what a server reported about itself in GetCapabilities
+type serverInfo struct {
+	version         int32
+	capabilities    map[string]bool
+	maxMessageBytes int64
+	chunkBytes      int
+}
+
+func (info *serverInfo) has(capability string) bool {
+	return info.capabilities[capability]
+}
+
+// messageOverhead is kept free in every message for the file name and other fields
+const messageOverhead = 64 * 1024
+
+/*
+chunkLimit is the largest chunk of file data to send the server in one
+message: preferred, or less when the server takes smaller chunks or
+messages. Servers not reporting their limits get preferred
+*/
+func (info *serverInfo) chunkLimit(preferred int) int {
+	limit := preferred
+	if info.chunkBytes > 0 {
+		limit = min(limit, info.chunkBytes)
+	}
+	if room := info.maxMessageBytes - messageOverhead; room > 0 && room < int64(limit) {
+		limit = int(room)
+	}
+	return limit
+}
+
+// how long the SDK trusts what a DataNode reported, see dataNodeInfo
+const dataNodeInfoTTL = 5 * time.Minute
+
+// cachedInfo is a DataNode's serverInfo, asked again once it expires
+type cachedInfo struct {
+	info    *serverInfo
+	expires time.Time
+}
+
+// legacyServer stands for servers predating GetCapabilities, which only
+// offer the original calls: HandleUploadFile, HandleDownloadFile and unary
+// DownloadFile
+var legacyServer = &serverInfo{version: 1}
+
+/*
+negotiate is the first call on a connection, asking the server for its API
+version and optional features. Servers predating the exchange answer
+Unimplemented and are treated as legacyServer; a server that no longer
+supports this SDK's version produces an error saying so
+*/
+func negotiate(ctx context.Context, client pb.FileServiceClient, addr string) (*serverInfo, error) {
+	response, err := client.GetCapabilities(ctx, &pb.GetCapabilitiesRequest{ApiVersion: APIVersion})
+	switch status.Code(err) {
+	case codes.OK:
+	case codes.Unimplemented:
+		return legacyServer, nil
+	case codes.FailedPrecondition:
+		return nil, fmt.Errorf("%s is incompatible with this client (API version %d): %s", addr, APIVersion, status.Convert(err).Message())
+	default:
+		return nil, fmt.Errorf("GetCapabilities on %s failed: %v", addr, err)
+	}
+	if response.MinApiVersion > APIVersion {
+		return nil, fmt.Errorf("%s needs API version %d or newer, this client speaks %d: upgrade the client", addr, response.MinApiVersion, APIVersion)
+	}
+	info := &serverInfo{
+		version:         response.ApiVersion,
+		capabilities:    make(map[string]bool),
+		maxMessageBytes: response.MaxMessageBytes,
+		chunkBytes:      int(response.ChunkBytes),
+	}
+	for _, capability := range response.Capabilities {
+		info.capabilities[capability] = true
+	}
+	return info, nil
+}
+
+func withVersion(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "dfs-api-version", strconv.Itoa(APIVersion))
+}
+
+func versionUnaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(withVersion(ctx), method, req, reply, cc, opts...)
+}
+
+func versionStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(withVersion(ctx), desc, cc, method, opts...)
+}
+
+// dialOptions are used for every connection to the master and DataNodes
+func (c *Client) dialOptions() []grpc.DialOption {
+	options := []grpc.DialOption{
+		grpc.WithTransportCredentials(c.credentials),
+		grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(int(c.maxMessageBytes)),
+			grpc.MaxCallSendMsgSize(int(c.maxMessageBytes))),
+		grpc.WithChainUnaryInterceptor(versionUnaryInterceptor),
+		grpc.WithChainStreamInterceptor(versionStreamInterceptor),
+	}
+	if c.token != "" {
+		options = append(options,
+			grpc.WithChainUnaryInterceptor(c.tokenUnaryInterceptor),
+			grpc.WithChainStreamInterceptor(c.tokenStreamInterceptor))
+	}
+	return options
+}
+
+// withToken adds the token of WithToken as authorization metadata
+func (c *Client) withToken(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+c.token)
+}
+
+func (c *Client) tokenUnaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(c.withToken(ctx), method, req, reply, cc, opts...)
+}
+
+func (c *Client) tokenStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(c.withToken(ctx), desc, cc, method, opts...)
+}
+
+// checkSync rejects a DataNode that can't commit the upload of ctx synced, see WithSync
+func checkSync(ctx context.Context, info *serverInfo, addr string) error {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if len(md.Get("sync-upload")) > 0 && !info.has("sync-uploads") {
+		return fmt.Errorf("DataNode %s doesn't support synced uploads, upgrade it", addr)
+	}
+	return nil
+}
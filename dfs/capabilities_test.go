@@ -0,0 +1,56 @@
+package dfs
+
+import (
+	"context"
+	pb "proj/Services"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// capabilitiesServer answers GetCapabilities, counting the calls
+type capabilitiesServer struct {
+	pb.FileServiceClient
+	calls int
+}
+
+func (s *capabilitiesServer) GetCapabilities(ctx context.Context, in *pb.GetCapabilitiesRequest, opts ...grpc.CallOption) (*pb.GetCapabilitiesResponse, error) {
+	s.calls++
+	return &pb.GetCapabilitiesResponse{ApiVersion: APIVersion, MinApiVersion: 1, Capabilities: []string{"append"}}, nil
+}
+
+func TestDataNodeInfoCached(t *testing.T) {
+	ctx := context.Background()
+	c := &Client{}
+	server := &capabilitiesServer{}
+	for i := 0; i < 3; i++ {
+		info, err := c.dataNodeInfo(ctx, server, "10.0.0.1:50052")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.has("append") {
+			t.Errorf("capabilities %v lack append", info.capabilities)
+		}
+	}
+	if server.calls != 1 {
+		t.Errorf("GetCapabilities called %d times for one DataNode, want once", server.calls)
+	}
+
+	if _, err := c.dataNodeInfo(ctx, server, "10.0.0.2:50052"); err != nil {
+		t.Fatal(err)
+	}
+	if server.calls != 2 {
+		t.Errorf("GetCapabilities called %d times for two DataNodes, want twice", server.calls)
+	}
+
+	// an expired answer is asked again
+	c.dataNodeInfos["10.0.0.1:50052"] = cachedInfo{info: legacyServer, expires: time.Now().Add(-time.Second)}
+	info, err := c.dataNodeInfo(ctx, server, "10.0.0.1:50052")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.calls != 3 || !info.has("append") {
+		t.Errorf("expired answer reused, %d calls", server.calls)
+	}
+}
@@ -0,0 +1,55 @@
+package dfs
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// chunkAttempts is how many times a chunk the DataNode received corrupted is sent.
+const chunkAttempts = 3
+
+// ChecksumError is returned when data didn't match the checksum sent with
+// it. Uploading, the DataNode received a chunk still corrupted after
+// chunkAttempts tries or a whole file that hashes differently, and the upload
+// can be sent again; downloading, the bytes received don't hash to the
+// checksum the DataNode announced.
+type ChecksumError struct {
+	FileName string
+	Err      error
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("dfs: %s was corrupted in transit: %v", e.FileName, e.Err)
+}
+
+// chunkChecksum returns the CRC-32C sent with a chunk
+func chunkChecksum(content []byte) *uint32 {
+	sum := crc32.Checksum(content, crc32cTable)
+	return &sum
+}
+
+// retryChunk repeats call while the DataNode is unreachable, and resends a chunk it received corrupted
+func retryChunk(ctx context.Context, call func() error) error {
+	var err error
+	for attempt := 0; attempt < chunkAttempts; attempt++ {
+		err = retryUnavailable(ctx, call)
+		if status.Code(err) != codes.DataLoss {
+			return err
+		}
+	}
+	return err
+}
+
+// uploadError describes a failed upload call, a *ChecksumError for corrupted data
+func uploadError(fileName, call string, err error) error {
+	if status.Code(err) == codes.DataLoss {
+		return &ChecksumError{FileName: fileName, Err: err}
+	}
+	return fmt.Errorf("%s failed: %v", call, err)
+}
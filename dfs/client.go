@@ -0,0 +1,980 @@
+// Package dfs is the client SDK for the distributed file system. It hides the
+// master/DataNode round trips behind standard io interfaces so callers can
+// stream files in and out of the cluster without buffering them in memory.
+package dfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	pb "proj/Services"
+	"proj/internal/tlsconfig"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	chunkSize   = 1024 * 1024       // 1MB, matches the DataNode chunk size
+	maxGRPCSize = 1024 * 1024 * 100 // 100 MB, default message limit
+)
+
+// FileSystem is the streaming file API of the cluster. Applications should
+// depend on it rather than on *Client so tests can substitute the in-memory
+// implementation from the dfstest package.
+type FileSystem interface {
+	Open(ctx context.Context, fileName string) (io.ReadCloser, error)
+	Create(ctx context.Context, fileName string, opts ...CreateOption) (io.WriteCloser, error)
+}
+
+// CreateOption customizes the upload intent sent to the master by Create.
+type CreateOption func(*pb.PrepareUploadRequest)
+
+// WithSize declares the file size up front so the master can check quotas
+// before any data is sent.
+func WithSize(size int64) CreateOption {
+	return func(req *pb.PrepareUploadRequest) {
+		req.FileSize = size
+	}
+}
+
+// WithConstraints restricts the file and its replicas to DataNodes carrying
+// all of the given labels.
+func WithConstraints(constraints map[string]string) CreateOption {
+	return func(req *pb.PrepareUploadRequest) {
+		req.Constraints = constraints
+	}
+}
+
+// WithContentEncoding declares that the written bytes are already encoded,
+// only "gzip" is supported. The file is stored as written; readers that don't
+// accept the encoding get it decoded by the DataNode.
+func WithContentEncoding(encoding string) CreateOption {
+	return func(req *pb.PrepareUploadRequest) {
+		req.ContentEncoding = encoding
+	}
+}
+
+// WithStorageClass picks the file's durability: "replicated-3" (the
+// default), "replicated-2", "single-copy-scratch" for data that is
+// neither repaired nor rebalanced and is lost with its DataNode, or
+// "erasure-6-3", which stores the file in blocks with three parity blocks
+// for every six and needs WithBlocks or WithBlockSize and WithSize.
+func WithStorageClass(class string) CreateOption {
+	return func(req *pb.PrepareUploadRequest) {
+		req.StorageClass = class
+	}
+}
+
+// WithSync has the DataNode receiving the upload flush the file and its
+// directories before acknowledging it, so the upload survives a power loss,
+// even when the DataNode isn't configured with SyncUploads. The replicas are
+// committed as their DataNodes are configured to.
+func WithSync() CreateOption {
+	return func(req *pb.PrepareUploadRequest) {
+		req.Sync = true
+	}
+}
+
+// WithTTL has the file deleted automatically once ttl has passed since it was
+// stored. Appending to the file doesn't extend it.
+func WithTTL(ttl time.Duration) CreateOption {
+	return func(req *pb.PrepareUploadRequest) {
+		req.TtlSeconds = int64(ttl.Round(time.Second) / time.Second)
+	}
+}
+
+// WithBlockSize stores a file larger than size in blocks of size bytes,
+// spread over the DataNodes and each replicated on its own, rather than
+// whole on each replica. The file's size must be declared with WithSize.
+func WithBlockSize(size int64) CreateOption {
+	return func(req *pb.PrepareUploadRequest) {
+		req.BlockBytes = size
+	}
+}
+
+// WithBlocks is WithBlockSize with the master's block size, 64 MB unless
+// configured otherwise.
+func WithBlocks() CreateOption {
+	return func(req *pb.PrepareUploadRequest) {
+		req.Blocks = true
+	}
+}
+
+var _ FileSystem = (*Client)(nil)
+
+// Client talks to the master to locate DataNodes and then to the DataNodes
+// themselves to move file contents.
+type Client struct {
+	conn   *grpc.ClientConn
+	master pb.FileServiceClient
+	// used for the master and every DataNode, plaintext unless WithTLS
+	credentials credentials.TransportCredentials
+	// largest message sent or received, see WithMaxMessageSize
+	maxMessageBytes int64
+	// upload chunk size, 0 uses the one the master advertises
+	chunkBytes int
+	// sent as authorization metadata on every call, see WithToken
+	token string
+	// the master's API version and features, asked on first use
+	infoMutex  sync.Mutex
+	masterInfo *serverInfo
+	// the DataNodes' by address, see dataNodeInfo
+	dataNodeInfos map[string]cachedInfo
+}
+
+// DialOption configures how Dial connects to the cluster.
+type DialOption func(*Client) error
+
+// WithTLS connects over mutual TLS, presenting the certificate in certFile
+// and keyFile and verifying the nodes against the cluster CA in caFile, as
+// generated by dfsctl init.
+func WithTLS(certFile, keyFile, caFile string) DialOption {
+	return func(c *Client) error {
+		transport, err := tlsconfig.ClientCredentials(certFile, keyFile, caFile)
+		if err != nil {
+			return err
+		}
+		c.credentials = transport
+		return nil
+	}
+}
+
+// WithMaxMessageSize limits the gRPC messages the client sends and accepts,
+// 100MB by default. DataNodes are asked for download chunks that fit.
+func WithMaxMessageSize(bytes int64) DialOption {
+	return func(c *Client) error {
+		if bytes <= messageOverhead || bytes > math.MaxInt32 {
+			return fmt.Errorf("message size %d out of range", bytes)
+		}
+		c.maxMessageBytes = bytes
+		return nil
+	}
+}
+
+// WithChunkSize sets the size of the chunks uploads are sent in, instead of
+// the master's. DataNodes taking smaller chunks still get smaller ones.
+func WithChunkSize(bytes int) DialOption {
+	return func(c *Client) error {
+		if bytes <= 0 {
+			return fmt.Errorf("chunk size %d out of range", bytes)
+		}
+		c.chunkBytes = bytes
+		return nil
+	}
+}
+
+// WithToken authenticates every call to the master and DataNodes with the
+// admin token or a scoped token from MintToken.
+func WithToken(token string) DialOption {
+	return func(c *Client) error {
+		c.token = token
+		return nil
+	}
+}
+
+// Dial connects to the master node at masterAddr.
+func Dial(masterAddr string, opts ...DialOption) (*Client, error) {
+	c := &Client{credentials: insecure.NewCredentials(), maxMessageBytes: maxGRPCSize}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	if int64(c.chunkBytes)+messageOverhead > c.maxMessageBytes {
+		return nil, fmt.Errorf("chunk size %d doesn't fit in the %d byte message size", c.chunkBytes, c.maxMessageBytes)
+	}
+	conn, err := grpc.Dial(masterAddr, c.dialOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("dial master fail %v", err)
+	}
+	c.conn, c.master = conn, pb.NewFileServiceClient(conn)
+	return c, nil
+}
+
+// info negotiates with the master on first use, see negotiate
+func (c *Client) info(ctx context.Context) (*serverInfo, error) {
+	c.infoMutex.Lock()
+	defer c.infoMutex.Unlock()
+	if c.masterInfo == nil {
+		info, err := negotiate(ctx, c.master, c.conn.Target())
+		if err != nil {
+			return nil, err
+		}
+		c.masterInfo = info
+	}
+	return c.masterInfo, nil
+}
+
+/*
+dataNodeInfo negotiates with the DataNode at addr, once per
+dataNodeInfoTTL rather than on every connection: its answer changes only
+with an upgrade or a new config
+*/
+func (c *Client) dataNodeInfo(ctx context.Context, client pb.FileServiceClient, addr string) (*serverInfo, error) {
+	now := time.Now()
+	c.infoMutex.Lock()
+	cached, ok := c.dataNodeInfos[addr]
+	c.infoMutex.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.info, nil
+	}
+	info, err := negotiate(ctx, client, addr)
+	if err != nil {
+		return nil, err
+	}
+	c.infoMutex.Lock()
+	if c.dataNodeInfos == nil {
+		c.dataNodeInfos = make(map[string]cachedInfo)
+	}
+	c.dataNodeInfos[addr] = cachedInfo{info: info, expires: now.Add(dataNodeInfoTTL)}
+	c.infoMutex.Unlock()
+	return info, nil
+}
+
+/*
+uploadChunkBytes is the chunk size uploads use before the DataNode's limits
+are applied: WithChunkSize, else the master's, else chunkSize; never more
+than fits in the client's messages
+*/
+func (c *Client) uploadChunkBytes() int {
+	limit := chunkSize
+	if c.chunkBytes > 0 {
+		limit = c.chunkBytes
+	} else {
+		c.infoMutex.Lock()
+		if c.masterInfo != nil && c.masterInfo.chunkBytes > 0 {
+			limit = c.masterInfo.chunkBytes
+		}
+		c.infoMutex.Unlock()
+	}
+	return int(min(int64(limit), c.maxMessageBytes-messageOverhead))
+}
+
+/*
+readLocations returns the replicas of fileName, from GetReadLocations or,
+on masters predating it, HandleDownloadFile
+*/
+func (c *Client) readLocations(ctx context.Context, fileName string) ([]*pb.ReplicaLocation, error) {
+	locations, err := c.locate(ctx, fileName)
+	if err != nil {
+		return nil, err
+	}
+	if len(locations.Blocks) > 0 {
+		return nil, fmt.Errorf("%s is stored in blocks, no DataNode holds it whole", fileName)
+	}
+	if locations.Packed != nil {
+		return nil, fmt.Errorf("%s is packed in %s, no DataNode holds it alone", fileName, locations.Packed.Container)
+	}
+	return locations.Replicas, nil
+}
+
+// locate returns the replicas of fileName or, for a file stored in blocks or packed, its blocks or container
+func (c *Client) locate(ctx context.Context, fileName string) (*pb.GetReadLocationsResponse, error) {
+	info, err := c.info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if info.has("read-locations") {
+		return c.master.GetReadLocations(ctx, &pb.GetReadLocationsRequest{FileName: fileName})
+	}
+	response, err := c.master.HandleDownloadFile(ctx, &pb.HandleDownloadFileRequest{FileName: fileName})
+	if err != nil {
+		return nil, err
+	}
+	locations := &pb.GetReadLocationsResponse{}
+	for i, ip := range response.IpAddress {
+		locations.Replicas = append(locations.Replicas, &pb.ReplicaLocation{IpAddress: ip, PortNumber: response.PortNumbers[i], Alive: true})
+	}
+	return locations, nil
+}
+
+/*
+prepareUpload asks the master where to upload, with PrepareUpload or, on
+masters predating it, HandleUploadFile, which names a single DataNode and
+knows no upload tokens or content encodings
+*/
+func (c *Client) prepareUpload(ctx context.Context, request *pb.PrepareUploadRequest) (*pb.PrepareUploadResponse, error) {
+	info, err := c.info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// older masters would store the file with their default durability
+	if request.Append && !info.has("append") {
+		return nil, errors.New("the master doesn't support appends, upgrade it")
+	}
+	if request.StorageClass != "" && !info.has("storage-classes") {
+		return nil, errors.New("the master doesn't support storage classes, upgrade it")
+	}
+	if info.has("prepare-upload") {
+		return c.master.PrepareUpload(ctx, request)
+	}
+	if request.ContentEncoding != "" {
+		return nil, errors.New("the master doesn't support content encodings, upgrade it")
+	}
+	response, err := c.master.HandleUploadFile(ctx, &pb.HandleUploadFileRequest{
+		Filename:    request.FileName,
+		Constraints: request.Constraints,
+		FileSize:    request.FileSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.PrepareUploadResponse{Targets: []*pb.UploadTarget{{
+		IpAddress:  response.IpAddress,
+		PortNumber: response.PortNumber,
+	}}}, nil
+}
+
+// Close releases the connection to the master.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+/*
+Open returns a reader streaming fileName from one of its replicas. Replicas
+are tried in the order ranked by the master (healthy, local, least loaded
+first), skipping dead and corrupt ones, until one starts serving the file.
+Cancelling ctx aborts the transfer. The reader is a *Reader, which also
+implements io.WriterTo. Files stored gzip encoded are transferred compressed
+and decoded by the reader.
+*/
+func (c *Client) Open(ctx context.Context, fileName string) (io.ReadCloser, error) {
+	return c.OpenRange(ctx, fileName, 0, 0)
+}
+
+/*
+OpenRange is Open for length bytes of fileName from offset, or the rest of
+the file when length is 0, so a download that broke off can be resumed or a
+large file read in parts from several replicas at once. Ranges are of the
+file's content, decoded when it is stored encoded. Whole-file checksums
+don't apply to a range, it isn't verified.
+*/
+func (c *Client) OpenRange(ctx context.Context, fileName string, offset, length int64) (io.ReadCloser, error) {
+	return c.open(ctx, fileName, offset, length, false)
+}
+
+/*
+OpenEncoded is Open without decoding: a file stored gzip encoded is read as
+stored, the bytes its size and checksum cover, so it can be copied elsewhere
+along with its encoding. Other files read as with Open.
+*/
+func (c *Client) OpenEncoded(ctx context.Context, fileName string) (io.ReadCloser, error) {
+	return c.open(ctx, fileName, 0, 0, true)
+}
+
+// open is OpenRange, leaving encoded files encoded when keepEncoding is set
+func (c *Client) open(ctx context.Context, fileName string, offset, length int64, keepEncoding bool) (io.ReadCloser, error) {
+	locations, err := c.locate(ctx, fileName)
+	if err != nil {
+		return nil, fmt.Errorf("download request failed: %v", err)
+	}
+	if len(locations.Blocks) > 0 {
+		return newBlockReader(ctx, c, locations.Blocks, offset, length), nil
+	}
+	if locations.Packed != nil {
+		return c.openPacked(ctx, fileName, locations.Packed, offset, length)
+	}
+	replicas := locations.Replicas
+
+	lastErr := errors.New("no available DataNodes for download")
+	for _, replica := range replicas {
+		if !replica.Alive || replica.Corrupt {
+			continue
+		}
+		addr := net.JoinHostPort(replica.IpAddress, strconv.Itoa(int(replica.PortNumber)))
+		reader, err := openReader(ctx, c, addr, fileName, offset, length, keepEncoding)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return reader, nil
+	}
+	return nil, lastErr
+}
+
+/*
+Checksum returns the hex SHA-256 of fileName as a DataNode stores it, the
+checksum downloads are verified against. For a file uploaded with a content
+encoding it covers the encoded bytes.
+*/
+func (c *Client) Checksum(ctx context.Context, fileName string) (string, error) {
+	replicas, err := c.readLocations(ctx, fileName)
+	if err != nil {
+		return "", fmt.Errorf("checksum request failed: %v", err)
+	}
+
+	lastErr := errors.New("no available DataNodes for checksum")
+	for _, replica := range replicas {
+		if !replica.Alive || replica.Corrupt {
+			continue
+		}
+		addr := net.JoinHostPort(replica.IpAddress, strconv.Itoa(int(replica.PortNumber)))
+		conn, err := grpc.Dial(addr, c.dialOptions()...)
+		if err != nil {
+			lastErr = fmt.Errorf("could not connect to DataNode %s: %v", addr, err)
+			continue
+		}
+		response, err := pb.NewFileServiceClient(conn).GetFileChecksum(ctx, &pb.GetFileChecksumRequest{FileName: fileName})
+		conn.Close()
+		if err != nil {
+			lastErr = fmt.Errorf("GetFileChecksum from %s failed: %v", addr, err)
+			continue
+		}
+		return response.Checksum, nil
+	}
+	return "", lastErr
+}
+
+/*
+Stat describes fileName as stored by one of its DataNodes: size,
+modification time, checksum and the replica's health, without downloading
+it.
+*/
+func (c *Client) Stat(ctx context.Context, fileName string) (*pb.StatFileResponse, error) {
+	replicas, err := c.readLocations(ctx, fileName)
+	if err != nil {
+		return nil, fmt.Errorf("stat request failed: %v", err)
+	}
+
+	lastErr := errors.New("no available DataNodes for stat")
+	for _, replica := range replicas {
+		if !replica.Alive || replica.Corrupt {
+			continue
+		}
+		addr := net.JoinHostPort(replica.IpAddress, strconv.Itoa(int(replica.PortNumber)))
+		conn, err := grpc.Dial(addr, c.dialOptions()...)
+		if err != nil {
+			lastErr = fmt.Errorf("could not connect to DataNode %s: %v", addr, err)
+			continue
+		}
+		response, err := pb.NewFileServiceClient(conn).StatFile(ctx, &pb.StatFileRequest{FileName: fileName})
+		conn.Close()
+		if err != nil {
+			lastErr = fmt.Errorf("StatFile from %s failed: %v", addr, err)
+			continue
+		}
+		return response, nil
+	}
+	return nil, lastErr
+}
+
+/*
+Delete removes fileName from the cluster. The DataNode asked clears it with
+the master, which refuses files under a hold and has the other replicas
+deleted too. A master keeping deleted files in the trash lets Restore bring
+it back until it's purged. A file stored in blocks or packed is deleted by
+the master, skipping the trash
+*/
+func (c *Client) Delete(ctx context.Context, fileName string) error {
+	locations, err := c.locate(ctx, fileName)
+	if err != nil {
+		return fmt.Errorf("delete request failed: %v", err)
+	}
+	// no DataNode holds a file stored in blocks or packed, the master deletes it
+	if len(locations.Blocks) > 0 || locations.Packed != nil {
+		if _, err := c.master.DeleteFile(ctx, &pb.FileDeleteRequest{FileName: fileName}); err != nil {
+			return fmt.Errorf("DeleteFile failed: %v", err)
+		}
+		return nil
+	}
+	replicas := locations.Replicas
+
+	lastErr := errors.New("no available DataNodes for delete")
+	for _, replica := range replicas {
+		if !replica.Alive {
+			continue
+		}
+		addr := net.JoinHostPort(replica.IpAddress, strconv.Itoa(int(replica.PortNumber)))
+		conn, err := grpc.Dial(addr, c.dialOptions()...)
+		if err != nil {
+			lastErr = fmt.Errorf("could not connect to DataNode %s: %v", addr, err)
+			continue
+		}
+		client := pb.NewFileServiceClient(conn)
+		info, err := c.dataNodeInfo(ctx, client, addr)
+		if err == nil && !info.has("delete-files") {
+			// an older DataNode would drop its copy without telling the master
+			err = fmt.Errorf("DataNode %s doesn't support deleting files, upgrade it", addr)
+		}
+		if err == nil {
+			_, err = client.DeleteFile(ctx, &pb.FileDeleteRequest{FileName: fileName})
+			if err != nil {
+				err = fmt.Errorf("DeleteFile on %s failed: %v", addr, err)
+			}
+		}
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
+/*
+Create returns a writer uploading fileName. The master validates the upload
+and picks its DataNodes with PrepareUpload; the writer goes to the first target
+that accepts it. Data is sent in chunks as it is written, see uploadChunkBytes;
+the upload is committed by Close, or given up with the *Writer's Abort.
+With WithBlockSize the writer is a *BlockWriter, writing block after block.
+*/
+func (c *Client) Create(ctx context.Context, fileName string, opts ...CreateOption) (io.WriteCloser, error) {
+	request := &pb.PrepareUploadRequest{FileName: fileName}
+	for _, opt := range opts {
+		opt(request)
+	}
+	if request.BlockBytes > 0 || request.Blocks {
+		writer, err := c.createBlocks(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		return writer, nil
+	}
+	ctx, targets, err := c.startUpload(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, addr := range targets {
+		writer, err := openWriter(ctx, c, addr, fileName, request.FileSize, request.ContentEncoding != "", false)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return writer, nil
+	}
+	return nil, lastErr
+}
+
+/*
+startUpload asks the master for the DataNodes to upload to and returns
+their addresses with ctx carrying the metadata they expect
+*/
+func (c *Client) startUpload(ctx context.Context, request *pb.PrepareUploadRequest) (context.Context, []string, error) {
+	response, err := c.prepareUpload(ctx, request)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get upload details: %v", err)
+	}
+	if len(response.Targets) == 0 {
+		return nil, nil, errors.New("master returned no upload targets")
+	}
+	return uploadContext(ctx, request, response.UploadToken), targetAddresses(response.Targets), nil
+}
+
+// uploadContext returns ctx carrying the metadata DataNodes expect with the uploads of request
+func uploadContext(ctx context.Context, request *pb.PrepareUploadRequest, token string) context.Context {
+	// the DataNode hands the token back to the master with NotifyUploaded
+	ctx = metadata.AppendToOutgoingContext(ctx, "upload-token", token)
+	if request.ContentEncoding != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "content-encoding", request.ContentEncoding)
+	}
+	if request.Sync {
+		ctx = metadata.AppendToOutgoingContext(ctx, "sync-upload", "true")
+	}
+	return ctx
+}
+
+func targetAddresses(targets []*pb.UploadTarget) []string {
+	var addrs []string
+	for _, target := range targets {
+		addrs = append(addrs, net.JoinHostPort(target.IpAddress, strconv.Itoa(int(target.PortNumber))))
+	}
+	return addrs
+}
+
+/*
+Rename moves fileName to newName. The master has every DataNode holding the
+file rename it and only then moves its record, a failure leaves the file
+under its old name. newName must not exist.
+*/
+func (c *Client) Rename(ctx context.Context, fileName, newName string) error {
+	info, err := c.info(ctx)
+	if err != nil {
+		return err
+	}
+	if !info.has("rename") {
+		return errors.New("the master doesn't support renaming files, upgrade it")
+	}
+	_, err = c.master.RenameFile(ctx, &pb.RenameFileRequest{FileName: fileName, NewName: newName})
+	if err != nil {
+		return fmt.Errorf("RenameFile failed: %v", err)
+	}
+	return nil
+}
+
+/*
+Restore brings the deleted fileName back from the trash. Its name must be
+free, rename or delete the file now holding it first.
+*/
+func (c *Client) Restore(ctx context.Context, fileName string) error {
+	info, err := c.info(ctx)
+	if err != nil {
+		return err
+	}
+	if !info.has("trash") {
+		return errors.New("the master doesn't keep deleted files, upgrade it")
+	}
+	if _, err := c.master.RestoreFile(ctx, &pb.RestoreFileRequest{FileName: fileName}); err != nil {
+		return fmt.Errorf("RestoreFile failed: %v", err)
+	}
+	return nil
+}
+
+// ListTrash lists the deleted files whose names start with prefix and that
+// can still be restored.
+func (c *Client) ListTrash(ctx context.Context, prefix string) ([]*pb.TrashedFile, error) {
+	response, err := c.master.ListTrash(ctx, &pb.ListTrashRequest{Prefix: prefix})
+	if err != nil {
+		return nil, fmt.Errorf("ListTrash failed: %v", err)
+	}
+	return response.Files, nil
+}
+
+// Versions lists the earlier contents kept of fileName, oldest first.
+func (c *Client) Versions(ctx context.Context, fileName string) ([]*pb.FileVersion, error) {
+	info, err := c.info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !info.has("versions") {
+		return nil, errors.New("the master doesn't keep file versions, upgrade it")
+	}
+	response, err := c.master.ListVersions(ctx, &pb.ListVersionsRequest{FileName: fileName})
+	if err != nil {
+		return nil, fmt.Errorf("ListVersions failed: %v", err)
+	}
+	return response.Versions, nil
+}
+
+/*
+ReadVersion returns an earlier content of fileName, the version with the
+generation stamp listed by Versions, from the first DataNode keeping it
+that answers. Versions are read in one message, see WithMaxMessageSize.
+*/
+func (c *Client) ReadVersion(ctx context.Context, fileName string, generation int64) ([]byte, error) {
+	versions, err := c.Versions(ctx, fileName)
+	if err != nil {
+		return nil, err
+	}
+	var replicas []*pb.ReplicaLocation
+	for _, version := range versions {
+		if version.Generation == generation {
+			replicas = version.Replicas
+		}
+	}
+	if replicas == nil {
+		return nil, fmt.Errorf("no version %d of %s is kept", generation, fileName)
+	}
+
+	lastErr := errors.New("no DataNode keeping the version is alive")
+	for _, replica := range replicas {
+		if !replica.Alive {
+			continue
+		}
+		addr := net.JoinHostPort(replica.IpAddress, strconv.Itoa(int(replica.PortNumber)))
+		conn, err := grpc.Dial(addr, c.dialOptions()...)
+		if err != nil {
+			lastErr = fmt.Errorf("could not connect to DataNode %s: %v", addr, err)
+			continue
+		}
+		response, err := pb.NewFileServiceClient(conn).DownloadVersion(ctx, &pb.DownloadVersionRequest{FileName: fileName, Generation: generation})
+		conn.Close()
+		if err != nil {
+			lastErr = fmt.Errorf("DownloadVersion on %s failed: %v", addr, err)
+			continue
+		}
+		return response.FileContent, nil
+	}
+	return nil, lastErr
+}
+
+/*
+SetPlacementConstraints declares the DataNode labels required to store path.
+path is either an existing file or a directory prefix such as "videos/",
+in which case files below it inherit the constraints. Empty constraints
+remove a directory rule.
+*/
+func (c *Client) SetPlacementConstraints(ctx context.Context, path string, constraints map[string]string) error {
+	_, err := c.master.SetPlacementConstraints(ctx, &pb.SetPlacementConstraintsRequest{
+		Path:        path,
+		Constraints: constraints,
+	})
+	if err != nil {
+		return fmt.Errorf("SetPlacementConstraints failed: %v", err)
+	}
+	return nil
+}
+
+// PinFile restricts fileName's replicas to the given DataNode IDs and excludes
+// it from rebalancing. An empty list removes the pin.
+func (c *Client) PinFile(ctx context.Context, fileName string, dataNodes []int32) error {
+	_, err := c.master.PinFile(ctx, &pb.PinFileRequest{
+		FileName:  fileName,
+		DataNodes: dataNodes,
+	})
+	if err != nil {
+		return fmt.Errorf("PinFile failed: %v", err)
+	}
+	return nil
+}
+
+// ScheduleMaintenance marks a DataNode as down for planned maintenance between
+// start and end: it gets no new writes and its absence raises no re-replication.
+// An end not after start cancels the window.
+func (c *Client) ScheduleMaintenance(ctx context.Context, dataNode int32, start, end time.Time) error {
+	_, err := c.master.ScheduleMaintenance(ctx, &pb.ScheduleMaintenanceRequest{
+		DataNode:  dataNode,
+		StartTime: start.Unix(),
+		EndTime:   end.Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("ScheduleMaintenance failed: %v", err)
+	}
+	return nil
+}
+
+// ExportNamespace returns the cluster's namespace metadata without file data.
+func (c *Client) ExportNamespace(ctx context.Context) (*pb.NamespaceDump, error) {
+	dump, err := c.master.ExportNamespace(ctx, &pb.ExportNamespaceRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("ExportNamespace failed: %v", err)
+	}
+	return dump, nil
+}
+
+// ImportNamespace loads namespace metadata produced by ExportNamespace,
+// returning how many files were applied now and how many await their data.
+func (c *Client) ImportNamespace(ctx context.Context, dump *pb.NamespaceDump) (applied, pending int32, err error) {
+	response, err := c.master.ImportNamespace(ctx, dump)
+	if err != nil {
+		return 0, 0, fmt.Errorf("ImportNamespace failed: %v", err)
+	}
+	return response.FilesApplied, response.FilesPending, nil
+}
+
+// MasterMetrics returns the master's namespace size and per-RPC statistics.
+func (c *Client) MasterMetrics(ctx context.Context) (*pb.GetMasterMetricsResponse, error) {
+	metrics, err := c.master.GetMasterMetrics(ctx, &pb.GetMasterMetricsRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("GetMasterMetrics failed: %v", err)
+	}
+	return metrics, nil
+}
+
+// MintToken returns a token granting operations ("read", "write", "delete",
+// "list") on the files under prefix for ttl, a day when zero, and when it
+// expires. Tokens can be shared with parties that must not get the admin
+// token, the master and DataNodes refuse anything else.
+func (c *Client) MintToken(ctx context.Context, prefix string, operations []string, ttl time.Duration) (string, time.Time, error) {
+	response, err := c.master.MintToken(ctx, &pb.MintTokenRequest{
+		Prefix:     prefix,
+		Operations: operations,
+		TtlSeconds: int64(ttl / time.Second),
+	})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("MintToken failed: %v", err)
+	}
+	return response.Token, time.Unix(response.ExpiresUnix, 0), nil
+}
+
+// SetQuota limits the bytes stored under the directory path. Exceeding soft
+// only raises warnings, uploads that would exceed hard are rejected with
+// codes.ResourceExhausted. Zero for both removes the quota.
+func (c *Client) SetQuota(ctx context.Context, path string, soft, hard int64) error {
+	_, err := c.master.SetQuota(ctx, &pb.SetQuotaRequest{
+		Path:      path,
+		SoftBytes: soft,
+		HardBytes: hard,
+	})
+	if err != nil {
+		return fmt.Errorf("SetQuota failed: %v", err)
+	}
+	return nil
+}
+
+// QuotaUsage returns the bytes stored under path and its quota limits.
+func (c *Client) QuotaUsage(ctx context.Context, path string) (*pb.GetQuotaUsageResponse, error) {
+	usage, err := c.master.GetQuotaUsage(ctx, &pb.GetQuotaUsageRequest{Path: path})
+	if err != nil {
+		return nil, fmt.Errorf("GetQuotaUsage failed: %v", err)
+	}
+	return usage, nil
+}
+
+// ReportBadReplica tells the master the copy of fileName on dataNode is
+// corrupt so reads avoid it and it gets re-replicated.
+func (c *Client) ReportBadReplica(ctx context.Context, fileName string, dataNode int32, reason string) error {
+	_, err := c.master.ReportBadReplica(ctx, &pb.ReportBadReplicaRequest{
+		FileName: fileName,
+		DataNode: dataNode,
+		Reason:   reason,
+	})
+	if err != nil {
+		return fmt.Errorf("ReportBadReplica failed: %v", err)
+	}
+	return nil
+}
+
+// FindByChecksum returns the files whose content has the given hex SHA-256,
+// letting callers skip uploads of bytes the cluster already stores.
+func (c *Client) FindByChecksum(ctx context.Context, checksum string) ([]*pb.NamespaceFile, error) {
+	response, err := c.master.FindByChecksum(ctx, &pb.FindByChecksumRequest{Checksum: checksum})
+	if err != nil {
+		return nil, fmt.Errorf("FindByChecksum failed: %v", err)
+	}
+	return response.Files, nil
+}
+
+// SetHold protects path (a file or a directory prefix) from deletion and
+// overwrite until retainUntil, which may be zero, and, with legalHold, until
+// ReleaseHold. Holds need the compliance token when the master has one, see
+// the "authorization" metadata.
+func (c *Client) SetHold(ctx context.Context, path string, retainUntil time.Time, legalHold bool, reason string) error {
+	request := &pb.SetHoldRequest{Path: path, LegalHold: legalHold, Reason: reason}
+	if !retainUntil.IsZero() {
+		request.RetainUntil = retainUntil.Unix()
+	}
+	if _, err := c.master.SetHold(ctx, request); err != nil {
+		return fmt.Errorf("SetHold failed: %v", err)
+	}
+	return nil
+}
+
+// ReleaseHold lifts the legal hold on path; its retention date still applies.
+func (c *Client) ReleaseHold(ctx context.Context, path, reason string) error {
+	if _, err := c.master.ReleaseHold(ctx, &pb.ReleaseHoldRequest{Path: path, Reason: reason}); err != nil {
+		return fmt.Errorf("ReleaseHold failed: %v", err)
+	}
+	return nil
+}
+
+// Holds lists the holds in force.
+func (c *Client) Holds(ctx context.Context) ([]*pb.Hold, error) {
+	response, err := c.master.ListHolds(ctx, &pb.ListHoldsRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("ListHolds failed: %v", err)
+	}
+	return response.Holds, nil
+}
+
+// AddTags attaches tags to a stored file and returns all of its tags.
+func (c *Client) AddTags(ctx context.Context, fileName string, tags ...string) ([]string, error) {
+	response, err := c.master.AddTags(ctx, &pb.AddTagsRequest{FileName: fileName, Tags: tags})
+	if err != nil {
+		return nil, fmt.Errorf("AddTags failed: %v", err)
+	}
+	return response.Tags, nil
+}
+
+// RemoveTags detaches tags from a stored file and returns the tags left.
+func (c *Client) RemoveTags(ctx context.Context, fileName string, tags ...string) ([]string, error) {
+	response, err := c.master.RemoveTags(ctx, &pb.RemoveTagsRequest{FileName: fileName, Tags: tags})
+	if err != nil {
+		return nil, fmt.Errorf("RemoveTags failed: %v", err)
+	}
+	return response.Tags, nil
+}
+
+// ListFiles lists the stored files whose names start with prefix and that
+// carry every one of tags.
+func (c *Client) ListFiles(ctx context.Context, prefix string, tags ...string) ([]*pb.NamespaceFile, error) {
+	response, err := c.master.ListFiles(ctx, &pb.ListFilesRequest{Prefix: prefix, Tags: tags})
+	if err != nil {
+		return nil, fmt.Errorf("ListFiles failed: %v", err)
+	}
+	return response.Files, nil
+}
+
+/*
+ListDir lists one directory of the namespace: the files directly in dir and
+its subdirectories holding files, names ending in "/", both limited to the
+files carrying every given tag. dir is "" for the top level. Directories
+exist as long as they hold files.
+*/
+func (c *Client) ListDir(ctx context.Context, dir string, tags ...string) ([]*pb.NamespaceFile, []string, error) {
+	if dir != "" && !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	response, err := c.master.ListFiles(ctx, &pb.ListFilesRequest{Prefix: dir, Tags: tags, Shallow: true})
+	if err != nil {
+		return nil, nil, fmt.Errorf("ListFiles failed: %v", err)
+	}
+	return response.Files, response.Directories, nil
+}
+
+/*
+UploadProgress reports the bytes an upload session on the DataNode whose
+client port is at addr received so far, against the size declared when it
+began, 0 when unknown.
+*/
+func (c *Client) UploadProgress(ctx context.Context, addr, sessionID string) (*pb.GetUploadProgressResponse, error) {
+	conn, err := grpc.Dial(addr, c.dialOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to DataNode %s: %v", addr, err)
+	}
+	defer conn.Close()
+	response, err := pb.NewFileServiceClient(conn).GetUploadProgress(ctx, &pb.GetUploadProgressRequest{SessionId: sessionID})
+	if err != nil {
+		return nil, fmt.Errorf("GetUploadProgress failed: %v", err)
+	}
+	return response, nil
+}
+
+/*
+Decommission puts the DataNode whose client port is at addr in drain mode,
+or with cancel takes it out, and returns how far its drain is. Calling it
+again on a draining DataNode only reports; shut the DataNode down once
+SafeToShutdown is set. It needs the admin token when the DataNode has one.
+*/
+func (c *Client) Decommission(ctx context.Context, addr string, cancel bool) (*pb.DecommissionResponse, error) {
+	conn, err := grpc.Dial(addr, c.dialOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to DataNode %s: %v", addr, err)
+	}
+	defer conn.Close()
+	response, err := pb.NewFileServiceClient(conn).Decommission(ctx, &pb.DecommissionRequest{Cancel: cancel})
+	if err != nil {
+		return nil, fmt.Errorf("Decommission failed: %v", err)
+	}
+	return response, nil
+}
+
+/*
+ListLocalFiles returns the inventory of the DataNode whose client port is at
+addr: the files it holds under prefix, whether or not the master knows of
+them. With computeChecksums the files not hashed yet are, which reads them
+whole; their checksum is empty otherwise.
+*/
+func (c *Client) ListLocalFiles(ctx context.Context, addr, prefix string, computeChecksums bool) ([]*pb.LocalFile, error) {
+	conn, err := grpc.Dial(addr, c.dialOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to DataNode %s: %v", addr, err)
+	}
+	defer conn.Close()
+	response, err := pb.NewFileServiceClient(conn).ListLocalFiles(ctx, &pb.ListLocalFilesRequest{Prefix: prefix, ComputeChecksums: computeChecksums})
+	if err != nil {
+		return nil, fmt.Errorf("ListLocalFiles failed: %v", err)
+	}
+	return response.Files, nil
+}
+
+// FileTimeline returns the recorded stages of a file's life, oldest first:
+// upload intent, commit, replicas completed, repairs and moves.
+func (c *Client) FileTimeline(ctx context.Context, fileName string) ([]*pb.TimelineEvent, error) {
+	response, err := c.master.GetFileTimeline(ctx, &pb.GetFileTimelineRequest{FileName: fileName})
+	if err != nil {
+		return nil, fmt.Errorf("GetFileTimeline failed: %v", err)
+	}
+	return response.Events, nil
+}
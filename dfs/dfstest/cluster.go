@@ -0,0 +1,263 @@
+package dfstest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	pb "proj/Services"
+	"proj/dfs"
+	"strconv"
+	"sync"
+
+	"google.golang.org/grpc"
+)
+
+const chunkSize = 1024 * 1024 // 1MB
+
+// Cluster is a fake cluster running in the test process. A single gRPC server
+// answers both the master RPCs (always pointing clients back at itself) and
+// the DataNode RPCs, storing file contents in FS.
+type Cluster struct {
+	FS *FS
+
+	listener   net.Listener
+	grpcServer *grpc.Server
+}
+
+// NewCluster starts a fake cluster listening on a random localhost port.
+func NewCluster() (*Cluster, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("tcp listen fail: %v", err)
+	}
+
+	c := &Cluster{
+		FS:         NewFS(),
+		listener:   listener,
+		grpcServer: grpc.NewServer(),
+	}
+	pb.RegisterFileServiceServer(c.grpcServer, &fakeServer{
+		fs:      c.FS,
+		addr:    listener.Addr().(*net.TCPAddr),
+		uploads: make(map[string]*fakeUpload),
+	})
+	go c.grpcServer.Serve(listener)
+	return c, nil
+}
+
+// Addr is the address to pass to dfs.Dial.
+func (c *Cluster) Addr() string {
+	return c.listener.Addr().String()
+}
+
+// Client dials the cluster with the real SDK client.
+func (c *Cluster) Client() (*dfs.Client, error) {
+	return dfs.Dial(c.Addr())
+}
+
+// Close stops the server and drops in-flight uploads.
+func (c *Cluster) Close() {
+	c.grpcServer.Stop()
+}
+
+type fakeServer struct {
+	pb.UnimplementedFileServiceServer
+	fs    *FS
+	addr  *net.TCPAddr
+	mutex sync.Mutex
+	// uploads in progress by session ID
+	uploads  map[string]*fakeUpload
+	sessions int
+}
+
+type fakeUpload struct {
+	fileName string
+	buf      bytes.Buffer
+}
+
+func (s *fakeServer) HandleUploadFile(ctx context.Context, in *pb.HandleUploadFileRequest) (*pb.HandleUploadFileResponse, error) {
+	return &pb.HandleUploadFileResponse{
+		PortNumber: int32(s.addr.Port),
+		IpAddress:  s.addr.IP.String(),
+	}, nil
+}
+
+func (s *fakeServer) PrepareUpload(ctx context.Context, in *pb.PrepareUploadRequest) (*pb.PrepareUploadResponse, error) {
+	if _, ok := s.fs.ReadFile(in.FileName); in.Append && !ok {
+		return nil, ErrNotExist
+	}
+	return &pb.PrepareUploadResponse{
+		Targets: []*pb.UploadTarget{{
+			IpAddress:  s.addr.IP.String(),
+			PortNumber: int32(s.addr.Port),
+		}},
+		UploadToken: "dfstest",
+	}, nil
+}
+
+func (s *fakeServer) HandleDownloadFile(ctx context.Context, in *pb.HandleDownloadFileRequest) (*pb.HandleDownloadFileResponse, error) {
+	if _, ok := s.fs.ReadFile(in.FileName); !ok {
+		return nil, ErrNotExist
+	}
+	return &pb.HandleDownloadFileResponse{
+		IpAddress:   []string{s.addr.IP.String()},
+		PortNumbers: []int32{int32(s.addr.Port)},
+	}, nil
+}
+
+func (s *fakeServer) GetReadLocations(ctx context.Context, in *pb.GetReadLocationsRequest) (*pb.GetReadLocationsResponse, error) {
+	if _, ok := s.fs.ReadFile(in.FileName); !ok {
+		return nil, ErrNotExist
+	}
+	return &pb.GetReadLocationsResponse{
+		Replicas: []*pb.ReplicaLocation{{
+			IpAddress:  s.addr.IP.String(),
+			PortNumber: int32(s.addr.Port),
+			Alive:      true,
+			Local:      true,
+		}},
+	}, nil
+}
+
+// GetCapabilities offers what the fake implements, as a current master and DataNode in one
+func (s *fakeServer) GetCapabilities(ctx context.Context, in *pb.GetCapabilitiesRequest) (*pb.GetCapabilitiesResponse, error) {
+	return &pb.GetCapabilitiesResponse{
+		ApiVersion:      dfs.APIVersion,
+		MinApiVersion:   1,
+		Capabilities:    []string{"prepare-upload", "read-locations", "find-by-checksum", "stream-download", "upload-offsets", "range-reads", "delete-files", "append", "rename", "stat-file", "sync-uploads"},
+		MaxMessageBytes: 4 * 1024 * 1024,
+		ChunkBytes:      chunkSize,
+	}, nil
+}
+
+func (s *fakeServer) BeginUploadFile(ctx context.Context, req *pb.FileUploadRequest) (*pb.FileUploadResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	upload := &fakeUpload{fileName: req.FileName}
+	// an append starts from the committed content, like the DataNode's staged copy
+	if req.Append {
+		content, ok := s.fs.ReadFile(req.FileName)
+		if !ok {
+			return nil, ErrNotExist
+		}
+		upload.buf.Write(content)
+	}
+	s.sessions++
+	id := strconv.Itoa(s.sessions)
+	s.uploads[id] = upload
+	return &pb.FileUploadResponse{Message: "Upload initiated", SessionId: id, Offset: int64(upload.buf.Len())}, nil
+}
+
+func (s *fakeServer) UpdateUploadFile(ctx context.Context, req *pb.FileUploadRequest) (*pb.FileUploadResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	upload, ok := s.uploads[req.SessionId]
+	if !ok {
+		return nil, fmt.Errorf("no active upload session %s", req.SessionId)
+	}
+	buf := &upload.buf
+	// a retried chunk replaces what was written from its offset on
+	if req.Offset != nil {
+		if *req.Offset > int64(buf.Len()) {
+			return nil, fmt.Errorf("offset %d past the %d bytes received", *req.Offset, buf.Len())
+		}
+		buf.Truncate(int(*req.Offset))
+	}
+	buf.Write(req.FileContent)
+	return &pb.FileUploadResponse{Message: "Chunk received"}, nil
+}
+
+func (s *fakeServer) EndUploadFile(ctx context.Context, req *pb.FileUploadRequest) (*pb.FileUploadResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	upload, ok := s.uploads[req.SessionId]
+	if !ok {
+		return nil, fmt.Errorf("no active upload session %s", req.SessionId)
+	}
+	delete(s.uploads, req.SessionId)
+	s.fs.WriteFile(upload.fileName, upload.buf.Bytes())
+	return &pb.FileUploadResponse{Message: "Upload complete"}, nil
+}
+
+func (s *fakeServer) DownloadFile(ctx context.Context, in *pb.FileDownloadRequest) (*pb.FileDownloadResponse, error) {
+	content, ok := s.fs.ReadFile(in.FileName)
+	if !ok {
+		return nil, ErrNotExist
+	}
+	return &pb.FileDownloadResponse{FileContent: content}, nil
+}
+
+func (s *fakeServer) StreamDownload(in *pb.FileDownloadRequest, stream pb.FileService_StreamDownloadServer) error {
+	content, ok := s.fs.ReadFile(in.FileName)
+	if !ok {
+		return ErrNotExist
+	}
+	if in.Offset < 0 || in.Length < 0 || in.Offset > int64(len(content)) {
+		return fmt.Errorf("bad range: offset %d, length %d of %d bytes", in.Offset, in.Length, len(content))
+	}
+	content = content[in.Offset:]
+	if in.Length > 0 && in.Length < int64(len(content)) {
+		content = content[:in.Length]
+	}
+	for offset := 0; offset < len(content); offset += chunkSize {
+		end := min(offset+chunkSize, len(content))
+		if err := stream.Send(&pb.FileDownloadResponse{FileContent: content[offset:end]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakeServer) GetFileChecksum(ctx context.Context, in *pb.GetFileChecksumRequest) (*pb.GetFileChecksumResponse, error) {
+	content, ok := s.fs.ReadFile(in.FileName)
+	if !ok {
+		return nil, ErrNotExist
+	}
+	sum := sha256.Sum256(content)
+	return &pb.GetFileChecksumResponse{Checksum: hex.EncodeToString(sum[:]), Size: int64(len(content))}, nil
+}
+
+func (s *fakeServer) DeleteFile(ctx context.Context, in *pb.FileDeleteRequest) (*pb.FileDeleteResponse, error) {
+	if err := s.fs.Delete(ctx, in.FileName); err != nil {
+		return nil, err
+	}
+	return &pb.FileDeleteResponse{}, nil
+}
+
+func (s *fakeServer) RenameFile(ctx context.Context, in *pb.RenameFileRequest) (*pb.RenameFileResponse, error) {
+	if err := s.fs.Rename(ctx, in.FileName, in.NewName); err != nil {
+		return nil, err
+	}
+	return &pb.RenameFileResponse{}, nil
+}
+
+func (s *fakeServer) StatFile(ctx context.Context, in *pb.StatFileRequest) (*pb.StatFileResponse, error) {
+	content, ok := s.fs.ReadFile(in.FileName)
+	if !ok {
+		return nil, ErrNotExist
+	}
+	sum := sha256.Sum256(content)
+	return &pb.StatFileResponse{Size: int64(len(content)), Checksum: hex.EncodeToString(sum[:]), Health: "ok"}, nil
+}
+
+func (s *fakeServer) FindByChecksum(ctx context.Context, in *pb.FindByChecksumRequest) (*pb.FindByChecksumResponse, error) {
+	response := &pb.FindByChecksumResponse{}
+	for _, name := range s.fs.FileNames() {
+		content, ok := s.fs.ReadFile(name)
+		if !ok {
+			continue
+		}
+		sum := sha256.Sum256(content)
+		if checksum := hex.EncodeToString(sum[:]); checksum == in.Checksum {
+			response.Files = append(response.Files, &pb.NamespaceFile{
+				FileName: name,
+				FileSize: int64(len(content)),
+				Checksum: checksum,
+			})
+		}
+	}
+	return response, nil
+}
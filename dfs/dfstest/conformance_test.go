@@ -0,0 +1,119 @@
+package dfstest_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"proj/dfs"
+	"proj/dfs/dfstest"
+	"strings"
+	"testing"
+)
+
+// fileSystem is what FS and dfs.Client have in common
+type fileSystem interface {
+	dfs.FileSystem
+	Delete(ctx context.Context, fileName string) error
+	Rename(ctx context.Context, fileName, newName string) error
+}
+
+/*
+outcome describes err, or what was read. The client's errors carry the
+cluster's only as text, so errors are told apart by their message
+*/
+func outcome(content string, err error) string {
+	switch {
+	case err == nil:
+		return "ok " + content
+	case strings.Contains(err.Error(), dfstest.ErrNotExist.Error()):
+		return "not exist"
+	case strings.Contains(err.Error(), dfstest.ErrExist.Error()):
+		return "exists"
+	}
+	return "error " + err.Error()
+}
+
+func read(ctx context.Context, fsys fileSystem, fileName string) string {
+	reader, err := fsys.Open(ctx, fileName)
+	if err != nil {
+		return outcome("", err)
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	return outcome(string(content), err)
+}
+
+func write(ctx context.Context, fsys fileSystem, fileName, content string) string {
+	writer, err := fsys.Create(ctx, fileName)
+	if err != nil {
+		return outcome("", err)
+	}
+	if _, err := io.WriteString(writer, content); err != nil {
+		writer.Close()
+		return outcome("", err)
+	}
+	return outcome("", writer.Close())
+}
+
+// run goes through the same calls on fsys, returning each call's outcome
+func run(ctx context.Context, fsys fileSystem) []string {
+	var outcomes []string
+	step := func(name, result string) {
+		outcomes = append(outcomes, fmt.Sprintf("%s: %s", name, result))
+	}
+	step("open missing", read(ctx, fsys, "missing.txt"))
+
+	writer, err := fsys.Create(ctx, "a.txt")
+	if err != nil {
+		step("create a.txt", outcome("", err))
+		return outcomes
+	}
+	io.WriteString(writer, "hello")
+	step("open a.txt before close", read(ctx, fsys, "a.txt"))
+	step("close a.txt", outcome("", writer.Close()))
+	step("open a.txt", read(ctx, fsys, "a.txt"))
+
+	step("create b.txt", write(ctx, fsys, "b.txt", "world"))
+	step("rename a.txt onto b.txt", outcome("", fsys.Rename(ctx, "a.txt", "b.txt")))
+	step("rename missing", outcome("", fsys.Rename(ctx, "missing.txt", "c.txt")))
+	step("rename a.txt", outcome("", fsys.Rename(ctx, "a.txt", "c.txt")))
+	step("open a.txt after rename", read(ctx, fsys, "a.txt"))
+	step("open c.txt", read(ctx, fsys, "c.txt"))
+
+	step("delete c.txt", outcome("", fsys.Delete(ctx, "c.txt")))
+	step("delete c.txt again", outcome("", fsys.Delete(ctx, "c.txt")))
+	step("delete missing", outcome("", fsys.Delete(ctx, "missing.txt")))
+	step("open c.txt after delete", read(ctx, fsys, "c.txt"))
+	step("open b.txt", read(ctx, fsys, "b.txt"))
+	return outcomes
+}
+
+func TestClientMatchesFS(t *testing.T) {
+	ctx := context.Background()
+	fs := dfstest.NewFS()
+	want := run(ctx, fs)
+
+	cluster, err := dfstest.NewCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	client, err := cluster.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	got := run(ctx, client)
+
+	if len(got) != len(want) {
+		t.Fatalf("client went through %d calls, FS %d:\n%s\n%s", len(got), len(want), strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("client %q, FS %q", got[i], want[i])
+		}
+	}
+	if got, want := strings.Join(cluster.FS.FileNames(), ","), strings.Join(fs.FileNames(), ","); got != want {
+		t.Errorf("cluster holds %s, FS %s", got, want)
+	}
+}
@@ -0,0 +1,174 @@
+// Package dfstest provides fakes of the distributed file system for tests of
+// applications built on the dfs SDK. FS is a plain in-memory dfs.FileSystem,
+// also deleting and renaming files like dfs.Client;
+// Cluster is a single-process gRPC server playing both master and DataNode so
+// the real dfs.Client can be exercised without a running cluster.
+package dfstest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"proj/dfs"
+	"sort"
+	"sync"
+)
+
+// ErrNotExist is returned when opening a file that was never committed.
+var ErrNotExist = errors.New("dfstest: No such filename exist")
+
+// ErrExist is returned when renaming a file onto a name already taken.
+var ErrExist = errors.New("dfstest: file already exists")
+
+// ErrClosed is returned when writing to a file after Close.
+var ErrClosed = errors.New("dfstest: write on closed file")
+
+// FS is an in-memory dfs.FileSystem. Files become visible to Open only once
+// the writer returned by Create is closed, mirroring EndUploadFile.
+type FS struct {
+	mutex sync.Mutex
+	files map[string][]byte
+}
+
+var _ dfs.FileSystem = (*FS)(nil)
+
+// NewFS returns an empty in-memory file system.
+func NewFS() *FS {
+	return &FS{files: make(map[string][]byte)}
+}
+
+// Open returns a reader over a snapshot of fileName's contents.
+func (f *FS) Open(ctx context.Context, fileName string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	content, ok := f.ReadFile(fileName)
+	if !ok {
+		return nil, ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+// Create returns a writer that commits fileName on Close. Placement options
+// are accepted and ignored since there are no DataNodes to place on.
+func (f *FS) Create(ctx context.Context, fileName string, opts ...dfs.CreateOption) (io.WriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &memWriter{ctx: ctx, fs: f, fileName: fileName}, nil
+}
+
+// Delete removes fileName, as dfs.Client.Delete does.
+func (f *FS) Delete(ctx context.Context, fileName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !f.RemoveFile(fileName) {
+		return ErrNotExist
+	}
+	return nil
+}
+
+// Rename moves fileName to newName, which must not exist, as
+// dfs.Client.Rename does.
+func (f *FS) Rename(ctx context.Context, fileName, newName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	content, ok := f.files[fileName]
+	if !ok {
+		return ErrNotExist
+	}
+	if _, exists := f.files[newName]; exists {
+		return ErrExist
+	}
+	delete(f.files, fileName)
+	f.files[newName] = content
+	return nil
+}
+
+// ReadFile returns a copy of fileName's committed contents.
+func (f *FS) ReadFile(fileName string) ([]byte, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	content, ok := f.files[fileName]
+	if !ok {
+		return nil, false
+	}
+	return bytes.Clone(content), true
+}
+
+// WriteFile commits fileName directly, for seeding test fixtures.
+func (f *FS) WriteFile(fileName string, content []byte) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.files[fileName] = bytes.Clone(content)
+}
+
+// RemoveFile deletes fileName, reporting whether it existed.
+func (f *FS) RemoveFile(fileName string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, ok := f.files[fileName]
+	delete(f.files, fileName)
+	return ok
+}
+
+// RenameFile moves fileName to newName, reporting whether fileName existed
+// and newName didn't.
+func (f *FS) RenameFile(fileName, newName string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	content, ok := f.files[fileName]
+	if _, exists := f.files[newName]; !ok || exists {
+		return false
+	}
+	delete(f.files, fileName)
+	f.files[newName] = content
+	return true
+}
+
+// FileNames returns the committed file names in sorted order.
+func (f *FS) FileNames() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	names := make([]string, 0, len(f.files))
+	for name := range f.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type memWriter struct {
+	ctx      context.Context
+	fs       *FS
+	fileName string
+	buf      bytes.Buffer
+	closed   bool
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memWriter) Close() error {
+	if w.closed {
+		return ErrClosed
+	}
+	w.closed = true
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	w.fs.WriteFile(w.fileName, w.buf.Bytes())
+	return nil
+}
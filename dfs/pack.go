@@ -0,0 +1,163 @@
+package dfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	pb "proj/Services"
+	"strconv"
+)
+
+/*
+Packer stores many small files, such as sensor readings, packed together in
+container files rather than each as a file of its own, sparing the
+DataNodes a file and the master a replica list per reading. Files are
+buffered by Add and uploaded as one container once containerBytes are
+buffered or on Flush; each is then read, listed, renamed and deleted under
+its own name like any file. A Packer isn't safe for concurrent use.
+*/
+type Packer struct {
+	ctx            context.Context
+	c              *Client
+	containerBytes int64
+	opts           []CreateOption
+	// the container being filled and the files in it
+	buffer bytes.Buffer
+	files  []*pb.PackedFile
+	names  map[string]bool
+}
+
+// NewPacker returns a Packer filling containers of about containerBytes,
+// the options apply to every file packed.
+func (c *Client) NewPacker(ctx context.Context, containerBytes int64, opts ...CreateOption) *Packer {
+	return &Packer{ctx: ctx, c: c, containerBytes: containerBytes, opts: opts, names: make(map[string]bool)}
+}
+
+// Add packs content as fileName, uploading the container first when it
+// would overflow or already holds fileName. The file is stored once its
+// container is uploaded.
+func (p *Packer) Add(fileName string, content []byte) error {
+	if len(p.files) > 0 && (int64(p.buffer.Len()+len(content)) > p.containerBytes || p.names[fileName]) {
+		if err := p.Flush(); err != nil {
+			return err
+		}
+	}
+	sum := sha256.Sum256(content)
+	p.files = append(p.files, &pb.PackedFile{
+		FileName: fileName,
+		Offset:   int64(p.buffer.Len()),
+		Length:   int64(len(content)),
+		Checksum: hex.EncodeToString(sum[:]),
+	})
+	p.names[fileName] = true
+	p.buffer.Write(content)
+	if int64(p.buffer.Len()) >= p.containerBytes {
+		return p.Flush()
+	}
+	return nil
+}
+
+// Flush uploads the files added since the last container, if any. On error
+// they stay buffered and Flush can be called again.
+func (p *Packer) Flush() error {
+	if len(p.files) == 0 {
+		return nil
+	}
+	info, err := p.c.info(p.ctx)
+	if err != nil {
+		return err
+	}
+	if !info.has("pack") {
+		return errors.New("the master doesn't support packing small files, upgrade it")
+	}
+	request := &pb.PrepareUploadRequest{}
+	for _, opt := range p.opts {
+		opt(request)
+	}
+	request.FileSize = int64(p.buffer.Len())
+	request.Packed = p.files
+	response, err := p.c.prepareUpload(p.ctx, request)
+	if err != nil {
+		return fmt.Errorf("failed to get upload details: %v", err)
+	}
+	ctx := uploadContext(p.ctx, request, response.UploadToken)
+
+	lastErr := errors.New("master returned no upload targets")
+	for _, addr := range targetAddresses(response.Targets) {
+		writer, err := openWriter(ctx, p.c, addr, response.FileName, request.FileSize, false, false)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if _, err := writer.Write(p.buffer.Bytes()); err != nil {
+			writer.Abort()
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		p.buffer.Reset()
+		p.files = nil
+		p.names = make(map[string]bool)
+		return nil
+	}
+	return lastErr
+}
+
+/*
+openPacked reads length bytes from offset of a file packed in a container,
+the rest of it when length is 0, as a range of the container. A file read
+whole is verified against its checksum.
+*/
+func (c *Client) openPacked(ctx context.Context, fileName string, packed *pb.PackedLocation, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 || offset+length > packed.Length {
+		length = packed.Length - offset
+	}
+	// a range of no bytes would read the whole container
+	if length <= 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	lastErr := errors.New("no available DataNodes for download")
+	for _, replica := range packed.Replicas {
+		if !replica.Alive || replica.Corrupt {
+			continue
+		}
+		addr := net.JoinHostPort(replica.IpAddress, strconv.Itoa(int(replica.PortNumber)))
+		reader, err := openReader(ctx, c, addr, packed.Container, packed.Offset+offset, length, false)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if offset != 0 || length != packed.Length || packed.Checksum == "" {
+			return reader, nil
+		}
+		return &packedReader{ReadCloser: reader, fileName: fileName, checksum: packed.Checksum, hash: sha256.New()}, nil
+	}
+	return nil, lastErr
+}
+
+// packedReader verifies a packed file read whole against its checksum
+type packedReader struct {
+	io.ReadCloser
+	fileName string
+	checksum string
+	hash     hash.Hash
+}
+
+func (r *packedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		if got := hex.EncodeToString(r.hash.Sum(nil)); got != r.checksum {
+			return n, &ChecksumError{FileName: r.fileName, Err: fmt.Errorf("received data hashes to %s, the master recorded %s", got, r.checksum)}
+		}
+	}
+	return n, err
+}
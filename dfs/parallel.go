@@ -0,0 +1,160 @@
+package dfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	pb "proj/Services"
+	"strconv"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+/*
+UploadParallel uploads the size bytes of src as fileName, split into ranges
+sent concurrently over streams connections to the same DataNode, so a
+high-latency, high-bandwidth link isn't limited by the window of a single
+stream. The DataNode assembles the file once every range arrived. DataNodes
+without parallel uploads get the file over one stream, like Create.
+*/
+func (c *Client) UploadParallel(ctx context.Context, fileName string, src io.ReaderAt, size int64, streams int, opts ...CreateOption) error {
+	request := &pb.PrepareUploadRequest{FileName: fileName}
+	for _, opt := range opts {
+		opt(request)
+	}
+	request.FileSize = size
+	// the blocks are written one after the other
+	if request.BlockBytes > 0 || request.Blocks {
+		return c.Upload(ctx, fileName, io.NewSectionReader(src, 0, size), append(opts, WithSize(size))...)
+	}
+	ctx, targets, err := c.startUpload(ctx, request)
+	if err != nil {
+		return err
+	}
+	encoded := request.ContentEncoding != ""
+
+	var lastErr error
+	for _, addr := range targets {
+		conn, err := grpc.Dial(addr, c.dialOptions()...)
+		if err != nil {
+			lastErr = fmt.Errorf("could not connect to DataNode %s: %v", addr, err)
+			continue
+		}
+		info, err := c.dataNodeInfo(ctx, pb.NewFileServiceClient(conn), addr)
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if streams <= 1 || size == 0 || !info.has("parallel-upload") {
+			writer, err := openWriter(ctx, c, addr, fileName, size, encoded, false)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if _, err := io.Copy(writer, io.NewSectionReader(src, 0, size)); err != nil {
+				writer.Close()
+				return err
+			}
+			return writer.Close()
+		}
+		if encoded && !info.has("content-encoding") {
+			lastErr = fmt.Errorf("DataNode %s doesn't support content encodings, upgrade it", addr)
+			continue
+		}
+		if err := checkSync(ctx, info, addr); err != nil {
+			lastErr = err
+			continue
+		}
+		return c.uploadRanges(ctx, addr, fileName, src, size, streams, info.chunkLimit(c.uploadChunkBytes()), info.has("upload-checksums"))
+	}
+	return lastErr
+}
+
+// uploadRanges sends src to addr as a parallel upload, each range over its own connection
+func (c *Client) uploadRanges(ctx context.Context, addr, fileName string, src io.ReaderAt, size int64, streams, chunk int, checksums bool) error {
+	// the declared size makes the DataNode accept the ranges in any order
+	ctx = metadata.AppendToOutgoingContext(ctx, "upload-size", strconv.FormatInt(size, 10))
+	conn, err := grpc.Dial(addr, c.dialOptions()...)
+	if err != nil {
+		return fmt.Errorf("could not connect to DataNode %s: %v", addr, err)
+	}
+	defer conn.Close()
+	client := pb.NewFileServiceClient(conn)
+	begun, err := client.BeginUploadFile(ctx, &pb.FileUploadRequest{FileName: fileName, ExpectedSize: size})
+	if err != nil {
+		return fmt.Errorf("BeginUpload failed: %v", err)
+	}
+	sessionID := begun.SessionId
+
+	// ranges are whole chunks, the last one takes the rest
+	chunks := (size + int64(chunk) - 1) / int64(chunk)
+	perStream := (chunks + int64(streams) - 1) / int64(streams) * int64(chunk)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	for start := int64(0); start < size; start += perStream {
+		end := min(start+perStream, size)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.uploadRange(ctx, addr, fileName, sessionID, src, start, end, chunk, checksums); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	err = retryUnavailable(ctx, func() error {
+		_, err := client.EndUploadFile(ctx, &pb.FileUploadRequest{FileName: fileName, SessionId: sessionID})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("EndUpload failed: %v", err)
+	}
+	return nil
+}
+
+// uploadRange sends bytes [start, end) of src in chunks with their offsets
+func (c *Client) uploadRange(ctx context.Context, addr, fileName, sessionID string, src io.ReaderAt, start, end int64, chunk int, checksums bool) error {
+	conn, err := grpc.Dial(addr, c.dialOptions()...)
+	if err != nil {
+		return fmt.Errorf("could not connect to DataNode %s: %v", addr, err)
+	}
+	defer conn.Close()
+	client := pb.NewFileServiceClient(conn)
+
+	buf := make([]byte, chunk)
+	for offset := start; offset < end; offset += int64(chunk) {
+		n, err := src.ReadAt(buf[:min(int64(chunk), end-offset)], offset)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("reading at %d: %v", offset, err)
+		}
+		if n == 0 {
+			return fmt.Errorf("reading at %d: %v", offset, io.ErrUnexpectedEOF)
+		}
+		request := &pb.FileUploadRequest{FileName: fileName, FileContent: buf[:n], Offset: &offset, SessionId: sessionID}
+		if checksums {
+			request.ChunkCrc32C = chunkChecksum(request.FileContent)
+		}
+		err = retryChunk(ctx, func() error {
+			_, err := client.UpdateUploadFile(ctx, request)
+			return err
+		})
+		if err != nil {
+			return uploadError(fileName, fmt.Sprintf("UpdateUpload at %d", offset), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package dfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	pb "proj/Services"
+)
+
+// resumeAttempts is how many times in a row UploadResumable resumes an upload that made no progress
+const resumeAttempts = 5
+
+/*
+UploadResumable uploads the size bytes of src as fileName through an upload
+session, like Create. When sending fails, say the connection dropped for
+longer than the retry window, it asks the DataNode how many bytes of the
+session it durably holds and sends the rest from there instead of starting
+over; it gives up after resumeAttempts tries in a row that got no further.
+DataNodes without upload-offset-query get a single attempt.
+*/
+func (c *Client) UploadResumable(ctx context.Context, fileName string, src io.ReaderAt, size int64, opts ...CreateOption) error {
+	writer, err := c.Create(ctx, fileName, opts...)
+	if err != nil {
+		return err
+	}
+	w := writer.(*Writer)
+	var resumedAt int64
+	for attempt := 1; ; attempt++ {
+		_, err := io.Copy(w, io.NewSectionReader(src, w.offset, size-w.offset))
+		if err == nil {
+			// the last chunk is sent here, Close can't be resumed
+			err = w.flush()
+		}
+		if err == nil && w.resumable {
+			// a chunk acknowledged but lost is sent again before committing
+			var durable int64
+			if durable, err = w.durableOffset(); err == nil && durable != w.offset {
+				err = fmt.Errorf("the DataNode holds %d of the %d bytes sent", durable, w.offset)
+			}
+		}
+		if err == nil {
+			return w.Close()
+		}
+		if !w.resumable || attempt == resumeAttempts || ctx.Err() != nil {
+			// the DataNode drops the abandoned session once it is idle
+			w.closed = true
+			w.conn.Close()
+			return err
+		}
+		if err := w.resume(src); err != nil {
+			w.closed = true
+			w.conn.Close()
+			return err
+		}
+		if w.offset > resumedAt {
+			attempt, resumedAt = 0, w.offset
+		}
+	}
+}
+
+// durableOffset asks the DataNode how many bytes of the session it durably holds
+func (w *Writer) durableOffset() (int64, error) {
+	var response *pb.GetUploadOffsetResponse
+	err := retryUnavailable(w.ctx, func() error {
+		var err error
+		response, err = w.client.GetUploadOffset(w.ctx, &pb.GetUploadOffsetRequest{FileName: w.fileName, SessionId: w.sessionID})
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("GetUploadOffset failed: %v", err)
+	}
+	return response.Offset, nil
+}
+
+// resume rewinds w to the bytes the DataNode durably holds, dropping what is buffered; src is what was sent, rehashed up to there
+func (w *Writer) resume(src io.ReaderAt) error {
+	offset, err := w.durableOffset()
+	if err != nil {
+		return err
+	}
+	w.offset, w.n = offset, 0
+	w.hash.Reset()
+	if _, err := io.Copy(w.hash, io.NewSectionReader(src, 0, w.offset)); err != nil {
+		return fmt.Errorf("reading %s: %v", w.fileName, err)
+	}
+	return nil
+}
@@ -0,0 +1,420 @@
+package dfs
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	pb "proj/Services"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// ErrClosed is returned when writing to a Writer after Close.
+var ErrClosed = errors.New("dfs: write on closed file")
+
+// restartRetryWindow is how long a Writer keeps retrying an unreachable
+// DataNode, enough for a restart that resumes its upload sessions.
+const restartRetryWindow = 30 * time.Second
+
+// retryUnavailable repeats call while the DataNode is unreachable.
+func retryUnavailable(ctx context.Context, call func() error) error {
+	deadline := time.Now().Add(restartRetryWindow)
+	for {
+		err := call()
+		if status.Code(err) != codes.Unavailable || time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// Reader streams a file from a DataNode. Chunks are only requested from the
+// stream as the caller consumes them, so a slow consumer applies backpressure
+// all the way to the DataNode through gRPC flow control.
+type Reader struct {
+	conn   *grpc.ClientConn
+	stream pb.FileService_StreamDownloadClient
+	cancel context.CancelFunc
+	buf    []byte
+	err    error
+	// decodes the received bytes when the DataNode sends them gzip encoded
+	decoder *gzip.Reader
+	// checksum the DataNode sent, what was received is checked against it at the end
+	fileName string
+	checksum string
+	hash     hash.Hash
+}
+
+// rawReader reads the chunks of a Reader as received, before decoding
+type rawReader struct{ r *Reader }
+
+func (raw rawReader) Read(p []byte) (int, error) {
+	return raw.r.readRaw(p)
+}
+
+/*
+openReader downloads fileName from addr, or only length bytes from offset
+when either is set. With keepEncoding a file stored encoded is read as
+stored rather than decoded
+*/
+func openReader(ctx context.Context, c *Client, addr, fileName string, offset, length int64, keepEncoding bool) (*Reader, error) {
+	conn, err := grpc.Dial(addr, c.dialOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to DataNode %s: %v", addr, err)
+	}
+	client := pb.NewFileServiceClient(conn)
+	info, err := c.dataNodeInfo(ctx, client, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ranged := offset != 0 || length != 0
+	if ranged && !info.has("range-reads") {
+		conn.Close()
+		return nil, fmt.Errorf("DataNode %s doesn't support range reads, upgrade it", addr)
+	}
+	if keepEncoding && !info.has("stream-download") {
+		conn.Close()
+		return nil, fmt.Errorf("DataNode %s can't send files as stored, upgrade it", addr)
+	}
+	// DataNodes without streaming send the whole file in one message
+	if !info.has("stream-download") {
+		response, err := client.DownloadFile(ctx, &pb.FileDownloadRequest{FileName: fileName})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("DownloadFile from %s failed: %v", addr, err)
+		}
+		r := &Reader{conn: conn, cancel: func() {}, buf: response.FileContent, fileName: fileName, checksum: response.Checksum, hash: sha256.New()}
+		r.hash.Write(response.FileContent)
+		if r.err = r.verify(); r.err != io.EOF {
+			r.Close()
+			return nil, r.err
+		}
+		return r, nil
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	// chunks must fit in the messages this client accepts
+	streamCtx = metadata.AppendToOutgoingContext(streamCtx, "chunk-bytes", strconv.FormatInt(c.maxMessageBytes-messageOverhead, 10))
+	// gzip stored files are sent compressed, saving bandwidth, and decoded
+	// here; a range is of the decoded bytes, the DataNode decodes it
+	if !ranged {
+		streamCtx = metadata.AppendToOutgoingContext(streamCtx, "accept-encoding", "gzip")
+	}
+	stream, err := client.StreamDownload(streamCtx, &pb.FileDownloadRequest{
+		FileName: fileName,
+		Offset:   offset,
+		Length:   length,
+	})
+	if err != nil {
+		cancel()
+		conn.Close()
+		return nil, fmt.Errorf("StreamDownload from %s failed: %v", addr, err)
+	}
+
+	r := &Reader{conn: conn, stream: stream, cancel: cancel, fileName: fileName, hash: sha256.New()}
+	// Pull the first chunk eagerly so a replica missing the file is reported here
+	r.recv()
+	if r.err != nil && r.err != io.EOF {
+		err := r.err
+		r.Close()
+		return nil, fmt.Errorf("StreamDownload from %s failed: %v", addr, err)
+	}
+	if header, err := stream.Header(); err == nil && len(header.Get("content-encoding")) > 0 && !keepEncoding {
+		decoder, err := gzip.NewReader(rawReader{r})
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("decoding %s from %s failed: %v", fileName, addr, err)
+		}
+		r.decoder = decoder
+	}
+	return r, nil
+}
+
+func (r *Reader) recv() {
+	response, err := r.stream.Recv()
+	if err == io.EOF {
+		r.err = r.verify()
+		return
+	}
+	if err != nil {
+		r.err = err
+		return
+	}
+	if response.Checksum != "" {
+		r.checksum = response.Checksum
+	}
+	r.hash.Write(response.FileContent)
+	r.buf = response.FileContent
+}
+
+// verify checks everything received against the checksum the DataNode sent, io.EOF when it matches
+func (r *Reader) verify() error {
+	if r.checksum == "" {
+		return io.EOF
+	}
+	if got := hex.EncodeToString(r.hash.Sum(nil)); got != r.checksum {
+		return &ChecksumError{FileName: r.fileName, Err: fmt.Errorf("received data hashes to %s, the DataNode sent %s", got, r.checksum)}
+	}
+	return io.EOF
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.decoder != nil {
+		return r.decoder.Read(p)
+	}
+	return r.readRaw(p)
+}
+
+func (r *Reader) readRaw(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.recv()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// WriteTo implements io.WriterTo, handing each received chunk straight to w
+// without an intermediate copy unless it has to be decoded.
+func (r *Reader) WriteTo(w io.Writer) (int64, error) {
+	if r.decoder != nil {
+		return io.Copy(w, r.decoder)
+	}
+	var total int64
+	for {
+		if len(r.buf) > 0 {
+			n, err := w.Write(r.buf)
+			total += int64(n)
+			r.buf = r.buf[n:]
+			if err != nil {
+				return total, err
+			}
+		}
+		if r.err == io.EOF {
+			return total, nil
+		}
+		if r.err != nil {
+			return total, r.err
+		}
+		r.recv()
+	}
+}
+
+// Close cancels the stream and releases the DataNode connection.
+func (r *Reader) Close() error {
+	r.cancel()
+	return r.conn.Close()
+}
+
+// Writer uploads a file to a DataNode using the Begin/Update/End upload
+// session. Writes are buffered up to the client's chunk size, or the smaller
+// chunk the DataNode's limits allow, before being sent.
+type Writer struct {
+	ctx      context.Context
+	conn     *grpc.ClientConn
+	client   pb.FileServiceClient
+	fileName string
+	// upload session from BeginUploadFile, empty from DataNodes predating session IDs
+	sessionID string
+	buf       []byte
+	n         int
+	// bytes acknowledged by the DataNode, sent with each chunk so retries are idempotent
+	offset int64
+	// whether the DataNode takes chunk offsets, older ones only append
+	offsets bool
+	// whether the DataNode verifies checksums, hash covers the chunks it
+	// acknowledged, of an append the appended ones
+	checksums bool
+	hash      hash.Hash
+	// whether the DataNode reports the durable offset of a session, see UploadResumable
+	resumable bool
+	// whether the DataNode drops a session on request, see Abort
+	cancels bool
+	// whether the DataNode reports the progress of a session, see Progress
+	progress bool
+	closed   bool
+}
+
+/*
+openWriter begins an upload session on the DataNode at addr. An appending
+writer's session starts from the stored file, the chunks it sends follow the
+file's current end. size, when known, is what the session is to receive,
+the total GetUploadProgress reports
+*/
+func openWriter(ctx context.Context, c *Client, addr, fileName string, size int64, encoded, appending bool) (*Writer, error) {
+	conn, err := grpc.Dial(addr, c.dialOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to DataNode %s: %v", addr, err)
+	}
+	client := pb.NewFileServiceClient(conn)
+	info, err := c.dataNodeInfo(ctx, client, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if encoded && !info.has("content-encoding") {
+		conn.Close()
+		return nil, fmt.Errorf("DataNode %s doesn't support content encodings, upgrade it", addr)
+	}
+	if appending && !info.has("append") {
+		conn.Close()
+		return nil, fmt.Errorf("DataNode %s doesn't support appends, upgrade it", addr)
+	}
+	if err := checkSync(ctx, info, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	begun, err := client.BeginUploadFile(ctx, &pb.FileUploadRequest{FileName: fileName, Append: appending, ExpectedSize: size})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("BeginUpload failed: %v", err)
+	}
+
+	return &Writer{
+		ctx:       ctx,
+		conn:      conn,
+		client:    client,
+		fileName:  fileName,
+		sessionID: begun.SessionId,
+		offset:    begun.Offset,
+		buf:       make([]byte, info.chunkLimit(c.uploadChunkBytes())),
+		offsets:   info.has("upload-offsets"),
+		checksums: info.has("upload-checksums"),
+		hash:      sha256.New(),
+		resumable: info.has("upload-offset-query"),
+		cancels:   info.has("cancel-upload"),
+		progress:  info.has("upload-progress"),
+	}, nil
+}
+
+// Write implements io.Writer. It blocks while a full chunk is being sent.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrClosed
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[w.n:], p)
+		w.n += n
+		written += n
+		p = p[n:]
+		if w.n == len(w.buf) {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *Writer) flush() error {
+	if w.n == 0 {
+		return nil
+	}
+	request := &pb.FileUploadRequest{FileName: w.fileName, FileContent: w.buf[:w.n], SessionId: w.sessionID}
+	if w.offsets {
+		offset := w.offset
+		request.Offset = &offset
+	}
+	if w.checksums {
+		request.ChunkCrc32C = chunkChecksum(request.FileContent)
+	}
+	err := retryChunk(w.ctx, func() error {
+		_, err := w.client.UpdateUploadFile(w.ctx, request)
+		return err
+	})
+	if err != nil {
+		return uploadError(w.fileName, "UpdateUpload", err)
+	}
+	w.hash.Write(request.FileContent)
+	w.offset += int64(w.n)
+	w.n = 0
+	return nil
+}
+
+// Close sends any buffered data and commits the upload.
+func (w *Writer) Close() error {
+	if w.closed {
+		return ErrClosed
+	}
+	w.closed = true
+	defer w.conn.Close()
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+	request := &pb.FileUploadRequest{FileName: w.fileName, SessionId: w.sessionID}
+	if w.checksums {
+		request.FileSha256 = hex.EncodeToString(w.hash.Sum(nil))
+	}
+	err := retryUnavailable(w.ctx, func() error {
+		_, err := w.client.EndUploadFile(w.ctx, request)
+		return err
+	})
+	if err != nil {
+		return uploadError(w.fileName, "EndUpload", err)
+	}
+	return nil
+}
+
+// SessionID returns the upload session on the DataNode, empty on DataNodes
+// predating sessions; others can watch it with Client.UploadProgress.
+func (w *Writer) SessionID() string {
+	return w.sessionID
+}
+
+// Progress reports the bytes the DataNode received so far, flushed chunks
+// only, against the size declared with WithSize.
+func (w *Writer) Progress() (*pb.GetUploadProgressResponse, error) {
+	if w.closed {
+		return nil, ErrClosed
+	}
+	if !w.progress {
+		return nil, errors.New("the DataNode doesn't report upload progress, upgrade it")
+	}
+	response, err := w.client.GetUploadProgress(w.ctx, &pb.GetUploadProgressRequest{FileName: w.fileName, SessionId: w.sessionID})
+	if err != nil {
+		return nil, fmt.Errorf("GetUploadProgress failed: %v", err)
+	}
+	return response, nil
+}
+
+// Abort gives up the upload: the DataNode drops what was written and the
+// stored file, if any, keeps its content. DataNodes predating CancelUpload
+// drop the session once it has been idle for their timeout.
+func (w *Writer) Abort() error {
+	if w.closed {
+		return ErrClosed
+	}
+	w.closed = true
+	defer w.conn.Close()
+
+	if !w.cancels {
+		return nil
+	}
+	_, err := w.client.CancelUpload(w.ctx, &pb.CancelUploadRequest{FileName: w.fileName, SessionId: w.sessionID})
+	if err != nil {
+		return fmt.Errorf("CancelUpload failed: %v", err)
+	}
+	return nil
+}
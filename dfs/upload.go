@@ -0,0 +1,138 @@
+package dfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	pb "proj/Services"
+
+	"google.golang.org/grpc"
+)
+
+/*
+Upload sends everything read from r as fileName. DataNodes offering
+stream-upload get it over a single StreamUpload stream, the chunks flowing
+without a round trip each; others get it through the Begin/Update/End
+session of Create. Unlike a session, a stream isn't resumed when the
+DataNode restarts: the upload fails and must be sent again.
+*/
+func (c *Client) Upload(ctx context.Context, fileName string, r io.Reader, opts ...CreateOption) error {
+	request := &pb.PrepareUploadRequest{FileName: fileName}
+	for _, opt := range opts {
+		opt(request)
+	}
+	if request.BlockBytes > 0 || request.Blocks {
+		writer, err := c.createBlocks(ctx, request)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(writer, r); err != nil {
+			writer.Abort()
+			return err
+		}
+		return writer.Close()
+	}
+	ctx, targets, err := c.startUpload(ctx, request)
+	if err != nil {
+		return err
+	}
+	encoded := request.ContentEncoding != ""
+
+	var lastErr error
+	for _, addr := range targets {
+		conn, err := grpc.Dial(addr, c.dialOptions()...)
+		if err != nil {
+			lastErr = fmt.Errorf("could not connect to DataNode %s: %v", addr, err)
+			continue
+		}
+		client := pb.NewFileServiceClient(conn)
+		info, err := c.dataNodeInfo(ctx, client, addr)
+		if err != nil {
+			conn.Close()
+			lastErr = err
+			continue
+		}
+		if encoded && !info.has("content-encoding") {
+			conn.Close()
+			lastErr = fmt.Errorf("DataNode %s doesn't support content encodings, upgrade it", addr)
+			continue
+		}
+		if err := checkSync(ctx, info, addr); err != nil {
+			conn.Close()
+			lastErr = err
+			continue
+		}
+		if !info.has("stream-upload") {
+			conn.Close()
+			writer, err := openWriter(ctx, c, addr, fileName, request.FileSize, encoded, false)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if _, err := io.Copy(writer, r); err != nil {
+				writer.Close()
+				return err
+			}
+			return writer.Close()
+		}
+		// r is consumed from here on, a failure can't move to the next target
+		err = streamUpload(ctx, client, fileName, r, info.chunkLimit(c.uploadChunkBytes()), info.has("upload-checksums"))
+		conn.Close()
+		return err
+	}
+	return lastErr
+}
+
+/*
+streamUpload sends r in chunks over one StreamUpload stream, the first chunk
+naming the file. With checksums each chunk carries its CRC-32C and a last,
+empty message the SHA-256 of the whole file
+*/
+func streamUpload(ctx context.Context, client pb.FileServiceClient, fileName string, r io.Reader, chunk int, checksums bool) error {
+	// cancelling aborts the stream, the DataNode then drops the partial file
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.StreamUpload(ctx)
+	if err != nil {
+		return fmt.Errorf("StreamUpload failed: %v", err)
+	}
+
+	buf := make([]byte, chunk)
+	hash := sha256.New()
+	request := &pb.FileUploadRequest{FileName: fileName}
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 || request.FileName != "" {
+			request.FileContent = buf[:n]
+			if checksums {
+				request.ChunkCrc32C = chunkChecksum(request.FileContent)
+				hash.Write(request.FileContent)
+			}
+			// Send copies the message out, buf can be refilled
+			if sendErr := stream.Send(request); sendErr != nil {
+				// the DataNode ended the stream, its error comes with the response
+				_, sendErr = stream.CloseAndRecv()
+				return uploadError(fileName, "StreamUpload", sendErr)
+			}
+			request.FileName = ""
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", fileName, err)
+		}
+	}
+	if checksums {
+		if err := stream.Send(&pb.FileUploadRequest{FileSha256: hex.EncodeToString(hash.Sum(nil))}); err != nil {
+			_, err = stream.CloseAndRecv()
+			return uploadError(fileName, "StreamUpload", err)
+		}
+	}
+	if _, err := stream.CloseAndRecv(); err != nil {
+		return uploadError(fileName, "StreamUpload", err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"proj/dfs"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// backupManifest is stored as <prefix>/manifest.json and records how far
+// previous exports got
+type backupManifest struct {
+	Generation int64     `json:"generation"`
+	Exported   time.Time `json:"exported"`
+	Files      int       `json:"files"`
+}
+
+/*
+Copies the namespace to S3-compatible storage at bucket/prefix: the file
+data under data/, the namespace dump under namespace/<generation>.json and
+the manifest. Unless full is set only files with a generation stamp newer
+than the manifest's are copied
+*/
+func backupCommand(ctx context.Context, client *dfs.Client, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	endpoint := flags.String("endpoint", "https://s3.amazonaws.com", "S3-compatible endpoint, e.g. https://storage.googleapis.com")
+	region := flags.String("region", "us-east-1", "signing region")
+	full := flags.Bool("full", false, "copy every file, not only those changed since the last export")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("expected bucket[/prefix]")
+	}
+	bucket, prefix, _ := strings.Cut(strings.Trim(flags.Arg(0), "/"), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	endpointURL, err := url.Parse(*endpoint)
+	if err != nil || endpointURL.Host == "" {
+		return fmt.Errorf("bad endpoint %q", *endpoint)
+	}
+	store := &s3Client{
+		endpoint:  endpointURL,
+		region:    *region,
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+	if store.accessKey == "" || store.secretKey == "" {
+		return errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+
+	var previous backupManifest
+	if !*full {
+		content, err := store.get(ctx, bucket, prefix+"manifest.json")
+		if err != nil && err != errNoSuchKey {
+			return fmt.Errorf("reading manifest: %v", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(content, &previous); err != nil {
+				return fmt.Errorf("decoding manifest: %v", err)
+			}
+		}
+	}
+
+	dump, err := client.ExportNamespace(ctx)
+	if err != nil {
+		return err
+	}
+
+	copied := 0
+	for _, file := range dump.Files {
+		if file.Generation <= previous.Generation {
+			continue
+		}
+		if err := backupFile(ctx, client, store, bucket, prefix+"data/"+file.FileName, file.FileName); err != nil {
+			return fmt.Errorf("%s: %v", file.FileName, err)
+		}
+		copied++
+		fmt.Printf("Copied %s (%d bytes)\n", file.FileName, file.FileSize)
+	}
+
+	content, err := protojson.MarshalOptions{Multiline: true}.Marshal(dump)
+	if err != nil {
+		return fmt.Errorf("encoding dump: %v", err)
+	}
+	dumpKey := fmt.Sprintf("%snamespace/%d.json", prefix, dump.Generation)
+	if err := store.put(ctx, bucket, dumpKey, strings.NewReader(string(content)), int64(len(content))); err != nil {
+		return err
+	}
+
+	manifest, err := json.Marshal(backupManifest{Generation: dump.Generation, Exported: time.Now().UTC(), Files: len(dump.Files)})
+	if err != nil {
+		return err
+	}
+	if err := store.put(ctx, bucket, prefix+"manifest.json", strings.NewReader(string(manifest)), int64(len(manifest))); err != nil {
+		return err
+	}
+	fmt.Printf("Exported generation %d: %d of %d files copied, namespace at %s/%s\n",
+		dump.Generation, copied, len(dump.Files), bucket, dumpKey)
+	return nil
+}
+
+/*
+Streams fileName from the cluster into bucket/key. The data is staged in a
+temporary file first since object stores need the length up front. A file
+stored encoded is copied as stored, matching the size, checksum and
+encoding the namespace dump records
+*/
+func backupFile(ctx context.Context, client *dfs.Client, store *s3Client, bucket, key, fileName string) error {
+	reader, err := client.OpenEncoded(ctx, fileName)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	staged, err := os.CreateTemp("", "dfsctl-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+
+	size, err := io.Copy(staged, reader)
+	if err != nil {
+		return err
+	}
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return store.put(ctx, bucket, key, staged, size)
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	pb "proj/Services"
+	"proj/dfs"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const masterAddress = "localhost:50060" // Address of the master node
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: dfsctl [-master addr] <command> [arguments]
+
+Commands:
+  init [-dir d] [-master host] [-datanodes host,...]
+                                                    generate the CA, certificates, secret and
+                                                    configs of a new secure cluster
+  namespace export [-format json|proto] [-o file]   dump namespace metadata (no data)
+  namespace import [-format json|proto] file        load a namespace dump
+  metrics                                           show master metrics
+  quota set path soft-bytes hard-bytes              set a directory quota, 0 0 removes it
+  quota get path                                    show a directory's usage and quota
+  hold set [-until date] [-legal] [-reason r] path  retain path until date (YYYY-MM-DD) and/or place a legal hold
+  hold release [-reason r] path                     release a legal hold
+  hold list                                         list holds in force
+  backup [-endpoint url] [-region r] [-full] bucket[/prefix]
+                                                    copy files changed since the last backup
+                                                    and the namespace to S3-compatible storage
+  ingest [-parallel n] [-manifest file] [-ttl 72h] dir dest
+                                                    upload a local directory tree, resumable
+  ls [-tag t]... [-d] [prefix]                      list files, only those with every given tag, -d one directory level
+  inventory [-checksums] datanode-addr [prefix]     list the files a DataNode holds
+  progress datanode-addr session-id                 show the bytes an upload session received so far
+  decommission [-cancel] datanode-addr              drain a DataNode before shutting it down, run
+                                                    again to follow the drain
+  tag add|remove file tag...                        attach or detach tags
+  timeline file                                     show the stages of a file's life
+  trash ls [prefix]                                 list deleted files still restorable
+  trash restore file                                bring a deleted file back
+  versions ls file                                  list the earlier contents kept of a file
+  versions get file generation                      write an earlier content of a file to stdout
+  token mint [-ops read,list] [-ttl 24h] prefix     mint a token limited to the files under prefix
+
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	master := flag.String("master", masterAddress, "address of the master node")
+	token := flag.String("token", "", "admin, compliance or scoped token sent as authorization metadata")
+	cert := flag.String("cert", "", "client certificate for clusters using TLS")
+	key := flag.String("key", "", "client certificate key")
+	ca := flag.String("ca", "", "cluster CA certificate")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	// init creates a cluster, there is no master to talk to yet
+	if flag.Arg(0) == "init" {
+		if err := initCommand(flag.Args()[1:]); err != nil {
+			log.Fatalf("init: %v", err)
+		}
+		return
+	}
+
+	var options []dfs.DialOption
+	if *cert != "" {
+		options = append(options, dfs.WithTLS(*cert, *key, *ca))
+	}
+	client, err := dfs.Dial(*master, options...)
+	if err != nil {
+		log.Fatalf("Cannot Dial Masternode %v", err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	if *token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+*token)
+	}
+	args := flag.Args()
+	switch args[0] {
+	case "namespace":
+		err = namespaceCommand(ctx, client, args[1:])
+	case "metrics":
+		err = metricsCommand(ctx, client)
+	case "quota":
+		err = quotaCommand(ctx, client, args[1:])
+	case "hold":
+		err = holdCommand(ctx, client, args[1:])
+	case "backup":
+		err = backupCommand(ctx, client, args[1:])
+	case "ingest":
+		err = ingestCommand(ctx, client, args[1:])
+	case "ls":
+		err = listCommand(ctx, client, args[1:])
+	case "inventory":
+		err = inventoryCommand(ctx, client, args[1:])
+	case "progress":
+		err = progressCommand(ctx, client, args[1:])
+	case "decommission":
+		err = decommissionCommand(ctx, client, args[1:])
+	case "tag":
+		err = tagCommand(ctx, client, args[1:])
+	case "timeline":
+		err = timelineCommand(ctx, client, args[1:])
+	case "token":
+		err = tokenCommand(ctx, client, args[1:])
+	case "trash":
+		err = trashCommand(ctx, client, args[1:])
+	case "versions":
+		err = versionsCommand(ctx, client, args[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", args[0], err)
+	}
+}
+
+func namespaceCommand(ctx context.Context, client *dfs.Client, args []string) error {
+	if len(args) < 1 {
+		return errors.New("expected export or import")
+	}
+	flags := flag.NewFlagSet("namespace "+args[0], flag.ExitOnError)
+	format := flags.String("format", "json", "dump format, json or proto")
+	output := flags.String("o", "", "output file, stdout when empty")
+	flags.Parse(args[1:])
+
+	if *format != "json" && *format != "proto" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	switch args[0] {
+	case "export":
+		dump, err := client.ExportNamespace(ctx)
+		if err != nil {
+			return err
+		}
+		var content []byte
+		if *format == "json" {
+			content, err = protojson.MarshalOptions{Multiline: true}.Marshal(dump)
+		} else {
+			content, err = proto.Marshal(dump)
+		}
+		if err != nil {
+			return fmt.Errorf("encoding dump: %v", err)
+		}
+		if *output == "" {
+			_, err = os.Stdout.Write(content)
+			return err
+		}
+		if err := os.WriteFile(*output, content, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Exported %d files and %d directories to %s\n", len(dump.Files), len(dump.Directories), *output)
+		return nil
+
+	case "import":
+		if flags.NArg() < 1 {
+			return errors.New("expected a dump file")
+		}
+		content, err := os.ReadFile(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		dump := &pb.NamespaceDump{}
+		if *format == "json" {
+			err = protojson.Unmarshal(content, dump)
+		} else {
+			err = proto.Unmarshal(content, dump)
+		}
+		if err != nil {
+			return fmt.Errorf("decoding dump: %v", err)
+		}
+		applied, pending, err := client.ImportNamespace(ctx, dump)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d directories, %d files applied, %d files pending upload\n", len(dump.Directories), applied, pending)
+		return nil
+	}
+	return fmt.Errorf("unknown namespace command %q", args[0])
+}
+
+func metricsCommand(ctx context.Context, client *dfs.Client) error {
+	metrics, err := client.MasterMetrics(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Files: %d\nDirectories: %d\nMetadata: %d bytes (heap %d bytes)\nDataNodes: %d live of %d, %d with clock skew\n",
+		metrics.Files, metrics.Directories, metrics.MetadataBytes, metrics.HeapAllocBytes,
+		metrics.LiveDataNodes, metrics.DataNodes, metrics.ClockSkewedDataNodes)
+	fmt.Printf("DataNode read caches: %d hits, %d misses\n", metrics.ReadCacheHits, metrics.ReadCacheMisses)
+	fmt.Printf("%-28s %10s %8s %8s %8s\n", "RPC", "calls", "errors", "qps", "err%")
+	for _, rpc := range metrics.Rpcs {
+		fmt.Printf("%-28s %10d %8d %8.2f %8.2f\n", rpc.Method, rpc.Calls, rpc.Errors, rpc.Qps, rpc.ErrorRate*100)
+	}
+	return nil
+}
+
+func quotaCommand(ctx context.Context, client *dfs.Client, args []string) error {
+	if len(args) == 4 && args[0] == "set" {
+		soft, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad soft limit %q", args[2])
+		}
+		hard, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad hard limit %q", args[3])
+		}
+		return client.SetQuota(ctx, args[1], soft, hard)
+	}
+	if len(args) == 2 && args[0] == "get" {
+		usage, err := client.QuotaUsage(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d bytes used, soft %d (exceeded %t), hard %d (exceeded %t)\n",
+			usage.Path, usage.UsedBytes, usage.SoftBytes, usage.SoftExceeded, usage.HardBytes, usage.HardExceeded)
+		return nil
+	}
+	return errors.New("expected set path soft hard, or get path")
+}
+
+func holdCommand(ctx context.Context, client *dfs.Client, args []string) error {
+	if len(args) < 1 {
+		return errors.New("expected set, release or list")
+	}
+	flags := flag.NewFlagSet("hold "+args[0], flag.ExitOnError)
+	until := flags.String("until", "", "retention date, YYYY-MM-DD or RFC 3339")
+	legal := flags.Bool("legal", false, "place a legal hold")
+	reason := flags.String("reason", "", "reason recorded in the audit log")
+	flags.Parse(args[1:])
+
+	switch args[0] {
+	case "set":
+		if flags.NArg() != 1 {
+			return errors.New("expected a path")
+		}
+		var retainUntil time.Time
+		if *until != "" {
+			var err error
+			if retainUntil, err = time.Parse("2006-01-02", *until); err != nil {
+				if retainUntil, err = time.Parse(time.RFC3339, *until); err != nil {
+					return fmt.Errorf("bad date %q", *until)
+				}
+			}
+		}
+		return client.SetHold(ctx, flags.Arg(0), retainUntil, *legal, *reason)
+
+	case "release":
+		if flags.NArg() != 1 {
+			return errors.New("expected a path")
+		}
+		return client.ReleaseHold(ctx, flags.Arg(0), *reason)
+
+	case "list":
+		holds, err := client.Holds(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-40s %-20s %-6s %s\n", "PATH", "RETAIN UNTIL", "LEGAL", "REASON")
+		for _, hold := range holds {
+			retainUntil := "-"
+			if hold.RetainUntil > 0 {
+				retainUntil = time.Unix(hold.RetainUntil, 0).UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%-40s %-20s %-6t %s\n", hold.Path, retainUntil, hold.LegalHold, hold.Reason)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown hold command %q", args[0])
+}
+
+func trashCommand(ctx context.Context, client *dfs.Client, args []string) error {
+	if len(args) < 1 {
+		return errors.New("expected ls or restore")
+	}
+	switch args[0] {
+	case "ls":
+		if len(args) > 2 {
+			return errors.New("expected at most one prefix")
+		}
+		prefix := ""
+		if len(args) == 2 {
+			prefix = args[1]
+		}
+		files, err := client.ListTrash(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-40s %12s %-20s %s\n", "PATH", "SIZE", "DELETED", "PURGED AFTER")
+		for _, file := range files {
+			fmt.Printf("%-40s %12d %-20s %s\n", file.FileName, file.Size,
+				time.UnixMilli(file.DeletedUnixMs).UTC().Format(time.RFC3339),
+				time.UnixMilli(file.PurgeUnixMs).UTC().Format(time.RFC3339))
+		}
+		return nil
+
+	case "restore":
+		if len(args) != 2 {
+			return errors.New("expected a file")
+		}
+		return client.Restore(ctx, args[1])
+	}
+	return fmt.Errorf("unknown trash command %q", args[0])
+}
+
+func versionsCommand(ctx context.Context, client *dfs.Client, args []string) error {
+	if len(args) < 1 {
+		return errors.New("expected ls or get")
+	}
+	switch args[0] {
+	case "ls":
+		if len(args) != 2 {
+			return errors.New("expected a file")
+		}
+		versions, err := client.Versions(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-12s %12s %-20s %s\n", "GENERATION", "SIZE", "REPLACED", "CHECKSUM")
+		for _, version := range versions {
+			fmt.Printf("%-12d %12d %-20s %s\n", version.Generation, version.Size,
+				time.UnixMilli(version.ReplacedUnixMs).UTC().Format(time.RFC3339), version.Checksum)
+		}
+		return nil
+
+	case "get":
+		if len(args) != 3 {
+			return errors.New("expected a file and a generation")
+		}
+		generation, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad generation %q", args[2])
+		}
+		content, err := client.ReadVersion(ctx, args[1], generation)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(content)
+		return err
+	}
+	return fmt.Errorf("unknown versions command %q", args[0])
+}
+
+// tagFlags collects repeated -tag flags
+type tagFlags []string
+
+func (t *tagFlags) String() string { return strings.Join(*t, ",") }
+
+func (t *tagFlags) Set(tag string) error {
+	*t = append(*t, tag)
+	return nil
+}
+
+func listCommand(ctx context.Context, client *dfs.Client, args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ExitOnError)
+	var tags tagFlags
+	flags.Var(&tags, "tag", "only files with this tag, may be repeated")
+	shallow := flags.Bool("d", false, "list one directory level, deeper files rolled up into their subdirectory")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		return errors.New("expected at most one prefix")
+	}
+
+	var files []*pb.NamespaceFile
+	var err error
+	if *shallow {
+		var directories []string
+		files, directories, err = client.ListDir(ctx, flags.Arg(0), tags...)
+		for _, directory := range directories {
+			fmt.Printf("%12s  %s\n", "dir", directory)
+		}
+	} else {
+		files, err = client.ListFiles(ctx, flags.Arg(0), tags...)
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		fmt.Printf("%12d  %s", file.FileSize, file.FileName)
+		if file.StorageClass != "" && file.StorageClass != "replicated-3" {
+			fmt.Printf("  (%s)", file.StorageClass)
+		}
+		if file.ExpiresUnixMs > 0 {
+			fmt.Printf("  (expires %s)", time.UnixMilli(file.ExpiresUnixMs).UTC().Format(time.RFC3339))
+		}
+		if len(file.Tags) > 0 {
+			fmt.Printf("  [%s]", strings.Join(file.Tags, ", "))
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func inventoryCommand(ctx context.Context, client *dfs.Client, args []string) error {
+	flags := flag.NewFlagSet("inventory", flag.ExitOnError)
+	checksums := flags.Bool("checksums", false, "hash the files whose checksum isn't known yet")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New("expected a DataNode client address and at most one prefix")
+	}
+
+	files, err := client.ListLocalFiles(ctx, flags.Arg(0), flags.Arg(1), *checksums)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		checksum, verified := "-", "-"
+		if file.Checksum != "" {
+			checksum = file.Checksum
+		}
+		if file.VerifiedUnixMs != 0 {
+			verified = time.UnixMilli(file.VerifiedUnixMs).Format(time.RFC3339)
+		}
+		fmt.Printf("%12d  %s  %-64s  %-25s  gen %-4d  %s\n", file.Size, time.UnixMilli(file.ModifiedUnixMs).Format(time.RFC3339), checksum, verified, file.Generation, file.FileName)
+	}
+	return nil
+}
+
+func progressCommand(ctx context.Context, client *dfs.Client, args []string) error {
+	if len(args) != 2 {
+		return errors.New("expected a DataNode client address and an upload session")
+	}
+	progress, err := client.UploadProgress(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d", progress.FileName, progress.ReceivedBytes)
+	if progress.ExpectedBytes > 0 {
+		fmt.Printf(" of %d bytes (%.1f%%)", progress.ExpectedBytes, 100*float64(progress.ReceivedBytes)/float64(progress.ExpectedBytes))
+	} else {
+		fmt.Printf(" bytes")
+	}
+	fmt.Printf(", started %s, last activity %s\n", time.UnixMilli(progress.StartedUnixMs).Format(time.RFC3339),
+		time.UnixMilli(progress.LastActivityUnixMs).Format(time.RFC3339))
+	return nil
+}
+
+func decommissionCommand(ctx context.Context, client *dfs.Client, args []string) error {
+	flags := flag.NewFlagSet("decommission", flag.ExitOnError)
+	cancel := flags.Bool("cancel", false, "leave drain mode, the DataNode takes uploads again")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("expected a DataNode client address")
+	}
+	drain, err := client.Decommission(ctx, flags.Arg(0), *cancel)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !drain.Draining:
+		fmt.Println("not draining, the DataNode takes uploads")
+	case drain.SafeToShutdown:
+		fmt.Println("drained, every file is replicated elsewhere: safe to shut down")
+	case drain.FilesRemaining < 0:
+		fmt.Println("draining, waiting for the master's answer")
+	default:
+		fmt.Printf("draining, %d file(s) still short of replicas elsewhere\n", drain.FilesRemaining)
+	}
+	return nil
+}
+
+func tagCommand(ctx context.Context, client *dfs.Client, args []string) error {
+	if len(args) < 3 {
+		return errors.New("expected add or remove, a file and tags")
+	}
+	var tags []string
+	var err error
+	switch args[0] {
+	case "add":
+		tags, err = client.AddTags(ctx, args[1], args[2:]...)
+	case "remove":
+		tags, err = client.RemoveTags(ctx, args[1], args[2:]...)
+	default:
+		return fmt.Errorf("unknown tag command %q", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: [%s]\n", args[1], strings.Join(tags, ", "))
+	return nil
+}
+
+func timelineCommand(ctx context.Context, client *dfs.Client, args []string) error {
+	if len(args) != 1 {
+		return errors.New("expected a file name")
+	}
+	events, err := client.FileTimeline(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	var start time.Time
+	for i, event := range events {
+		at := time.UnixMilli(event.TimeUnixMs)
+		if i == 0 {
+			start = at
+		}
+		dataNode := "-"
+		if event.DataNode != nil {
+			dataNode = strconv.Itoa(int(*event.DataNode))
+		}
+		fmt.Printf("%s  +%-10s %-22s %-4s %s\n", at.Format("2006-01-02 15:04:05.000"),
+			at.Sub(start).Round(time.Millisecond), event.Stage, dataNode, event.Detail)
+	}
+	return nil
+}
+
+func tokenCommand(ctx context.Context, client *dfs.Client, args []string) error {
+	if len(args) < 1 || args[0] != "mint" {
+		return errors.New("expected mint")
+	}
+	flags := flag.NewFlagSet("token mint", flag.ExitOnError)
+	operations := flags.String("ops", "read,list", "comma-separated operations: read, write, delete, list")
+	ttl := flags.Duration("ttl", 24*time.Hour, "lifetime of the token")
+	flags.Parse(args[1:])
+	if flags.NArg() != 1 {
+		return errors.New("expected a prefix")
+	}
+	token, expires, err := client.MintToken(ctx, flags.Arg(0), strings.Split(*operations, ","), *ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	fmt.Fprintf(os.Stderr, "%s on %s until %s\n", *operations, flags.Arg(0), expires.UTC().Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"proj/dfs"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how long to wait for the master to learn the checksum of an ingested file
+const ingestVerifyTimeout = 2 * time.Minute
+
+// ingestEntry is one line of the ingest manifest, a file stored and verified
+type ingestEntry struct {
+	Path     string    `json:"path"`
+	FileName string    `json:"file_name"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Checksum string    `json:"sha256"`
+}
+
+type ingestJob struct {
+	path     string
+	fileName string
+	info     fs.FileInfo
+	// lifetime of the uploaded file, 0 keeps it
+	ttl time.Duration
+}
+
+/*
+Uploads every regular file under a local directory to a DFS directory with
+parallel uploads, checks each stored file's checksum against the local one
+and appends it to a manifest. Files already in the manifest with the same
+size and modification time are skipped, so an interrupted ingest resumes by
+running the same command again
+*/
+func ingestCommand(ctx context.Context, client *dfs.Client, args []string) error {
+	flags := flag.NewFlagSet("ingest", flag.ExitOnError)
+	parallel := flags.Int("parallel", 8, "number of files uploaded at once")
+	manifestPath := flags.String("manifest", "ingest-manifest.jsonl", "manifest of ingested files, read to resume")
+	ttl := flags.Duration("ttl", 0, "delete the uploaded files automatically after this long, 0 keeps them")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return errors.New("expected a local directory and a DFS directory")
+	}
+	if *parallel < 1 {
+		return fmt.Errorf("bad parallelism %d", *parallel)
+	}
+	source := flags.Arg(0)
+	// DFS names are relative, "/archive" and "archive" are the same directory
+	destination := strings.Trim(flags.Arg(1), "/")
+
+	done, err := readIngestManifest(*manifestPath)
+	if err != nil {
+		return err
+	}
+	manifestFile, err := os.OpenFile(*manifestPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer manifestFile.Close()
+	var manifestMutex sync.Mutex
+
+	var files, bytes, skipped, failed atomic.Int64
+	jobs := make(chan ingestJob)
+	var workers sync.WaitGroup
+	for i := 0; i < *parallel; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				entry, err := ingestFile(ctx, client, job)
+				if err != nil {
+					failed.Add(1)
+					fmt.Fprintf(os.Stderr, "%s: %v\n", job.path, err)
+					continue
+				}
+				line, _ := json.Marshal(entry)
+				manifestMutex.Lock()
+				_, err = manifestFile.Write(append(line, '\n'))
+				manifestMutex.Unlock()
+				if err != nil {
+					failed.Add(1)
+					fmt.Fprintf(os.Stderr, "writing manifest: %v\n", err)
+					continue
+				}
+				files.Add(1)
+				bytes.Add(entry.Size)
+			}
+		}()
+	}
+
+	// report progress while the workers run
+	stopProgress := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Printf("%d files (%d bytes) ingested, %d skipped, %d failed\n",
+					files.Load(), bytes.Load(), skipped.Load(), failed.Load())
+			case <-stopProgress:
+				return
+			}
+		}
+	}()
+
+	walkErr := filepath.WalkDir(source, func(localPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if previous, ok := done[localPath]; ok && previous.Size == info.Size() && previous.ModTime.Equal(info.ModTime()) {
+			skipped.Add(1)
+			return nil
+		}
+		rel, err := filepath.Rel(source, localPath)
+		if err != nil {
+			return err
+		}
+		jobs <- ingestJob{path: localPath, fileName: path.Join(destination, filepath.ToSlash(rel)), info: info, ttl: *ttl}
+		return nil
+	})
+	close(jobs)
+	workers.Wait()
+	close(stopProgress)
+
+	fmt.Printf("Ingested %d files (%d bytes), %d already ingested, %d failed, manifest %s\n",
+		files.Load(), bytes.Load(), skipped.Load(), failed.Load(), *manifestPath)
+	if walkErr != nil {
+		return walkErr
+	}
+	if failed.Load() > 0 {
+		return fmt.Errorf("%d files failed, run again to retry them", failed.Load())
+	}
+	return nil
+}
+
+// readIngestManifest loads a manifest left by earlier runs, keyed by local path
+func readIngestManifest(manifestPath string) (map[string]ingestEntry, error) {
+	done := make(map[string]ingestEntry)
+	file, err := os.Open(manifestPath)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry ingestEntry
+		// a line cut short by an interruption is ingested again
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		done[entry.Path] = entry
+	}
+	return done, scanner.Err()
+}
+
+/*
+Uploads one file, hashing it as it is sent, then waits until the master
+reports the stored copy with the same checksum. A file the cluster already
+holds under that name with the same content isn't sent again
+*/
+func ingestFile(ctx context.Context, client *dfs.Client, job ingestJob) (ingestEntry, error) {
+	entry := ingestEntry{Path: job.path, FileName: job.fileName, Size: job.info.Size(), ModTime: job.info.ModTime()}
+
+	file, err := os.Open(job.path)
+	if err != nil {
+		return entry, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return entry, err
+	}
+	entry.Checksum = hex.EncodeToString(hash.Sum(nil))
+	if stored, err := isStored(ctx, client, job.fileName, entry.Checksum); err == nil && stored {
+		return entry, nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return entry, err
+	}
+	writer, err := client.Create(ctx, job.fileName, dfs.WithSize(entry.Size), dfs.WithTTL(job.ttl))
+	if err != nil {
+		return entry, err
+	}
+	sent := sha256.New()
+	if _, err := io.Copy(writer, io.TeeReader(file, sent)); err != nil {
+		writer.Close()
+		return entry, err
+	}
+	if err := writer.Close(); err != nil {
+		return entry, err
+	}
+	// the file changed while being read, its manifest entry would be wrong
+	if hex.EncodeToString(sent.Sum(nil)) != entry.Checksum {
+		return entry, errors.New("file changed during upload")
+	}
+
+	// DataNodes report the checksum once they have hashed the stored file
+	deadline := time.Now().Add(ingestVerifyTimeout)
+	for delay := 100 * time.Millisecond; ; delay = min(2*delay, 5*time.Second) {
+		stored, err := isStored(ctx, client, job.fileName, entry.Checksum)
+		if err != nil {
+			return entry, err
+		}
+		if stored {
+			return entry, nil
+		}
+		if time.Now().After(deadline) {
+			return entry, errors.New("stored copy not verified, checksum mismatch or DataNode notification lost")
+		}
+		time.Sleep(delay)
+	}
+}
+
+// isStored reports whether the cluster holds fileName with the given checksum
+func isStored(ctx context.Context, client *dfs.Client, fileName, checksum string) (bool, error) {
+	matches, err := client.FindByChecksum(ctx, checksum)
+	if err != nil {
+		return false, err
+	}
+	for _, match := range matches {
+		if match.FileName == fileName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
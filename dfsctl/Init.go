@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// port ranges of generated DataNode configs, DataNode i listens on base+i
+const (
+	initMasterNodePortBase = 51000
+	initClientNodePortBase = 52000
+	initDataNodePortBase   = 53000
+)
+
+// issuer signs node certificates with the cluster CA
+type issuer struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+/*
+Generates everything a secure cluster needs into one directory: a cluster
+CA, a certificate per node and one for clients, a shared cluster secret and
+ready to use master and DataNode configs referring to them
+*/
+func initCommand(args []string) error {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	dir := flags.String("dir", "cluster", "output directory, must not exist")
+	master := flags.String("master", "localhost", "master host name or address")
+	dataNodes := flags.String("datanodes", "localhost,localhost,localhost", "comma-separated DataNode hosts, one per DataNode")
+	validity := flags.Duration("validity", 2*365*24*time.Hour, "lifetime of the node and client certificates")
+	flags.Parse(args)
+
+	hosts := strings.Split(*dataNodes, ",")
+	if *master == "" || *dataNodes == "" {
+		return errors.New("expected a master host and at least one DataNode host")
+	}
+	if len(hosts) > 1000 {
+		return fmt.Errorf("at most 1000 DataNodes, got %d", len(hosts))
+	}
+	if err := os.Mkdir(*dir, 0700); err != nil {
+		return err
+	}
+
+	ca, err := newCA(*dir)
+	if err != nil {
+		return err
+	}
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return err
+	}
+	secret := hex.EncodeToString(secretBytes)
+	// signs the scoped tokens the master mints and the DataNodes check
+	if _, err := rand.Read(secretBytes); err != nil {
+		return err
+	}
+	tokenSecret := hex.EncodeToString(secretBytes)
+
+	if err := ca.issue(*dir, "master", []string{*master}, *validity); err != nil {
+		return err
+	}
+	if err := writeConfig(filepath.Join(*dir, "MasterNode_Config.json"), map[string]any{
+		"TLS":           tlsFiles("master"),
+		"ClusterSecret": secret,
+		"TokenSecret":   tokenSecret,
+	}); err != nil {
+		return err
+	}
+
+	masterAddress := net.JoinHostPort(*master, "50061")
+	for id, host := range hosts {
+		host = strings.TrimSpace(host)
+		name := fmt.Sprintf("datanode-%d", id)
+		if err := ca.issue(*dir, name, []string{host}, *validity); err != nil {
+			return err
+		}
+		if err := writeConfig(filepath.Join(*dir, fmt.Sprintf("DataNode_%d_Config.json", id)), map[string]any{
+			"IP":             host,
+			"MasterNodePort": fmt.Sprintf(":%d", initMasterNodePortBase+id),
+			"ClientNodePort": fmt.Sprintf(":%d", initClientNodePortBase+id),
+			"DataNodePort":   fmt.Sprintf(":%d", initDataNodePortBase+id),
+			"MasterAddress":  masterAddress,
+			"DataDir":        name + "-storage",
+			"TLS":            tlsFiles(name),
+			"ClusterSecret":  secret,
+			"TokenSecret":    tokenSecret,
+		}); err != nil {
+			return err
+		}
+	}
+	if err := ca.issue(*dir, "client", nil, *validity); err != nil {
+		return err
+	}
+
+	fmt.Printf("Cluster of 1 master and %d DataNodes written to %s\n", len(hosts), *dir)
+	fmt.Printf("Copy each node its config, certificate and key with ca.crt, and keep ca.key offline.\n")
+	fmt.Printf("Clients connect with: dfsctl -master %s -cert %s -key %s -ca %s <command>\n",
+		net.JoinHostPort(*master, "50060"), filepath.Join(*dir, "client.crt"), filepath.Join(*dir, "client.key"), filepath.Join(*dir, "ca.crt"))
+	return nil
+}
+
+// tlsFiles is the TLS section of a generated config, paths are relative to it
+func tlsFiles(name string) map[string]string {
+	return map[string]string{"CertFile": name + ".crt", "KeyFile": name + ".key", "CAFile": "ca.crt"}
+}
+
+func writeConfig(path string, config map[string]any) error {
+	content, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	// configs hold the cluster secret
+	return os.WriteFile(path, append(content, '\n'), 0600)
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// newCA creates the cluster CA, valid for 10 years, as ca.crt and ca.key
+func newCA(dir string) (*issuer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "DFS cluster CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePEM(dir, "ca", der, key); err != nil {
+		return nil, err
+	}
+	return &issuer{certificate: certificate, key: key}, nil
+}
+
+/*
+Issues <name>.crt and <name>.key, usable for both serving and dialing. The
+hosts become the certificate's DNS names or IP addresses; localhost also
+covers the loopback addresses
+*/
+func (ca *issuer) issue(dir, name string, hosts []string, validity time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+			continue
+		}
+		template.DNSNames = append(template.DNSNames, host)
+		if host == "localhost" {
+			template.IPAddresses = append(template.IPAddresses, net.IPv4(127, 0, 0, 1), net.IPv6loopback)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		return err
+	}
+	return writePEM(dir, name, der, key)
+}
+
+// writePEM stores a certificate and its private key, the key readable by the owner only
+func writePEM(dir, name string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certificatePEM, 0644); err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600)
+}
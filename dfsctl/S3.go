@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Client speaks the subset of the S3 REST API backups need (GET and PUT of
+// objects, path-style URLs, Signature Version 4), which S3, GCS in
+// interoperability mode and MinIO all accept
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	accessKey string
+	secretKey string
+}
+
+// errNoSuchKey is returned by get for a missing object
+var errNoSuchKey = fmt.Errorf("no such key")
+
+// awsEscape percent-encodes everything but the RFC 3986 unreserved
+// characters and, when keeping slashes, "/"
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+/*
+Signs req with AWS Signature Version 4. Every header set on req is signed
+along with Host; payloadHash is the hex SHA-256 of the body or
+"UNSIGNED-PAYLOAD"
+*/
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(strings.Fields(strings.Join(values, ",")), " ")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// pairs are sorted once encoded, by key then value
+	var canonicalQuery []string
+	for key, values := range req.URL.Query() {
+		for _, value := range values {
+			canonicalQuery = append(canonicalQuery, awsEscape(key, false)+"="+awsEscape(value, false))
+		}
+	}
+	sort.Slice(canonicalQuery, func(i, j int) bool {
+		keyI, valueI, _ := strings.Cut(canonicalQuery[i], "=")
+		keyJ, valueJ, _ := strings.Cut(canonicalQuery[j], "=")
+		if keyI != keyJ {
+			return keyI < keyJ
+		}
+		return valueI < valueJ
+	})
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func (c *s3Client) objectURL(bucket, key string) *url.URL {
+	u := *c.endpoint
+	u.Path = "/" + bucket + "/" + key
+	u.RawPath = "/" + awsEscape(bucket, false) + "/" + awsEscape(key, true)
+	return &u
+}
+
+// put uploads size bytes from body as bucket/key
+func (c *s3Client) put(ctx context.Context, bucket, key string, body io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.objectURL(bucket, key).String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	c.sign(req, "UNSIGNED-PAYLOAD", time.Now())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("PUT %s/%s: %s %s", bucket, key, resp.Status, message)
+	}
+	return nil
+}
+
+// get downloads bucket/key, errNoSuchKey when it doesn't exist
+func (c *s3Client) get(ctx context.Context, bucket, key string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.objectURL(bucket, key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	emptyHash := sha256.Sum256(nil)
+	c.sign(req, hex.EncodeToString(emptyHash[:]), time.Now())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNoSuchKey
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("GET %s/%s: %s %s", bucket, key, resp.Status, message)
+	}
+	return io.ReadAll(resp.Body)
+}
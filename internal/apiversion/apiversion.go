@@ -0,0 +1,62 @@
+// Package apiversion checks the RPC API version clients declare against
+// the versions the master and the DataNodes serve.
+package apiversion
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Current is the version of the RPC API served, raised when calls change incompatibly.
+	Current = 2
+	// Min is the oldest client API version still served.
+	Min = 1
+)
+
+// Check rejects clients older than Min. Version 0 is a client predating
+// versioning and is served as version 1.
+func Check(version int32) error {
+	if version != 0 && version < Min {
+		return status.Errorf(codes.FailedPrecondition,
+			"client API version %d is no longer supported, this server speaks versions %d to %d: upgrade the client",
+			version, Min, Current)
+	}
+	return nil
+}
+
+// CheckCall applies Check to the "dfs-api-version" metadata of a call.
+func CheckCall(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("dfs-api-version")
+	if len(values) == 0 {
+		return nil
+	}
+	version, err := strconv.ParseInt(strings.TrimSpace(values[0]), 10, 32)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "bad dfs-api-version %q", values[0])
+	}
+	return Check(int32(version))
+}
+
+// UnaryInterceptor refuses unary calls of clients CheckCall rejects.
+func UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := CheckCall(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// StreamInterceptor refuses streaming calls of clients CheckCall rejects.
+func StreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := CheckCall(stream.Context()); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
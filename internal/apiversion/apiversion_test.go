@@ -0,0 +1,34 @@
+package apiversion
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckCall(t *testing.T) {
+	tests := []struct {
+		version string
+		code    codes.Code
+	}{
+		{"", codes.OK},
+		{"0", codes.OK},
+		{"1", codes.OK},
+		{" 2 ", codes.OK},
+		{"3", codes.OK},
+		{"-1", codes.FailedPrecondition},
+		{"two", codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		ctx := context.Background()
+		if test.version != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("dfs-api-version", test.version))
+		}
+		if code := status.Code(CheckCall(ctx)); code != test.code {
+			t.Errorf("CheckCall with version %q = %v, want %v", test.version, code, test.code)
+		}
+	}
+}
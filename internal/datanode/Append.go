@@ -0,0 +1,103 @@
+package datanode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+appendBase is the stored file an append session started from. Its staged
+file begins with a copy of that content, so the append is committed like any
+upload, by a rename readers never see half done
+*/
+type appendBase struct {
+	Size    int64     `json:"Size"`
+	ModTime time.Time `json:"ModTime"`
+	// encoding of the copied content, plain appended data is gzipped to match it
+	Encoding string `json:"Encoding,omitempty"`
+}
+
+/*
+stageAppend creates the staged file of an append session holding a copy of
+the stored fileName, positioned at its end. The appended data must have the
+file's encoding: gzip members concatenate, plain and gzip data don't. Plain
+data appended to a gzip file is the exception, it is compressed into a member
+of its own when the append is committed, see encodeStaged
+*/
+func (d *DataNodeServer) stageAppend(fileName, sessionID, encoding string) (*os.File, *appendBase, error) {
+	savePath, err := d.storagePath(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	stored, err := d.openStored(savePath)
+	if os.IsNotExist(err) {
+		return nil, nil, status.Errorf(codes.NotFound, "%s not found, there is nothing to append to", fileName)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening file: %v", err)
+	}
+	defer stored.Close()
+	info, err := stored.raw.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading file size: %v", err)
+	}
+	storedEncoding := d.storedEncoding(fileName)
+	if storedEncoding != encoding && !(storedEncoding == gzipEncoding && encoding == "") {
+		return nil, nil, status.Errorf(codes.FailedPrecondition, "%s is stored with encoding %q, appended data must have the same encoding, not %q", fileName, storedEncoding, encoding)
+	}
+	if err := d.admit(stored.Size()); err != nil {
+		return nil, nil, err
+	}
+
+	file, err := d.createStaged(fileName, sessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	// copy_file_range where the platform has it, the data doesn't pass through this process,
+	// an encrypted file is copied decrypted and encrypted again on commit
+	var source io.Reader = stored
+	if stored.sealer == nil {
+		source = stored.raw
+	}
+	if _, err := io.Copy(file, source); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, nil, fmt.Errorf("error copying %s for the append: %v", fileName, err)
+	}
+	return file, &appendBase{Size: stored.Size(), ModTime: info.ModTime(), Encoding: storedEncoding}, nil
+}
+
+// checkBase fails with Aborted when the stored fileName changed since the append started from it
+func (d *DataNodeServer) checkBase(fileName string, base *appendBase) error {
+	savePath, err := d.storagePath(fileName)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(savePath)
+	if err != nil || storedSize(savePath, info) != base.Size || !info.ModTime().Equal(base.ModTime) {
+		return status.Errorf(codes.Aborted, "%s changed while appending to it, append again", fileName)
+	}
+	return nil
+}
+
+// appendedChecksum returns the hex SHA-256 of the bytes of path past offset
+func appendedChecksum(path string, offset int64) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, offset, 1<<62)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
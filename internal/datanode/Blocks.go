@@ -0,0 +1,95 @@
+package datanode
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	pb "proj/Services"
+	"proj/internal/fsutil"
+	"strings"
+	"sync"
+)
+
+// names the master stores the blocks of files stored in blocks under
+const blockPrefix = ".dfs-blocks/"
+
+/*
+blockIndex maps the blocks this DataNode holds to the file each belongs to,
+as the master sends with heartbeats once the file is committed or renamed.
+Blocks are reported with their owner, so a master that restarted and lost
+its records rebuilds the files from them. It's persisted next to the
+storage root like the replica index
+*/
+type blockIndex struct {
+	mutex  sync.Mutex
+	owners map[string]*pb.BlockOwner
+	path   string
+}
+
+func (d *DataNodeServer) loadBlockIndex() {
+	d.blockIndex = &blockIndex{owners: make(map[string]*pb.BlockOwner), path: d.storageDir() + ".blocks.json"}
+	content, err := os.ReadFile(d.blockIndex.path)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(content, &d.blockIndex.owners); err != nil {
+		log.Printf("bad block index %s: %v", d.blockIndex.path, err)
+	}
+}
+
+func isBlockName(fileName string) bool {
+	return strings.HasPrefix(fileName, blockPrefix)
+}
+
+// set records the owners the master sent
+func (index *blockIndex) set(owners []*pb.BlockOwner) {
+	if len(owners) == 0 {
+		return
+	}
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	for _, owner := range owners {
+		index.owners[owner.BlockName] = owner
+	}
+	index.save()
+}
+
+func (index *blockIndex) get(blockName string) *pb.BlockOwner {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	return index.owners[blockName]
+}
+
+// pruneBlockIndex forgets the owners of blocks no longer held, held lists those in an inventory
+func (d *DataNodeServer) pruneBlockIndex(held map[string]bool) {
+	index := d.blockIndex
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	pruned := false
+	for blockName := range index.owners {
+		if held[blockName] {
+			continue
+		}
+		// stored since the inventory was taken
+		if path, err := d.storagePath(blockName); err == nil {
+			if _, err := os.Stat(path); err == nil {
+				continue
+			}
+		}
+		delete(index.owners, blockName)
+		pruned = true
+	}
+	if pruned {
+		index.save()
+	}
+}
+
+func (index *blockIndex) save() {
+	content, err := json.Marshal(index.owners)
+	if err == nil {
+		err = fsutil.WriteFileAtomic(index.path, content, 0644)
+	}
+	if err != nil {
+		log.Printf("saving block index fail %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package datanode
+
+import (
+	"io"
+	"sync"
+)
+
+/*
+chunkPool recycles the ChunkBytes buffers streamed downloads, replications
+and scrubs read through, so serving many files at once doesn't allocate a
+buffer per call for the garbage collector to reclaim. Buffers are pooled as
+pointers, a slice put in a sync.Pool would allocate its header every time
+*/
+type chunkPool struct {
+	pool sync.Pool
+}
+
+func newChunkPool(size int) *chunkPool {
+	p := &chunkPool{}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// get returns a buffer of ChunkBytes, handed back with put once nothing refers to it
+func (p *chunkPool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *chunkPool) put(buf *[]byte) {
+	p.pool.Put(buf)
+}
+
+// expectedSize is the number of bytes read from reader between offset and offset+length, or the end when length is 0; -1 when unknown, for a file decoded on the way
+func expectedSize(reader io.Reader, offset, length int64) int64 {
+	file, raw := reader.(*storedFile)
+	if !raw {
+		return -1
+	}
+	size := max(file.Size()-offset, 0)
+	if length > 0 {
+		size = min(size, length)
+	}
+	return size
+}
+
+/*
+readMessage reads source for a download sent in one message. When the size
+is known the content is read into a buffer of that size, instead of one grown
+and copied as the read goes, and a file over limit is refused without reading
+it; tooLarge tells the caller to point the client to StreamDownload
+*/
+func readMessage(source io.Reader, expected, limit int64) (content []byte, tooLarge bool, err error) {
+	if expected > limit {
+		return nil, true, nil
+	}
+	if expected < 0 {
+		content, err = io.ReadAll(io.LimitReader(source, limit+1))
+		return content, int64(len(content)) > limit, err
+	}
+	content = make([]byte, expected)
+	n, err := io.ReadFull(source, content)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return content[:n], false, err
+}
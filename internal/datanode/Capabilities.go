@@ -0,0 +1,101 @@
+package datanode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	pb "proj/Services"
+	"proj/internal/apiversion"
+)
+
+const (
+	// room kept in every message for the file name and other fields
+	messageOverhead = 64 * 1024
+)
+
+// optional features of the DataNode, clients only use those listed
+var dataNodeCapabilities = []string{
+	"stream-download",
+	"upload-offsets",
+	"content-encoding",
+	"parallel-upload",
+	"scoped-tokens",
+	"stream-upload",
+	"upload-checksums",
+	"file-checksums",
+	"range-reads",
+	"upload-offset-query",
+	"delete-files",
+	"append",
+	"stat-file",
+	"local-inventory",
+	"sync-uploads",
+	"trash",
+	"versions",
+	"ttl",
+	"cancel-upload",
+	"upload-progress",
+	"replication-pipeline",
+	"decommission",
+}
+
+// GetCapabilities is a client's first call on a connection, telling it which API it can use
+func (d *DataNodeServer) GetCapabilities(ctx context.Context, in *pb.GetCapabilitiesRequest) (*pb.GetCapabilitiesResponse, error) {
+	if err := apiversion.Check(in.ApiVersion); err != nil {
+		return nil, err
+	}
+	return &pb.GetCapabilitiesResponse{
+		ApiVersion:      apiversion.Current,
+		MinApiVersion:   apiversion.Min,
+		Capabilities:    dataNodeCapabilities,
+		MaxMessageBytes: d.MaxMessageBytes,
+		ChunkBytes:      int32(d.ChunkBytes),
+		MaxFileBytes:    d.MaxFileBytes,
+	}, nil
+}
+
+/*
+checkLimits fills in the default message and chunk sizes and makes sure a
+chunk, with the other fields of its message, fits in a message
+*/
+func (d *DataNodeServer) checkLimits() error {
+	if d.MaxMessageBytes == 0 {
+		d.MaxMessageBytes = maxGRPCSize
+	}
+	if d.ChunkBytes == 0 {
+		d.ChunkBytes = chunkSize
+	}
+	if d.ChunkBytes < 0 || d.MaxMessageBytes < 0 {
+		return errors.New("MaxMessageBytes and ChunkBytes can't be negative")
+	}
+	if int64(d.ChunkBytes)+messageOverhead > d.MaxMessageBytes {
+		return fmt.Errorf("ChunkBytes %d doesn't fit in MaxMessageBytes %d, which must be at least %d bytes larger",
+			d.ChunkBytes, d.MaxMessageBytes, messageOverhead)
+	}
+	if d.MaxMessageBytes > math.MaxInt32 {
+		return fmt.Errorf("MaxMessageBytes %d is over gRPC's 2GB limit", d.MaxMessageBytes)
+	}
+	return nil
+}
+
+/*
+peerChunkLimit asks the DataNode behind client for its limits and returns
+the largest chunk of file data to send it in one message, at most
+ChunkBytes, with the optional features it offers. Nodes predating
+GetCapabilities accept chunks up to maxGRPCSize, in upload sessions
+*/
+func (d *DataNodeServer) peerChunkLimit(ctx context.Context, client pb.FileServiceClient) (limit int, capabilities []string) {
+	limit = d.ChunkBytes
+	response, err := client.GetCapabilities(ctx, &pb.GetCapabilitiesRequest{ApiVersion: apiversion.Current})
+	if err != nil {
+		return min(limit, maxGRPCSize-messageOverhead), nil
+	}
+	if response.ChunkBytes > 0 {
+		limit = min(limit, int(response.ChunkBytes))
+	}
+	if room := response.MaxMessageBytes - messageOverhead; room > 0 && room < int64(limit) {
+		limit = int(room)
+	}
+	return limit, response.Capabilities
+}
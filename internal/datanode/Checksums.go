@@ -0,0 +1,302 @@
+package datanode
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	pb "proj/Services"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+/*
+checksumMismatch is the error of data that arrived corrupted. It carries
+codes.DataLoss, which clients take as a cue to send the chunk or file again
+*/
+func checksumMismatch(what, got, want string) error {
+	return status.Errorf(codes.DataLoss, "checksum mismatch on %s: received data hashes to %s, expected %s", what, got, want)
+}
+
+// checkChunk verifies the content of an upload chunk against the checksums it was sent with
+func checkChunk(req *pb.FileUploadRequest) error {
+	if req.ChunkCrc32C != nil {
+		if sum := crc32.Checksum(req.FileContent, crc32cTable); sum != *req.ChunkCrc32C {
+			return checksumMismatch("chunk (CRC-32C)", fmt.Sprintf("%08x", sum), fmt.Sprintf("%08x", *req.ChunkCrc32C))
+		}
+	}
+	if req.ChunkSha256 != "" {
+		sum := sha256.Sum256(req.FileContent)
+		if got := hex.EncodeToString(sum[:]); got != req.ChunkSha256 {
+			return checksumMismatch("chunk (SHA-256)", got, req.ChunkSha256)
+		}
+	}
+	return nil
+}
+
+/*
+checksumCache keeps the SHA-256 of stored files by path, computed once when
+a file is committed, so downloads and checksum queries don't rehash it. An
+entry is only used while the file's size and modification time match, a
+file replaced some other way is hashed again
+*/
+type checksumCache struct {
+	mutex sync.Mutex
+	sums  map[string]cachedChecksum
+	// decrypts the encrypted files, whose checksum is the one of their content
+	sealer *sealer
+}
+
+type cachedChecksum struct {
+	checksum string
+	size     int64
+	modTime  time.Time
+	// when checksum was computed from the bytes, as written or read back
+	verified time.Time
+}
+
+// set records the checksum of the file at path, known from hashing it as it was written
+func (c *checksumCache) set(path, checksum string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	c.store(path, cachedChecksum{checksum: checksum, size: info.Size(), modTime: info.ModTime(), verified: time.Now()})
+}
+
+func (c *checksumCache) store(path string, entry cachedChecksum) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.sums == nil {
+		c.sums = make(map[string]cachedChecksum)
+	}
+	c.sums[path] = entry
+}
+
+// forget drops the checksum of a removed file
+func (c *checksumCache) forget(path string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.sums, path)
+}
+
+// move keeps the checksum of a renamed file, a rename leaves its size and modification time alone
+func (c *checksumCache) move(from, to string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if entry, ok := c.sums[from]; ok {
+		delete(c.sums, from)
+		c.sums[to] = entry
+	}
+}
+
+// cached returns the entry of the file at path if the cache has one matching info
+func (c *checksumCache) cached(path string, info os.FileInfo) (cachedChecksum, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cached, ok := c.sums[path]
+	if !ok || cached.size != info.Size() || !cached.modTime.Equal(info.ModTime()) {
+		return cachedChecksum{}, false
+	}
+	return cached, true
+}
+
+// get returns the checksum and size of the file at path, hashing it when the cache has no current entry
+func (c *checksumCache) get(path string) (string, int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", 0, err
+	}
+	if cached, ok := c.cached(path, info); ok {
+		return cached.checksum, storedSize(path, info), nil
+	}
+	file, err := c.sealer.open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", 0, err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	c.store(path, cachedChecksum{checksum: checksum, size: info.Size(), modTime: info.ModTime(), verified: time.Now()})
+	return checksum, file.Size(), nil
+}
+
+// sentChecksum is the checksum announced with a download of fileName through reader, "" when it is decoded on the way
+func (d *DataNodeServer) sentChecksum(fileName string, reader io.ReadCloser) string {
+	if _, decoded := reader.(*decodedFile); decoded {
+		return ""
+	}
+	filePath, err := d.storagePath(fileName)
+	if err != nil {
+		return ""
+	}
+	checksum, _, err := d.checksums.get(filePath)
+	if err != nil {
+		log.Printf("Checksum of %s failed: %v", filePath, err)
+	}
+	return checksum
+}
+
+/*
+Returns the SHA-256 and size of a stored file as kept on disk, encoded when
+content_encoding is set, so clients can verify what they downloaded
+*/
+func (d *DataNodeServer) GetFileChecksum(ctx context.Context, in *pb.GetFileChecksumRequest) (*pb.GetFileChecksumResponse, error) {
+	filePath, err := d.storagePath(in.FileName)
+	if err != nil {
+		return nil, err
+	}
+	checksum, size, err := d.checksums.get(filePath)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "no such file %s", in.FileName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("checksum of %s failed: %v", in.FileName, err)
+	}
+	return &pb.GetFileChecksumResponse{
+		Checksum:        checksum,
+		Size:            size,
+		ContentEncoding: d.storedEncoding(in.FileName),
+	}, nil
+}
+
+/*
+StatFile describes a stored file without sending it: size, modification
+time, checksum and encoding, the generation the master confirmed the replica
+at and its health. A replica changed on disk since the master confirmed it
+is corrupt; that is only told when its checksum is computed, which
+cached_checksum_only skips for files not hashed yet
+*/
+func (d *DataNodeServer) StatFile(ctx context.Context, in *pb.StatFileRequest) (*pb.StatFileResponse, error) {
+	filePath, err := d.storagePath(in.FileName)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "no such file %s", in.FileName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Stat fail %v", err)
+	}
+	response := &pb.StatFileResponse{
+		Size:              storedSize(filePath, info),
+		ModifiedUnixMs:    info.ModTime().UnixMilli(),
+		ContentEncoding:   d.storedEncoding(in.FileName),
+		UploadsInProgress: int32(d.uploads.uploading(in.FileName)),
+		Health:            "ok",
+	}
+	if cached, ok := d.checksums.cached(filePath, info); ok {
+		response.Checksum = cached.checksum
+	} else if !in.CachedChecksumOnly {
+		if response.Checksum, _, err = d.checksums.get(filePath); err != nil {
+			return nil, fmt.Errorf("checksum of %s failed: %v", in.FileName, err)
+		}
+	}
+	replica, confirmed := d.replicaIndex.get(in.FileName)
+	switch {
+	case !confirmed:
+		response.Health = "unconfirmed"
+	case response.Checksum != "" && response.Checksum != replica.Checksum:
+		response.Health = "corrupt"
+	}
+	response.Generation = replica.Generation
+	return response, nil
+}
+
+/*
+ListLocalFiles is the inventory of the files this DataNode holds, with what
+it knows of each: size, modification time, cached checksum and when it was
+computed, encoding and confirmed generation. The master reconciles it with
+its records and operators use it to track replica drift. Staged uploads
+aren't listed
+*/
+func (d *DataNodeServer) ListLocalFiles(ctx context.Context, in *pb.ListLocalFilesRequest) (*pb.ListLocalFilesResponse, error) {
+	response := &pb.ListLocalFilesResponse{}
+	for _, root := range d.volumeDirs() {
+		if err := d.listVolume(ctx, root, in, response); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// listVolume adds the files under the data directory root to response
+func (d *DataNodeServer) listVolume(ctx context.Context, root string, in *pb.ListLocalFilesRequest, response *pb.ListLocalFilesResponse) error {
+	err := filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if path == root && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && (relative == blobDir || relative == trashDir || relative == versionDir) {
+			return filepath.SkipDir
+		}
+		if entry.IsDir() || stagedFile.MatchString(path) {
+			return nil
+		}
+		fileName := filepath.ToSlash(relative)
+		if !strings.HasPrefix(fileName, in.Prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// removed while walking
+			return nil
+		}
+		response.Files = append(response.Files, d.localFile(fileName, path, info, in.ComputeChecksums))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing %s failed: %v", root, err)
+	}
+	return nil
+}
+
+// localFile is the inventory entry of the file stored at path, hashed if computeChecksum and its checksum isn't cached
+func (d *DataNodeServer) localFile(fileName, path string, info os.FileInfo, computeChecksum bool) *pb.LocalFile {
+	file := &pb.LocalFile{
+		FileName:        fileName,
+		Size:            storedSize(path, info),
+		ModifiedUnixMs:  info.ModTime().UnixMilli(),
+		ContentEncoding: d.storedEncoding(fileName),
+		FilePath:        path,
+	}
+	if computeChecksum {
+		var err error
+		if file.Checksum, _, err = d.checksums.get(path); err != nil {
+			log.Printf("Checksum of %s failed: %v", path, err)
+		}
+	}
+	if cached, ok := d.checksums.cached(path, info); ok {
+		file.Checksum = cached.checksum
+		file.VerifiedUnixMs = cached.verified.UnixMilli()
+	}
+	if replica, ok := d.replicaIndex.get(fileName); ok {
+		file.Generation = replica.Generation
+		file.ExpiresUnixMs = replica.ExpiresUnixMs
+	}
+	return file
+}
@@ -0,0 +1,2094 @@
+package datanode
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	pb "proj/Services"
+	"proj/internal/apiversion"
+	"proj/internal/faults"
+	"proj/internal/tlsconfig"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	masterAddress = "localhost:50061" // Default address of the master node
+	maxGRPCSize   = 1024 * 1024 * 100 // 100 MB
+)
+
+type DataNodeServer struct {
+	// address advertised to the master, detected by GetMachineIP unless the
+	// config sets it; may be an IPv4 or IPv6 address or a DNS hostname, and
+	// differ from BindAddress behind NAT
+	IP string `json:"IP"`
+	// network interface (wlan1, eth0) whose address the DataNode binds to and advertises
+	Interface string `json:"Interface"`
+	// address the ports listen on when they name no host, all addresses by default
+	BindAddress string `json:"BindAddress"`
+	// advertise a routable IPv6 address of the machine before its IPv4 ones
+	PreferIPv6    bool   `json:"PreferIPv6"`
+	PortForMaster string `json:"MasterNodePort"`
+	PortForClient string `json:"ClientNodePort"`
+	PortForDN     string `json:"DataNodePort"`
+	// one port serving clients, DataNodes and the master instead of the three above
+	Port string `json:"Port"`
+	// assigned by the master, see register and nodeID; the config may claim
+	// one. Atomic, a re-registration may change it while calls are served
+	id       atomic.Int32
+	ConfigID *int32 `json:"ID"`
+	// the DataNode has an ID, from a previous registration or the config
+	hasID    atomic.Bool
+	identity nodeIdentity
+	// ID of the cluster the DataNode joined, see cluster
+	clusterID atomic.Pointer[string]
+	// arbitrary key/value labels (ssd=true, region=eu) matched by placement constraints
+	Labels map[string]string `json:"Labels"`
+	// bytes of the volume never used for DFS data
+	ReservedBytes int64 `json:"ReservedBytes"`
+	// percentage of the volume never used for DFS data, the larger of the two reservations applies
+	ReservedPercent float64 `json:"ReservedPercent"`
+	// cap on the DFS data this DataNode stores, 0 means no cap
+	MaxBytes int64 `json:"MaxBytes"`
+	// transfers of files at least this large bypass the page cache, 0 disables it
+	DropCacheAboveBytes int64 `json:"DropCacheAboveBytes"`
+	// mode and owner of created files and directories, see parsePermissions
+	FileMode  string `json:"FileMode"`
+	DirMode   string `json:"DirMode"`
+	FileOwner string `json:"FileOwner"`
+	// address of the HTTP range GET endpoint (":8080"), empty disables it
+	HTTPPort string `json:"HTTPPort"`
+	// shared secret HTTP requests must present
+	HTTPToken string `json:"HTTPToken"`
+	// full access for clients, once set every client call needs it or a scoped token
+	AdminToken string `json:"AdminToken"`
+	// the master's key signing scoped tokens, empty rejects them
+	TokenSecret string `json:"TokenSecret"`
+	// address of the master, masterAddress when empty
+	MasterAddress string `json:"MasterAddress"`
+	// masters to try in turn when the current one can't be reached, over MasterAddress; see setUpMasters
+	MasterAddresses []string `json:"MasterAddresses"`
+	masters         []string
+	currentMaster   atomic.Int32
+	// look for the master with a LAN broadcast first, MasterAddress is the fallback
+	DiscoverMaster bool `json:"DiscoverMaster"`
+	permissions    storagePermissions
+	// storage root, derived from the address and client port when empty
+	DataDir string `json:"DataDir"`
+	// largest file accepted, 0 means no limit
+	MaxFileBytes int64 `json:"MaxFileBytes"`
+	// upload sessions, streamed uploads and replications at once, 0 means no limit; see admitSession
+	MaxUploadSessions int `json:"MaxUploadSessions"`
+	// codec plain uploads are stored compressed with, "gzip" or empty to store them as sent
+	Compression string `json:"Compression"`
+	// AES-256 key files are stored encrypted with, in hex or base64, see sealer;
+	// DFS_ENCRYPTION_KEY when empty, files are stored plain without either
+	EncryptionKey string `json:"EncryptionKey"`
+	sealer        *sealer
+	// store identical files once, as hard links to a blob of their content, see deduplicate
+	Deduplicate bool `json:"Deduplicate"`
+	blobs       *blobIndex
+	// held while stored names are replaced or removed, so a file is never swapped for its blob after it changed
+	blobMutex sync.Mutex
+	// commit every upload synced, see syncRequested
+	SyncUploads bool `json:"SyncUploads"`
+	// several data directories, one per disk, used instead of DataDir
+	DataDirs []string `json:"DataDirs"`
+	volumes  []*volume
+	// a restarted DataNode resumes uploads written to within this many seconds, 0 disables it
+	SessionGraceSeconds int `json:"SessionGraceSeconds"`
+	// longest an upload call, a download or streamed upload and a replication
+	// may run, and how long an upload session may go without chunks; defaults
+	// when 0, -1 disables
+	UploadChunkTimeoutSeconds int `json:"UploadChunkTimeoutSeconds"`
+	DownloadTimeoutSeconds    int `json:"DownloadTimeoutSeconds"`
+	ReplicateTimeoutSeconds   int `json:"ReplicateTimeoutSeconds"`
+	UploadIdleTimeoutSeconds  int `json:"UploadIdleTimeoutSeconds"`
+	// longest a call to the master, and a call to another DataNode other than a
+	// replication or streamed transfer, may run; 30 seconds when 0, -1 disables
+	MasterTimeoutSeconds int `json:"MasterTimeoutSeconds"`
+	PeerTimeoutSeconds   int `json:"PeerTimeoutSeconds"`
+	// how long a shutdown waits for calls in progress, 30 seconds when 0, -1 doesn't wait; see shutdown
+	ShutdownTimeoutSeconds int `json:"ShutdownTimeoutSeconds"`
+	// set once shutting down, the heartbeats stop
+	stopping atomic.Bool
+	// closed by Stop, ending the background work
+	stopped  chan struct{}
+	stopOnce sync.Once
+	// the servers started by serve
+	grpcServer *grpc.Server
+	httpServer *http.Server
+	// set by Main, a DataNode that can't go on exits the process, see fail
+	exitOnFail bool
+	// milliseconds between heartbeats, a second when 0; each wait is drawn up
+	// to HeartbeatJitterPercent (at most 50) shorter or longer, 10 when 0, -1 for none
+	HeartbeatIntervalMs    int `json:"HeartbeatIntervalMs"`
+	HeartbeatJitterPercent int `json:"HeartbeatJitterPercent"`
+	// largest gRPC message accepted and size of the file chunks sent and
+	// accepted, maxGRPCSize and chunkSize when 0
+	MaxMessageBytes int64 `json:"MaxMessageBytes"`
+	ChunkBytes      int   `json:"ChunkBytes"`
+	// buffers of ChunkBytes the read path reuses, see chunkPool
+	chunks *chunkPool
+	// memory kept for the content of recently downloaded files, 0 disables it; see readCache
+	ReadCacheBytes int64 `json:"ReadCacheBytes"`
+	readCache      *readCache
+	// bytes read ahead of sequential range reads, 0 disables it; see readAhead
+	ReadAheadBytes int64 `json:"ReadAheadBytes"`
+	readAhead      *readAhead
+	// concurrent chunk reads and writes, shared between client transfers and
+	// background replication by weight, see trafficScheduler; defaults when 0
+	IOSlots          int `json:"IOSlots"`
+	ClientWeight     int `json:"ClientWeight"`
+	BackgroundWeight int `json:"BackgroundWeight"`
+	traffic          *trafficScheduler
+	// test-only fault injection, see faults.Config
+	Faults *faults.Config `json:"Faults"`
+	faults *faults.Injector
+	// mutual TLS for every connection, plaintext when absent
+	TLS *tlsconfig.Config `json:"TLS"`
+	// secret presented to the master, which may require it to join
+	ClusterSecret string `json:"ClusterSecret"`
+	// credentials for dialing the master and other DataNodes, and for serving
+	dialCredentials   credentials.TransportCredentials
+	serverCredentials credentials.TransportCredentials
+	pb.UnimplementedFileServiceServer
+	// upload sessions in progress
+	uploads *UploadSessionManager
+	// serializes committing appends, each checks the file it started from is still the one stored
+	appendMutex sync.Mutex
+	// content encoding of stored files by name, absent for plain data
+	encodings      map[string]string
+	encodingsMutex sync.Mutex
+	// bytes stored, see usedBytes
+	used atomic.Int64
+	// uploads, downloads and replications in progress, reported as load to the master
+	activeTransfers atomic.Int32
+	// the downloads among them
+	activeDownloads atomic.Int32
+	// CPU time counters of the previous heartbeat, to measure the load between two
+	loadSample loadSample
+	// seconds between gossip rounds with a random peer, 0 disables gossip
+	GossipIntervalSeconds int `json:"GossipIntervalSeconds"`
+	// seconds between passes verifying stored replicas against their checksums, see scrub; a day when 0, -1 disables
+	ScrubIntervalSeconds int `json:"ScrubIntervalSeconds"`
+	// checksums of stored files, computed when they are committed
+	checksums checksumCache
+	// committed replicas compared by gossip, see replicaIndex
+	replicaIndex *replicaIndex
+	// file each held block belongs to, see blockIndex
+	blockIndex *blockIndex
+	// DataNode-port addresses of the other live DataNodes, from the last heartbeat
+	peers      []string
+	peersMutex sync.Mutex
+	// previous contents of overwritten files to keep, set by the master with heartbeats
+	keepVersions atomic.Int32
+	// seconds between full file reports to the master, see sendFileReport; 6 hours when 0, -1 sends one at startup only
+	FileReportIntervalSeconds int `json:"FileReportIntervalSeconds"`
+	// a file report is being sent, and when the last full one was
+	reporting      atomic.Bool
+	lastFileReport time.Time
+	// seconds before retrying a replica a replication failed to make, doubled
+	// with each attempt, and retries before giving up; 30 and 8 when 0, -1
+	// seconds disables retries, see replicationRetries
+	ReplicationRetrySeconds int `json:"ReplicationRetrySeconds"`
+	ReplicationRetries      int `json:"ReplicationRetries"`
+	retries                 *replicationRetries
+	// upload notifications the master is still to get
+	notices *uploadNotices
+	// lost replicas being fetched back from peers for the reads waiting on them, see restoreLost
+	restores replicaRestores
+	// drain mode of a DataNode being decommissioned, see Decommission
+	drain drainState
+}
+
+/*
+storageDir is the root directory holding this DataNode's files, DataDir when
+configured. The default name embeds the address and client port, with
+characters that aren't valid in Windows file names (the ':' of IPv6
+addresses) replaced. With DataDirs the files are spread over the volumes and
+this is the first of them, next to which the journal and indexes are kept
+*/
+func (d *DataNodeServer) storageDir() string {
+	if d.DataDir != "" {
+		return d.DataDir
+	}
+	if len(d.DataDirs) > 0 {
+		return d.DataDirs[0]
+	}
+	port := strings.TrimPrefix(d.PortForClient, ":")
+	if _, p, err := net.SplitHostPort(d.PortForClient); err == nil {
+		port = p
+	}
+	host := strings.Map(func(c rune) rune {
+		if strings.ContainsRune(`<>:"/\|?*%`, c) {
+			return '_'
+		}
+		return c
+	}, d.IP)
+	return fmt.Sprintf("./uploaded_%s_%s", host, port)
+}
+
+/*
+checkDataDir warns when the storage root is derived from the address and
+port but doesn't exist while other derived ones do: the node was most likely
+moved to another port or address and would start empty, DataDir keeps it
+pointed at its files
+*/
+func (d *DataNodeServer) checkDataDir() {
+	if d.DataDir != "" || len(d.DataDirs) > 0 {
+		return
+	}
+	dir := d.storageDir()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return
+	}
+	others, _ := filepath.Glob("./uploaded_*")
+	for _, other := range others {
+		if info, err := os.Stat(other); err == nil && info.IsDir() {
+			log.Printf("%s doesn't exist but %s does, set \"DataDir\": %q in the config to keep serving its files", dir, other, other)
+		}
+	}
+}
+
+/*
+Maps a file name to its path under the storage root. Names may contain "/"
+separated directories (logs/2024/05/app.log) but must stay inside the root:
+absolute names, backslashes, control characters and empty, "." or ".."
+components are rejected, as are names of the staged files uploads write
+before they commit. Every handler touching stored files goes through it.
+With several data directories the path is on the volume holding the file,
+see locate
+*/
+func (d *DataNodeServer) storagePath(fileName string) (string, error) {
+	if fileName == "" || strings.HasPrefix(fileName, "/") || strings.Contains(fileName, "\\") {
+		return "", status.Errorf(codes.InvalidArgument, "invalid file name %q", fileName)
+	}
+	for _, c := range fileName {
+		if c < 0x20 || c == 0x7f {
+			return "", status.Errorf(codes.InvalidArgument, "control character in file name %q", fileName)
+		}
+	}
+	for _, component := range strings.Split(fileName, "/") {
+		if component == "" || component == "." || component == ".." || !validComponent(component) {
+			return "", status.Errorf(codes.InvalidArgument, "invalid path component in %q", fileName)
+		}
+	}
+	if stagedFile.MatchString(fileName) {
+		return "", status.Errorf(codes.InvalidArgument, "%q is the name of an upload in progress", fileName)
+	}
+	if isBlobPath(fileName) {
+		return "", status.Errorf(codes.InvalidArgument, "%q is reserved for deduplicated content", blobDir)
+	}
+	if isTrashPath(fileName) {
+		return "", status.Errorf(codes.InvalidArgument, "%q is reserved for deleted files", trashDir)
+	}
+	if isVersionPath(fileName) {
+		return "", status.Errorf(codes.InvalidArgument, "%q is reserved for file versions", versionDir)
+	}
+	return d.locate(filepath.FromSlash(fileName))
+}
+
+/*
+Handles file upload from client
+*/
+func (d *DataNodeServer) UploadFile(ctx context.Context, req *pb.FileUploadRequest) (*pb.FileUploadResponse, error) {
+	log.Printf("Received upload request for: %s", req.FileName)
+	d.activeTransfers.Add(1)
+	defer d.activeTransfers.Add(-1)
+
+	// Metadata extraction (client IP and port)
+	md, exists := metadata.FromIncomingContext(ctx)
+	if !exists {
+		log.Println("No metadata in request")
+	}
+	clientIP := strings.Join(md.Get("client-ip"), ",")
+	clientPort := strings.Join(md.Get("client-port"), ",")
+	uploadToken := strings.Join(md.Get("upload-token"), "")
+	encoding := strings.Join(md.Get("content-encoding"), "")
+	if err := checkEncoding(encoding); err != nil {
+		return nil, err
+	}
+
+	outMeta := metadata.Pairs("client-ip", clientIP, "client-port", clientPort)
+	outCtx := metadata.NewOutgoingContext(context.Background(), outMeta)
+
+	if err := d.refuseDraining(); err != nil {
+		return nil, err
+	}
+	if err := d.checkFileSize(int64(len(req.FileContent))); err != nil {
+		return nil, err
+	}
+	if err := d.admit(int64(len(req.FileContent))); err != nil {
+		return nil, err
+	}
+	release, err := d.admitSession()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// written aside and renamed into place, a crash never leaves a truncated file under the name
+	file, err := d.createStaged(req.FileName, newSessionID())
+	if err != nil {
+		return nil, err
+	}
+	if err := d.traffic.acquire(ctx, d.trafficClassOf(ctx)); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	_, err = file.Write(req.FileContent)
+	d.traffic.release()
+	if err == nil {
+		err = d.faults.SyncFile(file)
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("error writing file content: %v", err)
+	}
+	staged, encoding, err := d.encodeStaged(file.Name(), encoding, nil)
+	if err != nil {
+		return nil, err
+	}
+	savePath, err := d.commitStaged(staged, req.FileName, d.syncRequested(ctx))
+	if err != nil {
+		return nil, err
+	}
+	d.setEncoding(req.FileName, encoding)
+
+	log.Printf("File uploaded success at %s", savePath)
+
+	// Asynchronously notify the master node about the upload
+	go notifyMasterOfUpload(d, outCtx, req.FileName, savePath, uploadToken, false)
+
+	return &pb.FileUploadResponse{Message: "Upload successful"}, nil
+}
+
+const chunkSize = 1024 * 1024 // 1MB default chunk size
+
+// Replicate copies a stored file to other DataNodes. Only the master calls it, for repairs and moves
+func (d *DataNodeServer) Replicate(ctx context.Context, req *pb.ReplicateRequest) (*pb.ReplicateResponse, error) {
+	if !d.fromCluster(ctx) {
+		return nil, status.Error(codes.PermissionDenied, "only the master asks for replications")
+	}
+	return d.replicate(ctx, req, backgroundTraffic)
+}
+
+/*
+replicate copies the stored file to the targets of req. Targets out of space
+are handed back, the master picks other nodes; those failing otherwise are
+queued to be retried, see replicationRetries
+*/
+func (d *DataNodeServer) replicate(ctx context.Context, req *pb.ReplicateRequest, class trafficClass) (*pb.ReplicateResponse, error) {
+	log.Printf("Replicating file: %s to %d node(s)", req.FileName, len(req.IpAddresses))
+	if req.ClusterId != "" && d.cluster() != "" && req.ClusterId != d.cluster() {
+		return nil, status.Errorf(codes.FailedPrecondition, "DataNode %d belongs to cluster %s, not %s", d.nodeID(), d.cluster(), req.ClusterId)
+	}
+	release, err := d.admitSession()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	d.activeTransfers.Add(1)
+	defer d.activeTransfers.Add(-1)
+
+	// the path comes from the name, never from the request, a replication stays inside the storage root
+	filePath, err := d.storagePath(req.FileName)
+	if err != nil {
+		return nil, err
+	}
+	// the file is read a chunk at a time, files of any size fit in memory
+	file, err := d.openStored(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("replication failed, cannot read file: %v", err)
+	}
+	defer file.Close()
+	// replicas are stored with the same encoding
+	if encoding := d.storedEncoding(req.FileName); encoding != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "content-encoding", encoding)
+	}
+	if d.bypassCache(file.Size()) {
+		adviseSequential(file.raw)
+	}
+	// each replica made is checked against the checksum of the file here, network corruption would make it bad
+	checksum, _, err := d.checksums.get(filePath)
+	if err != nil {
+		log.Printf("Checksum of %s failed, its replicas aren't verified: %v", req.FileName, err)
+	}
+	pooled := d.chunks.get()
+	defer d.chunks.put(pooled)
+	buf := *pooled
+	// the outcome for each target is handed back, the master records it
+	response := &pb.ReplicateResponse{}
+	settle := func(target int, err error) {
+		result := &pb.ReplicaResult{Address: net.JoinHostPort(req.IpAddresses[target], strconv.Itoa(int(req.PortNumbers[target]))), Id: -1, Success: err == nil}
+		response.Results = append(response.Results, result)
+		if err == nil {
+			result.Bytes = file.Size()
+		} else {
+			result.Error = err.Error()
+		}
+		if target >= len(req.Ids) {
+			return
+		}
+		result.Id = req.Ids[target]
+		if isOutOfSpace(err) {
+			response.Full = append(response.Full, req.Ids[target])
+		}
+		if isBadReplica(err) {
+			go d.reportBadReplicaOf(req.FileName, req.Ids[target], fmt.Sprintf("checksum mismatch after replication from DataNode %d", d.nodeID()))
+		}
+		if err == nil || isOutOfSpace(err) || isBadReplica(err) {
+			d.retries.done(req.FileName, req.Ids[target])
+			return
+		}
+		gaveUp := d.retries.failed(req, target, err)
+		if gaveUp != nil {
+			go d.reportReplicationFailure(*gaveUp)
+		}
+		result.Retrying = d.retries != nil && gaveUp == nil
+	}
+
+	// several targets are sent the file once, down a pipeline through them, if they all offer it;
+	// those it didn't reach are sent it one by one
+	piped := d.replicatePipeline(ctx, req, file, checksum, buf, class)
+
+	// Iterate over the provided IP addresses and ports
+	for i, ip := range req.IpAddresses {
+		if i < len(req.Ids) {
+			if err, ok := piped[req.Ids[i]]; ok {
+				settle(i, err)
+				continue
+			}
+		}
+		// past the deadline or cancelled, the targets left are settled without trying them
+		if err := ctx.Err(); err != nil {
+			settle(i, status.FromContextError(err).Err())
+			continue
+		}
+		addr := net.JoinHostPort(ip, strconv.Itoa(int(req.PortNumbers[i])))
+		err := d.replicateTo(ctx, req.FileName, addr, file, checksum, buf, class)
+		if err != nil {
+			log.Printf("Replication to %s failed: %v", addr, err)
+		} else {
+			log.Printf("Replication completed successfully to %s", addr)
+		}
+		settle(i, err)
+	}
+	return response, nil
+}
+
+// replicateTo copies the stored file, opened as file, to the DataNode at addr and verifies the copy against checksum
+func (d *DataNodeServer) replicateTo(ctx context.Context, fileName, addr string, file *storedFile, checksum string, buf []byte, class trafficClass) error {
+	conn, err := d.dialPeer(addr)
+	if err != nil {
+		return fmt.Errorf("connection failed: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewFileServiceClient(conn)
+	limit, capabilities := d.peerChunkLimit(ctx, client)
+
+	// a peer taking stream uploads is sent the file over one stream, no session to begin and end
+	if !slices.Contains(capabilities, "file-checksums") {
+		checksum = ""
+	}
+	if slices.Contains(capabilities, "stream-upload") {
+		if _, err := d.replicateStream(ctx, client, fileName, file, buf[:limit], class, nil); err != nil {
+			return err
+		}
+		return d.verifyReplica(ctx, client, fileName, checksum)
+	}
+
+	// STEP 1: Begin Upload
+	totalSize := file.Size()
+	begun, err := client.BeginUploadFile(ctx, &pb.FileUploadRequest{
+		FileName:     fileName,
+		ExpectedSize: totalSize,
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Replication started for %s on %s", fileName, addr)
+
+	// STEP 2: Update Upload with chunks, as large as the target's message limit allows, and progress logging
+	large := d.bypassCache(totalSize)
+	for offset := int64(0); offset < totalSize; offset += int64(limit) {
+		if err := d.traffic.acquire(ctx, class); err != nil {
+			return err
+		}
+		n, err := file.ReadAt(buf[:limit], offset)
+		d.traffic.release()
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("read of %s failed at offset %d: %v", fileName, offset, err)
+		}
+		if large {
+			dropCache(file.raw, offset, int64(n))
+		}
+		end := offset + int64(n)
+		chunkOffset := offset
+		_, err = client.UpdateUploadFile(ctx, &pb.FileUploadRequest{
+			FileName:    fileName,
+			FileContent: buf[:n],
+			Offset:      &chunkOffset,
+			SessionId:   begun.SessionId,
+		})
+		if err != nil {
+			return err
+		}
+
+		progress := float64(end) / float64(totalSize) * 100
+		log.Printf("Replication progress to %s: %.2f%%", addr, progress)
+	}
+
+	// STEP 3: End Upload, only reached when every chunk was sent
+	_, err = client.EndUploadFile(ctx, &pb.FileUploadRequest{
+		FileName:  fileName,
+		SessionId: begun.SessionId,
+	})
+	if err != nil {
+		return err
+	}
+	return d.verifyReplica(ctx, client, fileName, checksum)
+}
+
+func (d *DataNodeServer) BeginUploadFile(ctx context.Context, req *pb.FileUploadRequest) (*pb.FileUploadResponse, error) {
+	log.Printf("Begin upload for: %s", req.FileName)
+
+	// Metadata extraction
+	md, exists := metadata.FromIncomingContext(ctx)
+	if !exists {
+		log.Println("No metadata in request")
+	}
+	// the client may store data it already encoded, e.g. gzip compressed
+	encoding := strings.Join(md.Get("content-encoding"), "")
+	if err := checkEncoding(encoding); err != nil {
+		return nil, err
+	}
+	// a declared size makes a parallel upload, sent in ranges over several streams
+	size, err := uploadSize(md)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.refuseDraining(); err != nil {
+		return nil, err
+	}
+	// a replicating DataNode announces the size, a file that can't fit is refused before any chunk
+	if err := d.checkFileSize(max(size, req.ExpectedSize)); err != nil {
+		return nil, err
+	}
+	if err := d.admit(max(size, req.ExpectedSize, 1)); err != nil {
+		return nil, err
+	}
+	// the session counts against MaxUploadSessions from when it is added
+	release, err := d.admitSession()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	session := &uploadSession{id: newSessionID(), fileName: req.FileName, encoding: encoding, sync: d.syncRequested(ctx), expected: max(size, req.ExpectedSize), started: time.Now()}
+	var file *os.File
+	if req.Append {
+		if size > 0 {
+			return nil, status.Error(codes.InvalidArgument, "a parallel upload can't append")
+		}
+		file, session.base, err = d.stageAppend(req.FileName, session.id, encoding)
+	} else {
+		file, err = d.createStaged(req.FileName, session.id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size > 0 {
+		if err := file.Truncate(size); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return nil, fmt.Errorf("error sizing file: %v", err)
+		}
+		session.parallel = &parallelUpload{size: size}
+	}
+	session.file = file
+	d.uploads.add(session)
+
+	log.Printf("Upload session %s of %s staged at: %s", session.id, req.FileName, file.Name())
+	response := &pb.FileUploadResponse{Message: "Upload initiated", SessionId: session.id}
+	if session.base != nil {
+		response.Offset = session.base.Size
+	}
+	return response, nil
+}
+
+func (d *DataNodeServer) UpdateUploadFile(ctx context.Context, req *pb.FileUploadRequest) (*pb.FileUploadResponse, error) {
+	if len(req.FileContent) > d.ChunkBytes {
+		return nil, status.Errorf(codes.ResourceExhausted,
+			"chunk of %d bytes is larger than this DataNode's %d byte chunks, see chunk_bytes in GetCapabilities",
+			len(req.FileContent), d.ChunkBytes)
+	}
+	if err := checkChunk(req); err != nil {
+		return nil, err
+	}
+	session, err := d.uploads.lookup(req.SessionId, req.FileName)
+	if err != nil {
+		return nil, err
+	}
+	file := session.file
+
+	// out of space: abort the upload and drop what was written so far
+	if err := d.admit(int64(len(req.FileContent))); err != nil {
+		if d.uploads.remove(session) {
+			// Windows can't remove a file that is still open
+			file.Close()
+			os.Remove(file.Name())
+		}
+		return nil, err
+	}
+
+	// injected fault: acknowledge the chunk without writing it
+	if d.faults.DropChunk() {
+		log.Printf("fault injection: dropped chunk of %s", session.fileName)
+		return &pb.FileUploadResponse{Message: "Chunk received", SessionId: session.id}, nil
+	}
+
+	// ranges of a parallel upload arrive concurrently and in any order
+	if upload := session.parallel; upload != nil {
+		if req.Offset == nil || *req.Offset < 0 || *req.Offset+int64(len(req.FileContent)) > upload.size {
+			return nil, status.Errorf(codes.InvalidArgument, "chunks of a parallel upload need an offset within its %d bytes", upload.size)
+		}
+		if err := d.traffic.acquire(ctx, d.trafficClassOf(ctx)); err != nil {
+			return nil, err
+		}
+		_, err := file.WriteAt(req.FileContent, *req.Offset)
+		d.traffic.release()
+		if err != nil {
+			return nil, fmt.Errorf("error writing file content: %v", err)
+		}
+		upload.add(*req.Offset, *req.Offset+int64(len(req.FileContent)))
+		return &pb.FileUploadResponse{Message: "Chunk received", SessionId: session.id}, nil
+	}
+
+	// chunks of one sequential session are written in turn, each at the file's position
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if req.Offset != nil {
+		// a chunk may be rewritten but never leave a gap
+		if info, err := file.Stat(); err == nil && *req.Offset > info.Size() {
+			return nil, status.Errorf(codes.OutOfRange, "offset %d past the %d bytes received", *req.Offset, info.Size())
+		}
+		if session.base != nil && *req.Offset < session.base.Size {
+			return nil, status.Errorf(codes.OutOfRange, "offset %d is before the end of the %d bytes appended to", *req.Offset, session.base.Size)
+		}
+		if _, err := file.Seek(*req.Offset, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("error seeking to offset %d: %v", *req.Offset, err)
+		}
+	}
+	// a file over the limit can never be committed, its upload is dropped
+	if position, err := file.Seek(0, io.SeekCurrent); err == nil {
+		if err := d.checkFileSize(position + int64(len(req.FileContent))); err != nil {
+			if d.uploads.remove(session) {
+				file.Close()
+				os.Remove(file.Name())
+			}
+			return nil, err
+		}
+	}
+	if err := d.traffic.acquire(ctx, d.trafficClassOf(ctx)); err != nil {
+		return nil, err
+	}
+	_, err = file.Write(req.FileContent)
+	d.traffic.release()
+	if err != nil {
+		return nil, fmt.Errorf("error writing file content: %v", err)
+	}
+	// large upload: start writing this chunk out and evict the ones already written
+	if written, err := file.Seek(0, io.SeekCurrent); err == nil && d.bypassCache(written) {
+		chunkStart := written - int64(len(req.FileContent))
+		startWriteback(file, chunkStart, int64(len(req.FileContent)))
+		dropCache(file, 0, chunkStart)
+	}
+
+	log.Printf("Chunk written to %s", session.fileName)
+	return &pb.FileUploadResponse{Message: "Chunk received", SessionId: session.id}, nil
+}
+
+/*
+Commits an upload session: its staged file is checked against file_sha256
+when given, made durable and renamed over the stored file. Sessions of the same name commit independently, the last
+one to end is the content kept; an append only commits if the file it
+started from wasn't replaced meanwhile
+*/
+func (d *DataNodeServer) EndUploadFile(ctx context.Context, req *pb.FileUploadRequest) (*pb.FileUploadResponse, error) {
+	session, err := d.uploads.lookup(req.SessionId, req.FileName)
+	if err != nil {
+		return nil, err
+	}
+	// a parallel upload is assembled once every range arrived, the client may still resend the others
+	if upload := session.parallel; upload != nil {
+		if missing := upload.missing(); missing != "" {
+			return nil, status.Errorf(codes.FailedPrecondition, "upload of %s is missing %s", session.fileName, missing)
+		}
+	}
+	// a corrupted file keeps its session, the client can resend chunks and end again
+	verified := ""
+	if req.FileSha256 != "" {
+		session.mutex.Lock()
+		var checksum string
+		if session.base != nil {
+			checksum, err = appendedChecksum(session.file.Name(), session.base.Size)
+		} else {
+			checksum, err = fileChecksum(session.file.Name())
+		}
+		session.mutex.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("error checksumming upload: %v", err)
+		}
+		if checksum != req.FileSha256 {
+			return nil, checksumMismatch("file "+session.fileName, checksum, req.FileSha256)
+		}
+		if session.base == nil {
+			verified = checksum
+		}
+	}
+	if session.base != nil {
+		d.appendMutex.Lock()
+		defer d.appendMutex.Unlock()
+		if err := d.checkBase(session.fileName, session.base); err != nil {
+			if d.uploads.remove(session) {
+				session.file.Close()
+				os.Remove(session.file.Name())
+			}
+			return nil, err
+		}
+	}
+	if !d.uploads.remove(session) {
+		return nil, fmt.Errorf("upload session %s was aborted", session.id)
+	}
+	file := session.file
+	fileName := session.fileName
+	// an UpdateUploadFile of this session still writing finishes first
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	// make the upload durable before the master counts it as a replica
+	if err := d.faults.SyncFile(file); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("error syncing file: %v", err)
+	}
+	if info, err := file.Stat(); err == nil && d.bypassCache(info.Size()) {
+		dropCache(file, 0, 0)
+	}
+	file.Close()
+
+	staged, encoding, err := d.encodeStaged(file.Name(), session.encoding, session.base)
+	if err != nil {
+		return nil, err
+	}
+	savePath, err := d.commitStaged(staged, fileName, session.sync || d.syncRequested(ctx))
+	if err != nil {
+		return nil, err
+	}
+	d.setEncoding(fileName, encoding)
+	// the checksum of the bytes received, not of what was compressed from them
+	if verified != "" && encoding == session.encoding {
+		d.checksums.set(savePath, verified)
+	}
+
+	log.Printf("Upload finished for %s, session %s", fileName, session.id)
+
+	// Metadata for notifying master
+	md, exists := metadata.FromIncomingContext(ctx)
+	if !exists {
+		log.Println("No metadata in request")
+	}
+	clientIP := strings.Join(md.Get("client-ip"), ",")
+	clientPort := strings.Join(md.Get("client-port"), ",")
+	// token handed out by the master's PrepareUpload, passed back so it can match the intent
+	uploadToken := strings.Join(md.Get("upload-token"), "")
+	outMeta := metadata.Pairs("client-ip", clientIP, "client-port", clientPort)
+	outCtx := metadata.NewOutgoingContext(context.Background(), outMeta)
+
+	go notifyMasterOfUpload(d, outCtx, fileName, savePath, uploadToken, session.base != nil)
+
+	return &pb.FileUploadResponse{Message: "Upload complete", SessionId: session.id}, nil
+}
+
+/*
+Reports how many bytes of an upload session are durably written: the staged
+file is synced first, so a client whose connection dropped can resume
+sending from there. For a parallel upload it is the end of the range
+received from the start of the file
+*/
+func (d *DataNodeServer) GetUploadOffset(ctx context.Context, req *pb.GetUploadOffsetRequest) (*pb.GetUploadOffsetResponse, error) {
+	session, err := d.uploads.lookup(req.SessionId, req.FileName)
+	if err != nil {
+		return nil, err
+	}
+	// no chunk of the session is written meanwhile
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if err := d.faults.SyncFile(session.file); err != nil {
+		return nil, fmt.Errorf("error syncing file: %v", err)
+	}
+	offset := int64(0)
+	if session.parallel != nil {
+		offset = session.parallel.prefix()
+	} else {
+		info, err := session.file.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("error reading upload size: %v", err)
+		}
+		offset = info.Size()
+	}
+	return &pb.GetUploadOffsetResponse{Offset: offset, SessionId: session.id}, nil
+}
+
+/*
+CancelUpload ends an upload session the client gives up on: the staged file
+is closed and removed, and the stored file, if any, is left as it was.
+Sessions nobody cancels are aborted after UploadIdleTimeoutSeconds
+*/
+func (d *DataNodeServer) CancelUpload(ctx context.Context, req *pb.CancelUploadRequest) (*pb.CancelUploadResponse, error) {
+	session, err := d.uploads.lookup(req.SessionId, req.FileName)
+	if err != nil {
+		return nil, err
+	}
+	if !d.uploads.remove(session) {
+		return nil, status.Errorf(codes.NotFound, "upload session %s already ended", session.id)
+	}
+	d.uploads.discard(session)
+	log.Printf("upload session %s of %s canceled", session.id, session.fileName)
+	return &pb.CancelUploadResponse{}, nil
+}
+
+/*
+GetUploadProgress reports how many bytes an upload session received against
+the size declared when it began, so dashboards and clients can show the
+transfer's progress. Asking doesn't count as activity, a session nobody
+sends chunks to is still aborted when idle
+*/
+func (d *DataNodeServer) GetUploadProgress(ctx context.Context, req *pb.GetUploadProgressRequest) (*pb.GetUploadProgressResponse, error) {
+	session, activity, err := d.uploads.peek(req.SessionId, req.FileName)
+	if err != nil {
+		return nil, err
+	}
+	var received int64
+	if session.parallel != nil {
+		received = session.parallel.receivedBytes()
+	} else {
+		info, err := session.file.Stat()
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "upload session %s already ended", session.id)
+		}
+		received = info.Size()
+		if session.base != nil {
+			received -= session.base.Size
+		}
+	}
+	return &pb.GetUploadProgressResponse{
+		SessionId:          session.id,
+		FileName:           session.fileName,
+		ReceivedBytes:      received,
+		ExpectedBytes:      session.expected,
+		StartedUnixMs:      session.started.UnixMilli(),
+		LastActivityUnixMs: activity.UnixMilli(),
+	}, nil
+}
+
+// fileChecksum returns the hex SHA-256 of a stored file
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/*
+notifyMasterOfUpload tells the master a file was stored, with its size,
+checksum and a new upload ID; ctx carries the client to tell in turn. A
+notification the master doesn't acknowledge is queued and retried, see
+uploadNotices
+*/
+func notifyMasterOfUpload(d *DataNodeServer, ctx context.Context, filename, path, uploadToken string, appended bool) {
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = storedSize(path, info)
+	}
+	// hashed here once if the upload didn't bring its checksum, then cached for downloads
+	checksum, _, err := d.checksums.get(path)
+	if err != nil {
+		log.Printf("Checksum of %s failed: %v", path, err)
+	}
+	d.deduplicate(path, filename)
+
+	md, _ := metadata.FromOutgoingContext(ctx)
+	d.deliverUploadNotice(uploadNotice{
+		FileName:        filename,
+		FilePath:        path,
+		FileSize:        size,
+		Checksum:        checksum,
+		ContentEncoding: d.storedEncoding(filename),
+		UploadToken:     uploadToken,
+		Appended:        appended,
+		UploadID:        newSessionID(),
+		ClientIP:        strings.Join(md.Get("client-ip"), ","),
+		ClientPort:      strings.Join(md.Get("client-port"), ","),
+		Seq:             time.Now().UnixNano(),
+	})
+}
+
+/*
+notifyMasterOfDelete clears a client's delete of filename, or the deletion
+of an expired file, with the master. Its error (a hold on the file, or the
+master out of reach) keeps the file. The response tells whether the copy
+goes to the trash
+*/
+func notifyMasterOfDelete(d *DataNodeServer, ctx context.Context, filename string, expired bool) (*pb.NotifyDeletedResponse, error) {
+	conn, err := d.dialMaster()
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not reach the master: %v", err)
+	}
+	defer conn.Close()
+
+	response, err := pb.NewFileServiceClient(conn).NotifyDeleted(d.withClusterSecret(ctx), &pb.NotifyDeletedRequest{
+		FileName: filename,
+		DataNode: d.nodeID(),
+		Expired:  expired,
+	})
+	if err != nil {
+		log.Printf("Master refused to delete %s: %v", filename, err)
+		return nil, err
+	}
+	return response, nil
+}
+
+func (d *DataNodeServer) DownloadFile(ctx context.Context, in *pb.FileDownloadRequest) (*pb.FileDownloadResponse, error) {
+	log.Printf("FileDownloadRequest %s", in.FileName)
+	d.activeTransfers.Add(1)
+	defer d.activeTransfers.Add(-1)
+	d.activeDownloads.Add(1)
+	defer d.activeDownloads.Add(-1)
+	md, _ := metadata.FromIncomingContext(ctx)
+	reader, encoding, err := d.openForReader(ctx, in.FileName, strings.Join(md.Get("accept-encoding"), ","))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	source, err := d.selectRangeAhead(ctx, in.FileName, reader, in.Offset, in.Length)
+	if err != nil {
+		return nil, err
+	}
+
+	// the whole file goes in one message, larger ones have to be streamed
+	limit := d.MaxMessageBytes - messageOverhead
+	class := d.trafficClassOf(ctx)
+	fileContent, tooLarge, err := readMessage(slottedReader{Reader: source, ctx: ctx, class: class, traffic: d.traffic},
+		expectedSize(reader, in.Offset, in.Length), limit)
+	if err != nil {
+		return nil, fmt.Errorf("ReadFile fail %v", err)
+	}
+	if tooLarge {
+		return nil, status.Errorf(codes.ResourceExhausted,
+			"%s is larger than the %d byte message limit, download it with StreamDownload", in.FileName, d.MaxMessageBytes)
+	}
+	if encoding != "" {
+		grpc.SetHeader(ctx, metadata.Pairs("content-encoding", encoding))
+	}
+	// Create and return the response with the file content
+	response := &pb.FileDownloadResponse{
+		FileContent: fileContent,
+	}
+	// the checksum covers the whole file, a range can't be checked against it
+	if in.Offset == 0 && in.Length == 0 {
+		response.Checksum = d.sentChecksum(in.FileName, reader)
+	}
+	return response, nil
+}
+
+/*
+Streams a stored file to the client in ChunkBytes pieces, or smaller ones
+the client asks for with chunk-bytes metadata, so neither side has to hold
+the whole file in memory, or the range of it the request asks for. The first
+message of a whole file carries its checksum, an empty file is sent as one
+message without content. Encoded files are sent raw with a content-encoding
+header to clients listing it in accept-encoding metadata, and decoded for
+the others
+*/
+func (d *DataNodeServer) StreamDownload(in *pb.FileDownloadRequest, stream pb.FileService_StreamDownloadServer) error {
+	log.Printf("StreamDownload request %s", in.FileName)
+	d.activeTransfers.Add(1)
+	defer d.activeTransfers.Add(-1)
+	d.activeDownloads.Add(1)
+	defer d.activeDownloads.Add(-1)
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	reader, encoding, err := d.openForReader(stream.Context(), in.FileName, strings.Join(md.Get("accept-encoding"), ","))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	source, err := d.selectRangeAhead(stream.Context(), in.FileName, reader, in.Offset, in.Length)
+	if err != nil {
+		return err
+	}
+	if encoding != "" {
+		if err := stream.SendHeader(metadata.Pairs("content-encoding", encoding)); err != nil {
+			return err
+		}
+	}
+	// a large file is read once, keep it from evicting the hot small files
+	file, raw := reader.(*storedFile)
+	var large bool
+	if raw && d.bypassCache(file.Size()) {
+		large = true
+		adviseSequential(file.raw)
+	}
+
+	pooled := d.chunks.get()
+	defer d.chunks.put(pooled)
+	buf := *pooled
+	if requested, err := strconv.Atoi(strings.Join(md.Get("chunk-bytes"), "")); err == nil && requested > 0 && requested < d.ChunkBytes {
+		buf = buf[:requested]
+	}
+	ctx := stream.Context()
+	class := d.trafficClassOf(ctx)
+	checksum := ""
+	if in.Offset == 0 && in.Length == 0 {
+		checksum = d.sentChecksum(in.FileName, reader)
+	}
+	offset := in.Offset
+	sent := false
+	for {
+		if err := d.traffic.acquire(ctx, class); err != nil {
+			return err
+		}
+		n, err := source.Read(buf)
+		d.traffic.release()
+		// offsets in an encrypted file are a little off, the pages dropped are about right
+		if large && n > 0 {
+			dropCache(file.raw, offset, int64(n))
+		}
+		offset += int64(n)
+		if n > 0 || (err == io.EOF && !sent) {
+			// Send blocks under gRPC flow control when the client stops reading
+			if sendErr := stream.Send(&pb.FileDownloadResponse{FileContent: buf[:n], Checksum: checksum}); sendErr != nil {
+				return sendErr
+			}
+			checksum = ""
+			sent = true
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Read fail %v", err)
+		}
+	}
+}
+
+func (d *DataNodeServer) BeginDownloadFile(ctx context.Context, in *pb.FileDownloadRequest) (*pb.FileDownloadResponse, error) {
+	log.Printf("FileDownloadRequest %s", in.FileName)
+	filePath, err := d.storagePath(in.FileName)
+	if err != nil {
+		return nil, err
+	}
+
+	fileContent, err := d.readStored(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("ReadFile fail %v", err)
+	}
+	// Create and return the response with the file content
+	response := &pb.FileDownloadResponse{
+		FileContent: fileContent,
+	}
+	return response, nil
+}
+
+func (d *DataNodeServer) UpdateDownloadFile(ctx context.Context, in *pb.FileDownloadRequest) (*pb.FileDownloadResponse, error) {
+	log.Printf("FileDownloadRequest %s", in.FileName)
+	filePath, err := d.storagePath(in.FileName)
+	if err != nil {
+		return nil, err
+	}
+
+	fileContent, err := d.readStored(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("ReadFile fail %v", err)
+	}
+	// Create and return the response with the file content
+	response := &pb.FileDownloadResponse{
+		FileContent: fileContent,
+	}
+	return response, nil
+}
+
+func (d *DataNodeServer) EndDownloadFile(ctx context.Context, in *pb.FileDownloadRequest) (*pb.FileDownloadResponse, error) {
+	log.Printf("FileDownloadRequest %s", in.FileName)
+	filePath, err := d.storagePath(in.FileName)
+	if err != nil {
+		return nil, err
+	}
+
+	fileContent, err := d.readStored(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("ReadFile fail %v", err)
+	}
+	// Create and return the response with the file content
+	response := &pb.FileDownloadResponse{
+		FileContent: fileContent,
+	}
+	return response, nil
+}
+
+/*
+Removes a stored file and aborts the uploads of its name still in progress.
+The master uses it to drop the source copy once a replica has been moved and
+the other copies of a deleted file; a client's delete is first cleared with
+the master, which refuses files under a hold and has the other replicas
+deleted as well. When the master keeps deleted files restorable the copy is
+moved to the trash instead, see RestoreFile. A client's delete drops the
+versions of the file too
+*/
+func (d *DataNodeServer) DeleteFile(ctx context.Context, req *pb.FileDeleteRequest) (*pb.FileDeleteResponse, error) {
+	log.Printf("FileDeleteRequest %s", req.FileName)
+	filePath, err := d.storagePath(req.FileName)
+	if err != nil {
+		return nil, err
+	}
+	if !d.fromCluster(ctx) {
+		response, err := notifyMasterOfDelete(d, ctx, req.FileName, false)
+		if err != nil {
+			return nil, err
+		}
+		req = &pb.FileDeleteRequest{FileName: req.FileName, TrashId: response.TrashId, PurgeUnixMs: response.PurgeUnixMs, DropVersions: true}
+	}
+	return d.removeStored(filePath, req)
+}
+
+// removeStored deletes the stored file at filePath once the delete req is cleared, see DeleteFile
+func (d *DataNodeServer) removeStored(filePath string, req *pb.FileDeleteRequest) (*pb.FileDeleteResponse, error) {
+	if req.DropVersions {
+		d.dropVersions(req.FileName)
+	}
+	aborted := d.uploads.abort(req.FileName)
+	if aborted > 0 {
+		log.Printf("Aborted %d upload session(s) of %s", aborted, req.FileName)
+	}
+	var err error
+	d.blobMutex.Lock()
+	if req.TrashId > 0 {
+		err = d.moveToTrash(filePath, req.FileName, req.TrashId, req.PurgeUnixMs)
+	} else {
+		err = d.replaceStored(filePath, func() error { return os.Remove(filePath) })
+	}
+	d.blobMutex.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) && aborted > 0 {
+			return &pb.FileDeleteResponse{}, nil
+		}
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "%s not found", req.FileName)
+		}
+		return nil, fmt.Errorf("Remove fail %v", err)
+	}
+	d.setEncoding(req.FileName, "")
+	d.replicaIndex.set(req.FileName, nil)
+	d.forgetBlob(req.FileName)
+	d.checksums.forget(filePath)
+	d.readCache.forget(filePath)
+	d.pruneEmptyDirs(filePath)
+	if req.TrashId > 0 {
+		log.Printf("Moved %s to the trash", req.FileName)
+	} else {
+		log.Printf("Deleted %s", req.FileName)
+	}
+	return &pb.FileDeleteResponse{}, nil
+}
+
+// pruneEmptyDirs drops the directories a nested name leaves empty, os.Remove fails on the first non-empty one
+func (d *DataNodeServer) pruneEmptyDirs(filePath string) {
+	root := d.volumeRoot(filePath)
+	for dir := filepath.Dir(filePath); dir != root; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
+
+// usedBytes is the running count of the bytes stored by this DataNode, see countUsedBytes
+func (d *DataNodeServer) usedBytes() int64 {
+	return d.used.Load()
+}
+
+/*
+countUsedBytes sums the size of every file stored by this DataNode, a
+deduplicated one counting once with its blob; staged uploads count once
+committed. It walks every data directory, so it runs at startup and every
+usedBytesRecountInterval only: in between, the count is kept up to date as
+files are committed, linked to blobs and removed, see replaceStored
+*/
+func (d *DataNodeServer) countUsedBytes() int64 {
+	var total int64
+	for _, dir := range d.volumeDirs() {
+		total += d.countedBytes(dir)
+	}
+	return total
+}
+
+// countedBytes is what the file or directory at path adds to usedBytes
+func (d *DataNodeServer) countedBytes(path string) int64 {
+	root := d.volumeRoot(path)
+	var total int64
+	filepath.WalkDir(path, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || stagedFile.MatchString(path) {
+			return nil
+		}
+		if relative, err := filepath.Rel(root, path); err == nil && !isBlobPath(relative) {
+			if _, linked := d.blobs.get(filepath.ToSlash(relative)); linked {
+				return nil
+			}
+		}
+		if info, err := entry.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// fileBytes is the size of the file at path, 0 when there is none
+func fileBytes(path string) int64 {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+/*
+replaceStored runs change, which stores a new file at path or removes the
+one there, and updates usedBytes: the old file stops counting, the new one
+counts whole, being linked to no blob yet. Nothing is counted when change fails
+*/
+func (d *DataNodeServer) replaceStored(path string, change func() error) error {
+	before := d.countedBytes(path)
+	if err := change(); err != nil {
+		return err
+	}
+	d.used.Add(fileBytes(path) - before)
+	return nil
+}
+
+// moveStored renames the stored file from over to, and updates usedBytes
+func (d *DataNodeServer) moveStored(from, to string) error {
+	before := d.countedBytes(from) + d.countedBytes(to)
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	d.used.Add(d.countedBytes(to) - before)
+	return nil
+}
+
+/*
+recountUsedBytes walks the data directories every usedBytesRecountInterval,
+correcting what the running count can't follow, such as a volume failing. A
+change made during the walk may be missed or counted twice until the next
+*/
+func (d *DataNodeServer) recountUsedBytes() {
+	for d.sleep(usedBytesRecountInterval) {
+		d.used.Store(d.countUsedBytes())
+	}
+}
+
+/*
+Bytes this DataNode still accepts: the free space of its volumes in service
+minus the reservation on each, capped by what's left of MaxBytes. -1 when
+neither applies
+*/
+func (d *DataNodeServer) availableBytes() int64 {
+	available := int64(-1)
+	if d.MaxBytes > 0 {
+		available = max(d.MaxBytes-d.usedBytes(), 0)
+	}
+	free, known := int64(0), false
+	for _, dir := range d.volumeDirs() {
+		if volumeFree := d.volumeFree(dir); volumeFree >= 0 {
+			free += volumeFree
+			known = true
+		}
+	}
+	if known && (available < 0 || free < available) {
+		available = free
+	}
+	return available
+}
+
+// capacityBytes is the size of the volumes in service, or MaxBytes when smaller, -1 when neither is known
+func (d *DataNodeServer) capacityBytes() int64 {
+	capacity, known := int64(0), false
+	for _, dir := range d.volumeDirs() {
+		if _, err := os.Stat(dir); err != nil {
+			dir = "."
+		}
+		if _, total, ok := diskSpace(dir); ok {
+			capacity += total
+			known = true
+		}
+	}
+	if d.MaxBytes > 0 && (!known || d.MaxBytes < capacity) {
+		return d.MaxBytes
+	}
+	if !known {
+		return -1
+	}
+	return capacity
+}
+
+// bypassCache reports whether a transfer of size bytes should get page cache hints
+func (d *DataNodeServer) bypassCache(size int64) bool {
+	return d.DropCacheAboveBytes > 0 && size >= d.DropCacheAboveBytes
+}
+
+// checkFileSize refuses a file of size bytes when it is over MaxFileBytes
+func (d *DataNodeServer) checkFileSize(size int64) error {
+	if d.MaxFileBytes > 0 && size > d.MaxFileBytes {
+		return status.Errorf(codes.ResourceExhausted, "a file of %d bytes is over DataNode %d's %d byte file size limit", size, d.nodeID(), d.MaxFileBytes)
+	}
+	return nil
+}
+
+// outOfSpaceReason marks the errors of a DataNode refusing data it has no room for
+const outOfSpaceReason = "DATANODE_FULL"
+
+// busyReason marks the errors of a DataNode refusing a write because MaxUploadSessions are in progress
+const busyReason = "DATANODE_BUSY"
+
+// time a client refused by a busy DataNode is told to wait before retrying
+const busyRetryDelay = time.Second
+
+/*
+admitSession reserves one of the MaxUploadSessions for a write about to
+start and returns its release. A DataNode at the limit refuses it with
+Unavailable, retryable, carrying an ErrorInfo with busyReason and a
+RetryInfo, so a burst of clients can't exhaust the file descriptors and
+memory of a small board; the SDK moves on to the upload's other targets
+*/
+func (d *DataNodeServer) admitSession() (func(), error) {
+	release, inProgress, ok := d.uploads.reserve()
+	if ok {
+		return release, nil
+	}
+	refused := status.New(codes.Unavailable, fmt.Sprintf("DataNode %d busy with %d upload and replication sessions, retry later", d.nodeID(), inProgress))
+	detailed, err := refused.WithDetails(
+		&errdetails.ErrorInfo{Reason: busyReason, Domain: "dfs"},
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(busyRetryDelay)})
+	if err == nil {
+		return nil, detailed.Err()
+	}
+	return nil, refused.Err()
+}
+
+/*
+outOfSpace is the error of a refused write: ResourceExhausted, as gRPC's own
+message size errors are, carrying an ErrorInfo with outOfSpaceReason so a
+replicating DataNode tells the master to pick another node
+*/
+func (d *DataNodeServer) outOfSpace(format string, args ...interface{}) error {
+	refused := status.New(codes.ResourceExhausted, fmt.Sprintf(format, args...))
+	if detailed, err := refused.WithDetails(&errdetails.ErrorInfo{Reason: outOfSpaceReason, Domain: "dfs"}); err == nil {
+		return detailed.Err()
+	}
+	return refused.Err()
+}
+
+// isOutOfSpace reports whether err is a DataNode's outOfSpace error
+func isOutOfSpace(err error) bool {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Reason == outOfSpaceReason {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+admit is the upload admission check, rejecting writes of size bytes that
+don't fit before anything is written, so the volume never fills up and
+ReservedBytes and ReservedPercent stay free
+*/
+func (d *DataNodeServer) admit(size int64) error {
+	if available := d.availableBytes(); available >= 0 && size > available {
+		return d.outOfSpace("DataNode %d out of space: %d bytes available, %d needed", d.nodeID(), available, size)
+	}
+	// a file is stored whole on one volume
+	if len(d.volumes) > 1 {
+		largest := int64(-1)
+		for _, dir := range d.volumeDirs() {
+			largest = max(largest, d.volumeFree(dir))
+		}
+		if largest >= 0 && size > largest {
+			return d.outOfSpace("DataNode %d out of space: at most %d bytes available on a data directory, %d needed", d.nodeID(), largest, size)
+		}
+	}
+	return nil
+}
+
+const (
+	defaultHeartbeatInterval      = time.Second
+	defaultHeartbeatJitterPercent = 10
+	// most time between heartbeats while the master can't be reached, unless the interval is longer
+	maxHeartbeatBackoff = 10 * time.Second
+	// longest a heartbeat waits for the master's answer
+	heartbeatTimeout = 5 * time.Second
+	// how often the data directories are walked to correct the count of the bytes stored
+	usedBytesRecountInterval = 10 * time.Minute
+)
+
+/*
+sendHeartbeat tells the master the DataNode is alive every
+HeartbeatIntervalMs, jittered so DataNodes started together don't beat in
+step. The master is dialed lazily and the heartbeats go on while it can't
+be reached, backing off to one every maxHeartbeatBackoff, so a DataNode may
+start before the master and outlives its restarts; the restarted master
+learns of the node from its next heartbeat
+*/
+func (d *DataNodeServer) sendHeartbeat() {
+	var masterConn *grpc.ClientConn
+	var masterClient pb.FileServiceClient
+	defer func() {
+		if masterConn != nil {
+			masterConn.Close()
+		}
+	}()
+	// this clock minus the master's, measured by the last heartbeat
+	var clockOffset *int64
+	var clockSkewed bool
+	// heartbeats in a row the master didn't answer, and the wait before the next
+	failures := 0
+	wait := d.heartbeatInterval()
+	// the master knows the DataNode's ID, it registers again when the master forgot it
+	registered := false
+	// the next heartbeat goes to the next master of the list, if any
+	failover := func() {
+		if d.nextMaster() && masterConn != nil {
+			masterConn.Close()
+			masterConn = nil
+		}
+	}
+	for {
+
+		if !d.sleep(d.jittered(wait)) || d.stopping.Load() {
+			return
+		}
+		// a node playing dead goes silent
+		if d.faults.Dead(time.Now()) {
+			continue
+		}
+		if masterConn == nil {
+			conn, err := d.dialMaster()
+			if err != nil {
+				failures++
+				wait = d.heartbeatBackoff(failures)
+				log.Printf("Cannot connect to Master %v, retrying in %v", err, wait)
+				failover()
+				continue
+			}
+			masterConn, masterClient = conn, pb.NewFileServiceClient(conn)
+		}
+		if !registered {
+			err := d.register(masterClient)
+			switch status.Code(err) {
+			case codes.OK:
+				registered = true
+			case codes.Unimplemented:
+				log.Printf("the master doesn't assign DataNode IDs, it knows this one as %d by its address", d.nodeID())
+				registered = true
+			default:
+				if err := d.registrationError(err); err != nil {
+					d.fail(err)
+					return
+				}
+				failures++
+				previous := wait
+				wait = d.heartbeatBackoff(failures)
+				if wait != previous || failures%30 == 0 {
+					log.Printf("Cannot register with the master %v, retrying in %v", err, wait)
+				}
+				failover()
+				continue
+			}
+		}
+		dataNode := d.nodeID()
+		keepAliveRequest := &pb.KeepAliveRequest{
+			DataNode_IP:         d.IP,
+			PortNumber:          []string{d.PortForMaster, d.PortForClient, d.PortForDN},
+			IsAlive:             true,
+			Labels:              d.Labels,
+			UsedBytes:           d.usedBytes(),
+			ActiveTransfers:     d.activeTransfers.Load() + int32(d.uploads.count()),
+			AvailableBytes:      d.availableBytes(),
+			MaxMessageBytes:     d.MaxMessageBytes,
+			ChunkBytes:          int32(d.ChunkBytes),
+			ClockOffsetMs:       clockOffset,
+			Draining:            d.drain.draining.Load(),
+			HeartbeatIntervalMs: d.heartbeatInterval().Milliseconds(),
+			DataNode:            &dataNode,
+			NodeUuid:            d.identity.UUID,
+			ClusterId:           d.cluster(),
+		}
+		keepAliveRequest.ReadCacheHits, keepAliveRequest.ReadCacheMisses = d.readCache.counts()
+		keepAliveRequest.CapacityBytes = d.capacityBytes()
+		keepAliveRequest.ActiveDownloads = d.activeDownloads.Load()
+		keepAliveRequest.ActiveUploads = keepAliveRequest.ActiveTransfers - keepAliveRequest.ActiveDownloads
+		keepAliveRequest.CpuLoad, keepAliveRequest.IoLoad = d.systemLoad()
+
+		sent := time.Now()
+		keepAliveRequest.SentUnixMs = sent.UnixMilli()
+		ctx, cancel := context.WithTimeout(context.Background(), heartbeatTimeout)
+		response, err := masterClient.KeepAlive(d.withClusterSecret(ctx), keepAliveRequest)
+		cancel()
+		if err != nil {
+			if err := d.registrationError(err); err != nil {
+				d.fail(err)
+				return
+			}
+			failures++
+			previous := wait
+			wait = d.heartbeatBackoff(failures)
+			// logged when the master goes away and then as the wait grows, not every heartbeat
+			if wait != previous || failures%30 == 0 {
+				log.Printf("Cannot Send KeepAlive %v, retrying in %v", err, wait)
+			}
+			failover()
+			continue
+		}
+		if failures > 0 {
+			log.Printf("master reachable again after %d failed heartbeat(s)", failures)
+			failures, wait = 0, d.heartbeatInterval()
+		}
+		if response.Register {
+			log.Printf("the master doesn't know this DataNode's ID, registering again")
+			registered = false
+			continue
+		}
+		// the master answered halfway through the round trip
+		if response.MasterUnixMs != 0 {
+			received := time.Now()
+			midpoint := sent.Add(received.Sub(sent) / 2)
+			offset := midpoint.Sub(time.UnixMilli(response.MasterUnixMs)).Milliseconds()
+			clockOffset = &offset
+		}
+		d.peersMutex.Lock()
+		d.peers = response.Peers
+		d.peersMutex.Unlock()
+		d.keepVersions.Store(response.KeepVersions)
+		d.blockIndex.set(response.BlockOwners)
+		if keepAliveRequest.Draining {
+			d.noteDrain(response)
+		}
+		// file reports are sent aside so a long inventory doesn't hold heartbeats back
+		go d.sendFileReport(masterClient, response.ReportFiles)
+		if response.ClockSkewed != clockSkewed {
+			clockSkewed = response.ClockSkewed
+			if clockSkewed {
+				log.Printf("the master reports this clock is off by %dms: check time synchronization", *clockOffset)
+			} else {
+				log.Printf("clock back in sync with the master")
+			}
+		}
+	}
+}
+
+// heartbeatBackoff is the wait before the next heartbeat after failures in a row, doubling from the interval
+func (d *DataNodeServer) heartbeatBackoff(failures int) time.Duration {
+	wait := d.heartbeatInterval()
+	limit := max(wait, maxHeartbeatBackoff)
+	for i := 0; i < failures && wait < limit; i++ {
+		wait *= 2
+	}
+	return min(wait, limit)
+}
+
+// heartbeatInterval is the time between two heartbeats while the master answers them
+func (d *DataNodeServer) heartbeatInterval() time.Duration {
+	if d.HeartbeatIntervalMs <= 0 {
+		return defaultHeartbeatInterval
+	}
+	return time.Duration(d.HeartbeatIntervalMs) * time.Millisecond
+}
+
+/*
+jittered draws a wait up to HeartbeatJitterPercent shorter or longer than
+wait. The jitter is capped at half the wait, the master takes a node for dead
+after two intervals without heartbeats
+*/
+func (d *DataNodeServer) jittered(wait time.Duration) time.Duration {
+	percent := d.HeartbeatJitterPercent
+	switch {
+	case percent < 0:
+		return wait
+	case percent == 0:
+		percent = defaultHeartbeatJitterPercent
+	}
+	spread := int64(wait) * int64(min(percent, 50)) / 100
+	if spread <= 0 {
+		return wait
+	}
+	return wait + time.Duration(rand.Int63n(2*spread+1)-spread)
+}
+
+//func (d *DataNodeServer) Replicate(ctx context.Context, req *pb.ReplicateRequest) (*pb.ReplicateResponse, error) {
+//
+//	log.Printf("Replicating file: %s to %d node(s)", req.FileName, len(req.IpAddresses))
+//
+//	// Read the content of the file
+//	content, err := os.ReadFile(req.FilePath)
+//	if err != nil {
+//		return nil, fmt.Errorf("replication failed, cannot read file: %v", err)
+//	}
+//
+//	// Iterate over the provided IP addresses and ports
+//	for i, ip := range req.IpAddresses {
+//
+//		addr := fmt.Sprintf("%s:%d", ip, req.PortNumbers[i])
+//
+//		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+//		if err != nil {
+//			log.Printf("Connection failed to %s: %v", addr, err)
+//			continue
+//		}
+//		defer conn.Close()
+//
+//		client := pb.NewFileServiceClient(conn)
+//
+//		// Invoke the UploadFile service
+//		_, err = client.UploadFile(ctx, &pb.FileUploadRequest{
+//			FileName:    req.FileName,
+//			FileContent: content,
+//		})
+//		if err != nil {
+//			log.Printf("Replication upload failed to %s: %v", addr, err)
+//		} else {
+//			log.Printf("Replicated to %s", addr)
+//		}
+//
+//	}
+//
+//	return &pb.ReplicateResponse{}, nil
+//}
+
+/*
+This function extracts the local IP that the data node runs on, preferring
+IPv4 and falling back to a global IPv6 address on IPv6-only machines
+*/
+func GetMachineIP() (string, error) {
+	return interfaceIP("", false)
+}
+
+/*
+interfaceIP is the address GetMachineIP picks among those of the network
+interface named, or of every interface when the name is empty. A named
+interface may be the loopback, it must be up. IPv6 addresses are skipped
+unless routable (global, or the loopback of a named interface), and come
+first with preferIPv6, last otherwise
+*/
+func interfaceIP(name string, preferIPv6 bool) (string, error) {
+	// get the network interfaces within machine (ethernet0, wifi ..)
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	var ipv4, ipv6 net.IP
+	found := false
+	for _, iface := range ifaces {
+		if name != "" {
+			if iface.Name != name {
+				continue
+			}
+			found = true
+			if iface.Flags&net.FlagUp == 0 {
+				return "", fmt.Errorf("interface %s is down", name)
+			}
+		} else if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			// Skip down or loopback interfaces
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			var ip net.IP
+
+			switch v := addr.(type) {
+			case *net.IPNet:
+				ip = v.IP
+			case *net.IPAddr:
+				ip = v.IP
+			}
+
+			if ip == nil || (ip.IsLoopback() && name == "") {
+				continue
+			}
+
+			if ip.To4() == nil {
+				// not an IPv4 address, remember the first routable IPv6 one
+				if ipv6 == nil && (ip.IsGlobalUnicast() || ip.IsLoopback()) {
+					ipv6 = ip
+				}
+			} else if ipv4 == nil {
+				ipv4 = ip.To4()
+			}
+		}
+	}
+
+	if preferIPv6 && ipv6 != nil {
+		return ipv6.String(), nil
+	}
+	if ipv4 != nil {
+		return ipv4.String(), nil
+	}
+	if ipv6 != nil {
+		return ipv6.String(), nil
+	}
+	if name != "" && !found {
+		return "", fmt.Errorf("no interface named %s", name)
+	}
+	return "", fmt.Errorf("no suitable IP address found")
+}
+
+// listenAddress is where a port of the config listens: on BindAddress unless the port names a host
+func (d *DataNodeServer) listenAddress(port string) string {
+	host, number, err := net.SplitHostPort(port)
+	if err != nil || host != "" || d.BindAddress == "" {
+		return port
+	}
+	return net.JoinHostPort(d.BindAddress, number)
+}
+
+/*
+setUpAddresses picks the bind and advertised addresses. Interface binds to
+the address of that interface, and a DataNode bound to one address
+advertises it unless IP names another, the public address of a NAT
+*/
+func (d *DataNodeServer) setUpAddresses() error {
+	if d.Interface != "" && d.BindAddress == "" {
+		ip, err := interfaceIP(d.Interface, d.PreferIPv6)
+		if err != nil {
+			return err
+		}
+		d.BindAddress = ip
+	}
+	if d.IP != "" {
+		return nil
+	}
+	if ip := net.ParseIP(d.BindAddress); d.BindAddress != "" && (ip == nil || !ip.IsUnspecified()) {
+		d.IP = d.BindAddress
+		return nil
+	}
+	ip, err := interfaceIP("", d.PreferIPv6)
+	if err != nil {
+		fmt.Println("Error in extracting IP of machine", err)
+	}
+	d.IP = ip
+	return nil
+}
+
+/*
+Main runs the DataNode of the config file named on the command line until
+it is interrupted or terminated, then shuts it down gracefully
+*/
+func Main() {
+	// flags set override the config file
+	heartbeatInterval := flag.Duration("heartbeat-interval", 0, "time between heartbeats, HeartbeatIntervalMs")
+	heartbeatJitter := flag.Int("heartbeat-jitter", 0, "percent each heartbeat wait varies by, -1 for none, HeartbeatJitterPercent")
+	masters := flag.String("master", "", "address of the master, or comma separated masters, over "+masterAddressEnv+" and MasterAddress")
+	flag.Parse()
+	// the config file must be passed
+	if flag.NArg() < 1 {
+		log.Fatalf("Please pass the dataNode configuration file by terminal")
+	}
+
+	config_file_path := flag.Arg(0)
+	config, err := os.ReadFile(config_file_path)
+	if err != nil {
+		log.Fatalf("couldn't read the file specified")
+	}
+
+	// Start to configure our data node server
+	dataServer := &DataNodeServer{exitOnFail: true}
+	// parse the json configuration to the data Node server
+	err = json.Unmarshal(config, dataServer)
+	if err != nil {
+		log.Fatalf("couldn't parse config file")
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "heartbeat-interval":
+			dataServer.HeartbeatIntervalMs = int(heartbeatInterval.Milliseconds())
+		case "heartbeat-jitter":
+			dataServer.HeartbeatJitterPercent = *heartbeatJitter
+		}
+	})
+	if err := dataServer.setUp(filepath.Dir(config_file_path), *masters); err != nil {
+		log.Fatal(err)
+	}
+
+	// open TCP ports for future connections with Master, Client, DataNodes
+	lisC, err := net.Listen("tcp", dataServer.listenAddress(dataServer.PortForClient))
+	if err != nil {
+		log.Fatalf("tcp portForClient listen fail %v", err)
+	}
+	listeners := []net.Listener{lisC}
+	if dataServer.Port == "" {
+		lisD, err := net.Listen("tcp", dataServer.listenAddress(dataServer.PortForDN))
+		if err != nil {
+			log.Fatalf("tcp portForDN listen fail %v", err)
+		}
+
+		lisMaster, err := net.Listen("tcp", dataServer.listenAddress(dataServer.PortForMaster))
+		if err != nil {
+			log.Fatalf("tcp portForM listen fail %v", err)
+		}
+		listeners = append(listeners, lisD, lisMaster)
+	}
+	if err := dataServer.serve(listeners); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(listeners) == 1 {
+		log.Printf("DataNode running at %s for client, DataNodes and Master", lisC.Addr())
+	} else {
+		log.Printf("DataNode running at %s for client and %s for DataNodes and %s for Master", lisC.Addr(), listeners[1].Addr(), listeners[2].Addr())
+	}
+	// serve until interrupted or terminated, then shut down gracefully
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	dataServer.shutdown()
+}
+
+// Listeners are the bound ports a DataNode started by Start serves on
+type Listeners struct {
+	// the only one served with the config's single Port
+	Client   net.Listener
+	DataNode net.Listener
+	Master   net.Listener
+}
+
+/*
+Start sets up the DataNode of config, the content of a config file whose
+relative paths are resolved against configDir, waits for the master to
+assign it an ID when it has none, then serves on listeners until Stop. The
+ports in the config are those of the listeners, advertised to the master
+*/
+func Start(config []byte, configDir string, listeners Listeners) (*DataNodeServer, error) {
+	d := &DataNodeServer{}
+	if err := json.Unmarshal(config, d); err != nil {
+		return nil, fmt.Errorf("couldn't parse config file: %v", err)
+	}
+	if err := d.setUp(configDir, ""); err != nil {
+		return nil, err
+	}
+	served := []net.Listener{listeners.Client}
+	if d.Port == "" {
+		served = append(served, listeners.DataNode, listeners.Master)
+	}
+	if err := d.serve(served); err != nil {
+		d.Stop()
+		return nil, err
+	}
+	return d, nil
+}
+
+/*
+setUp checks the config, then opens the storage and the state kept next to
+it, and registers with the master when the DataNode has no ID yet. masters
+overrides the master addresses of the config when set
+*/
+func (d *DataNodeServer) setUp(configDir, masters string) error {
+	d.stopped = make(chan struct{})
+	if err := d.setUpAddresses(); err != nil {
+		return fmt.Errorf("Interface: %v", err)
+	}
+	if err := d.parsePermissions(); err != nil {
+		return fmt.Errorf("couldn't parse config file: %v", err)
+	}
+	if err := d.checkLimits(); err != nil {
+		return fmt.Errorf("couldn't parse config file: %v", err)
+	}
+	if err := d.checkSecrets(); err != nil {
+		return fmt.Errorf("couldn't parse config file: %v", err)
+	}
+	d.chunks = newChunkPool(d.ChunkBytes)
+	d.readCache = newReadCache(d.ReadCacheBytes)
+	d.readAhead = newReadAhead(d.ReadAheadBytes)
+	if err := d.setUpTraffic(); err != nil {
+		return fmt.Errorf("couldn't parse config file: %v", err)
+	}
+	if d.HTTPPort != "" && d.HTTPToken == "" {
+		return errors.New("HTTPPort needs an HTTPToken")
+	}
+	var err error
+	if d.sealer, err = newSealer(d.EncryptionKey); err != nil {
+		return fmt.Errorf("EncryptionKey: %v", err)
+	}
+	d.checksums.sealer = d.sealer
+	if err := checkEncoding(d.Compression); err != nil {
+		return fmt.Errorf("Compression: %v", err)
+	}
+	if d.ReservedPercent < 0 || d.ReservedPercent >= 100 {
+		return fmt.Errorf("ReservedPercent must be at least 0 and below 100, not %v", d.ReservedPercent)
+	}
+	if d.Port != "" {
+		d.PortForMaster, d.PortForClient, d.PortForDN = d.Port, d.Port, d.Port
+	}
+	d.setUpMasters(masters)
+	log.Printf("master at %s", strings.Join(d.masters, ", "))
+	d.faults = faults.New(d.Faults)
+	if d.TLS != nil {
+		d.TLS.ResolvePaths(configDir)
+	}
+	if d.serverCredentials, d.dialCredentials, err = tlsconfig.Credentials(d.TLS); err != nil {
+		return fmt.Errorf("couldn't set up TLS: %v", err)
+	}
+
+	d.checkDataDir()
+	if err := d.setUpVolumes(); err != nil {
+		return fmt.Errorf("couldn't set up the data directories: %v", err)
+	}
+	// re-attach to the uploads a previous process left open before serving
+	d.uploads = newUploadSessionManager(d.storageDir()+".sessions.json",
+		time.Duration(max(d.SessionGraceSeconds, 0))*time.Second,
+		configTimeout(d.UploadIdleTimeoutSeconds, defaultUploadIdleTimeout), d.MaxUploadSessions)
+	d.uploads.recover(d.volumeDirs())
+	d.loadEncodings()
+	d.loadReplicaIndex()
+	d.loadBlockIndex()
+	d.loadBlobIndex()
+	d.used.Store(d.countUsedBytes())
+	d.loadReplicationRetries()
+	d.loadUploadNotices()
+	d.loadDrainMode()
+	if err := d.loadIdentity(); err != nil {
+		return err
+	}
+	return d.registerAtStart()
+}
+
+// serve serves the gRPC API on listeners, and the HTTP endpoint if configured, and starts the background work
+func (d *DataNodeServer) serve(listeners []net.Listener) error {
+	var httpListener net.Listener
+	if d.HTTPPort != "" {
+		var err error
+		if httpListener, err = net.Listen("tcp", d.listenAddress(d.HTTPPort)); err != nil {
+			return fmt.Errorf("http listen fail %v", err)
+		}
+	}
+
+	// create a Grpc server and bind our data node server to it
+	d.grpcServer = grpc.NewServer(append(d.faults.ServerOptions(),
+		grpc.Creds(d.serverCredentials),
+		grpc.MaxRecvMsgSize(int(d.MaxMessageBytes)),
+		grpc.InTapHandle(d.timeoutTap),
+		grpc.ChainUnaryInterceptor(apiversion.UnaryInterceptor, d.clusterInterceptor, d.timeoutInterceptor, d.tokenInterceptor),
+		grpc.ChainStreamInterceptor(apiversion.StreamInterceptor, d.clusterStreamInterceptor, d.timeoutStreamInterceptor, d.tokenStreamInterceptor))...)
+	pb.RegisterFileServiceServer(d.grpcServer, d)
+
+	// Start serving each listener in separate goroutines: client, DataNode and master ports
+	for _, lis := range listeners {
+		go d.grpcServer.Serve(lis)
+	}
+	// tell the master I'm online
+	go d.sendHeartbeat()
+	go d.uploads.reapIdle(d.stopped)
+	go d.gossip()
+	go d.watchVolumes()
+	go d.scrub()
+	go d.purgeTrash()
+	go d.recountUsedBytes()
+	go d.expireReplicas()
+	go d.retryReplications()
+	go d.retryUploadNotices()
+	if httpListener != nil {
+		d.httpServer = &http.Server{Handler: d.httpHandler()}
+		go d.serveHTTP(httpListener)
+	}
+	return nil
+}
+
+/*
+Stop stops the DataNode at once, as if its process was killed: the master
+isn't told, the listeners are closed, calls in progress cut off and the
+background work ends
+*/
+func (d *DataNodeServer) Stop() {
+	d.stopOnce.Do(func() {
+		d.stopping.Store(true)
+		close(d.stopped)
+		if d.grpcServer != nil {
+			d.grpcServer.Stop()
+		}
+		if d.httpServer != nil {
+			d.httpServer.Close()
+		}
+	})
+}
+
+/*
+fail stops a DataNode that can't go on serving, such as one the master
+refuses: run by Main the process exits, started by Start the DataNode stops
+*/
+func (d *DataNodeServer) fail(err error) {
+	if d.exitOnFail {
+		log.Fatal(err)
+	}
+	log.Printf("DataNode %d stopping: %v", d.nodeID(), err)
+	d.Stop()
+}
+
+// sleep waits for wait, false when the DataNode stops meanwhile
+func (d *DataNodeServer) sleep(wait time.Duration) bool {
+	select {
+	case <-d.stopped:
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
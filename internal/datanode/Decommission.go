@@ -0,0 +1,88 @@
+package datanode
+
+import (
+	"context"
+	"log"
+	"os"
+	pb "proj/Services"
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// drainState is how far the drain of a decommissioned DataNode is, as the master last answered a heartbeat
+type drainState struct {
+	// files still short of replicas elsewhere, -1 until a heartbeat tells
+	remaining atomic.Int32
+	drained   atomic.Bool
+	draining  atomic.Bool
+}
+
+// drainMarker is the file recording drain mode next to the storage root, so a restart keeps draining
+func (d *DataNodeServer) drainMarker() string {
+	return d.storageDir() + ".draining"
+}
+
+// loadDrainMode resumes a drain started before a restart
+func (d *DataNodeServer) loadDrainMode() {
+	if _, err := os.Stat(d.drainMarker()); err == nil {
+		d.drain.remaining.Store(-1)
+		d.drain.draining.Store(true)
+		log.Printf("DataNode %d is draining to be decommissioned, it takes no new uploads", d.nodeID())
+	}
+}
+
+/*
+Decommission puts the DataNode in drain mode before it is shut down for
+good. It refuses new uploads and tells the master with its heartbeats; the
+master places no new data on it and its repair copies every file it holds
+to other nodes, sending them from this one. Called again it reports how far
+the drain is: safe_to_shutdown once the master found every file replicated
+elsewhere. Drain mode lasts across restarts until cancelled
+*/
+func (d *DataNodeServer) Decommission(ctx context.Context, in *pb.DecommissionRequest) (*pb.DecommissionResponse, error) {
+	if in.Cancel {
+		if d.drain.draining.CompareAndSwap(true, false) {
+			if err := os.Remove(d.drainMarker()); err != nil && !os.IsNotExist(err) {
+				log.Printf("removing the drain marker fail %v", err)
+			}
+			log.Printf("DataNode %d left drain mode, it takes uploads again", d.nodeID())
+		}
+	} else if !d.drain.draining.Load() {
+		if err := os.WriteFile(d.drainMarker(), nil, 0644); err != nil {
+			return nil, status.Errorf(codes.Internal, "recording drain mode failed: %v", err)
+		}
+		d.drain.remaining.Store(-1)
+		d.drain.drained.Store(false)
+		d.drain.draining.Store(true)
+		log.Printf("DataNode %d is draining to be decommissioned, it takes no new uploads", d.nodeID())
+	}
+	draining := d.drain.draining.Load()
+	response := &pb.DecommissionResponse{Draining: draining}
+	if draining {
+		response.FilesRemaining = d.drain.remaining.Load()
+		response.SafeToShutdown = d.drain.drained.Load()
+	}
+	return response, nil
+}
+
+// noteDrain keeps what the master answered a heartbeat sent while draining
+func (d *DataNodeServer) noteDrain(response *pb.KeepAliveResponse) {
+	if !d.drain.draining.Load() {
+		return
+	}
+	if response.Drained && !d.drain.drained.Load() {
+		log.Printf("DataNode %d is drained, every file it holds is replicated elsewhere: it is safe to shut down", d.nodeID())
+	}
+	d.drain.remaining.Store(response.UndrainedFiles)
+	d.drain.drained.Store(response.Drained)
+}
+
+// refuseDraining is the error of an upload to a draining DataNode, the client moves on to its next target
+func (d *DataNodeServer) refuseDraining() error {
+	if d.drain.draining.Load() {
+		return status.Errorf(codes.FailedPrecondition, "DataNode %d is draining to be decommissioned, it takes no new uploads", d.nodeID())
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package datanode
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"proj/internal/fsutil"
+	"strings"
+	"sync"
+)
+
+// directory of every data directory holding the blobs of deduplicated files, a reserved name
+const blobDir = ".dfs-blobs"
+
+/*
+blobIndex maps the names of deduplicated files to the checksum of their
+content, the name of the blob they are hard links to, and counts the names
+of every blob so the last one going removes it. It's persisted next to the
+storage root like the replica index
+*/
+type blobIndex struct {
+	mutex  sync.Mutex
+	hashes map[string]string
+	refs   map[string]int
+	path   string
+}
+
+func (d *DataNodeServer) loadBlobIndex() {
+	d.blobs = &blobIndex{hashes: make(map[string]string), refs: make(map[string]int), path: d.storageDir() + ".blobs.json"}
+	content, err := os.ReadFile(d.blobs.path)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(content, &d.blobs.hashes); err != nil {
+		log.Printf("bad blob index %s: %v", d.blobs.path, err)
+	}
+	for _, hash := range d.blobs.hashes {
+		d.blobs.refs[hash]++
+	}
+}
+
+/*
+set links fileName to the blob hash, or unlinks it when hash is empty. It
+returns the blob fileName was linked to when no name is left linked to it
+*/
+func (index *blobIndex) set(fileName, hash string) string {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	old, linked := index.hashes[fileName]
+	if old == hash {
+		return ""
+	}
+	if hash == "" {
+		delete(index.hashes, fileName)
+	} else {
+		index.hashes[fileName] = hash
+		index.refs[hash]++
+	}
+	released := ""
+	if linked {
+		if index.refs[old]--; index.refs[old] <= 0 {
+			delete(index.refs, old)
+			released = old
+		}
+	}
+	index.save()
+	return released
+}
+
+// move keeps the blob of a renamed file
+func (index *blobIndex) move(from, to string) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	if hash, ok := index.hashes[from]; ok {
+		delete(index.hashes, from)
+		index.hashes[to] = hash
+		index.save()
+	}
+}
+
+func (index *blobIndex) get(fileName string) (string, bool) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	hash, ok := index.hashes[fileName]
+	return hash, ok
+}
+
+// save writes the index, must be called with the mutex held
+func (index *blobIndex) save() {
+	content, err := json.Marshal(index.hashes)
+	if err == nil {
+		err = fsutil.WriteFileAtomic(index.path, content, 0644)
+	}
+	if err != nil {
+		log.Printf("saving blob index fail %v", err)
+	}
+}
+
+func blobPath(root, hash string) string {
+	return filepath.Join(root, blobDir, hash[:2], hash)
+}
+
+// isBlobPath tells whether the relative path lies in the blob directory
+func isBlobPath(relative string) bool {
+	first, _, _ := strings.Cut(filepath.ToSlash(relative), "/")
+	return first == blobDir
+}
+
+/*
+deduplicate is called once a file is committed at savePath. With
+Deduplicate set, a file whose content a blob already holds is replaced by a
+hard link to the blob, and one with new content becomes the blob of its
+content, so identical files take space once whatever their names. The
+content is the file as stored, compressed and encrypted files being
+deduplicated by their content too. Without it the file is just unlinked from
+the blob it replaced, if any
+*/
+func (d *DataNodeServer) deduplicate(savePath, fileName string) {
+	if !d.Deduplicate {
+		d.forgetBlob(fileName)
+		return
+	}
+	info, err := os.Stat(savePath)
+	if err != nil {
+		return
+	}
+	hash, _, err := d.checksums.get(savePath)
+	if err != nil {
+		log.Printf("Checksum of %s failed, not deduplicating it: %v", savePath, err)
+		d.forgetBlob(fileName)
+		return
+	}
+	d.blobMutex.Lock()
+	defer d.blobMutex.Unlock()
+	// replaced or removed meanwhile, the new content is deduplicated when it's committed
+	if current, err := os.Stat(savePath); err != nil || !os.SameFile(info, current) {
+		return
+	}
+	if !d.linkBlob(savePath, hash) {
+		hash = ""
+	}
+	d.releaseBlob(d.blobs.set(fileName, hash))
+}
+
+// forgetBlob unlinks a removed or replaced file from its blob
+func (d *DataNodeServer) forgetBlob(fileName string) {
+	d.blobMutex.Lock()
+	defer d.blobMutex.Unlock()
+	d.releaseBlob(d.blobs.set(fileName, ""))
+}
+
+// linkBlob makes savePath and the blob of hash one file, must be called with blobMutex held
+func (d *DataNodeServer) linkBlob(savePath, hash string) bool {
+	blob := blobPath(d.volumeRoot(savePath), hash)
+	if err := d.mkdirStored(filepath.Dir(blob)); err != nil {
+		log.Printf("error creating blob dir: %v", err)
+		return false
+	}
+	// new content, the file becomes the blob
+	err := os.Link(savePath, blob)
+	if err == nil {
+		return true
+	}
+	if !os.IsExist(err) {
+		log.Printf("storing %s as a blob failed: %v", savePath, err)
+		return false
+	}
+	existing, err := os.Stat(blob)
+	if err != nil {
+		return false
+	}
+	if info, err := os.Stat(savePath); err == nil && os.SameFile(info, existing) {
+		return true
+	}
+	// the link replaces the file in one rename, readers see either copy
+	link := stagedPath(savePath, newSessionID())
+	if err := os.Link(blob, link); err != nil {
+		log.Printf("linking %s to its blob failed: %v", savePath, err)
+		return false
+	}
+	size := fileBytes(savePath)
+	if err := os.Rename(link, savePath); err != nil {
+		os.Remove(link)
+		log.Printf("linking %s to its blob failed: %v", savePath, err)
+		return false
+	}
+	// the blob counts for the file from now on
+	d.used.Add(-size)
+	d.checksums.set(savePath, hash)
+	log.Printf("%s has the content of an existing file, stored once", savePath)
+	return true
+}
+
+// releaseBlob removes the blob of hash once no file is linked to it, must be called with blobMutex held
+func (d *DataNodeServer) releaseBlob(hash string) {
+	if hash == "" {
+		return
+	}
+	for _, dir := range d.volumeDirs() {
+		blob := blobPath(dir, hash)
+		size := fileBytes(blob)
+		if err := os.Remove(blob); err == nil {
+			d.used.Add(-size)
+			d.checksums.forget(blob)
+			os.Remove(filepath.Dir(blob))
+		}
+	}
+}
+
+// dropBlob stops new files from being linked to the blob of fileName, whose content was found corrupt
+func (d *DataNodeServer) dropBlob(fileName string) {
+	hash, ok := d.blobs.get(fileName)
+	if !ok {
+		return
+	}
+	d.blobMutex.Lock()
+	defer d.blobMutex.Unlock()
+	for _, dir := range d.volumeDirs() {
+		blob := blobPath(dir, hash)
+		size := fileBytes(blob)
+		if err := os.Remove(blob); err == nil {
+			d.used.Add(-size)
+			log.Printf("dropped the corrupt blob %s of %s", hash, fileName)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package datanode
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// UDP port the master answers discovery broadcasts on
+	discoveryPort     = 50070
+	discoveryRequest  = "DFS-DISCOVER"
+	discoveryResponse = "DFS-MASTER "
+	discoveryAttempts = 5
+)
+
+/*
+Finds the master by broadcasting "DFS-DISCOVER" on the LAN and waiting for
+its "DFS-MASTER <port>" reply. The request goes out as an IPv4 broadcast and
+to the IPv6 all-nodes group of every interface, so IPv6-only LANs find the
+master too. Returns the master address and false when no master answered
+*/
+func discoverMaster() (string, bool) {
+	found := make(chan string, 1)
+	var conns []*net.UDPConn
+	for _, network := range []string{"udp4", "udp6"} {
+		conn, err := net.ListenUDP(network, nil)
+		if err != nil {
+			log.Printf("discovery %s listen fail: %v", network, err)
+			continue
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+		go awaitMaster(conn, found)
+	}
+	if len(conns) == 0 {
+		return "", false
+	}
+
+	for attempt := 0; attempt < discoveryAttempts; attempt++ {
+		sent := false
+		for _, conn := range conns {
+			for _, target := range discoveryTargets(conn) {
+				if _, err := conn.WriteToUDP([]byte(discoveryRequest), target); err == nil {
+					sent = true
+				}
+			}
+		}
+		if !sent {
+			log.Printf("discovery broadcast fail: no network to send it on")
+			return "", false
+		}
+		select {
+		case addr := <-found:
+			return addr, true
+		case <-time.After(time.Second):
+			// timed out, broadcast again
+		}
+	}
+	return "", false
+}
+
+// discoveryTargets are where a discovery request goes from conn: the IPv4 broadcast, or the IPv6 all-nodes group of each interface
+func discoveryTargets(conn *net.UDPConn) []*net.UDPAddr {
+	if conn.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		return []*net.UDPAddr{{IP: net.IPv4bcast, Port: discoveryPort}}
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var targets []*net.UDPAddr
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 {
+			targets = append(targets, &net.UDPAddr{IP: net.IPv6linklocalallnodes, Port: discoveryPort, Zone: iface.Name})
+		}
+	}
+	return targets
+}
+
+/*
+dialTarget escapes the zone of a link-local IPv6 address, as in
+"[fe80::1%eth0]:50061", for gRPC parsing dial targets as URLs
+*/
+func dialTarget(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || !strings.Contains(host, "%") || strings.Contains(host, "%25") {
+		return addr
+	}
+	return net.JoinHostPort(strings.Replace(host, "%", "%25", 1), port)
+}
+
+// awaitMaster reads the replies arriving on conn until it is closed, passing on the first master address
+func awaitMaster(conn *net.UDPConn, found chan<- string) {
+	buf := make([]byte, 64)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		port, ok := strings.CutPrefix(string(buf[:n]), discoveryResponse)
+		if !ok || !strings.HasPrefix(port, ":") {
+			continue
+		}
+		host := from.IP.String()
+		// a link-local master is only reachable through the interface it answered on
+		if from.Zone != "" {
+			host += "%" + from.Zone
+		}
+		select {
+		case found <- net.JoinHostPort(host, port[1:]):
+		default:
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package datanode
+
+// diskSpace is unknown on this platform, only MaxBytes caps the DataNode
+func diskSpace(dir string) (free, total int64, ok bool) {
+	return 0, 0, false
+}
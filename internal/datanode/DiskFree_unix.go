@@ -0,0 +1,14 @@
+//go:build unix
+
+package datanode
+
+import "syscall"
+
+// diskSpace returns the bytes available to unprivileged users and the size of the volume holding dir
+func diskSpace(dir string) (free, total int64, ok bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, 0, false
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), int64(stat.Blocks) * int64(stat.Bsize), true
+}
@@ -0,0 +1,38 @@
+package datanode
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+/*
+Uploads are always synced before they're acknowledged, while the directory
+entries of the rename committing them and of the directories created for
+them are flushed on a best effort basis. A synced commit, configured with
+SyncUploads or asked for by an upload with the "sync-upload" metadata,
+flushes those as well and fails the upload when it can't, so an acknowledged
+upload survives a power loss
+*/
+
+// syncRequested reports whether the upload of a call must be committed synced
+func (d *DataNodeServer) syncRequested(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return d.SyncUploads || strings.Join(md.Get("sync-upload"), "") == "true"
+}
+
+// syncParents flushes the directory of savePath and its parents up to its data directory
+func (d *DataNodeServer) syncParents(savePath string) error {
+	root := d.volumeRoot(savePath)
+	for dir := filepath.Dir(savePath); ; dir = filepath.Dir(dir) {
+		if err := syncDir(dir); err != nil {
+			return fmt.Errorf("flushing %s failed: %v", dir, err)
+		}
+		if dir == root || filepath.Dir(dir) == dir {
+			return nil
+		}
+	}
+}
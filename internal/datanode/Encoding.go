@@ -0,0 +1,232 @@
+package datanode
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"proj/internal/fsutil"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the only content encoding files may be stored with
+const gzipEncoding = "gzip"
+
+// encodingsFile records which stored files are encoded, next to the storage
+// root like the sessions file
+func (d *DataNodeServer) encodingsFile() string {
+	return d.storageDir() + ".encodings.json"
+}
+
+func (d *DataNodeServer) loadEncodings() {
+	d.encodings = make(map[string]string)
+	content, err := os.ReadFile(d.encodingsFile())
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(content, &d.encodings); err != nil {
+		log.Printf("bad encodings file %s: %v", d.encodingsFile(), err)
+	}
+}
+
+func checkEncoding(encoding string) error {
+	if encoding != "" && encoding != gzipEncoding {
+		return status.Errorf(codes.InvalidArgument, "unsupported content encoding %q", encoding)
+	}
+	return nil
+}
+
+// setEncoding records the content encoding of a stored file, "" for plain data
+func (d *DataNodeServer) setEncoding(fileName, encoding string) {
+	d.encodingsMutex.Lock()
+	defer d.encodingsMutex.Unlock()
+	if d.encodings[fileName] == encoding {
+		return
+	}
+	if encoding == "" {
+		delete(d.encodings, fileName)
+	} else {
+		d.encodings[fileName] = encoding
+	}
+	content, err := json.Marshal(d.encodings)
+	if err == nil {
+		err = fsutil.WriteFileAtomic(d.encodingsFile(), content, 0644)
+	}
+	if err != nil {
+		log.Printf("saving encodings fail %v", err)
+	}
+}
+
+func (d *DataNodeServer) storedEncoding(fileName string) string {
+	d.encodingsMutex.Lock()
+	defer d.encodingsMutex.Unlock()
+	return d.encodings[fileName]
+}
+
+/*
+encodeStaged is called on a staged upload about to be committed with the
+encoding it was sent with. Plain data is stored gzipped when it extends a
+gzip file, or when the DataNode is configured with "Compression": "gzip" and
+compressing shrinks it. It returns the staged file to commit, the staged
+upload is removed when it was replaced or on error, and its encoding
+*/
+func (d *DataNodeServer) encodeStaged(staged, encoding string, base *appendBase) (string, string, error) {
+	if encoding != "" {
+		return staged, encoding, nil
+	}
+	switch {
+	case base != nil && base.Encoding == gzipEncoding:
+		compressed, _, err := d.compressStaged(staged, base.Size, true)
+		return compressed, gzipEncoding, err
+	case base == nil && d.Compression == gzipEncoding:
+		compressed, shrunk, err := d.compressStaged(staged, 0, false)
+		if shrunk {
+			return compressed, gzipEncoding, err
+		}
+		return compressed, "", err
+	}
+	return staged, "", nil
+}
+
+/*
+compressStaged writes a copy of a staged file whose bytes past offset are
+gzipped into one member, the first offset bytes being copied as they are.
+Unless always is set, the staged file is kept when the copy isn't smaller.
+It returns the file to commit and whether it is the compressed copy
+*/
+func (d *DataNodeServer) compressStaged(staged string, offset int64, always bool) (string, bool, error) {
+	source, err := os.Open(staged)
+	if err != nil {
+		os.Remove(staged)
+		return "", false, fmt.Errorf("error compressing upload: %v", err)
+	}
+	defer source.Close()
+	path := stagedPath(stagedTarget(staged), newSessionID())
+	compressed, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, d.permissions.fileMode)
+	if err != nil {
+		os.Remove(staged)
+		return "", false, fmt.Errorf("error compressing upload: %v", err)
+	}
+	_, err = io.CopyN(compressed, source, offset)
+	if err == nil {
+		writer := gzip.NewWriter(compressed)
+		if _, err = io.Copy(writer, source); err == nil {
+			err = writer.Close()
+		}
+	}
+	if err == nil {
+		err = d.applyPermissions(path, d.permissions.fileMode)
+	}
+	if err == nil && !always {
+		if sourceInfo, statErr := source.Stat(); statErr == nil {
+			if info, statErr := compressed.Stat(); statErr == nil && info.Size() >= sourceInfo.Size() {
+				compressed.Close()
+				os.Remove(path)
+				return staged, false, nil
+			}
+		}
+	}
+	if err == nil {
+		err = d.faults.SyncFile(compressed)
+	}
+	compressed.Close()
+	os.Remove(staged)
+	if err != nil {
+		os.Remove(path)
+		return "", false, fmt.Errorf("error compressing upload: %v", err)
+	}
+	return path, true, nil
+}
+
+// accepts reports whether an Accept-Encoding style list ("gzip, br;q=0.5") allows encoding
+func accepts(acceptEncoding, encoding string) bool {
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		if name != encoding && name != "*" {
+			continue
+		}
+		return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+	}
+	return false
+}
+
+// decodedFile reads a stored encoded file decoded, closing both layers on Close
+type decodedFile struct {
+	io.Reader
+	decoder *gzip.Reader
+	file    *storedFile
+}
+
+func (f *decodedFile) Close() error {
+	f.decoder.Close()
+	return f.file.Close()
+}
+
+/*
+Opens a stored file for a reader accepting the acceptEncoding list. Encoded
+data goes out raw when the reader accepts its encoding, which is returned to
+be announced, and is decoded on the fly otherwise. A lost replica is first
+restored from a peer
+*/
+func (d *DataNodeServer) openForReader(ctx context.Context, fileName, acceptEncoding string) (io.ReadCloser, string, error) {
+	filePath, err := d.storagePath(fileName)
+	if err != nil {
+		return nil, "", err
+	}
+	d.restoreLost(ctx, fileName)
+	return d.openEncoded(filePath, fileName, d.storedEncoding(fileName), acceptEncoding)
+}
+
+// openEncoded opens the stored file at filePath, holding fileName in encoding, like openForReader
+func (d *DataNodeServer) openEncoded(filePath, fileName, encoding, acceptEncoding string) (io.ReadCloser, string, error) {
+	file, err := d.openCached(filePath)
+	if err != nil {
+		return nil, "", fmt.Errorf("Open fail %v", err)
+	}
+	if encoding == "" || accepts(acceptEncoding, encoding) {
+		return file, encoding, nil
+	}
+	decoder, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, "", fmt.Errorf("decoding %s fail %v", fileName, err)
+	}
+	return &decodedFile{Reader: decoder, decoder: decoder, file: file}, "", nil
+}
+
+/*
+selectRange narrows a download to length bytes from offset, the rest of the
+file when length is 0. A stored file is read from the offset directly, one
+decoded on the fly has to be read up to it
+*/
+func selectRange(reader io.ReadCloser, offset, length int64) (io.Reader, error) {
+	if offset < 0 || length < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "bad range: offset %d, length %d", offset, length)
+	}
+	if file, raw := reader.(*storedFile); raw {
+		if offset > file.Size() {
+			return nil, status.Errorf(codes.OutOfRange, "offset %d past the %d bytes of the file", offset, file.Size())
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("error seeking to offset %d: %v", offset, err)
+		}
+	} else if offset > 0 {
+		skipped, err := io.CopyN(io.Discard, reader, offset)
+		if err == io.EOF {
+			return nil, status.Errorf(codes.OutOfRange, "offset %d past the %d bytes of the file", offset, skipped)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Read fail %v", err)
+		}
+	}
+	if length > 0 {
+		return io.LimitReader(reader, length), nil
+	}
+	return reader, nil
+}
@@ -0,0 +1,343 @@
+package datanode
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// environment variable holding the encryption key when EncryptionKey isn't set
+	encryptionKeyEnv = "DFS_ENCRYPTION_KEY"
+	// plaintext bytes sealed together, the unit a range read decrypts
+	sealedSegment = 64 * 1024
+	// magic, key ID and nonce prefix
+	sealedHeaderSize = 24
+	// GCM tag added to every segment
+	sealedOverhead = 16
+)
+
+var sealedMagic = []byte("DFSSEAL1")
+
+/*
+sealer encrypts stored files with AES-256-GCM under the DataNode's own key,
+so the data on a lost or stolen disk is unreadable. A sealed file starts
+with a header (magic, an ID of the key, a random nonce prefix) followed by
+the content in segments of 64KB sealed one by one, the nonce being the
+prefix and the segment's number and the last segment being marked as such,
+so segments can't be reordered or cut off unnoticed. A nil sealer leaves new
+files plain and can't read sealed ones
+*/
+type sealer struct {
+	aead  cipher.AEAD
+	keyID []byte
+}
+
+/*
+newSealer makes the sealer of the key in config or in DFS_ENCRYPTION_KEY,
+64 hex digits or base64, nil when there's none
+*/
+func newSealer(configured string) (*sealer, error) {
+	encoded := strings.TrimSpace(configured)
+	if encoded == "" {
+		encoded = strings.TrimSpace(os.Getenv(encryptionKeyEnv))
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		if key, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, errors.New("the encryption key must be 32 bytes in hex or base64")
+		}
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("the encryption key must be 32 bytes, not %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256(append([]byte("dfs key id"), key...))
+	return &sealer{aead: aead, keyID: id[:8]}, nil
+}
+
+func (s *sealer) nonce(header []byte, segment int64) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, header[16:24])
+	binary.BigEndian.PutUint32(nonce[8:], uint32(segment))
+	return nonce
+}
+
+// additionalData binds a segment to the file's header and tells whether it is the last
+func additionalData(header []byte, last bool) []byte {
+	data := append([]byte{}, header...)
+	if last {
+		return append(data, 1)
+	}
+	return append(data, 0)
+}
+
+/*
+sealStaged replaces a staged upload about to be committed with a sealed
+copy when the DataNode has a key. It returns the staged file to commit, the
+plain one being removed when it was replaced or on error
+*/
+func (d *DataNodeServer) sealStaged(staged string) (string, error) {
+	if d.sealer == nil {
+		return staged, nil
+	}
+	plain, err := os.Open(staged)
+	if err != nil {
+		os.Remove(staged)
+		return "", fmt.Errorf("error encrypting upload: %v", err)
+	}
+	defer plain.Close()
+	path := stagedPath(stagedTarget(staged), newSessionID())
+	sealed, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, d.permissions.fileMode)
+	if err != nil {
+		os.Remove(staged)
+		return "", fmt.Errorf("error encrypting upload: %v", err)
+	}
+	err = d.sealer.seal(sealed, plain)
+	if err == nil {
+		err = d.applyPermissions(path, d.permissions.fileMode)
+	}
+	if err == nil {
+		err = d.faults.SyncFile(sealed)
+	}
+	sealed.Close()
+	os.Remove(staged)
+	if err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("error encrypting upload: %v", err)
+	}
+	return path, nil
+}
+
+// seal writes the plain file sealed to out
+func (s *sealer) seal(out io.Writer, plain *os.File) error {
+	info, err := plain.Stat()
+	if err != nil {
+		return err
+	}
+	header := make([]byte, sealedHeaderSize)
+	copy(header, sealedMagic)
+	copy(header[8:], s.keyID)
+	if _, err := rand.Read(header[16:]); err != nil {
+		return err
+	}
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+	// an empty file still has a last segment, telling it wasn't cut off
+	segments := max((info.Size()+sealedSegment-1)/sealedSegment, 1)
+	if segments > 1<<32 {
+		return errors.New("file too large to encrypt")
+	}
+	buf := make([]byte, sealedSegment)
+	var sealed []byte
+	for segment := int64(0); segment < segments; segment++ {
+		n, err := io.ReadFull(plain, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		sealed = s.aead.Seal(sealed[:0], s.nonce(header, segment), buf[:n], additionalData(header, segment == segments-1))
+		if _, err := out.Write(sealed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+storedFile is a stored file opened for reading, decrypted as it is read when
+it is sealed. Offsets and the size are those of the content, not of the
+bytes on disk. It isn't safe for concurrent use. The file isn't embedded,
+its WriteTo would let io.Copy read the bytes on disk
+*/
+type storedFile struct {
+	raw  *os.File
+	size int64
+	// nil for a plain file
+	sealer   *sealer
+	header   []byte
+	physical int64
+	position int64
+	// the last segment decrypted
+	segment int64
+	plain   []byte
+	// the content kept by the read cache, read instead of the file when set
+	cached *bytes.Reader
+}
+
+// sealedSize is the size of the content of a sealed file of physical bytes
+func sealedSize(physical int64) int64 {
+	body := physical - sealedHeaderSize
+	segments := (body + sealedSegment + sealedOverhead - 1) / (sealedSegment + sealedOverhead)
+	return body - segments*sealedOverhead
+}
+
+// isSealed tells whether header starts a sealed file
+func isSealed(header []byte) bool {
+	return len(header) >= len(sealedMagic) && bytes.Equal(header[:len(sealedMagic)], sealedMagic)
+}
+
+// openStored opens the stored file at path for reading, see storedFile
+func (d *DataNodeServer) openStored(path string) (*storedFile, error) {
+	return d.sealer.open(path)
+}
+
+// open opens the stored file at path for reading, a nil sealer opens plain files only
+func (s *sealer) open(path string) (*storedFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	stored := &storedFile{raw: file, size: info.Size(), segment: -1}
+	header := make([]byte, sealedHeaderSize)
+	if n, _ := file.ReadAt(header, 0); n < sealedHeaderSize || !isSealed(header) {
+		return stored, nil
+	}
+	if s == nil || !bytes.Equal(header[8:16], s.keyID) {
+		file.Close()
+		return nil, fmt.Errorf("%s is encrypted with a key this DataNode doesn't have", path)
+	}
+	stored.sealer, stored.header, stored.physical = s, header, info.Size()
+	stored.size = sealedSize(info.Size())
+	return stored, nil
+}
+
+// storedSize is the size of the content of the stored file at path, described by info
+func storedSize(path string, info os.FileInfo) int64 {
+	if info.Size() < sealedHeaderSize+sealedOverhead {
+		return info.Size()
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return info.Size()
+	}
+	defer file.Close()
+	magic := make([]byte, len(sealedMagic))
+	if _, err := io.ReadFull(file, magic); err != nil || !isSealed(magic) {
+		return info.Size()
+	}
+	return sealedSize(info.Size())
+}
+
+// readStored returns the content of the stored file at path
+func (d *DataNodeServer) readStored(path string) ([]byte, error) {
+	file, err := d.openStored(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// Size returns the size of the content
+func (f *storedFile) Size() int64 {
+	return f.size
+}
+
+func (f *storedFile) Close() error {
+	return f.raw.Close()
+}
+
+func (f *storedFile) Read(p []byte) (int, error) {
+	if f.cached != nil {
+		return f.cached.Read(p)
+	}
+	if f.sealer == nil {
+		return f.raw.Read(p)
+	}
+	n, err := f.ReadAt(p, f.position)
+	f.position += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *storedFile) Seek(offset int64, whence int) (int64, error) {
+	if f.cached != nil {
+		return f.cached.Seek(offset, whence)
+	}
+	if f.sealer == nil {
+		return f.raw.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.position
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the file")
+	}
+	f.position = offset
+	return offset, nil
+}
+
+func (f *storedFile) ReadAt(p []byte, offset int64) (int, error) {
+	if f.cached != nil {
+		return f.cached.ReadAt(p, offset)
+	}
+	if f.sealer == nil {
+		return f.raw.ReadAt(p, offset)
+	}
+	read := 0
+	for read < len(p) {
+		if offset >= f.size {
+			return read, io.EOF
+		}
+		segment := offset / sealedSegment
+		if err := f.decrypt(segment); err != nil {
+			return read, err
+		}
+		n := copy(p[read:], f.plain[offset-segment*sealedSegment:])
+		read += n
+		offset += int64(n)
+	}
+	return read, nil
+}
+
+// decrypt reads and opens segment into f.plain, failing when it was altered
+func (f *storedFile) decrypt(segment int64) error {
+	if f.segment == segment {
+		return nil
+	}
+	start := sealedHeaderSize + segment*(sealedSegment+sealedOverhead)
+	length := min(sealedSegment+sealedOverhead, f.physical-start)
+	sealed := make([]byte, length)
+	if _, err := f.raw.ReadAt(sealed, start); err != nil && err != io.EOF {
+		return err
+	}
+	last := start+length == f.physical
+	plain, err := f.sealer.aead.Open(f.plain[:0], f.sealer.nonce(f.header, segment), sealed, additionalData(f.header, last))
+	if err != nil {
+		f.segment = -1
+		return fmt.Errorf("segment %d of %s fails authentication, the stored data was altered", segment, f.raw.Name())
+	}
+	f.plain, f.segment = plain, segment
+	return nil
+}
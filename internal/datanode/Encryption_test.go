@@ -0,0 +1,206 @@
+package datanode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func TestNewSealer(t *testing.T) {
+	raw := make([]byte, 32)
+	for i := range raw {
+		raw[i] = byte(i)
+	}
+	tests := []struct {
+		name   string
+		key    string
+		sealer bool
+		fails  bool
+	}{
+		{"no key", "", false, false},
+		{"hex", testKey, true, false},
+		{"base64", base64.StdEncoding.EncodeToString(raw), true, false},
+		{"surrounding space", " " + testKey + "\n", true, false},
+		{"short", testKey[:32], false, true},
+		{"neither hex nor base64", strings.Repeat("z", 64), false, true},
+	}
+	t.Setenv(encryptionKeyEnv, "")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := newSealer(test.key)
+			if (err != nil) != test.fails {
+				t.Fatalf("newSealer() error %v, want failure %v", err, test.fails)
+			}
+			if (s != nil) != test.sealer {
+				t.Errorf("newSealer() = %v, want a sealer %v", s, test.sealer)
+			}
+		})
+	}
+	// hex and base64 of the same key are the same key
+	hexSealer, _ := newSealer(testKey)
+	base64Sealer, _ := newSealer(base64.StdEncoding.EncodeToString(raw))
+	if !bytes.Equal(hexSealer.keyID, base64Sealer.keyID) {
+		t.Error("the key's hex and base64 forms have different IDs")
+	}
+}
+
+// sealFile seals content into a file in dir and returns its path
+func sealFile(t *testing.T, s *sealer, dir string, content []byte) string {
+	plainPath := filepath.Join(dir, "plain")
+	if err := os.WriteFile(plainPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := os.Open(plainPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	var sealed bytes.Buffer
+	if err := s.seal(&sealed, plain); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "sealed")
+	if err := os.WriteFile(path, sealed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	s, err := newSealer(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, sealedSegment - 1, sealedSegment, sealedSegment + 1, 3*sealedSegment + 5} {
+		content := make([]byte, size)
+		for i := range content {
+			content[i] = byte(i * 31)
+		}
+		path := sealFile(t, s, t.TempDir(), content)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := storedSize(path, info); got != int64(size) {
+			t.Errorf("storedSize() of %d bytes sealed = %d", size, got)
+		}
+
+		file, err := s.open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file.Size() != int64(size) {
+			t.Errorf("Size() of %d bytes sealed = %d", size, file.Size())
+		}
+		read, err := io.ReadAll(file)
+		if err != nil {
+			t.Errorf("reading %d bytes sealed: %v", size, err)
+		}
+		if !bytes.Equal(read, content) {
+			t.Errorf("read %d bytes back, not the %d sealed", len(read), size)
+		}
+		// a range across a segment boundary decrypts both segments
+		if size > sealedSegment+1 {
+			p := make([]byte, 20)
+			if _, err := file.ReadAt(p, sealedSegment-10); err != nil {
+				t.Errorf("ReadAt across segments of %d bytes: %v", size, err)
+			}
+			if !bytes.Equal(p, content[sealedSegment-10:sealedSegment+10]) {
+				t.Errorf("ReadAt across segments of %d bytes read the wrong bytes", size)
+			}
+		}
+		file.Close()
+	}
+}
+
+func TestSealedFileTampering(t *testing.T) {
+	s, err := newSealer(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("sealed segment "), 3*sealedSegment/15+1)
+	segmentBytes := sealedSegment + sealedOverhead
+	tests := []struct {
+		name   string
+		tamper func(sealed []byte) []byte
+	}{
+		{"byte flipped", func(sealed []byte) []byte {
+			sealed[sealedHeaderSize+segmentBytes+100] ^= 1
+			return sealed
+		}},
+		{"last segment cut off", func(sealed []byte) []byte {
+			last := sealedHeaderSize + (len(sealed)-sealedHeaderSize)/segmentBytes*segmentBytes
+			return sealed[:last]
+		}},
+		{"segments swapped", func(sealed []byte) []byte {
+			first := sealed[sealedHeaderSize : sealedHeaderSize+segmentBytes]
+			second := sealed[sealedHeaderSize+segmentBytes : sealedHeaderSize+2*segmentBytes]
+			swapped := append([]byte{}, sealed[:sealedHeaderSize]...)
+			swapped = append(swapped, second...)
+			swapped = append(swapped, first...)
+			return append(swapped, sealed[sealedHeaderSize+2*segmentBytes:]...)
+		}},
+		{"nonce changed", func(sealed []byte) []byte {
+			sealed[20] ^= 1
+			return sealed
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := sealFile(t, s, t.TempDir(), content)
+			sealed, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, test.tamper(sealed), 0644); err != nil {
+				t.Fatal(err)
+			}
+			file, err := s.open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			if _, err := io.ReadAll(file); err == nil {
+				t.Error("tampered file read without an error")
+			}
+		})
+	}
+}
+
+func TestSealedFileNeedsItsKey(t *testing.T) {
+	s, err := newSealer(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newSealer(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := sealFile(t, s, t.TempDir(), []byte("only for its key"))
+	if _, err := other.open(path); err == nil {
+		t.Error("opened with another key")
+	}
+	var none *sealer
+	if _, err := none.open(path); err == nil {
+		t.Error("opened without a key")
+	}
+	// without a key plain files still open
+	plain := filepath.Join(t.TempDir(), "plain")
+	if err := os.WriteFile(plain, []byte("plain"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := none.open(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if read, err := io.ReadAll(file); err != nil || string(read) != "plain" {
+		t.Errorf("plain file read as %q, %v", read, err)
+	}
+}
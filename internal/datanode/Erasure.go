@@ -0,0 +1,158 @@
+package datanode
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	pb "proj/Services"
+	"proj/internal/erasure"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// downloadReader reads the content of a StreamDownload
+type downloadReader struct {
+	stream  pb.FileService_StreamDownloadClient
+	pending []byte
+}
+
+func (r *downloadReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		chunk, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.pending = chunk.FileContent
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+/*
+RebuildBlock rebuilds a block of an erasure-6-3 file from six other blocks
+of its stripe, streamed from the DataNodes holding them a chunk at a time
+and decoded as they come, then stores it like a replica. The master asks
+when no copy of the block is left and learns of the new one from the upload
+notification
+*/
+func (d *DataNodeServer) RebuildBlock(ctx context.Context, req *pb.RebuildBlockRequest) (*pb.RebuildBlockResponse, error) {
+	if !d.fromCluster(ctx) {
+		return nil, status.Error(codes.PermissionDenied, "only the master asks for rebuilds")
+	}
+	if req.ClusterId != "" && d.cluster() != "" && req.ClusterId != d.cluster() {
+		return nil, status.Errorf(codes.FailedPrecondition, "DataNode %d belongs to cluster %s, not %s", d.nodeID(), d.cluster(), req.ClusterId)
+	}
+	if req.Shard < 0 || req.Shard >= erasure.Shards || req.Length <= 0 || req.Length > req.ShardBytes || req.DataBlocks <= 0 || req.DataBlocks > erasure.DataShards {
+		return nil, status.Errorf(codes.InvalidArgument, "shard %d of %d bytes can't be rebuilt from a stripe of %d data blocks of %d bytes", req.Shard, req.Length, req.DataBlocks, req.ShardBytes)
+	}
+	if err := d.checkFileSize(req.Length); err != nil {
+		return nil, err
+	}
+	if err := d.admit(req.Length); err != nil {
+		return nil, err
+	}
+	release, err := d.admitSession()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	d.activeTransfers.Add(1)
+	defer d.activeTransfers.Add(-1)
+
+	readers := make([]io.Reader, erasure.Shards)
+	lengths := make([]int64, erasure.Shards)
+	for _, source := range req.Sources {
+		if source.Shard < 0 || source.Shard >= erasure.Shards || source.Shard == req.Shard || readers[source.Shard] != nil || source.Length > req.ShardBytes {
+			return nil, status.Errorf(codes.InvalidArgument, "source %s can't be shard %d of the stripe", source.FileName, source.Shard)
+		}
+		conn, err := d.dialPeer(net.JoinHostPort(source.IpAddress, strconv.Itoa(int(source.PortNumber))))
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "could not reach the DataNode holding %s: %v", source.FileName, err)
+		}
+		defer conn.Close()
+		stream, err := pb.NewFileServiceClient(conn).StreamDownload(ctx, &pb.FileDownloadRequest{FileName: source.FileName})
+		if err != nil {
+			return nil, err
+		}
+		readers[source.Shard] = &downloadReader{stream: stream}
+		lengths[source.Shard] = source.Length
+	}
+
+	file, err := d.createStaged(req.FileName, newSessionID())
+	if err != nil {
+		return nil, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+	hash := sha256.New()
+	segment := int64(d.ChunkBytes)
+	buffers := make([][]byte, erasure.Shards)
+	// the data blocks a short last stripe lacks are zeros
+	zeros := make([]byte, segment)
+	for offset := int64(0); offset < req.Length; offset += segment {
+		n := min(segment, req.Length-offset)
+		shards := make([][]byte, erasure.Shards)
+		for i, reader := range readers {
+			switch {
+			case reader != nil:
+				if buffers[i] == nil {
+					buffers[i] = make([]byte, segment)
+				}
+				shards[i] = buffers[i][:n]
+				// a block shorter than the stripe's first is padded with zeros
+				read := min(max(lengths[i]-offset, 0), n)
+				if _, err := io.ReadFull(reader, shards[i][:read]); err != nil {
+					return nil, fmt.Errorf("reading shard %d of the stripe: %v", i, err)
+				}
+				clear(shards[i][read:])
+			case i >= int(req.DataBlocks) && i < erasure.DataShards:
+				shards[i] = zeros[:n]
+			}
+		}
+		if err := erasure.Reconstruct(shards); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "rebuilding %s: %v", req.FileName, err)
+		}
+		if _, err := file.Write(shards[req.Shard]); err != nil {
+			return nil, fmt.Errorf("error writing %s: %v", req.FileName, err)
+		}
+		hash.Write(shards[req.Shard])
+	}
+
+	if checksum := hex.EncodeToString(hash.Sum(nil)); req.Checksum != "" && checksum != req.Checksum {
+		return nil, checksumMismatch("rebuilt block "+req.FileName, checksum, req.Checksum)
+	}
+	if err := d.faults.SyncFile(file); err != nil {
+		return nil, fmt.Errorf("error syncing file: %v", err)
+	}
+	file.Close()
+	committed = true
+	staged, encoding, err := d.encodeStaged(file.Name(), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	savePath, err := d.commitStaged(staged, req.FileName, false)
+	if err != nil {
+		return nil, err
+	}
+	d.setEncoding(req.FileName, encoding)
+	if encoding == "" {
+		d.checksums.set(savePath, hex.EncodeToString(hash.Sum(nil)))
+	}
+	log.Printf("Rebuilt %s, %d bytes, from %d blocks of its stripe", req.FileName, req.Length, len(req.Sources))
+
+	go notifyMasterOfUpload(d, context.Background(), req.FileName, savePath, "", false)
+	return &pb.RebuildBlockResponse{}, nil
+}
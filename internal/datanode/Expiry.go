@@ -0,0 +1,46 @@
+package datanode
+
+import (
+	"context"
+	"log"
+	pb "proj/Services"
+	"time"
+)
+
+const (
+	// time between looks for expired replicas
+	expiryInterval = time.Minute
+	// how long past its expiry a replica is left to the master before the DataNode deletes it itself
+	expiryGrace = 5 * time.Minute
+)
+
+/*
+expireReplicas deletes the replicas of files past their expiry, which the
+master gives when it confirms an upload. The master deletes expired files
+itself; a replica still here a while later, because the master restarted and
+lost the file's record for instance, is deleted by the DataNode, cleared
+with the master like a client's delete so a hold still keeps it
+*/
+func (d *DataNodeServer) expireReplicas() {
+	for d.sleep(expiryInterval) {
+		deadline := time.Now().Add(-expiryGrace).UnixMilli()
+		for _, fileName := range d.replicaIndex.names() {
+			info, ok := d.replicaIndex.get(fileName)
+			if !ok || info.ExpiresUnixMs == 0 || info.ExpiresUnixMs > deadline || d.uploads.uploading(fileName) > 0 {
+				continue
+			}
+			filePath, err := d.storagePath(fileName)
+			if err != nil {
+				continue
+			}
+			if _, err := notifyMasterOfDelete(d, context.Background(), fileName, true); err != nil {
+				continue
+			}
+			if _, err := d.removeStored(filePath, &pb.FileDeleteRequest{FileName: fileName, DropVersions: true}); err != nil {
+				log.Printf("deleting the expired %s failed: %v", fileName, err)
+				continue
+			}
+			log.Printf("%s expired", fileName)
+		}
+	}
+}
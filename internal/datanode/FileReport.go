@@ -0,0 +1,144 @@
+package datanode
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	pb "proj/Services"
+	"time"
+)
+
+// time between full file reports when FileReportIntervalSeconds is 0
+const defaultFileReportInterval = 6 * time.Hour
+
+/*
+sendFileReport is called after each heartbeat. It sends the master the full
+inventory once the DataNode starts, when the master asks for it and every
+FileReportIntervalSeconds, so replicas removed by hand or lost with a disk
+are noticed; in between, the files added and removed since the previous
+report. Only one report is sent at a time
+*/
+func (d *DataNodeServer) sendFileReport(masterClient pb.FileServiceClient, asked bool) {
+	if !d.reporting.CompareAndSwap(false, true) {
+		return
+	}
+	defer d.reporting.Store(false)
+	interval := configTimeout(d.FileReportIntervalSeconds, defaultFileReportInterval)
+	if asked || d.lastFileReport.IsZero() || (interval > 0 && time.Since(d.lastFileReport) >= interval) {
+		if err := d.reportFiles(masterClient); err != nil {
+			log.Printf("Cannot report files %v", err)
+			return
+		}
+		d.lastFileReport = time.Now()
+		return
+	}
+	if err := d.reportChanges(masterClient); err != nil {
+		log.Printf("Cannot report file changes %v", err)
+	}
+}
+
+/*
+reportFiles sends the master the inventory of every file this DataNode
+holds, so the files written before a restart, of the DataNode or of the
+master which keeps its records in memory, are known again without waiting
+for something to touch them. Checksums the master confirmed are sent as
+confirmed, the others are computed once and cached
+*/
+func (d *DataNodeServer) reportFiles(masterClient pb.FileServiceClient) error {
+	ctx := context.Background()
+	// the inventory covers the changes made so far
+	changed := d.replicaIndex.takeChanged()
+	inventory, err := d.ListLocalFiles(ctx, &pb.ListLocalFilesRequest{})
+	if err != nil {
+		d.replicaIndex.markChanged(changed)
+		return err
+	}
+	held := make(map[string]bool)
+	for _, file := range inventory.Files {
+		d.reportedChecksum(file)
+		if isBlockName(file.FileName) {
+			held[file.FileName] = true
+			file.BlockOwner = d.blockIndex.get(file.FileName)
+		}
+	}
+	d.pruneBlockIndex(held)
+	response, err := masterClient.ReportFiles(d.withClusterSecret(ctx), &pb.ReportFilesRequest{DataNode: d.nodeID(), Files: inventory.Files})
+	if err != nil {
+		d.replicaIndex.markChanged(changed)
+		return fmt.Errorf("ReportFiles failed: %v", err)
+	}
+	d.blockIndex.set(response.BlockOwners)
+	log.Printf("reported %d files to the master: %d recovered, %d replicas added, %d stale, %d missing",
+		len(inventory.Files), response.Recovered, response.Added, response.Stale, response.Missing)
+	return nil
+}
+
+// reportChanges sends the master the files added, changed or removed since the previous report
+func (d *DataNodeServer) reportChanges(masterClient pb.FileServiceClient) error {
+	changed := d.replicaIndex.takeChanged()
+	if len(changed) == 0 {
+		return nil
+	}
+	request := &pb.ReportFilesRequest{DataNode: d.nodeID(), Incremental: true}
+	for _, fileName := range changed {
+		path, err := d.storagePath(fileName)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			request.Removed = append(request.Removed, fileName)
+			continue
+		}
+		file := d.localFile(fileName, path, info, false)
+		d.reportedChecksum(file)
+		if isBlockName(fileName) {
+			file.BlockOwner = d.blockIndex.get(fileName)
+		}
+		request.Files = append(request.Files, file)
+	}
+	response, err := masterClient.ReportFiles(d.withClusterSecret(context.Background()), request)
+	if err != nil {
+		d.replicaIndex.markChanged(changed)
+		return fmt.Errorf("ReportFiles failed: %v", err)
+	}
+	d.blockIndex.set(response.BlockOwners)
+	return nil
+}
+
+// reportedChecksum fills in the checksum of a reported file, the one the master confirmed or else computed
+func (d *DataNodeServer) reportedChecksum(file *pb.LocalFile) {
+	if replica, ok := d.replicaIndex.get(file.FileName); ok && replica.Checksum != "" {
+		file.Checksum = replica.Checksum
+		return
+	}
+	if file.Checksum != "" {
+		return
+	}
+	var err error
+	if file.Checksum, _, err = d.checksums.get(file.FilePath); err != nil {
+		log.Printf("Checksum of %s failed: %v", file.FilePath, err)
+	}
+}
+
+// takeChanged returns the names set since it was last called
+func (index *replicaIndex) takeChanged() []string {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	names := make([]string, 0, len(index.changed))
+	for fileName := range index.changed {
+		names = append(names, fileName)
+	}
+	clear(index.changed)
+	return names
+}
+
+// markChanged puts back names whose report failed
+func (index *replicaIndex) markChanged(names []string) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	for _, fileName := range names {
+		index.changed[fileName] = true
+	}
+}
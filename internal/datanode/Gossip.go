@@ -0,0 +1,371 @@
+package datanode
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	pb "proj/Services"
+	"proj/internal/fsutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// gossipBuckets is the fan-out of the Merkle tree compared between peers
+const gossipBuckets = 256
+
+// replicaInfo is what a DataNode knows of a replica it committed
+type replicaInfo struct {
+	Checksum   string `json:"Checksum"`
+	Generation int64  `json:"Generation"`
+	// when the file expires, Unix milliseconds, 0 never; see expireReplicas
+	ExpiresUnixMs int64 `json:"ExpiresUnixMs,omitempty"`
+}
+
+// replicaJournalLimit is how many changes are journaled before the replica index is written whole again
+const replicaJournalLimit = 1000
+
+/*
+replicaIndex records the checksum and the master's generation stamp of
+every committed replica, persisted next to the storage root like the
+encodings. Gossip compares it with peers to find stale replicas
+*/
+type replicaIndex struct {
+	mutex    sync.Mutex
+	replicas map[string]replicaInfo
+	path     string
+	// names set since the last file report, see reportChanges
+	changed map[string]bool
+	// changes since the index was last written whole, one line each, see set
+	journal   *os.File
+	journaled int
+}
+
+// replicaChange is a line of the replica journal, Info is nil for a forgotten replica
+type replicaChange struct {
+	FileName string       `json:"f"`
+	Info     *replicaInfo `json:"i,omitempty"`
+}
+
+func (d *DataNodeServer) loadReplicaIndex() {
+	d.replicaIndex = openReplicaIndex(d.storageDir() + ".replicas.json")
+}
+
+// openReplicaIndex reads the index kept in path and replays its journal
+func openReplicaIndex(path string) *replicaIndex {
+	index := &replicaIndex{replicas: make(map[string]replicaInfo), path: path, changed: make(map[string]bool)}
+	if content, err := os.ReadFile(index.path); err == nil {
+		if err := json.Unmarshal(content, &index.replicas); err != nil {
+			log.Printf("bad replica index %s: %v", index.path, err)
+		}
+	}
+	// the changes made after the index was last written whole
+	if content, err := os.ReadFile(index.journalPath()); err == nil {
+		for _, line := range bytes.Split(content, []byte("\n")) {
+			var entry replicaChange
+			// a line cut short by a crash is the last one, its change is lost
+			if len(line) == 0 || json.Unmarshal(line, &entry) != nil {
+				continue
+			}
+			if entry.Info == nil {
+				delete(index.replicas, entry.FileName)
+			} else {
+				index.replicas[entry.FileName] = *entry.Info
+			}
+		}
+	}
+	index.mutex.Lock()
+	index.compact()
+	index.mutex.Unlock()
+	return index
+}
+
+func (index *replicaIndex) journalPath() string {
+	return strings.TrimSuffix(index.path, ".json") + ".journal"
+}
+
+/*
+set records a replica, or forgets it when info is nil. The change is
+appended to the journal rather than the whole index being written on every
+commit and delete; the index is written whole every replicaJournalLimit
+changes
+*/
+func (index *replicaIndex) set(fileName string, info *replicaInfo) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	if info == nil {
+		if _, ok := index.replicas[fileName]; !ok {
+			return
+		}
+		delete(index.replicas, fileName)
+	} else {
+		index.replicas[fileName] = *info
+	}
+	index.changed[fileName] = true
+	if index.journal == nil || index.journaled >= replicaJournalLimit {
+		index.compact()
+		return
+	}
+	line, err := json.Marshal(replicaChange{FileName: fileName, Info: info})
+	if err == nil {
+		_, err = index.journal.Write(append(line, '\n'))
+	}
+	if err != nil {
+		log.Printf("journaling replica of %s fail %v", fileName, err)
+		index.compact()
+		return
+	}
+	index.journaled++
+}
+
+/*
+compact writes the whole index and starts an empty journal. The index is
+written first, so a crash in between leaves a journal whose changes it
+holds already. Must be called with the index mutex held
+*/
+func (index *replicaIndex) compact() {
+	content, err := json.Marshal(index.replicas)
+	if err == nil {
+		err = fsutil.WriteFileAtomic(index.path, content, 0644)
+	}
+	if err != nil {
+		log.Printf("saving replica index fail %v", err)
+		return
+	}
+	if index.journal != nil {
+		index.journal.Close()
+		index.journal = nil
+	}
+	journal, err := os.OpenFile(index.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("opening replica journal fail %v", err)
+		return
+	}
+	index.journal = journal
+	index.journaled = 0
+}
+
+// names returns the file names of the recorded replicas
+func (index *replicaIndex) names() []string {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	names := make([]string, 0, len(index.replicas))
+	for fileName := range index.replicas {
+		names = append(names, fileName)
+	}
+	return names
+}
+
+func (index *replicaIndex) get(fileName string) (replicaInfo, bool) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	info, ok := index.replicas[fileName]
+	return info, ok
+}
+
+func bucketOf(fileName string) int {
+	sum := sha256.Sum256([]byte(fileName))
+	return int(sum[0])
+}
+
+/*
+merkle returns the root and bucket hashes of the replicas, leaving out the
+files being uploaded. Each bucket hashes its sorted replicas' names,
+checksums and generations, the root hashes the buckets
+*/
+func (d *DataNodeServer) merkle() ([]byte, [][]byte, map[int][]*pb.GossipEntry) {
+	entries := make(map[int][]*pb.GossipEntry)
+	d.replicaIndex.mutex.Lock()
+	for fileName, info := range d.replicaIndex.replicas {
+		bucket := bucketOf(fileName)
+		entries[bucket] = append(entries[bucket], &pb.GossipEntry{FileName: fileName, Checksum: info.Checksum, Generation: info.Generation})
+	}
+	d.replicaIndex.mutex.Unlock()
+	for bucket, list := range entries {
+		kept := list[:0]
+		for _, entry := range list {
+			if d.uploads.uploading(entry.FileName) == 0 {
+				kept = append(kept, entry)
+			}
+		}
+		entries[bucket] = kept
+	}
+
+	buckets := make([][]byte, gossipBuckets)
+	root := sha256.New()
+	for i := range buckets {
+		list := entries[i]
+		sort.Slice(list, func(a, b int) bool { return list[a].FileName < list[b].FileName })
+		hash := sha256.New()
+		for _, entry := range list {
+			fmt.Fprintf(hash, "%s\x00%s\x00%d\x00", entry.FileName, entry.Checksum, entry.Generation)
+		}
+		buckets[i] = hash.Sum(nil)
+		root.Write(buckets[i])
+	}
+	return root.Sum(nil), buckets, entries
+}
+
+/*
+GossipDigest compares a peer's Merkle tree with this DataNode's, returning
+the replicas of the buckets that differ. The replica index is no one
+else's business, only DataNodes of the cluster ask
+*/
+func (d *DataNodeServer) GossipDigest(ctx context.Context, in *pb.GossipDigestRequest) (*pb.GossipDigestResponse, error) {
+	if !d.fromCluster(ctx) {
+		return nil, status.Error(codes.PermissionDenied, "only DataNodes of the cluster gossip")
+	}
+	root, buckets, entries := d.merkle()
+	response := &pb.GossipDigestResponse{}
+	if bytes.Equal(root, in.Root) || len(in.Buckets) != gossipBuckets {
+		return response, nil
+	}
+	for i, hash := range buckets {
+		if !bytes.Equal(hash, in.Buckets[i]) {
+			response.Entries = append(response.Entries, entries[i]...)
+		}
+	}
+	return response, nil
+}
+
+/*
+gossip exchanges Merkle summaries with a random peer every
+GossipIntervalSeconds. Replicas both hold that differ are repaired directly:
+when the peer's copy has a newer generation, it replaces this one. Replicas
+only one side holds are left to the master, which decides placement
+*/
+func (d *DataNodeServer) gossip() {
+	if d.GossipIntervalSeconds <= 0 {
+		return
+	}
+	for d.sleep(time.Duration(d.GossipIntervalSeconds) * time.Second) {
+		d.peersMutex.Lock()
+		peers := d.peers
+		d.peersMutex.Unlock()
+		if len(peers) == 0 {
+			continue
+		}
+		peer := peers[rand.Intn(len(peers))]
+		if err := d.gossipWith(peer); err != nil {
+			log.Printf("gossip with %s failed: %v", peer, err)
+		}
+	}
+}
+
+func (d *DataNodeServer) gossipWith(peer string) error {
+	conn, err := d.dialPeer(peer)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := pb.NewFileServiceClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), configTimeout(d.ReplicateTimeoutSeconds, defaultReplicateTimeout))
+	defer cancel()
+	root, buckets, _ := d.merkle()
+	response, err := client.GossipDigest(ctx, &pb.GossipDigestRequest{Root: root, Buckets: buckets})
+	if err != nil {
+		return err
+	}
+	for _, entry := range response.Entries {
+		ours, ok := d.replicaIndex.get(entry.FileName)
+		if !ok || ours.Checksum == entry.Checksum {
+			continue
+		}
+		switch {
+		case entry.Generation > ours.Generation:
+			if err := d.pullReplica(ctx, client, entry); err != nil {
+				log.Printf("repairing %s from %s failed: %v", entry.FileName, peer, err)
+			} else {
+				log.Printf("repaired stale replica of %s from %s (generation %d to %d)", entry.FileName, peer, ours.Generation, entry.Generation)
+			}
+		case entry.Generation == ours.Generation:
+			log.Printf("replicas of %s here and on %s differ at generation %d, leaving them to the master", entry.FileName, peer, ours.Generation)
+		}
+	}
+	return nil
+}
+
+// pullReplica replaces the local replica of entry with the peer's copy, verified against its checksum
+func (d *DataNodeServer) pullReplica(ctx context.Context, client pb.FileServiceClient, entry *pb.GossipEntry) error {
+	if _, err := d.storagePath(entry.FileName); err != nil {
+		return err
+	}
+	// stored bytes are fetched as they are, encoded or not
+	ctx = metadata.AppendToOutgoingContext(ctx, "accept-encoding", gzipEncoding)
+	stream, err := client.StreamDownload(ctx, &pb.FileDownloadRequest{FileName: entry.FileName})
+	if err != nil {
+		return err
+	}
+	tmp, err := d.createStaged(entry.FileName, newSessionID())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		tmp.Write(chunk.FileContent)
+		hash.Write(chunk.FileContent)
+	}
+	if checksum := hex.EncodeToString(hash.Sum(nil)); checksum != entry.Checksum {
+		tmp.Close()
+		return fmt.Errorf("received content has checksum %s, expected %s", checksum, entry.Checksum)
+	}
+	if err := d.faults.SyncFile(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	encoding := ""
+	if header, err := stream.Header(); err == nil {
+		encoding = strings.Join(header.Get("content-encoding"), "")
+	}
+	// a client started overwriting the file meanwhile, its upload wins
+	if d.uploads.uploading(entry.FileName) > 0 {
+		return fmt.Errorf("%s is being uploaded", entry.FileName)
+	}
+	savePath := stagedTarget(tmp.Name())
+	staged, err := d.sealStaged(tmp.Name())
+	if err != nil {
+		return err
+	}
+	previous, _ := d.replicaIndex.get(entry.FileName)
+	d.blobMutex.Lock()
+	// a lost replica restored is of the same generation, not an earlier version
+	if previous.Generation < entry.Generation {
+		d.keepVersion(savePath, entry.FileName, previous, d.storedEncoding(entry.FileName))
+	}
+	err = d.replaceStored(savePath, func() error { return os.Rename(staged, savePath) })
+	d.blobMutex.Unlock()
+	if err != nil {
+		os.Remove(staged)
+		return err
+	}
+	d.removeOtherCopies(savePath, entry.FileName)
+	d.applyPermissions(savePath, d.permissions.fileMode)
+	d.setEncoding(entry.FileName, encoding)
+	d.checksums.set(savePath, entry.Checksum)
+	d.deduplicate(savePath, entry.FileName)
+	d.replicaIndex.set(entry.FileName, &replicaInfo{Checksum: entry.Checksum, Generation: entry.Generation})
+	return nil
+}
@@ -0,0 +1,75 @@
+package datanode
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplicaIndexJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.replicas.json")
+	index := openReplicaIndex(path)
+	index.set("a.txt", &replicaInfo{Checksum: "aa", Generation: 1})
+	index.set("b.txt", &replicaInfo{Checksum: "bb", Generation: 2})
+	index.set("a.txt", &replicaInfo{Checksum: "aa2", Generation: 3})
+	index.set("b.txt", nil)
+	index.journal.Close()
+
+	// the changes are only journaled, the index holds none of them yet
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "{}" {
+		t.Errorf("index written whole after every change: %s", content)
+	}
+
+	reopened := openReplicaIndex(path)
+	defer reopened.journal.Close()
+	if info, ok := reopened.get("a.txt"); !ok || info.Checksum != "aa2" || info.Generation != 3 {
+		t.Errorf("a.txt replayed as %+v, %v", info, ok)
+	}
+	if _, ok := reopened.get("b.txt"); ok {
+		t.Error("b.txt forgotten but replayed")
+	}
+	// reopening wrote the index whole and emptied the journal
+	if info, err := os.Stat(reopened.journalPath()); err != nil || info.Size() != 0 {
+		t.Errorf("journal not emptied after replay: %v", err)
+	}
+}
+
+func TestReplicaIndexJournalCutShort(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.replicas.json")
+	index := openReplicaIndex(path)
+	index.set("a.txt", &replicaInfo{Checksum: "aa", Generation: 1})
+	index.journal.WriteString(`{"f":"b.txt","i":{"Checks`)
+	index.journal.Close()
+
+	reopened := openReplicaIndex(path)
+	defer reopened.journal.Close()
+	if _, ok := reopened.get("a.txt"); !ok {
+		t.Error("a.txt lost with the line after it")
+	}
+	if _, ok := reopened.get("b.txt"); ok {
+		t.Error("b.txt recorded from a line cut short")
+	}
+}
+
+func TestReplicaIndexCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.replicas.json")
+	index := openReplicaIndex(path)
+	defer func() { index.journal.Close() }()
+	for i := 0; i <= replicaJournalLimit; i++ {
+		index.set("a.txt", &replicaInfo{Generation: int64(i)})
+	}
+	if index.journaled != 0 {
+		t.Errorf("%d changes journaled after %d, want the index written whole", index.journaled, replicaJournalLimit+1)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"a.txt":{"Checksum":"","Generation":1000}}`; string(content) != want {
+		t.Errorf("index holds %s, want %s", content, want)
+	}
+}
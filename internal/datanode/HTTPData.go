@@ -0,0 +1,93 @@
+package datanode
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"path/filepath"
+)
+
+/*
+Serves GET /data/{file} over HTTP so browsers, video players and CDNs
+can pull stored files directly. http.ServeContent handles Range, If-Range and
+HEAD. Requests must carry HTTPToken or a scoped token allowing to read the
+file, as an "Authorization: Bearer" header or, for clients that can't set
+headers, a token query parameter. Encoded files go
+out with Content-Encoding to clients accepting it, decoded (without range
+support) to the others
+*/
+func (d *DataNodeServer) serveHTTP(listener net.Listener) {
+	log.Printf("DataNode HTTP data endpoint at %s", listener.Addr())
+	// with TLS configured the endpoint is HTTPS with the node certificate
+	var err error
+	if d.TLS != nil {
+		err = d.httpServer.ServeTLS(listener, d.TLS.CertFile, d.TLS.KeyFile)
+	} else {
+		err = d.httpServer.Serve(listener)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		d.fail(fmt.Errorf("http serve fail %v", err))
+	}
+}
+
+// httpHandler routes the HTTP endpoint served by serveHTTP
+func (d *DataNodeServer) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /data/{file...}", d.handleHTTPData)
+	return mux
+}
+
+func (d *DataNodeServer) handleHTTPData(w http.ResponseWriter, r *http.Request) {
+	fileName := r.PathValue("file")
+	if !d.authorizedHTTP(r, fileName) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if _, err := d.storagePath(fileName); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reader, encoding, err := d.openForReader(r.Context(), fileName, r.Header.Get("Accept-Encoding"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer reader.Close()
+
+	log.Printf("HTTP %s %s range %q", r.Method, fileName, r.Header.Get("Range"))
+	d.activeTransfers.Add(1)
+	defer d.activeTransfers.Add(-1)
+	d.activeDownloads.Add(1)
+	defer d.activeDownloads.Add(-1)
+	if d.storedEncoding(fileName) != "" {
+		w.Header().Set("Vary", "Accept-Encoding")
+	}
+
+	file, raw := reader.(*storedFile)
+	if !raw {
+		// decoded on the fly, the length and byte ranges are unknown
+		if r.Method != http.MethodHead {
+			io.Copy(w, d.clientReader(r.Context(), reader))
+		}
+		return
+	}
+	info, err := file.raw.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+		// ServeContent would sniff the type of the encoded bytes
+		contentType := mime.TypeByExtension(filepath.Ext(fileName))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), d.clientReader(r.Context(), file))
+}
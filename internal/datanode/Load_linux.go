@@ -0,0 +1,64 @@
+package datanode
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// loadSample holds the CPU time counters of /proc/stat when last read
+type loadSample struct {
+	iowait uint64
+	total  uint64
+}
+
+/*
+systemLoad returns the load average of the last minute per CPU, and the share
+of CPU time spent waiting on disk since the previous call. Either is -1 when
+it can't be read
+*/
+func (d *DataNodeServer) systemLoad() (cpu, io float64) {
+	cpu, io = -1, -1
+	if data, err := os.ReadFile("/proc/loadavg"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 0 {
+			if average, err := strconv.ParseFloat(fields[0], 64); err == nil {
+				cpu = average / float64(runtime.NumCPU())
+			}
+		}
+	}
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return cpu, io
+	}
+	// cpu user nice system idle iowait irq softirq steal ...
+	line, _, _ := strings.Cut(string(data), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 6 || fields[0] != "cpu" {
+		return cpu, io
+	}
+	var sample loadSample
+	for i, field := range fields[1:] {
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return cpu, io
+		}
+		// guest time is counted in user time already
+		if i < 8 {
+			sample.total += value
+		}
+		if i == 4 {
+			sample.iowait = value
+		}
+	}
+	previous := d.loadSample
+	d.loadSample = sample
+	if previous.total != 0 && sample.total > previous.total {
+		// the kernel's iowait counter may go backwards
+		io = 0
+		if sample.iowait > previous.iowait {
+			io = float64(sample.iowait-previous.iowait) / float64(sample.total-previous.total)
+		}
+	}
+	return cpu, io
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package datanode
+
+// System load is only measured on Linux
+
+type loadSample struct{}
+
+func (d *DataNodeServer) systemLoad() (cpu, io float64) {
+	return -1, -1
+}
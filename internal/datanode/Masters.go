@@ -0,0 +1,92 @@
+package datanode
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+)
+
+// environment variable naming the master, or a comma separated list of masters, over the config
+const masterAddressEnv = "DFS_MASTER_ADDRESS"
+
+/*
+setUpMasters settles the masters the DataNode talks to. The -master flag
+wins over the DFS_MASTER_ADDRESS environment variable, which wins over
+MasterAddresses and MasterAddress in the config; each may list several
+masters, comma separated, and masterAddress is the default. A master found
+by discovery comes first with the others as fallbacks
+*/
+func (d *DataNodeServer) setUpMasters(flagMasters string) {
+	var masters []string
+	switch env := os.Getenv(masterAddressEnv); {
+	case flagMasters != "":
+		masters = splitMasters(flagMasters)
+	case env != "":
+		masters = splitMasters(env)
+	case len(d.MasterAddresses) > 0:
+		masters = d.MasterAddresses
+	case d.MasterAddress != "":
+		masters = splitMasters(d.MasterAddress)
+	}
+	if len(masters) == 0 {
+		masters = []string{masterAddress}
+	}
+	if d.DiscoverMaster {
+		if discovered, ok := discoverMaster(); ok {
+			masters = append([]string{discovered}, masters...)
+		} else {
+			log.Printf("no master answered discovery, using %s", strings.Join(masters, ", "))
+		}
+	}
+	for _, master := range masters {
+		d.masters = append(d.masters, dialTarget(master))
+	}
+}
+
+// splitMasters is the list of master addresses in a comma separated string
+func splitMasters(list string) []string {
+	var masters []string
+	for _, master := range strings.Split(list, ",") {
+		if master = strings.TrimSpace(master); master != "" {
+			masters = append(masters, master)
+		}
+	}
+	return masters
+}
+
+// masterAddr is the address of the master the DataNode talks to now
+func (d *DataNodeServer) masterAddr() string {
+	return d.masters[int(d.currentMaster.Load())%len(d.masters)]
+}
+
+/*
+nextMaster moves on to the next master of the list after the current one
+failed, false when there is no other. The master is shared by every call,
+the heartbeats decide when to move
+*/
+func (d *DataNodeServer) nextMaster() bool {
+	if len(d.masters) < 2 {
+		return false
+	}
+	log.Printf("master at %s unreachable, trying %s", d.masterAddr(), d.masters[int(d.currentMaster.Add(1))%len(d.masters)])
+	return true
+}
+
+/*
+dialMaster connects to the current master. Calls without a deadline get
+MasterTimeoutSeconds, a master that stopped answering can't hold a
+notification or a report forever
+*/
+func (d *DataNodeServer) dialMaster() (*grpc.ClientConn, error) {
+	return grpc.Dial(d.masterAddr(), grpc.WithTransportCredentials(d.dialCredentials),
+		grpc.WithChainUnaryInterceptor(d.masterDeadlineInterceptor))
+}
+
+func (d *DataNodeServer) masterDeadlineInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, cancel := withDeadline(ctx, configTimeout(d.MasterTimeoutSeconds, defaultMasterTimeout))
+	defer cancel()
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
@@ -0,0 +1,24 @@
+package datanode
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Page cache hints for large sequential transfers. They are only advice to
+// the kernel, failures are ignored
+
+func adviseSequential(file *os.File) {
+	unix.Fadvise(int(file.Fd()), 0, 0, unix.FADV_SEQUENTIAL)
+}
+
+// dropCache evicts the file's cached pages in [offset, offset+length), length 0 means to the end
+func dropCache(file *os.File, offset, length int64) {
+	unix.Fadvise(int(file.Fd()), offset, length, unix.FADV_DONTNEED)
+}
+
+// startWriteback queues dirty pages for writing without waiting, so a later dropCache can evict them
+func startWriteback(file *os.File, offset, length int64) {
+	unix.SyncFileRange(int(file.Fd()), offset, length, unix.SYNC_FILE_RANGE_WRITE)
+}
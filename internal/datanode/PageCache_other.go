@@ -0,0 +1,13 @@
+//go:build !linux
+
+package datanode
+
+import "os"
+
+// Page cache hints are only implemented on Linux
+
+func adviseSequential(file *os.File) {}
+
+func dropCache(file *os.File, offset, length int64) {}
+
+func startWriteback(file *os.File, offset, length int64) {}
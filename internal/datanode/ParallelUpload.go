@@ -0,0 +1,95 @@
+package datanode
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*
+parallelUpload is an upload session declared with its size in upload-size
+metadata. The file is sized up front so clients can send ranges of it over
+several streams at once, in any order; EndUploadFile assembles it, refusing
+to commit while any byte is missing
+*/
+type parallelUpload struct {
+	size  int64
+	mutex sync.Mutex
+	// received [start, end) ranges, sorted and merged
+	received [][2]int64
+}
+
+// uploadSize returns the size declared in upload-size metadata, 0 for a sequential upload
+func uploadSize(md metadata.MD) (int64, error) {
+	value := strings.Join(md.Get("upload-size"), "")
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "bad upload-size %q", value)
+	}
+	return size, nil
+}
+
+// add records that bytes [start, end) were written
+func (p *parallelUpload) add(start, end int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	ranges := append(p.received, [2]int64{start, end})
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r[0] <= last[1] {
+			last[1] = max(last[1], r[1])
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	p.received = merged
+}
+
+// prefix returns how many bytes from the start of the file arrived without a gap
+func (p *parallelUpload) prefix() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.received) > 0 && p.received[0][0] == 0 {
+		return p.received[0][1]
+	}
+	return 0
+}
+
+// receivedBytes returns how many bytes of the file arrived, gaps left aside
+func (p *parallelUpload) receivedBytes() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var received int64
+	for _, r := range p.received {
+		received += r[1] - r[0]
+	}
+	return received
+}
+
+// missing describes the first range not received yet, empty when the file is complete
+func (p *parallelUpload) missing() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var next int64
+	for _, r := range p.received {
+		if r[0] > next {
+			return fmt.Sprintf("bytes %d to %d", next, r[0])
+		}
+		next = max(next, r[1])
+	}
+	if next < p.size {
+		return fmt.Sprintf("bytes %d to %d", next, p.size)
+	}
+	return ""
+}
@@ -0,0 +1,166 @@
+package datanode
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	pb "proj/Services"
+	"proj/internal/faults"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestParallelUploadRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		ranges   [][2]int64
+		received [][2]int64
+		prefix   int64
+		missing  string
+	}{
+		{"nothing", nil, nil, 0, "bytes 0 to 10"},
+		{"in order", [][2]int64{{0, 4}, {4, 10}}, [][2]int64{{0, 10}}, 10, ""},
+		{"out of order", [][2]int64{{6, 10}, {0, 3}}, [][2]int64{{0, 3}, {6, 10}}, 3, "bytes 3 to 6"},
+		{"overlapping", [][2]int64{{0, 5}, {3, 8}}, [][2]int64{{0, 8}}, 8, "bytes 8 to 10"},
+		{"resent within", [][2]int64{{0, 10}, {2, 4}}, [][2]int64{{0, 10}}, 10, ""},
+		{"start missing", [][2]int64{{2, 10}}, [][2]int64{{2, 10}}, 0, "bytes 0 to 2"},
+		{"filling gaps", [][2]int64{{4, 6}, {0, 2}, {8, 10}, {2, 4}}, [][2]int64{{0, 6}, {8, 10}}, 6, "bytes 6 to 8"},
+		{"spanning several", [][2]int64{{1, 2}, {4, 5}, {7, 8}, {0, 10}}, [][2]int64{{0, 10}}, 10, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upload := &parallelUpload{size: 10}
+			var received int64
+			for _, r := range test.ranges {
+				upload.add(r[0], r[1])
+			}
+			for _, r := range test.received {
+				received += r[1] - r[0]
+			}
+			if !slices.Equal(upload.received, test.received) {
+				t.Errorf("received %v, want %v", upload.received, test.received)
+			}
+			if got := upload.prefix(); got != test.prefix {
+				t.Errorf("prefix() = %d, want %d", got, test.prefix)
+			}
+			if got := upload.receivedBytes(); got != received {
+				t.Errorf("receivedBytes() = %d, want %d", got, received)
+			}
+			if got := upload.missing(); got != test.missing {
+				t.Errorf("missing() = %q, want %q", got, test.missing)
+			}
+		})
+	}
+}
+
+// testDataNode sets up a DataNode storing in a temporary directory, with no master answering
+func testDataNode(t *testing.T) *DataNodeServer {
+	d := &DataNodeServer{DataDir: filepath.Join(t.TempDir(), "data"), MasterAddress: "127.0.0.1:1"}
+	if err := d.checkLimits(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.setUpTraffic(); err != nil {
+		t.Fatal(err)
+	}
+	d.chunks = newChunkPool(d.ChunkBytes)
+	d.readCache = newReadCache(d.ReadCacheBytes)
+	d.readAhead = newReadAhead(d.ReadAheadBytes)
+	d.faults = faults.New(nil)
+	d.dialCredentials = insecure.NewCredentials()
+	d.setUpMasters("")
+	if err := d.setUpVolumes(); err != nil {
+		t.Fatal(err)
+	}
+	d.uploads = newUploadSessionManager(d.storageDir()+".sessions.json", 0, defaultUploadIdleTimeout, 0)
+	d.loadEncodings()
+	d.loadReplicaIndex()
+	d.loadBlockIndex()
+	d.loadBlobIndex()
+	d.loadUploadNotices()
+	return d
+}
+
+// waitForNotice waits until the master failed to take the upload notification of fileName, queuing it
+func waitForNotice(t *testing.T, d *DataNodeServer, fileName string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		d.notices.mutex.Lock()
+		_, queued := d.notices.notices[fileName]
+		d.notices.mutex.Unlock()
+		if queued {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no upload notification of %s queued", fileName)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParallelUploadCommit(t *testing.T) {
+	d := testDataNode(t)
+	const fileName = "parallel.bin"
+	content := make([]byte, 10000)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	sum := sha256.Sum256(content)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("upload-size", "10000"))
+
+	begun, err := d.BeginUploadFile(ctx, &pb.FileUploadRequest{FileName: fileName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(start, end int64) {
+		t.Helper()
+		if _, err := d.UpdateUploadFile(ctx, &pb.FileUploadRequest{FileName: fileName, SessionId: begun.SessionId, FileContent: content[start:end], Offset: &start}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	end := func() error {
+		_, err := d.EndUploadFile(ctx, &pb.FileUploadRequest{FileName: fileName, SessionId: begun.SessionId, FileSha256: hex.EncodeToString(sum[:])})
+		return err
+	}
+
+	// ranges sent over several streams arrive in any order
+	send(6000, 10000)
+	send(0, 3000)
+	if err := end(); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("ending with bytes 3000 to 6000 missing: %v, want FailedPrecondition", err)
+	}
+	outside := int64(9000)
+	if _, err := d.UpdateUploadFile(ctx, &pb.FileUploadRequest{FileName: fileName, SessionId: begun.SessionId, FileContent: content[:2000], Offset: &outside}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("chunk past the declared size: %v, want InvalidArgument", err)
+	}
+	send(2000, 6000)
+	if err := end(); err != nil {
+		t.Fatal(err)
+	}
+	waitForNotice(t, d, fileName)
+
+	savePath, err := d.storagePath(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := os.ReadFile(savePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(stored, content) {
+		t.Errorf("stored %d bytes differing from the %d sent", len(stored), len(content))
+	}
+	if got := d.usedBytes(); got != int64(len(content)) {
+		t.Errorf("usedBytes() = %d after the commit, want %d", got, len(content))
+	}
+	if err := end(); err == nil {
+		t.Error("session committed twice")
+	}
+}
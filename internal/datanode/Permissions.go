@@ -0,0 +1,80 @@
+package datanode
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// storagePermissions are the parsed FileMode, DirMode and FileOwner settings
+type storagePermissions struct {
+	fileMode os.FileMode
+	dirMode  os.FileMode
+	// -1 leaves the owner or group of the DataNode process
+	uid int
+	gid int
+}
+
+/*
+Parses the permission settings of the config: FileMode and DirMode as octal
+strings ("0640") and FileOwner as numeric "uid:gid" or "uid"
+*/
+func (d *DataNodeServer) parsePermissions() error {
+	d.permissions = storagePermissions{fileMode: 0666, dirMode: 0755, uid: -1, gid: -1}
+	if d.FileMode != "" {
+		mode, err := strconv.ParseUint(d.FileMode, 8, 32)
+		if err != nil || mode > 0777 {
+			return fmt.Errorf("bad FileMode %q", d.FileMode)
+		}
+		d.permissions.fileMode = os.FileMode(mode)
+	}
+	if d.DirMode != "" {
+		mode, err := strconv.ParseUint(d.DirMode, 8, 32)
+		if err != nil || mode > 0777 {
+			return fmt.Errorf("bad DirMode %q", d.DirMode)
+		}
+		d.permissions.dirMode = os.FileMode(mode)
+	}
+	if d.FileOwner != "" {
+		uid, gid, hasGroup := strings.Cut(d.FileOwner, ":")
+		var err error
+		if d.permissions.uid, err = strconv.Atoi(uid); err != nil {
+			return fmt.Errorf("bad FileOwner %q", d.FileOwner)
+		}
+		if hasGroup {
+			if d.permissions.gid, err = strconv.Atoi(gid); err != nil {
+				return fmt.Errorf("bad FileOwner %q", d.FileOwner)
+			}
+		}
+	}
+	return nil
+}
+
+// applyPermissions sets the configured mode, ignoring the umask, and owner on a created path
+func (d *DataNodeServer) applyPermissions(path string, mode os.FileMode) error {
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	if d.permissions.uid >= 0 || d.permissions.gid >= 0 {
+		return os.Chown(path, d.permissions.uid, d.permissions.gid)
+	}
+	return nil
+}
+
+// mkdirStored creates dir and its missing parents with the configured mode and owner
+func (d *DataNodeServer) mkdirStored(dir string) error {
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		return nil
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := d.mkdirStored(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, d.permissions.dirMode); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return d.applyPermissions(dir, d.permissions.dirMode)
+}
@@ -0,0 +1,173 @@
+package datanode
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	pb "proj/Services"
+	"slices"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+/*
+replicatePipeline replicates the stored file, opened as file, HDFS-style
+when every target of req offers it: the file is streamed once to the first,
+which writes each chunk and forwards it to the next, and so on down the
+chain, so the uplink of this node carries the file once however many
+replicas are made. Each DataNode answers once those after it did. It returns
+the outcome for the ids of the targets done with, nil for those that stored
+the file; the others are left to be sent it one by one, all of them when
+the file isn't sent down a pipeline. The replicas stored are verified
+against checksum, that of the file here
+*/
+func (d *DataNodeServer) replicatePipeline(ctx context.Context, req *pb.ReplicateRequest, file *storedFile, checksum string, buf []byte, class trafficClass) map[int32]error {
+	if len(req.IpAddresses) < 2 || len(req.PortNumbers) != len(req.IpAddresses) || len(req.Ids) != len(req.IpAddresses) {
+		return nil
+	}
+	// chunks are forwarded as they are, they must fit every DataNode of the chain
+	limit := len(buf)
+	chain := make([]*pb.PipelineTarget, len(req.IpAddresses))
+	var first *grpc.ClientConn
+	defer func() {
+		if first != nil {
+			first.Close()
+		}
+	}()
+	for i, ip := range req.IpAddresses {
+		conn, err := d.dialPeer(net.JoinHostPort(ip, strconv.Itoa(int(req.PortNumbers[i]))))
+		if err != nil {
+			return nil
+		}
+		peerLimit, capabilities := d.peerChunkLimit(ctx, pb.NewFileServiceClient(conn))
+		if i == 0 {
+			first = conn
+		} else {
+			conn.Close()
+		}
+		if !slices.Contains(capabilities, "replication-pipeline") {
+			return nil
+		}
+		limit = min(limit, peerLimit)
+		chain[i] = &pb.PipelineTarget{IpAddress: ip, PortNumber: req.PortNumbers[i], Id: req.Ids[i]}
+	}
+
+	reply, err := d.replicateStream(ctx, pb.NewFileServiceClient(first), req.FileName, file, buf[:limit], class, chain[1:])
+	if err != nil {
+		// the first DataNode failed like a target on its own, the others are sent the file one by one
+		log.Printf("Replication pipeline of %s failed at DataNode %d: %v", req.FileName, chain[0].Id, err)
+		return map[int32]error{chain[0].Id: err}
+	}
+	outcomes := make(map[int32]error, len(chain))
+	for _, target := range chain {
+		outcomes[target.Id] = nil
+	}
+	for _, id := range reply.Failed {
+		delete(outcomes, id)
+	}
+	for _, id := range reply.Full {
+		outcomes[id] = d.outOfSpace("DataNode %d down the pipeline is out of space", id)
+	}
+	d.verifyPipeline(ctx, req.FileName, chain, outcomes, checksum)
+	log.Printf("Replicated %s down a pipeline of %d DataNodes, %d didn't store it", req.FileName, len(chain), len(reply.Failed))
+	return outcomes
+}
+
+// pipelineForward forwards the chunks of a StreamUpload to the next DataNode down a pipeline
+type pipelineForward struct {
+	conn    *grpc.ClientConn
+	cancel  context.CancelFunc
+	stream  pb.FileService_StreamUploadClient
+	started bool
+	// the next DataNode and those after it
+	targets []*pb.PipelineTarget
+	// the first error forwarding, nothing more is forwarded after it
+	err error
+}
+
+// forwardUpload starts forwarding the StreamUpload whose first message is req down its pipeline, nil when it has none
+func (d *DataNodeServer) forwardUpload(ctx context.Context, req *pb.FileUploadRequest) *pipelineForward {
+	if len(req.Forward) == 0 {
+		return nil
+	}
+	f := &pipelineForward{targets: req.Forward}
+	next := req.Forward[0]
+	f.conn, f.err = d.dialPeer(net.JoinHostPort(next.IpAddress, strconv.Itoa(int(next.PortNumber))))
+	if f.err != nil {
+		return f
+	}
+	// replicas are stored with the same encoding
+	md, _ := metadata.FromIncomingContext(ctx)
+	if encoding := strings.Join(md.Get("content-encoding"), ""); encoding != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "content-encoding", encoding)
+	}
+	ctx, f.cancel = context.WithCancel(ctx)
+	f.stream, f.err = pb.NewFileServiceClient(f.conn).StreamUpload(ctx)
+	return f
+}
+
+// send forwards a message of the upload, once it's written here
+func (f *pipelineForward) send(req *pb.FileUploadRequest) {
+	if f == nil || f.err != nil {
+		return
+	}
+	message := &pb.FileUploadRequest{
+		FileName:     req.FileName,
+		FileContent:  req.FileContent,
+		Offset:       req.Offset,
+		ChunkCrc32C:  req.ChunkCrc32C,
+		ChunkSha256:  req.ChunkSha256,
+		FileSha256:   req.FileSha256,
+		ExpectedSize: req.ExpectedSize,
+	}
+	if !f.started {
+		message.Forward = f.targets[1:]
+		f.started = true
+	}
+	if err := f.stream.Send(message); err != nil {
+		// the next DataNode ended the stream, its error comes with the response
+		if err == io.EOF {
+			_, err = f.stream.CloseAndRecv()
+		}
+		f.err = err
+	}
+}
+
+// finish waits for the DataNodes down the pipeline to store the file and returns the ids of those that didn't, and of those out of space
+func (f *pipelineForward) finish() (failed, full []int32) {
+	if f == nil {
+		return nil, nil
+	}
+	if f.err == nil {
+		response, err := f.stream.CloseAndRecv()
+		if err == nil {
+			return response.Failed, response.Full
+		}
+		f.err = err
+	}
+	log.Printf("Forwarding down the pipeline to DataNode %d failed: %v", f.targets[0].Id, f.err)
+	for _, target := range f.targets {
+		failed = append(failed, target.Id)
+	}
+	if isOutOfSpace(f.err) {
+		full = []int32{f.targets[0].Id}
+	}
+	return failed, full
+}
+
+// close ends the forwarding, the next DataNode drops an upload not finished
+func (f *pipelineForward) close() {
+	if f == nil {
+		return
+	}
+	if f.cancel != nil {
+		f.cancel()
+	}
+	if f.conn != nil {
+		f.conn.Close()
+	}
+}
@@ -0,0 +1,141 @@
+package datanode
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	pb "proj/Services"
+	"strconv"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+replicaRestores are the replicas being fetched back from peers, so the reads
+of one arriving together wait for a single copy
+*/
+type replicaRestores struct {
+	mutex sync.Mutex
+	// file name -> restore in progress
+	running map[string]*replicaRestore
+}
+
+// replicaRestore is closed once the replica is restored, or failed with err
+type replicaRestore struct {
+	done chan struct{}
+	err  error
+}
+
+/*
+lostReplica reports whether the replica of fileName here is lost: the file
+is missing, the disk was replaced or it was removed by hand, or its content
+changed on disk since it was committed, as the scrubber found. Only
+checksums already computed are compared, a read doesn't hash the file
+*/
+func (d *DataNodeServer) lostReplica(fileName string) bool {
+	path, err := d.storagePath(fileName)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	replica, confirmed := d.replicaIndex.get(fileName)
+	cached, computed := d.checksums.cached(path, info)
+	return confirmed && computed && cached.checksum != replica.Checksum
+}
+
+/*
+restoreLost fetches the replica of fileName back from another DataNode
+holding it, listed by the master, before a client reads it, when the copy
+here is lost. The client is served the restored copy rather than an error.
+Reads from other DataNodes aren't served this way, they are replicating or
+restoring themselves and go to another replica
+*/
+func (d *DataNodeServer) restoreLost(ctx context.Context, fileName string) {
+	if d.trafficClassOf(ctx) == backgroundTraffic || d.uploads.uploading(fileName) > 0 || !d.lostReplica(fileName) {
+		return
+	}
+	d.restores.mutex.Lock()
+	restore, running := d.restores.running[fileName]
+	if !running {
+		if d.restores.running == nil {
+			d.restores.running = make(map[string]*replicaRestore)
+		}
+		restore = &replicaRestore{done: make(chan struct{})}
+		d.restores.running[fileName] = restore
+	}
+	d.restores.mutex.Unlock()
+	if running {
+		select {
+		case <-restore.done:
+		case <-ctx.Done():
+		}
+		return
+	}
+
+	log.Printf("replica of %s is lost, restoring it from a peer", fileName)
+	restore.err = d.restoreReplica(ctx, fileName)
+	if restore.err != nil {
+		log.Printf("restoring the replica of %s failed: %v", fileName, restore.err)
+	} else {
+		log.Printf("restored the replica of %s from a peer", fileName)
+	}
+	d.restores.mutex.Lock()
+	delete(d.restores.running, fileName)
+	d.restores.mutex.Unlock()
+	close(restore.done)
+}
+
+// restoreReplica copies fileName from the first healthy replica the master lists on another DataNode
+func (d *DataNodeServer) restoreReplica(ctx context.Context, fileName string) error {
+	conn, err := d.dialMaster()
+	if err != nil {
+		return fmt.Errorf("connection to the master failed: %v", err)
+	}
+	defer conn.Close()
+	locations, err := pb.NewFileServiceClient(conn).GetReadLocations(d.withClusterSecret(ctx), &pb.GetReadLocationsRequest{FileName: fileName})
+	if err != nil {
+		return fmt.Errorf("replicas of %s unknown: %v", fileName, err)
+	}
+	lastErr := status.Errorf(codes.NotFound, "no other replica of %s to restore it from", fileName)
+	for _, replica := range locations.Replicas {
+		if replica.DataNode == d.nodeID() || !replica.Alive || replica.Corrupt || replica.DataNodePort == 0 {
+			continue
+		}
+		addr := net.JoinHostPort(replica.IpAddress, strconv.Itoa(int(replica.DataNodePort)))
+		if err := d.restoreFrom(ctx, addr, fileName); err != nil {
+			log.Printf("restoring %s from %s failed: %v", fileName, addr, err)
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
+// restoreFrom replaces the replica of fileName here with the copy of the DataNode at addr, verified against its checksum
+func (d *DataNodeServer) restoreFrom(ctx context.Context, addr, fileName string) error {
+	conn, err := d.dialPeer(addr)
+	if err != nil {
+		return fmt.Errorf("connection failed: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewFileServiceClient(conn)
+	stat, err := client.StatFile(ctx, &pb.StatFileRequest{FileName: fileName})
+	if err != nil {
+		return err
+	}
+	if stat.Health == "corrupt" {
+		return fmt.Errorf("the copy of %s there is corrupt too", fileName)
+	}
+	return d.pullReplica(ctx, client, &pb.GossipEntry{FileName: fileName, Checksum: stat.Checksum, Generation: stat.Generation})
+}
@@ -0,0 +1,161 @@
+package datanode
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// most files whose sequential reads are followed at once, the least recently read is forgotten beyond
+const maxReadAheadFiles = 64
+
+/*
+readAhead follows the range reads of each file. When a read starts where the
+previous one of the file ended, as when a client streams a video or tails a
+log range by range, the ReadAheadBytes after it are read into memory in the
+background, so the next read is answered without waiting for the disk. A
+file changed since, by size or modification time, is followed anew
+*/
+type readAhead struct {
+	mutex sync.Mutex
+	files map[string]*sequentialReads
+}
+
+type sequentialReads struct {
+	size    int64
+	modTime time.Time
+	// offset the next read is expected at, where the last one ended
+	next int64
+	used time.Time
+	// the bytes read ahead, nil when none are
+	fetch *prefetched
+}
+
+// prefetched holds the bytes read from start, ready is closed once they are; data stays nil when the read failed
+type prefetched struct {
+	start int64
+	data  []byte
+	ready chan struct{}
+}
+
+// newReadAhead returns the read-ahead state, nil when bytes is 0 and it's disabled
+func newReadAhead(bytes int64) *readAhead {
+	if bytes <= 0 {
+		return nil
+	}
+	return &readAhead{files: make(map[string]*sequentialReads)}
+}
+
+/*
+follow records a read of length bytes from offset of the file at path,
+described by info. It returns the bytes read ahead from offset, if any, and
+when the read follows the previous one, the prefetch of what comes after it
+for the caller to fill
+*/
+func (r *readAhead) follow(ctx context.Context, path string, info os.FileInfo, offset, length int64) (ahead []byte, fill *prefetched) {
+	r.mutex.Lock()
+	now := time.Now()
+	reads, ok := r.files[path]
+	if !ok || reads.size != info.Size() || !reads.modTime.Equal(info.ModTime()) {
+		if !ok && len(r.files) >= maxReadAheadFiles {
+			r.forgetOldest()
+		}
+		reads = &sequentialReads{size: info.Size(), modTime: info.ModTime(), next: -1}
+		r.files[path] = reads
+	}
+	sequential := reads.next == offset
+	reads.next, reads.used = offset+length, now
+	fetch := reads.fetch
+	reads.fetch = nil
+	if sequential && offset+length < info.Size() {
+		fill = &prefetched{start: offset + length, ready: make(chan struct{})}
+		reads.fetch = fill
+	}
+	r.mutex.Unlock()
+
+	if fetch == nil || fetch.start != offset {
+		return nil, fill
+	}
+	select {
+	case <-fetch.ready:
+		return fetch.data, fill
+	case <-ctx.Done():
+		return nil, fill
+	}
+}
+
+// forgetOldest drops the file read least recently, must be called with the mutex held
+func (r *readAhead) forgetOldest() {
+	oldest := ""
+	for path, reads := range r.files {
+		if oldest == "" || reads.used.Before(r.files[oldest].used) {
+			oldest = path
+		}
+	}
+	delete(r.files, oldest)
+}
+
+/*
+selectRangeAhead is selectRange for the downloads of the stored fileName,
+serving what was read ahead of a sequential read from memory and
+reading ahead of it in turn. Only ranges of length bytes of files read as
+stored are followed, nor are files in the read cache
+*/
+func (d *DataNodeServer) selectRangeAhead(ctx context.Context, fileName string, reader io.ReadCloser, offset, length int64) (io.Reader, error) {
+	file, raw := reader.(*storedFile)
+	if d.readAhead == nil || !raw || file.cached != nil || length <= 0 || offset < 0 || offset > file.Size() {
+		return selectRange(reader, offset, length)
+	}
+	path, err := d.storagePath(fileName)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.raw.Stat()
+	if err != nil {
+		return selectRange(reader, offset, length)
+	}
+	ahead, fill := d.readAhead.follow(ctx, path, info, offset, length)
+	if fill != nil {
+		go d.prefetch(path, info, fill, d.trafficClassOf(ctx))
+	}
+	ahead = ahead[:min(int64(len(ahead)), length)]
+	if len(ahead) == 0 {
+		return selectRange(reader, offset, length)
+	}
+	// a length of 0 would select the rest of the file
+	if int64(len(ahead)) == length {
+		return bytes.NewReader(ahead), nil
+	}
+	rest, err := selectRange(reader, offset+int64(len(ahead)), length-int64(len(ahead)))
+	if err != nil {
+		return nil, err
+	}
+	return io.MultiReader(bytes.NewReader(ahead), rest), nil
+}
+
+// prefetch reads the ReadAheadBytes of the file at path from fill.start, unless the file changed from info
+func (d *DataNodeServer) prefetch(path string, info os.FileInfo, fill *prefetched, class trafficClass) {
+	defer close(fill.ready)
+	file, err := d.openStored(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	// info is of the bytes on disk, an encrypted file holds a little less
+	if current, err := file.raw.Stat(); err != nil || current.Size() != info.Size() || !current.ModTime().Equal(info.ModTime()) || fill.start >= file.Size() {
+		return
+	}
+	if err := d.traffic.acquire(context.Background(), class); err != nil {
+		return
+	}
+	defer d.traffic.release()
+	data := make([]byte, min(d.ReadAheadBytes, file.Size()-fill.start))
+	n, err := file.ReadAt(data, fill.start)
+	if err != nil && err != io.EOF {
+		return
+	}
+	fill.data = data[:n]
+}
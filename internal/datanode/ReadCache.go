@@ -0,0 +1,141 @@
+package datanode
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+readCache keeps the content of recently downloaded files in memory, up to
+ReadCacheBytes, evicting the least recently used first, so hot files are
+served without reading them from disk again. Files over a quarter of the
+cache aren't kept, a single one would evict the rest. An entry is only used
+while the file's size and modification time match, like checksumCache
+*/
+type readCache struct {
+	mutex    sync.Mutex
+	maxBytes int64
+	used     int64
+	// path -> element of order holding its *cachedContent, most recent first
+	entries map[string]*list.Element
+	order   *list.List
+	// downloads served from memory and from disk, reported with heartbeats
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type cachedContent struct {
+	path    string
+	content []byte
+	size    int64
+	modTime time.Time
+}
+
+// newReadCache returns a cache of maxBytes, nil when 0 disables it
+func newReadCache(maxBytes int64) *readCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &readCache{maxBytes: maxBytes, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns the content of the file at path if the cache has it as described by info
+func (c *readCache) get(path string, info os.FileInfo) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cachedContent)
+	if entry.size != info.Size() || !entry.modTime.Equal(info.ModTime()) {
+		c.remove(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry.content, true
+}
+
+// put keeps content as that of the file at path, described by info
+func (c *readCache) put(path string, info os.FileInfo, content []byte) {
+	if int64(len(content)) > c.maxBytes/4 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[path]; ok {
+		c.remove(element)
+	}
+	c.entries[path] = c.order.PushFront(&cachedContent{path: path, content: content, size: info.Size(), modTime: info.ModTime()})
+	c.used += int64(len(content))
+	for c.used > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// forget drops the content of a removed or renamed file
+func (c *readCache) forget(path string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[path]; ok {
+		c.remove(element)
+	}
+}
+
+// remove drops element, must be called with the mutex held
+func (c *readCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*cachedContent)
+	delete(c.entries, entry.path)
+	c.used -= int64(len(entry.content))
+}
+
+// counts returns the hits and misses so far, zeros when the cache is disabled
+func (c *readCache) counts() (hits, misses int64) {
+	if c == nil {
+		return 0, 0
+	}
+	return c.hits.Load(), c.misses.Load()
+}
+
+/*
+openCached opens the stored file at path for a download, served from the
+read cache when it holds the file. The file is still opened and its size
+and modification time checked, its content isn't read. A file small enough
+to be cached is read whole on a miss and kept
+*/
+func (d *DataNodeServer) openCached(path string) (*storedFile, error) {
+	file, err := d.openStored(path)
+	if err != nil || d.readCache == nil {
+		return file, err
+	}
+	info, err := file.raw.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if content, ok := d.readCache.get(path, info); ok {
+		d.readCache.hits.Add(1)
+		file.size, file.cached = int64(len(content)), bytes.NewReader(content)
+		return file, nil
+	}
+	d.readCache.misses.Add(1)
+	if file.Size() > d.readCache.maxBytes/4 {
+		return file, nil
+	}
+	content := make([]byte, file.Size())
+	if _, err := io.ReadFull(file, content); err != nil {
+		file.Close()
+		return nil, err
+	}
+	d.readCache.put(path, info, content)
+	file.cached = bytes.NewReader(content)
+	return file, nil
+}
@@ -0,0 +1,211 @@
+package datanode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	pb "proj/Services"
+	"proj/internal/fsutil"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// nodeIdentity is what a DataNode keeps of its registration with the master
+type nodeIdentity struct {
+	// random, generated the first time the DataNode starts
+	UUID string `json:"UUID"`
+	ID   int32  `json:"ID"`
+	// cluster of the master that assigned the ID
+	ClusterID string `json:"ClusterID,omitempty"`
+}
+
+// identityPath is where the identity is kept, next to the storage root so it goes with the data
+func (d *DataNodeServer) identityPath() string {
+	return d.storageDir() + ".node.json"
+}
+
+/*
+loadIdentity restores the ID the master assigned before a restart. A new
+DataNode generates its identity, and claims the ID set in its config, if
+any, as DataNodes did before the master assigned them
+*/
+func (d *DataNodeServer) loadIdentity() error {
+	content, err := os.ReadFile(d.identityPath())
+	if err == nil {
+		if err := json.Unmarshal(content, &d.identity); err != nil {
+			return fmt.Errorf("bad node identity %s: %v", d.identityPath(), err)
+		}
+		d.setID(d.identity.ID)
+		d.clusterID.Store(&d.identity.ClusterID)
+		return nil
+	}
+	d.identity.UUID = newSessionID()
+	if d.ConfigID != nil {
+		d.setID(*d.ConfigID)
+	}
+	return nil
+}
+
+// nodeID is the DataNode's ID, 0 until loaded or assigned, see hasID
+func (d *DataNodeServer) nodeID() int32 {
+	return d.id.Load()
+}
+
+func (d *DataNodeServer) setID(id int32) {
+	d.id.Store(id)
+	d.hasID.Store(true)
+}
+
+func (d *DataNodeServer) saveIdentity() {
+	content, err := json.Marshal(d.identity)
+	if err == nil {
+		err = fsutil.WriteFileAtomic(d.identityPath(), content, 0644)
+	}
+	if err != nil {
+		log.Printf("saving node identity fail %v", err)
+	}
+}
+
+/*
+register tells the master the DataNode's identity, address and cluster. A
+DataNode with an ID claims it, the master refuses it when another DataNode
+holds it; one without is assigned its ID, which is kept for the restarts
+with the cluster it joined
+*/
+func (d *DataNodeServer) register(client pb.FileServiceClient) error {
+	request := &pb.RegisterDataNodeRequest{
+		NodeUuid:    d.identity.UUID,
+		DataNode_IP: d.IP,
+		PortNumber:  []string{d.PortForMaster, d.PortForClient, d.PortForDN},
+		ClusterId:   d.cluster(),
+	}
+	if d.hasID.Load() {
+		claimed := d.nodeID()
+		request.DataNode = &claimed
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), heartbeatTimeout)
+	defer cancel()
+	response, err := client.RegisterDataNode(d.withClusterSecret(ctx), request)
+	if err != nil {
+		return err
+	}
+	if d.hasID.Load() && response.DataNode != d.nodeID() {
+		return status.Errorf(codes.AlreadyExists, "registered as DataNode %d, not %d", response.DataNode, d.nodeID())
+	}
+	d.setID(response.DataNode)
+	if d.cluster() == "" && response.ClusterId != "" {
+		log.Printf("joined cluster %s", response.ClusterId)
+		clusterID := response.ClusterId
+		d.clusterID.Store(&clusterID)
+	}
+	if _, err := os.Stat(d.identityPath()); err != nil || d.identity.ID != d.nodeID() || d.identity.ClusterID != d.cluster() {
+		d.identity.ID, d.identity.ClusterID = d.nodeID(), d.cluster()
+		d.saveIdentity()
+	}
+	return nil
+}
+
+/*
+registrationError is the error stopping a DataNode whose ID another
+DataNode holds, that the master refused as a DataNode of another cluster,
+or whose config claims an ID or ports the master rejects; it can't serve
+under that master. nil for the errors worth retrying
+*/
+func (d *DataNodeServer) registrationError(err error) error {
+	switch status.Code(err) {
+	case codes.AlreadyExists:
+		return fmt.Errorf("DataNode ID %d: %v; remove %s to register as a new DataNode", d.nodeID(), status.Convert(err).Message(), d.identityPath())
+	case codes.FailedPrecondition:
+		return fmt.Errorf("%v: check MasterAddress, or remove %s to join this cluster as a new DataNode", status.Convert(err).Message(), d.identityPath())
+	case codes.InvalidArgument:
+		return fmt.Errorf("the master refused to register this DataNode: %v; check ID and the ports in the config", status.Convert(err).Message())
+	}
+	return nil
+}
+
+// cluster is the ID of the cluster the DataNode joined, empty until it first registers
+func (d *DataNodeServer) cluster() string {
+	if clusterID := d.clusterID.Load(); clusterID != nil {
+		return *clusterID
+	}
+	return ""
+}
+
+// withClusterID tells the DataNodes the calls go to which cluster they come from
+func (d *DataNodeServer) withClusterID(ctx context.Context) context.Context {
+	if clusterID := d.cluster(); clusterID != "" {
+		return metadata.AppendToOutgoingContext(ctx, "cluster-id", clusterID)
+	}
+	return ctx
+}
+
+// checkClusterID refuses calls from the DataNodes or the master of another cluster
+func (d *DataNodeServer) checkClusterID(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	theirs, ours := strings.Join(md.Get("cluster-id"), ""), d.cluster()
+	if theirs != "" && ours != "" && theirs != ours {
+		return status.Errorf(codes.FailedPrecondition, "DataNode %d belongs to cluster %s, not %s", d.nodeID(), ours, theirs)
+	}
+	return nil
+}
+
+func (d *DataNodeServer) clusterInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := d.checkClusterID(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (d *DataNodeServer) clusterStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := d.checkClusterID(stream.Context()); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+/*
+registerAtStart waits for the master to assign an ID to a DataNode without
+one before it serves, backing off like the heartbeats while the master
+can't be reached. A DataNode with an ID registers with its heartbeats
+*/
+func (d *DataNodeServer) registerAtStart() error {
+	if d.hasID.Load() {
+		return nil
+	}
+	log.Printf("waiting for the master to assign this DataNode an ID")
+	for failures := 1; ; failures++ {
+		err := d.registerOnce()
+		if err == nil {
+			log.Printf("the master assigned this DataNode ID %d", d.nodeID())
+			return nil
+		}
+		if status.Code(err) == codes.Unimplemented {
+			return fmt.Errorf("the master at %s doesn't assign DataNode IDs, set \"ID\" in the config", d.masterAddr())
+		}
+		if err := d.registrationError(err); err != nil {
+			return err
+		}
+		wait := d.heartbeatBackoff(failures)
+		log.Printf("Cannot register with the master %v, retrying in %v", err, wait)
+		d.nextMaster()
+		if !d.sleep(d.jittered(wait)) {
+			return errors.New("stopped before the master assigned an ID")
+		}
+	}
+}
+
+func (d *DataNodeServer) registerOnce() error {
+	conn, err := d.dialMaster()
+	if err != nil {
+		return fmt.Errorf("connection to the master failed: %v", err)
+	}
+	defer conn.Close()
+	return d.register(pb.NewFileServiceClient(conn))
+}
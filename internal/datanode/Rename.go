@@ -0,0 +1,70 @@
+package datanode
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	pb "proj/Services"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+RenameFile moves a stored file to a new name. Only the master calls it, on
+every DataNode holding the file, and moves its record once all of them
+renamed their replica; a client asks the master's RenameFile instead. The
+encoding, checksum and replica index entry follow the file
+*/
+func (d *DataNodeServer) RenameFile(ctx context.Context, req *pb.RenameFileRequest) (*pb.RenameFileResponse, error) {
+	if !d.fromCluster(ctx) {
+		return nil, status.Error(codes.PermissionDenied, "renames go through the master's RenameFile")
+	}
+	log.Printf("RenameFile %s to %s", req.FileName, req.NewName)
+	oldPath, err := d.storagePath(req.FileName)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := d.storagePath(req.NewName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(oldPath); os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "%s not found", req.FileName)
+	}
+	if _, err := os.Stat(existing); err == nil {
+		return nil, status.Errorf(codes.AlreadyExists, "%s already exists", req.NewName)
+	}
+	// a rename never crosses data directories
+	newPath := filepath.Join(d.volumeRoot(oldPath), filepath.FromSlash(req.NewName))
+	if err := d.mkdirStored(filepath.Dir(newPath)); err != nil {
+		return nil, fmt.Errorf("error creating dir: %v", err)
+	}
+	d.blobMutex.Lock()
+	err = d.moveStored(oldPath, newPath)
+	d.blobMutex.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("Rename fail %v", err)
+	}
+	if err := syncDir(filepath.Dir(newPath)); err != nil {
+		log.Printf("sync of %s failed: %v", filepath.Dir(newPath), err)
+	}
+	d.pruneEmptyDirs(oldPath)
+
+	encoding := d.storedEncoding(req.FileName)
+	d.setEncoding(req.NewName, encoding)
+	d.setEncoding(req.FileName, "")
+	d.checksums.move(oldPath, newPath)
+	d.readCache.forget(oldPath)
+	d.blobs.move(req.FileName, req.NewName)
+	d.moveVersions(req.FileName, req.NewName)
+	if info, ok := d.replicaIndex.get(req.FileName); ok {
+		info.Generation = req.Generation
+		d.replicaIndex.set(req.NewName, &info)
+		d.replicaIndex.set(req.FileName, nil)
+	}
+	log.Printf("Renamed %s to %s", req.FileName, req.NewName)
+	return &pb.RenameFileResponse{FilePath: newPath}, nil
+}
@@ -0,0 +1,121 @@
+package datanode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	pb "proj/Services"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+badReplicaError is the error of a replica made whose checksum on the target
+differs from the copy here, the file was corrupted on its way there. The
+target already stored it and told the master, so it isn't sent again, it's
+reported bad and the master's repair copies the file elsewhere
+*/
+type badReplicaError struct {
+	fileName string
+	got      string
+	want     string
+}
+
+func (e *badReplicaError) Error() string {
+	return fmt.Sprintf("replica of %s hashes to %s on the target, %s here", e.fileName, e.got, e.want)
+}
+
+func isBadReplica(err error) bool {
+	var bad *badReplicaError
+	return errors.As(err, &bad)
+}
+
+/*
+verifyReplica compares the checksum of the replica of fileName just made
+through client against checksum, that of the copy here. Nothing is compared
+when checksum is empty, or when the target stored the file encoded
+differently and its bytes differ anyway. A replica whose checksum can't be
+had is taken as made, it's stored already and sending it again won't help
+*/
+func (d *DataNodeServer) verifyReplica(ctx context.Context, client pb.FileServiceClient, fileName, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+	response, err := client.GetFileChecksum(ctx, &pb.GetFileChecksumRequest{FileName: fileName})
+	if err != nil {
+		log.Printf("Replica of %s not verified, its checksum failed: %v", fileName, err)
+		return nil
+	}
+	if response.ContentEncoding != d.storedEncoding(fileName) {
+		return nil
+	}
+	if response.Checksum != checksum {
+		return &badReplicaError{fileName: fileName, got: response.Checksum, want: checksum}
+	}
+	return nil
+}
+
+// verifyReplicaAt is verifyReplica for the DataNode at addr
+func (d *DataNodeServer) verifyReplicaAt(ctx context.Context, addr, fileName, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+	conn, err := d.dialPeer(addr)
+	if err != nil {
+		log.Printf("Replica of %s not verified, connection failed: %v", fileName, err)
+		return nil
+	}
+	defer conn.Close()
+	return d.verifyReplica(ctx, pb.NewFileServiceClient(conn), fileName, checksum)
+}
+
+// verifyPipeline verifies the replicas a pipeline stored, replacing the outcome of those that don't match
+func (d *DataNodeServer) verifyPipeline(ctx context.Context, fileName string, chain []*pb.PipelineTarget, outcomes map[int32]error, checksum string) {
+	for _, target := range chain {
+		if err, ok := outcomes[target.Id]; !ok || err != nil {
+			continue
+		}
+		addr := net.JoinHostPort(target.IpAddress, strconv.Itoa(int(target.PortNumber)))
+		if err := d.verifyReplicaAt(ctx, addr, fileName, checksum); err != nil {
+			outcomes[target.Id] = err
+		}
+	}
+}
+
+/*
+reportBadReplicaOf tells the master the replica of fileName on dataNode is
+bad. The target tells the master of the replica it stored in the background,
+a report arriving first is sent again shortly
+*/
+func (d *DataNodeServer) reportBadReplicaOf(fileName string, dataNode int32, reason string) {
+	conn, err := d.dialMaster()
+	if err != nil {
+		log.Printf("could not report the bad replica of %s on DataNode %d: %v", fileName, dataNode, err)
+		return
+	}
+	defer conn.Close()
+	client := pb.NewFileServiceClient(conn)
+	for attempt := 0; attempt < 5; attempt++ {
+		if attempt > 0 {
+			time.Sleep(2 * time.Second)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err = client.ReportBadReplica(d.withClusterSecret(ctx), &pb.ReportBadReplicaRequest{
+			FileName: fileName,
+			DataNode: dataNode,
+			Reason:   reason,
+		})
+		cancel()
+		if status.Code(err) != codes.NotFound {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("reporting the bad replica of %s on DataNode %d fail %v", fileName, dataNode, err)
+	}
+}
@@ -0,0 +1,64 @@
+package datanode
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	pb "proj/Services"
+)
+
+/*
+replicateStream sends the stored file, opened as file, to the DataNode
+behind client over one StreamUpload, reading it from disk a chunk of buf at
+a time as the stream takes it, so no more than a chunk is ever in memory.
+A read that fails cancels the stream, the peer drops what it received.
+The peer forwards the file to the DataNodes of forward in turn, see
+Pipeline.go, its response tells which of them didn't store it
+*/
+func (d *DataNodeServer) replicateStream(ctx context.Context, client pb.FileServiceClient, fileName string, file *storedFile, buf []byte, class trafficClass, forward []*pb.PipelineTarget) (*pb.FileUploadResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.StreamUpload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	totalSize := file.Size()
+	large := d.bypassCache(totalSize)
+	// the first message names the file and announces its size, even when it has no bytes
+	for offset := int64(0); offset == 0 || offset < totalSize; {
+		if err := d.traffic.acquire(ctx, class); err != nil {
+			return nil, err
+		}
+		n, err := file.ReadAt(buf, offset)
+		d.traffic.release()
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("read of %s failed at offset %d: %v", fileName, offset, err)
+		}
+		if large {
+			dropCache(file.raw, offset, int64(n))
+		}
+		chunkOffset := offset
+		message := &pb.FileUploadRequest{FileName: fileName, FileContent: buf[:n], Offset: &chunkOffset}
+		if offset == 0 {
+			message.ExpectedSize, message.Forward = totalSize, forward
+		}
+		if err := stream.Send(message); err != nil {
+			// the peer ended the stream, its error comes with the response
+			if err == io.EOF {
+				_, err = stream.CloseAndRecv()
+			}
+			return nil, err
+		}
+		offset += int64(n)
+		if n == 0 {
+			break
+		}
+	}
+	response, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Replicated %s, %d bytes, over one stream", fileName, totalSize)
+	return response, nil
+}
@@ -0,0 +1,213 @@
+package datanode
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	pb "proj/Services"
+	"proj/internal/fsutil"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// wait before the first retry of a failed replica and the most it doubles to
+	defaultReplicationRetryDelay = 30 * time.Second
+	maxReplicationRetryDelay     = time.Hour
+	// retries before a replica is given up and reported to the master
+	defaultReplicationRetries = 8
+)
+
+// replicationTask is a replica a replication failed to make
+type replicationTask struct {
+	FileName    string    `json:"FileName"`
+	IPAddress   string    `json:"IPAddress"`
+	PortNumber  int32     `json:"PortNumber"`
+	Target      int32     `json:"Target"`
+	Attempts    int       `json:"Attempts"`
+	NextAttempt time.Time `json:"NextAttempt"`
+	LastError   string    `json:"LastError"`
+}
+
+/*
+replicationRetries queues the replicas replications failed to make, for a
+target that was unreachable or broke off, persisted next to the storage root
+like the replica index so a restart doesn't forget them. Each is retried
+after ReplicationRetrySeconds, the wait doubling with every failed attempt up
+to an hour; one still failing after ReplicationRetries retries is given up
+and reported to the master, whose repair places the copy elsewhere. Targets
+out of space aren't queued, the master already picks other nodes for them
+*/
+type replicationRetries struct {
+	mutex sync.Mutex
+	path  string
+	delay time.Duration
+	limit int
+	// file name and target -> task
+	tasks map[string]*replicationTask
+}
+
+func retryKey(fileName string, target int32) string {
+	return strconv.Itoa(int(target)) + "/" + fileName
+}
+
+// loadReplicationRetries reads back the queue, it stays nil when ReplicationRetrySeconds is -1
+func (d *DataNodeServer) loadReplicationRetries() {
+	if d.ReplicationRetrySeconds < 0 {
+		return
+	}
+	d.retries = &replicationRetries{
+		path:  d.storageDir() + ".retries.json",
+		delay: configTimeout(d.ReplicationRetrySeconds, defaultReplicationRetryDelay),
+		limit: d.ReplicationRetries,
+		tasks: make(map[string]*replicationTask),
+	}
+	if d.retries.limit <= 0 {
+		d.retries.limit = defaultReplicationRetries
+	}
+	content, err := os.ReadFile(d.retries.path)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(content, &d.retries.tasks); err != nil {
+		log.Printf("bad replication retry queue %s: %v", d.retries.path, err)
+	}
+}
+
+/*
+failed queues the replica of req's file to its target-th target, or counts
+another failed attempt of it, and returns it when that was the last
+*/
+func (q *replicationRetries) failed(req *pb.ReplicateRequest, target int, err error) *replicationTask {
+	if q == nil {
+		return nil
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	key := retryKey(req.FileName, req.Ids[target])
+	task, ok := q.tasks[key]
+	if !ok {
+		task = &replicationTask{FileName: req.FileName, IPAddress: req.IpAddresses[target], PortNumber: req.PortNumbers[target], Target: req.Ids[target]}
+		q.tasks[key] = task
+	}
+	task.Attempts++
+	task.LastError = err.Error()
+	if task.Attempts > q.limit {
+		delete(q.tasks, key)
+		q.save()
+		return task
+	}
+	wait := q.delay
+	for i := 1; i < task.Attempts && wait < maxReplicationRetryDelay; i++ {
+		wait *= 2
+	}
+	task.NextAttempt = time.Now().Add(min(wait, maxReplicationRetryDelay))
+	q.save()
+	return nil
+}
+
+// done forgets the replica of fileName on target, made or no longer to be retried
+func (q *replicationRetries) done(fileName string, target int32) {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	key := retryKey(fileName, target)
+	if _, ok := q.tasks[key]; ok {
+		delete(q.tasks, key)
+		q.save()
+	}
+}
+
+// due returns the replicas whose next attempt has come
+func (q *replicationRetries) due(now time.Time) []replicationTask {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var tasks []replicationTask
+	for _, task := range q.tasks {
+		if !now.Before(task.NextAttempt) {
+			tasks = append(tasks, *task)
+		}
+	}
+	return tasks
+}
+
+// save writes the queue, called with the mutex held
+func (q *replicationRetries) save() {
+	content, err := json.Marshal(q.tasks)
+	if err == nil {
+		err = fsutil.WriteFileAtomic(q.path, content, 0644)
+	}
+	if err != nil {
+		log.Printf("saving replication retry queue fail %v", err)
+	}
+}
+
+// retryReplications runs the queued replicas as they come due, as background traffic
+func (d *DataNodeServer) retryReplications() {
+	if d.retries == nil {
+		return
+	}
+	ticker := time.NewTicker(min(d.retries.delay, 10*time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopped:
+			return
+		case <-ticker.C:
+		}
+		for _, task := range d.retries.due(time.Now()) {
+			// a file deleted or moved away since has nothing left to replicate
+			path, err := d.storagePath(task.FileName)
+			if err == nil {
+				_, err = os.Stat(path)
+			}
+			if err != nil {
+				log.Printf("dropping the retry of %s to DataNode %d: %v", task.FileName, task.Target, err)
+				d.retries.done(task.FileName, task.Target)
+				continue
+			}
+			log.Printf("retrying the replica of %s on DataNode %d, attempt %d", task.FileName, task.Target, task.Attempts+1)
+			ctx, cancel := context.WithTimeout(context.Background(), configTimeout(d.ReplicateTimeoutSeconds, defaultReplicateTimeout))
+			request := &pb.ReplicateRequest{
+				FileName:    task.FileName,
+				IpAddresses: []string{task.IPAddress},
+				PortNumbers: []int32{task.PortNumber},
+				Ids:         []int32{task.Target},
+			}
+			// the outcome of the copy updates the queue, a replication that couldn't start counts as an attempt
+			_, err = d.replicate(ctx, request, backgroundTraffic)
+			cancel()
+			if err != nil {
+				log.Printf("retrying the replica of %s failed: %v", task.FileName, err)
+				if gaveUp := d.retries.failed(request, 0, err); gaveUp != nil {
+					go d.reportReplicationFailure(*gaveUp)
+				}
+			}
+		}
+	}
+}
+
+// reportReplicationFailure tells the master a replica was given up
+func (d *DataNodeServer) reportReplicationFailure(task replicationTask) {
+	log.Printf("giving up the replica of %s on DataNode %d after %d attempts: %s", task.FileName, task.Target, task.Attempts, task.LastError)
+	conn, err := d.dialMaster()
+	if err != nil {
+		log.Printf("Failed to report replication failure: %v", err)
+		return
+	}
+	defer conn.Close()
+	_, err = pb.NewFileServiceClient(conn).ReportReplicationFailure(d.withClusterSecret(context.Background()), &pb.ReportReplicationFailureRequest{
+		FileName: task.FileName,
+		DataNode: d.nodeID(),
+		Target:   task.Target,
+		Attempts: int32(task.Attempts),
+		Error:    task.LastError,
+	})
+	if err != nil {
+		log.Printf("Failed to report replication failure: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package datanode
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	// time between scrub passes when ScrubIntervalSeconds is 0
+	defaultScrubInterval = 24 * time.Hour
+	// files written more recently are left to the next pass, their new checksum may not be indexed yet
+	scrubSettle = time.Minute
+)
+
+/*
+scrub re-reads every committed replica once per ScrubIntervalSeconds and
+compares its content with the checksum it was committed with. Data that
+changed on disk without being written (bit rot, a failing sector) is reported
+to the master, which stops reading from the replica and re-replicates the
+file from a healthy copy. Reads go through the IO slots as background
+traffic, so a pass yields to clients
+*/
+func (d *DataNodeServer) scrub() {
+	interval := configTimeout(d.ScrubIntervalSeconds, defaultScrubInterval)
+	if interval == 0 {
+		return
+	}
+	for d.sleep(interval) {
+		start := time.Now()
+		var bad []string
+		checked := 0
+		for _, fileName := range d.replicaIndex.names() {
+			ok, err := d.scrubReplica(fileName)
+			if ok {
+				checked++
+			}
+			if err != nil {
+				log.Printf("scrub: replica of %s is bad: %v", fileName, err)
+				bad = append(bad, fileName)
+			}
+		}
+		log.Printf("scrub: checked %d replica(s) in %v, %d bad", checked, time.Since(start).Round(time.Millisecond), len(bad))
+		if len(bad) > 0 {
+			d.reportBadReplicas(bad, fmt.Sprintf("checksum mismatch found by the scrubber of DataNode %d", d.nodeID()))
+		}
+	}
+}
+
+/*
+scrubReplica verifies the stored content of fileName against the checksum
+of its replica. It returns false when the file was skipped: gone, being
+uploaded or just written. The error tells the replica is bad
+*/
+func (d *DataNodeServer) scrubReplica(fileName string) (bool, error) {
+	replica, ok := d.replicaIndex.get(fileName)
+	if !ok || d.uploads.uploading(fileName) > 0 {
+		return false, nil
+	}
+	path, err := d.storagePath(fileName)
+	if err != nil {
+		return false, nil
+	}
+	before, err := os.Stat(path)
+	if os.IsNotExist(err) || (err == nil && time.Since(before.ModTime()) < scrubSettle) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	checksum, err := d.scrubChecksum(path)
+	if err != nil {
+		return false, fmt.Errorf("reading it failed: %v", err)
+	}
+	// rewritten meanwhile, the checksum was of neither version
+	after, err := os.Stat(path)
+	if err != nil || after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		return false, nil
+	}
+	if current, ok := d.replicaIndex.get(fileName); !ok || current != replica {
+		return false, nil
+	}
+	// the cache holds what was read, StatFile then reports a bad replica corrupt
+	d.checksums.store(path, cachedChecksum{checksum: checksum, size: after.Size(), modTime: after.ModTime(), verified: time.Now()})
+	if checksum != replica.Checksum {
+		d.dropBlob(fileName)
+		return true, fmt.Errorf("stored data hashes to %s, committed as %s", checksum, replica.Checksum)
+	}
+	return true, nil
+}
+
+// scrubChecksum hashes the content of the file at path, taking a background IO slot for every chunk read
+func (d *DataNodeServer) scrubChecksum(path string) (string, error) {
+	file, err := d.openStored(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	reader := slottedReader{Reader: file, ctx: context.Background(), class: backgroundTraffic, traffic: d.traffic}
+	buf := d.chunks.get()
+	defer d.chunks.put(buf)
+	if _, err := io.CopyBuffer(hash, reader, *buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
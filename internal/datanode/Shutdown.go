@@ -0,0 +1,68 @@
+package datanode
+
+import (
+	"context"
+	"log"
+	pb "proj/Services"
+	"time"
+)
+
+// how long a shutdown waits for calls in progress when ShutdownTimeoutSeconds is 0
+const defaultShutdownTimeout = 30 * time.Second
+
+/*
+shutdown stops the DataNode on SIGINT or SIGTERM. The heartbeats stop and a
+last one tells the master the node is going offline, so it stops sending
+clients and replications here at once rather than after the heartbeat
+timeout. The listeners then close and the calls in progress get up to
+ShutdownTimeoutSeconds to finish before they are cut off. Upload sessions
+still open are kept for the restart to resume, or aborted, see
+UploadSessionManager.close
+*/
+func (d *DataNodeServer) shutdown() {
+	log.Printf("DataNode %d shutting down", d.nodeID())
+	d.stopping.Store(true)
+	d.sendOffline()
+
+	stopped := make(chan struct{})
+	go func() {
+		d.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	timeout := configTimeout(d.ShutdownTimeoutSeconds, defaultShutdownTimeout)
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		log.Printf("calls still in progress after %v, cutting them off", timeout)
+		d.grpcServer.Stop()
+		<-stopped
+	}
+	d.uploads.close()
+	d.Stop()
+	log.Printf("DataNode %d stopped", d.nodeID())
+}
+
+// sendOffline sends the last heartbeat, telling the master the DataNode is going offline
+func (d *DataNodeServer) sendOffline() {
+	conn, err := d.dialMaster()
+	if err != nil {
+		log.Printf("Cannot Send KeepAlive %v", err)
+		return
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dataNode := d.nodeID()
+	_, err = pb.NewFileServiceClient(conn).KeepAlive(d.withClusterSecret(ctx), &pb.KeepAliveRequest{
+		DataNode_IP: d.IP,
+		PortNumber:  []string{d.PortForMaster, d.PortForClient, d.PortForDN},
+		IsAlive:     false,
+		SentUnixMs:  time.Now().UnixMilli(),
+		DataNode:    &dataNode,
+		NodeUuid:    d.identity.UUID,
+		ClusterId:   d.cluster(),
+	})
+	if err != nil {
+		log.Printf("Cannot Send KeepAlive %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package datanode
+
+import (
+	"context"
+	"crypto/subtle"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+/*
+dialPeer connects to another DataNode. Its calls say they come from a
+DataNode, with the cluster secret and the cluster ID, so a DataNode serving
+every role on one port tells them from client calls, see fromCluster.
+Calls without a deadline get one, see outboundTimeout
+*/
+func (d *DataNodeServer) dialPeer(addr string) (*grpc.ClientConn, error) {
+	return grpc.Dial(addr, grpc.WithTransportCredentials(d.dialCredentials),
+		grpc.WithChainUnaryInterceptor(d.peerInterceptor),
+		grpc.WithChainStreamInterceptor(d.peerStreamInterceptor))
+}
+
+// asPeer marks an outgoing call as coming from a DataNode of the cluster
+func (d *DataNodeServer) asPeer(ctx context.Context) context.Context {
+	return d.withClusterID(d.withClusterSecret(metadata.AppendToOutgoingContext(ctx, "dfs-role", "datanode")))
+}
+
+func (d *DataNodeServer) peerInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, cancel := withDeadline(ctx, d.outboundTimeout(method))
+	defer cancel()
+	return invoker(d.asPeer(ctx), method, req, reply, cc, opts...)
+}
+
+func (d *DataNodeServer) peerStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx, cancel := withDeadline(ctx, d.outboundTimeout(method))
+	stream, err := streamer(d.asPeer(ctx), desc, cc, method, opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &cancelingStream{ClientStream: stream, cancel: cancel, serverStreams: desc.ServerStreams}, nil
+}
+
+/*
+fromCluster reports whether a call comes from the master or another
+DataNode, as they say in "dfs-role" metadata. When the cluster has a secret
+the call must present it, clients can't pass for DataNodes. Without one
+the role is taken at its word, which checkSecrets allows only on a
+DataNode without tokens to protect
+*/
+func (d *DataNodeServer) fromCluster(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if strings.Join(md.Get("dfs-role"), "") == "" {
+		return false
+	}
+	if d.ClusterSecret == "" {
+		return true
+	}
+	secret := strings.Join(md.Get("cluster-secret"), "")
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(d.ClusterSecret)) == 1
+}
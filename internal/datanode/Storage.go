@@ -0,0 +1,29 @@
+package datanode
+
+import "strings"
+
+// names Windows reserves for devices in every directory, with or without extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+/*
+Rejects path components NTFS can't store or would reinterpret: characters
+such as ':' (drive letters, alternate data streams), reserved device names
+and trailing dots or spaces, which Windows silently strips. validComponent
+applies it on Windows, it is here so every platform can check it
+*/
+func validWindowsComponent(component string) bool {
+	if strings.ContainsAny(component, `<>:"|?*`) {
+		return false
+	}
+	if strings.HasSuffix(component, ".") || strings.HasSuffix(component, " ") {
+		return false
+	}
+	base, _, _ := strings.Cut(component, ".")
+	return !reservedNames[strings.ToUpper(base)]
+}
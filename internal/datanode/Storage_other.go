@@ -0,0 +1,21 @@
+//go:build !windows
+
+package datanode
+
+import "os"
+
+// validComponent accepts any component, only "/" and NUL are special here
+// and storagePath rejects both before
+func validComponent(component string) bool {
+	return true
+}
+
+// syncDir flushes a directory so newly created entries survive a crash
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
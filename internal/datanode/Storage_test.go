@@ -0,0 +1,81 @@
+package datanode
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestValidWindowsComponent(t *testing.T) {
+	tests := []struct {
+		component string
+		valid     bool
+	}{
+		{"report.txt", true},
+		{"data", true},
+		{".hidden", true},
+		{"CONSOLE", true},
+		{"COM10", true},
+		{"con", false},
+		{"CON", false},
+		{"NUL", false},
+		{"nul.txt", false},
+		{"COM1", false},
+		{"com1.log", false},
+		{"LPT9", false},
+		{"AUX.tar.gz", false},
+		{"name.", false},
+		{"name ", false},
+		{"...", false},
+		{"c:", false},
+		{"file:stream", false},
+		{"a<b", false},
+		{"a>b", false},
+		{`a"b`, false},
+		{"a|b", false},
+		{"a?b", false},
+		{"a*b", false},
+	}
+	for _, test := range tests {
+		if valid := validWindowsComponent(test.component); valid != test.valid {
+			t.Errorf("validWindowsComponent(%q) = %v, want %v", test.component, valid, test.valid)
+		}
+	}
+}
+
+// validComponent applies the Windows rules on Windows only, elsewhere storagePath's checks are enough
+func TestValidComponent(t *testing.T) {
+	for _, component := range []string{"CON", "name.", "file:stream", "report.txt"} {
+		want := true
+		if runtime.GOOS == "windows" {
+			want = validWindowsComponent(component)
+		}
+		if valid := validComponent(component); valid != want {
+			t.Errorf("validComponent(%q) = %v, want %v on %s", component, valid, want, runtime.GOOS)
+		}
+	}
+}
+
+func TestStorageDir(t *testing.T) {
+	tests := []struct {
+		name string
+		node *DataNodeServer
+		want string
+	}{
+		{"IPv4", &DataNodeServer{IP: "10.0.0.5", PortForClient: ":50052"}, "./uploaded_10.0.0.5_50052"},
+		{"IPv6", &DataNodeServer{IP: "2001:db8::1", PortForClient: ":50052"}, "./uploaded_2001_db8__1_50052"},
+		{"link-local IPv6", &DataNodeServer{IP: "fe80::1%eth0", PortForClient: ":50052"}, "./uploaded_fe80__1_eth0_50052"},
+		{"hostname", &DataNodeServer{IP: "dn1.example.com", PortForClient: ":50052"}, "./uploaded_dn1.example.com_50052"},
+		{"port with a host", &DataNodeServer{IP: "10.0.0.5", PortForClient: "127.0.0.1:50052"}, "./uploaded_10.0.0.5_50052"},
+		{"port with an IPv6 host", &DataNodeServer{IP: "::1", PortForClient: "[::1]:50052"}, "./uploaded___1_50052"},
+		{"DataDir", &DataNodeServer{IP: "10.0.0.5", PortForClient: ":50052", DataDir: "/srv/dfs"}, "/srv/dfs"},
+		{"DataDirs", &DataNodeServer{IP: "10.0.0.5", PortForClient: ":50052", DataDirs: []string{"/disk1", "/disk2"}}, "/disk1"},
+		{"DataDir over DataDirs", &DataNodeServer{DataDir: "/srv/dfs", DataDirs: []string{"/disk1"}}, "/srv/dfs"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.node.storageDir(); got != test.want {
+				t.Errorf("storageDir() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
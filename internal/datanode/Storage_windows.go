@@ -0,0 +1,12 @@
+package datanode
+
+// validComponent rejects the components Windows can't store, see validWindowsComponent
+func validComponent(component string) bool {
+	return validWindowsComponent(component)
+}
+
+// syncDir is a no-op, Windows can't open directories for flushing and
+// persists directory entries with the file's metadata
+func syncDir(dir string) error {
+	return nil
+}
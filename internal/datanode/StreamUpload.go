@@ -0,0 +1,180 @@
+package datanode
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	pb "proj/Services"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*
+StreamUpload receives a whole file over one client stream: the first message
+names the file, each message carries the next chunk, written as it arrives,
+and the file is staged aside and renamed into place when the client closes
+its side. No upload session is kept, a stream that breaks off leaves no
+session behind and its partial file is removed. A replicating DataNode may
+name DataNodes to forward the file to, see replicatePipeline
+*/
+func (d *DataNodeServer) StreamUpload(stream pb.FileService_StreamUploadServer) error {
+	ctx := stream.Context()
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return status.Error(codes.InvalidArgument, "empty upload stream")
+	}
+	if err != nil {
+		return err
+	}
+	fileName := req.FileName
+	log.Printf("StreamUpload request %s", fileName)
+	d.activeTransfers.Add(1)
+	defer d.activeTransfers.Add(-1)
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	encoding := strings.Join(md.Get("content-encoding"), "")
+	if err := checkEncoding(encoding); err != nil {
+		return err
+	}
+	uploadToken := strings.Join(md.Get("upload-token"), "")
+	outMeta := metadata.Pairs("client-ip", strings.Join(md.Get("client-ip"), ","), "client-port", strings.Join(md.Get("client-port"), ","))
+
+	if err := d.refuseDraining(); err != nil {
+		return err
+	}
+	// a replicating DataNode announces the size, a file that can't fit is refused before any chunk
+	if err := d.checkFileSize(req.ExpectedSize); err != nil {
+		return err
+	}
+	if err := d.admit(max(req.ExpectedSize, 1)); err != nil {
+		return err
+	}
+	release, err := d.admitSession()
+	if err != nil {
+		return err
+	}
+	defer release()
+	file, err := d.createStaged(fileName, newSessionID())
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			// Windows can't remove a file that is still open
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	// a replication pipeline goes on to the next DataNode, each chunk is forwarded once written here
+	forward := d.forwardUpload(ctx, req)
+	defer forward.close()
+
+	class := d.trafficClassOf(ctx)
+	var written int64
+	// hash of what was written, checked against file_sha256 if any message sets it
+	hash := sha256.New()
+	wantChecksum := ""
+	for {
+		if req.FileName != "" && req.FileName != fileName {
+			return status.Errorf(codes.InvalidArgument, "stream for %s received a chunk of %s", fileName, req.FileName)
+		}
+		if req.FileSha256 != "" {
+			wantChecksum = req.FileSha256
+		}
+		if err := d.writeStreamChunk(ctx, class, file, hash, req, written); err != nil {
+			return err
+		}
+		forward.send(req)
+		written += int64(len(req.FileContent))
+
+		req, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if checksum := hex.EncodeToString(hash.Sum(nil)); wantChecksum != "" && checksum != wantChecksum {
+		return checksumMismatch("file "+fileName, checksum, wantChecksum)
+	}
+	// make the upload durable before the master counts it as a replica
+	if err := d.faults.SyncFile(file); err != nil {
+		return fmt.Errorf("error syncing file: %v", err)
+	}
+	if d.bypassCache(written) {
+		dropCache(file, 0, 0)
+	}
+	file.Close()
+	committed = true
+	staged, storedEncoding, err := d.encodeStaged(file.Name(), encoding, nil)
+	if err != nil {
+		return err
+	}
+	savePath, err := d.commitStaged(staged, fileName, d.syncRequested(ctx))
+	if err != nil {
+		return err
+	}
+	d.setEncoding(fileName, storedEncoding)
+	if storedEncoding == encoding {
+		d.checksums.set(savePath, hex.EncodeToString(hash.Sum(nil)))
+	}
+	log.Printf("Stream upload finished for %s, %d bytes", fileName, written)
+
+	go notifyMasterOfUpload(d, metadata.NewOutgoingContext(context.Background(), outMeta), fileName, savePath, uploadToken, false)
+	// the DataNodes down the pipeline answer first, the response acknowledges them up the chain
+	failed, full := forward.finish()
+	return stream.SendAndClose(&pb.FileUploadResponse{Message: "Upload complete", Failed: failed, Full: full})
+}
+
+// writeStreamChunk appends one chunk of a stream upload to file and hash, its offset if given must be where the file ends
+func (d *DataNodeServer) writeStreamChunk(ctx context.Context, class trafficClass, file *os.File, hash hash.Hash, req *pb.FileUploadRequest, written int64) error {
+	if len(req.FileContent) > d.ChunkBytes {
+		return status.Errorf(codes.ResourceExhausted,
+			"chunk of %d bytes is larger than this DataNode's %d byte chunks, see chunk_bytes in GetCapabilities",
+			len(req.FileContent), d.ChunkBytes)
+	}
+	if err := d.checkFileSize(written + int64(len(req.FileContent))); err != nil {
+		return err
+	}
+	if req.Offset != nil && *req.Offset != written {
+		return status.Errorf(codes.OutOfRange, "chunk at offset %d, the stream is at %d", *req.Offset, written)
+	}
+	if err := checkChunk(req); err != nil {
+		return err
+	}
+	if err := d.admit(int64(len(req.FileContent))); err != nil {
+		return err
+	}
+	// injected fault: acknowledge the chunk without writing it
+	if d.faults.DropChunk() {
+		log.Printf("fault injection: dropped chunk of %s", req.FileName)
+		return nil
+	}
+	if err := d.traffic.acquire(ctx, class); err != nil {
+		return err
+	}
+	_, err := file.Write(req.FileContent)
+	d.traffic.release()
+	if err != nil {
+		return fmt.Errorf("error writing file content: %v", err)
+	}
+	hash.Write(req.FileContent)
+	// large upload: start writing this chunk out and evict the ones already written
+	if end := written + int64(len(req.FileContent)); d.bypassCache(end) {
+		startWriteback(file, written, int64(len(req.FileContent)))
+		dropCache(file, 0, written)
+	}
+	return nil
+}
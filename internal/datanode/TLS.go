@@ -0,0 +1,15 @@
+package datanode
+
+import (
+	"context"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// withClusterSecret adds the cluster secret the master checks on calls from DataNodes
+func (d *DataNodeServer) withClusterSecret(ctx context.Context) context.Context {
+	if d.ClusterSecret == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, "cluster-secret", d.ClusterSecret)
+}
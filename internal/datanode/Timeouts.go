@@ -0,0 +1,137 @@
+package datanode
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/tap"
+)
+
+// limits applied when the config leaves a timeout at 0, -1 disables one
+const (
+	defaultUploadChunkTimeout = time.Minute
+	defaultDownloadTimeout    = time.Hour
+	defaultReplicateTimeout   = time.Hour
+	defaultUploadIdleTimeout  = 5 * time.Minute
+	defaultMasterTimeout      = 30 * time.Second
+	defaultPeerTimeout        = 30 * time.Second
+)
+
+// configTimeout turns a config value in seconds into a limit, 0 for none
+func configTimeout(seconds int, fallback time.Duration) time.Duration {
+	switch {
+	case seconds < 0:
+		return 0
+	case seconds == 0:
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// rpcTimeout is the longest a call of the gRPC method may run, 0 when unlimited
+func (d *DataNodeServer) rpcTimeout(fullMethod string) time.Duration {
+	switch path.Base(fullMethod) {
+	case "UploadFile", "BeginUploadFile", "UpdateUploadFile", "EndUploadFile", "CancelUpload":
+		return configTimeout(d.UploadChunkTimeoutSeconds, defaultUploadChunkTimeout)
+	case "DownloadFile", "StreamDownload", "StreamUpload":
+		return configTimeout(d.DownloadTimeoutSeconds, defaultDownloadTimeout)
+	case "Replicate", "RebuildBlock":
+		return configTimeout(d.ReplicateTimeoutSeconds, defaultReplicateTimeout)
+	}
+	return 0
+}
+
+/*
+outboundTimeout is the longest an outbound call of the gRPC method to a
+peer may run: replications and streamed transfers get ReplicateTimeoutSeconds,
+the other calls PeerTimeoutSeconds
+*/
+func (d *DataNodeServer) outboundTimeout(fullMethod string) time.Duration {
+	switch path.Base(fullMethod) {
+	case "Replicate", "StreamUpload", "StreamDownload":
+		return configTimeout(d.ReplicateTimeoutSeconds, defaultReplicateTimeout)
+	}
+	return configTimeout(d.PeerTimeoutSeconds, defaultPeerTimeout)
+}
+
+/*
+withDeadline bounds a call by limit unless its context has a deadline
+already, the caller's own wins. The cancel func is a no-op when no deadline
+was added
+*/
+func withDeadline(ctx context.Context, limit time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || limit == 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, limit)
+}
+
+// cancelingStream releases the deadline of a client stream once it ends
+type cancelingStream struct {
+	grpc.ClientStream
+	cancel context.CancelFunc
+	// the server sends a stream of replies, only an error or io.EOF ends it
+	serverStreams bool
+}
+
+func (s *cancelingStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil || !s.serverStreams {
+		s.cancel()
+	}
+	return err
+}
+
+// timeoutError reports a call cut short by its limit, other errors pass through
+func timeoutError(ctx context.Context, fullMethod string, limit time.Duration, err error) error {
+	if err != nil && limit > 0 && ctx.Err() == context.DeadlineExceeded {
+		return status.Errorf(codes.DeadlineExceeded, "%s exceeded the DataNode's %v limit", path.Base(fullMethod), limit)
+	}
+	return err
+}
+
+// streamCancelKey holds the func releasing the deadline timeoutTap gave a stream
+type streamCancelKey struct{}
+
+/*
+timeoutTap gives the stream of every upload, download and replicate call
+its limit as a deadline before the handler runs. gRPC fails a send held back
+by a client that stopped reading, or a receive waiting on one that stopped
+sending, once its stream's context is done, so no call outlives its limit
+*/
+func (d *DataNodeServer) timeoutTap(ctx context.Context, info *tap.Info) (context.Context, error) {
+	limit := d.rpcTimeout(info.FullMethodName)
+	if limit == 0 {
+		return ctx, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, limit)
+	return context.WithValue(ctx, streamCancelKey{}, cancel), nil
+}
+
+// releaseDeadline stops the timer of the deadline timeoutTap gave the stream of ctx
+func releaseDeadline(ctx context.Context) {
+	if cancel, ok := ctx.Value(streamCancelKey{}).(context.CancelFunc); ok {
+		cancel()
+	}
+}
+
+/*
+timeoutInterceptor reports upload, download and replicate calls cut short by
+the deadline timeoutTap set. Handlers stop waiting for IO slots, peers and
+the client once it passes, releasing the file handles they hold
+*/
+func (d *DataNodeServer) timeoutInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	defer releaseDeadline(ctx)
+	response, err := handler(ctx, req)
+	return response, timeoutError(ctx, info.FullMethod, d.rpcTimeout(info.FullMethod), err)
+}
+
+func (d *DataNodeServer) timeoutStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx := stream.Context()
+	defer releaseDeadline(ctx)
+	return timeoutError(ctx, info.FullMethod, d.rpcTimeout(info.FullMethod), handler(srv, stream))
+}
@@ -0,0 +1,134 @@
+package datanode
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	pb "proj/Services"
+	"proj/internal/token"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*
+checkSecrets refuses tokens without a cluster secret, a client claiming to
+be the master or a DataNode would otherwise skip them, see fromCluster
+*/
+func (d *DataNodeServer) checkSecrets() error {
+	if (d.AdminToken != "" || d.TokenSecret != "") && d.ClusterSecret == "" {
+		return errors.New("AdminToken and TokenSecret need a ClusterSecret")
+	}
+	return nil
+}
+
+/*
+authorizeRequest checks the "authorization" metadata of a client's call on
+any port; calls of the master and other DataNodes present the cluster
+secret instead, see fromCluster. A scoped token must allow the operation on
+the file, or on the prefix of a listing, otherwise, once the DataNode has an
+AdminToken, the call needs it
+*/
+func (d *DataNodeServer) authorizeRequest(ctx context.Context, req interface{}) error {
+	if d.fromCluster(ctx) {
+		return nil
+	}
+	var operation, fileName string
+	switch in := req.(type) {
+	case *pb.FileUploadRequest:
+		operation, fileName = "write", in.FileName
+	case *pb.GetUploadOffsetRequest:
+		operation, fileName = "write", in.FileName
+	case *pb.CancelUploadRequest:
+		operation, fileName = "write", in.FileName
+	case *pb.GetUploadProgressRequest:
+		operation, fileName = "write", in.FileName
+	case *pb.FileDownloadRequest:
+		operation, fileName = "read", in.FileName
+	case *pb.DownloadVersionRequest:
+		operation, fileName = "read", in.FileName
+	case *pb.GetFileChecksumRequest:
+		operation, fileName = "read", in.FileName
+	case *pb.StatFileRequest:
+		operation, fileName = "read", in.FileName
+	case *pb.ListLocalFilesRequest:
+		operation, fileName = "list", in.Prefix
+	case *pb.FileDeleteRequest:
+		operation, fileName = "delete", in.FileName
+	case *pb.GetCapabilitiesRequest:
+		return nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		bearer := strings.TrimPrefix(value, "Bearer ")
+		if strings.HasPrefix(bearer, token.Version) {
+			claims, err := token.Parse(d.TokenSecret, bearer)
+			if err != nil {
+				return err
+			}
+			if operation == "" {
+				return status.Error(codes.PermissionDenied, "scoped tokens can't make this call")
+			}
+			// a listing above the token's directory is narrowed to it
+			if in, ok := req.(*pb.ListLocalFilesRequest); ok {
+				in.Prefix = claims.Narrow(in.Prefix)
+				fileName = in.Prefix
+			}
+			if !claims.Allows(operation, fileName) {
+				return status.Errorf(codes.PermissionDenied, "token doesn't allow %s on %q", operation, fileName)
+			}
+			return nil
+		}
+		if d.AdminToken != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(d.AdminToken)) == 1 {
+			return nil
+		}
+	}
+	if d.AdminToken != "" {
+		return status.Error(codes.Unauthenticated, "calls need the admin token or a scoped token")
+	}
+	return nil
+}
+
+func (d *DataNodeServer) tokenInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := d.authorizeRequest(ctx, req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (d *DataNodeServer) tokenStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &authorizedStream{ServerStream: stream, d: d})
+}
+
+// authorizedStream checks the first message of a stream, which names the file
+type authorizedStream struct {
+	grpc.ServerStream
+	d       *DataNodeServer
+	checked bool
+}
+
+func (s *authorizedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil || s.checked {
+		return err
+	}
+	s.checked = true
+	return s.d.authorizeRequest(s.Context(), m)
+}
+
+// authorizedHTTP accepts the HTTPToken or a scoped token allowing to read fileName
+func (d *DataNodeServer) authorizedHTTP(r *http.Request, fileName string) bool {
+	bearer := r.URL.Query().Get("token")
+	if header, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		bearer = header
+	}
+	if strings.HasPrefix(bearer, token.Version) {
+		claims, err := token.Parse(d.TokenSecret, bearer)
+		return err == nil && claims.Allows("read", fileName)
+	}
+	return subtle.ConstantTimeCompare([]byte(bearer), []byte(d.HTTPToken)) == 1
+}
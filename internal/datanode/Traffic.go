@@ -0,0 +1,173 @@
+package datanode
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// trafficClass separates client transfers from background replication
+type trafficClass int
+
+const (
+	// uploads and downloads of clients, and HTTP reads
+	clientTraffic trafficClass = iota
+	// replication and rebalancing, called by the master and other DataNodes
+	backgroundTraffic
+)
+
+const (
+	defaultIOSlots          = 8
+	defaultClientWeight     = 4
+	defaultBackgroundWeight = 1
+)
+
+/*
+trafficScheduler hands out a fixed number of IO slots, one per chunk read or
+written. When both classes are waiting, slots go to the class with the least
+service relative to its weight, so clients get ClientWeight slots for every
+BackgroundWeight slots of replication; when only one class is waiting it gets
+every free slot, so repairs run at whatever capacity clients leave unused
+*/
+type trafficScheduler struct {
+	mutex   sync.Mutex
+	free    int
+	weights [2]int64
+	// slots granted to each class since both last competed
+	served  [2]int64
+	waiting [2][]chan struct{}
+}
+
+func newTrafficScheduler(slots, clientWeight, backgroundWeight int) *trafficScheduler {
+	return &trafficScheduler{
+		free:    slots,
+		weights: [2]int64{int64(clientWeight), int64(backgroundWeight)},
+	}
+}
+
+// grant records a slot given to class, called with t.mutex held
+func (t *trafficScheduler) grant(class trafficClass) {
+	other := 1 - class
+	// fairness only matters while both compete, an idle class earns no credit
+	if len(t.waiting[other]) == 0 {
+		t.served = [2]int64{}
+	}
+	t.served[class]++
+}
+
+// acquire waits for an IO slot for class, or until ctx is done
+func (t *trafficScheduler) acquire(ctx context.Context, class trafficClass) error {
+	t.mutex.Lock()
+	if t.free > 0 && len(t.waiting[clientTraffic]) == 0 && len(t.waiting[backgroundTraffic]) == 0 {
+		t.free--
+		t.grant(class)
+		t.mutex.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	t.waiting[class] = append(t.waiting[class], ready)
+	t.mutex.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		t.mutex.Lock()
+		for i, waiter := range t.waiting[class] {
+			if waiter == ready {
+				t.waiting[class] = append(t.waiting[class][:i], t.waiting[class][i+1:]...)
+				t.mutex.Unlock()
+				return ctx.Err()
+			}
+		}
+		t.mutex.Unlock()
+		// granted while giving up, hand the slot on
+		t.release()
+		return ctx.Err()
+	}
+}
+
+// release returns a slot, giving it to the waiting class that is furthest behind its weight
+func (t *trafficScheduler) release() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	client, background := len(t.waiting[clientTraffic]) > 0, len(t.waiting[backgroundTraffic]) > 0
+	var class trafficClass
+	switch {
+	case client && background:
+		// served[client]/weight[client] <= served[background]/weight[background]
+		if t.served[clientTraffic]*t.weights[backgroundTraffic] <= t.served[backgroundTraffic]*t.weights[clientTraffic] {
+			class = clientTraffic
+		} else {
+			class = backgroundTraffic
+		}
+	case client:
+		class = clientTraffic
+	case background:
+		class = backgroundTraffic
+	default:
+		t.free++
+		return
+	}
+	ready := t.waiting[class][0]
+	t.waiting[class] = t.waiting[class][1:]
+	t.grant(class)
+	close(ready)
+}
+
+// setUpTraffic applies the default IO slots and weights and creates the scheduler
+func (d *DataNodeServer) setUpTraffic() error {
+	if d.IOSlots == 0 {
+		d.IOSlots = defaultIOSlots
+	}
+	if d.ClientWeight == 0 {
+		d.ClientWeight = defaultClientWeight
+	}
+	if d.BackgroundWeight == 0 {
+		d.BackgroundWeight = defaultBackgroundWeight
+	}
+	if d.IOSlots < 0 || d.ClientWeight < 0 || d.BackgroundWeight < 0 {
+		return errors.New("IOSlots, ClientWeight and BackgroundWeight can't be negative")
+	}
+	d.traffic = newTrafficScheduler(d.IOSlots, d.ClientWeight, d.BackgroundWeight)
+	return nil
+}
+
+/*
+trafficClassOf classifies a call by who makes it: the master and other
+DataNodes say who they are and present the cluster secret, see fromCluster,
+every other call is a client's whichever port it arrived on
+*/
+func (d *DataNodeServer) trafficClassOf(ctx context.Context) trafficClass {
+	if d.fromCluster(ctx) {
+		return backgroundTraffic
+	}
+	return clientTraffic
+}
+
+// slottedReader takes an IO slot for every Read of the underlying reader
+type slottedReader struct {
+	io.Reader
+	ctx     context.Context
+	class   trafficClass
+	traffic *trafficScheduler
+}
+
+func (r slottedReader) Read(p []byte) (int, error) {
+	if err := r.traffic.acquire(r.ctx, r.class); err != nil {
+		return 0, err
+	}
+	defer r.traffic.release()
+	return r.Reader.Read(p)
+}
+
+// Seek lets http.ServeContent serve ranges, the underlying reader must be a file
+func (r slottedReader) Seek(offset int64, whence int) (int64, error) {
+	return r.Reader.(io.Seeker).Seek(offset, whence)
+}
+
+// clientReader reads for an HTTP client, in the client traffic class
+func (d *DataNodeServer) clientReader(ctx context.Context, reader io.Reader) slottedReader {
+	return slottedReader{Reader: reader, ctx: ctx, class: clientTraffic, traffic: d.traffic}
+}
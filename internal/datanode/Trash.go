@@ -0,0 +1,145 @@
+package datanode
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	pb "proj/Services"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// directory of every data directory holding the copies of deleted files until they are purged, a reserved name
+	trashDir = ".dfs-trash"
+	// time between looks for trashed copies past their purge time
+	trashPurgeInterval = time.Minute
+)
+
+/*
+trashPath is where the data directory root keeps the copy of fileName
+trashed under id. Every delete has its own directory, named after the ID
+and the purge time, so a name deleted twice keeps both copies
+*/
+func trashPath(root, fileName string, id, purgeUnixMs int64) string {
+	return filepath.Join(root, trashDir, fmt.Sprintf("%d-%d", id, purgeUnixMs), filepath.FromSlash(fileName))
+}
+
+// isTrashPath tells whether the relative path lies in the trash directory
+func isTrashPath(relative string) bool {
+	first, _, _ := strings.Cut(filepath.ToSlash(relative), "/")
+	return first == trashDir
+}
+
+// moveToTrash moves the stored file at filePath to the trash of its data directory, must be called with blobMutex held
+func (d *DataNodeServer) moveToTrash(filePath, fileName string, id, purgeUnixMs int64) error {
+	if _, err := os.Lstat(filePath); err != nil {
+		return err
+	}
+	trashed := trashPath(d.volumeRoot(filePath), fileName, id, purgeUnixMs)
+	if err := d.mkdirStored(filepath.Dir(trashed)); err != nil {
+		return err
+	}
+	return d.moveStored(filePath, trashed)
+}
+
+// findTrashed returns the data directory and path of the copy of fileName trashed under id
+func (d *DataNodeServer) findTrashed(fileName string, id int64) (string, string, bool) {
+	prefix := strconv.FormatInt(id, 10) + "-"
+	for _, root := range d.volumeDirs() {
+		entries, err := os.ReadDir(filepath.Join(root, trashDir))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), prefix) {
+				continue
+			}
+			path := filepath.Join(root, trashDir, entry.Name(), filepath.FromSlash(fileName))
+			if _, err := os.Lstat(path); err == nil {
+				return root, path, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+/*
+RestoreFile moves a trashed copy back under its name, in the data directory
+it was trashed from. Only the master calls it, clients restore files through
+the master's RestoreFile which gives the trash ID and the metadata the copy
+had when it was deleted
+*/
+func (d *DataNodeServer) RestoreFile(ctx context.Context, req *pb.RestoreFileRequest) (*pb.RestoreFileResponse, error) {
+	if !d.fromCluster(ctx) {
+		return nil, status.Error(codes.PermissionDenied, "restores go through the master's RestoreFile")
+	}
+	log.Printf("RestoreFile %s from trash %d", req.FileName, req.TrashId)
+	existing, err := d.storagePath(req.FileName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(existing); err == nil {
+		return nil, status.Errorf(codes.AlreadyExists, "%s already exists", req.FileName)
+	}
+	root, trashed, ok := d.findTrashed(req.FileName, req.TrashId)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "%s isn't in the trash", req.FileName)
+	}
+	restored := filepath.Join(root, filepath.FromSlash(req.FileName))
+	if err := d.mkdirStored(filepath.Dir(restored)); err != nil {
+		return nil, fmt.Errorf("error creating dir: %v", err)
+	}
+	d.blobMutex.Lock()
+	err = d.moveStored(trashed, restored)
+	d.blobMutex.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("Rename fail %v", err)
+	}
+	if err := syncDir(filepath.Dir(restored)); err != nil {
+		log.Printf("sync of %s failed: %v", filepath.Dir(restored), err)
+	}
+	d.pruneEmptyDirs(trashed)
+
+	d.setEncoding(req.FileName, req.ContentEncoding)
+	d.replicaIndex.set(req.FileName, &replicaInfo{Checksum: req.Checksum, Generation: req.Generation})
+	d.deduplicate(restored, req.FileName)
+	log.Printf("Restored %s", req.FileName)
+	return &pb.RestoreFileResponse{FilePath: restored}, nil
+}
+
+// purgeTrash removes the trashed copies past their purge time
+func (d *DataNodeServer) purgeTrash() {
+	for d.sleep(trashPurgeInterval) {
+		now := time.Now().UnixMilli()
+		for _, root := range d.volumeDirs() {
+			dir := filepath.Join(root, trashDir)
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				_, purge, _ := strings.Cut(entry.Name(), "-")
+				purgeUnixMs, err := strconv.ParseInt(purge, 10, 64)
+				if err != nil || purgeUnixMs > now {
+					continue
+				}
+				purged := filepath.Join(dir, entry.Name())
+				size := d.countedBytes(purged)
+				if err := os.RemoveAll(purged); err != nil {
+					log.Printf("purging %s failed: %v", purged, err)
+					continue
+				}
+				d.used.Add(-size)
+				log.Printf("purged %s from the trash", purged)
+			}
+			os.Remove(dir)
+		}
+	}
+}
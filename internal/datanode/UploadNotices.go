@@ -0,0 +1,227 @@
+package datanode
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	pb "proj/Services"
+	"proj/internal/fsutil"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// wait before the first retry of an upload notification and the most it doubles to
+	uploadNoticeRetryDelay    = 2 * time.Second
+	maxUploadNoticeRetryDelay = 5 * time.Minute
+)
+
+// uploadNotice is an upload the master has to be told of, see notifyMasterOfUpload
+type uploadNotice struct {
+	FileName        string `json:"FileName"`
+	FilePath        string `json:"FilePath"`
+	FileSize        int64  `json:"FileSize"`
+	Checksum        string `json:"Checksum"`
+	ContentEncoding string `json:"ContentEncoding"`
+	UploadToken     string `json:"UploadToken"`
+	Appended        bool   `json:"Appended"`
+	// unique to the stored upload and kept across retries, the master records it once
+	UploadID string `json:"UploadID"`
+	// the client to tell when the master records the file
+	ClientIP   string `json:"ClientIP"`
+	ClientPort string `json:"ClientPort"`
+	// when the upload finished, a later notice of the file supersedes it
+	Seq         int64     `json:"Seq"`
+	Attempts    int       `json:"Attempts"`
+	NextAttempt time.Time `json:"NextAttempt"`
+	LastError   string    `json:"LastError"`
+}
+
+/*
+uploadNotices queues the upload notifications the master didn't get, for
+it was unreachable or busy, persisted next to the storage root so a restart
+doesn't forget them; otherwise a file would sit on disk without ever
+appearing in the master's metadata. Each is retried after two seconds, the
+wait doubling with every failed attempt up to five minutes, until the
+master acknowledges it: the notification is delivered at least once, and
+the master tells retries by their upload ID. A file has one notice queued
+at most, the latest upload of it
+*/
+type uploadNotices struct {
+	mutex sync.Mutex
+	path  string
+	// file name -> notice
+	notices map[string]*uploadNotice
+}
+
+// loadUploadNotices reads back the queue
+func (d *DataNodeServer) loadUploadNotices() {
+	d.notices = &uploadNotices{
+		path:    d.storageDir() + ".notices.json",
+		notices: make(map[string]*uploadNotice),
+	}
+	content, err := os.ReadFile(d.notices.path)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(content, &d.notices.notices); err != nil {
+		log.Printf("bad upload notification queue %s: %v", d.notices.path, err)
+	}
+	if len(d.notices.notices) > 0 {
+		log.Printf("%d upload notification(s) still to send to the master", len(d.notices.notices))
+	}
+}
+
+/*
+failed queues notice after a failed attempt, or counts another failed
+attempt of it. A newer notice of the file already queued wins; an append
+to an upload still queued stays news of the whole upload
+*/
+func (q *uploadNotices) failed(notice uploadNotice, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if queued, ok := q.notices[notice.FileName]; ok {
+		if queued.Seq > notice.Seq {
+			return
+		}
+		if notice.Appended && !queued.Appended {
+			notice.Appended, notice.UploadToken = false, queued.UploadToken
+		}
+		notice.Attempts = max(notice.Attempts, queued.Attempts)
+	}
+	notice.Attempts++
+	notice.LastError = err.Error()
+	wait := uploadNoticeRetryDelay
+	for i := 1; i < notice.Attempts && wait < maxUploadNoticeRetryDelay; i++ {
+		wait *= 2
+	}
+	notice.NextAttempt = time.Now().Add(min(wait, maxUploadNoticeRetryDelay))
+	q.notices[notice.FileName] = &notice
+	q.save()
+}
+
+// done forgets the notices of fileName up to seq, the master got one as recent
+func (q *uploadNotices) done(fileName string, seq int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if queued, ok := q.notices[fileName]; ok && queued.Seq <= seq {
+		delete(q.notices, fileName)
+		q.save()
+	}
+}
+
+// due returns the notices whose next attempt has come
+func (q *uploadNotices) due(now time.Time) []uploadNotice {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var notices []uploadNotice
+	for _, notice := range q.notices {
+		if !now.Before(notice.NextAttempt) {
+			notices = append(notices, *notice)
+		}
+	}
+	return notices
+}
+
+// save writes the queue, called with the mutex held
+func (q *uploadNotices) save() {
+	content, err := json.Marshal(q.notices)
+	if err == nil {
+		err = fsutil.WriteFileAtomic(q.path, content, 0644)
+	}
+	if err != nil {
+		log.Printf("saving upload notification queue fail %v", err)
+	}
+}
+
+/*
+retryableNotice reports whether a notification that failed with err may
+get through later. A notification the master found malformed, or an upload
+it refused over a hard quota, is refused again, and the master has the copy
+deleted; the master may be unreachable, busy, or not yet know this DataNode
+or its cluster secret
+*/
+func retryableNotice(err error) bool {
+	code := status.Code(err)
+	return code != codes.InvalidArgument && code != codes.ResourceExhausted
+}
+
+// sendUploadNotice tells the master of an upload and keeps the checksum and generation it answers with
+func (d *DataNodeServer) sendUploadNotice(notice uploadNotice) error {
+	conn, err := d.dialMaster()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "client-ip", notice.ClientIP, "client-port", notice.ClientPort)
+	response, err := pb.NewFileServiceClient(conn).NotifyUploaded(d.withClusterSecret(ctx), &pb.NotifyUploadedRequest{
+		FileName:    notice.FileName,
+		DataNode:    d.nodeID(),
+		FilePath:    notice.FilePath,
+		FileSize:    notice.FileSize,
+		UploadToken: notice.UploadToken,
+		Checksum:    notice.Checksum,
+		// the master keeps the encoding with the file's metadata
+		ContentEncoding: notice.ContentEncoding,
+		Appended:        notice.Appended,
+		UploadId:        notice.UploadID,
+	})
+	if err != nil {
+		return err
+	}
+	if !response.Acknowledged {
+		return status.Error(codes.Unavailable, "the master didn't acknowledge the upload")
+	}
+	if notice.Checksum != "" {
+		d.replicaIndex.set(notice.FileName, &replicaInfo{Checksum: notice.Checksum, Generation: response.Generation, ExpiresUnixMs: response.ExpiresUnixMs})
+	}
+	return nil
+}
+
+// deliverUploadNotice sends notice and settles it in the queue: done, queued for a retry or dropped
+func (d *DataNodeServer) deliverUploadNotice(notice uploadNotice) {
+	err := d.sendUploadNotice(notice)
+	switch {
+	case err == nil:
+		if notice.Attempts > 0 {
+			log.Printf("the master got the upload notification of %s after %d failed attempt(s)", notice.FileName, notice.Attempts)
+		}
+		d.notices.done(notice.FileName, notice.Seq)
+	case retryableNotice(err):
+		if notice.Attempts == 0 {
+			log.Printf("Master notification failed, retrying: %v", err)
+		}
+		d.notices.failed(notice, err)
+	default:
+		log.Printf("Master notification of %s refused: %v", notice.FileName, err)
+		d.notices.done(notice.FileName, notice.Seq)
+	}
+}
+
+// retryUploadNotices sends the queued notifications as they come due
+func (d *DataNodeServer) retryUploadNotices() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopped:
+			return
+		case <-ticker.C:
+		}
+		for _, notice := range d.notices.due(time.Now()) {
+			// a file deleted since has nothing left to tell
+			if _, err := os.Stat(notice.FilePath); err != nil {
+				log.Printf("dropping the upload notification of %s: %v", notice.FileName, err)
+				d.notices.done(notice.FileName, notice.Seq)
+				continue
+			}
+			d.deliverUploadNotice(notice)
+		}
+	}
+}
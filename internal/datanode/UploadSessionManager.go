@@ -0,0 +1,496 @@
+package datanode
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"proj/internal/fsutil"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+uploadSession is one Begin/Update/End upload. Each session writes its own
+staged file next to the stored one, so clients uploading the same name at
+once never write into each other's data; EndUploadFile renames it into place
+*/
+type uploadSession struct {
+	id       string
+	fileName string
+	file     *os.File
+	encoding string
+	// set for a parallel upload, see parallelUpload
+	parallel *parallelUpload
+	// set for an append, the stored file its staged copy started from
+	base *appendBase
+	// commit synced, see syncRequested
+	sync bool
+	// size the client declared, 0 when unknown; see GetUploadProgress
+	expected int64
+	started  time.Time
+	// when the session last received data, guarded by the manager's mutex
+	activity time.Time
+	// serializes the seek and write of sequential chunks
+	mutex sync.Mutex
+}
+
+// newSessionID returns a random upload session ID
+func newSessionID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// stagedPath is where an upload session writes before it commits
+func stagedPath(savePath, sessionID string) string {
+	return savePath + "." + sessionID + ".tmp"
+}
+
+// stagedFile matches the paths made by stagedPath
+var stagedFile = regexp.MustCompile(`\.[0-9a-f]{32}\.tmp$`)
+
+// stagedTarget returns the path a staged file commits to, on the same volume
+func stagedTarget(staged string) string {
+	return stagedFile.ReplaceAllString(staged, "")
+}
+
+// insideStaged tells whether path is a staged file under one of the dirs
+func insideStaged(dirs []string, path string) bool {
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(dir, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return stagedFile.MatchString(path)
+		}
+	}
+	return false
+}
+
+// createStaged creates the staged file of an upload session along with its parent directories
+func (d *DataNodeServer) createStaged(fileName, sessionID string) (*os.File, error) {
+	savePath, err := d.storagePath(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.mkdirStored(filepath.Dir(savePath)); err != nil {
+		return nil, fmt.Errorf("error creating upload dir: %v", err)
+	}
+	path := stagedPath(savePath, sessionID)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, d.permissions.fileMode)
+	if err != nil {
+		return nil, fmt.Errorf("error creating file: %v", err)
+	}
+	if err := d.applyPermissions(path, d.permissions.fileMode); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("error setting file permissions: %v", err)
+	}
+	return file, nil
+}
+
+/*
+commitStaged renames a synced staged file over the stored fileName, the only
+point at which an upload replaces what readers see. The file stays on the
+volume it was staged on, a copy another upload committed meanwhile on
+another volume is removed. A synced commit fails when the directories can't
+be flushed, see syncRequested
+*/
+func (d *DataNodeServer) commitStaged(staged, fileName string, synced bool) (string, error) {
+	if _, err := d.storagePath(fileName); err != nil {
+		os.Remove(staged)
+		return "", err
+	}
+	savePath := stagedTarget(staged)
+	staged, err := d.sealStaged(staged)
+	if err != nil {
+		return "", err
+	}
+	previous, _ := d.replicaIndex.get(fileName)
+	encoding := d.storedEncoding(fileName)
+	// the old content is gone, gossip knows the replica again once the master confirms it
+	d.replicaIndex.set(fileName, nil)
+	d.blobMutex.Lock()
+	d.keepVersion(savePath, fileName, previous, encoding)
+	err = d.replaceStored(savePath, func() error { return os.Rename(staged, savePath) })
+	d.blobMutex.Unlock()
+	if err != nil {
+		os.Remove(staged)
+		return "", fmt.Errorf("error committing upload: %v", err)
+	}
+	d.removeOtherCopies(savePath, fileName)
+	if synced {
+		if err := d.syncParents(savePath); err != nil {
+			return "", status.Errorf(codes.Internal, "%s was committed but may not survive a power loss: %v", fileName, err)
+		}
+	} else if err := syncDir(filepath.Dir(savePath)); err != nil {
+		log.Printf("sync of %s failed: %v", filepath.Dir(savePath), err)
+	}
+	return savePath, nil
+}
+
+/*
+UploadSessionManager keeps the upload sessions in progress. Every change is
+written to a journal next to the storage root, so after a restart the staged
+files of interrupted uploads are found: those written to within the grace
+period are resumed, the others are removed
+*/
+type UploadSessionManager struct {
+	mutex    sync.Mutex
+	sessions map[string]*uploadSession
+	// journal of the sessions in progress, read back by recover
+	journal string
+	// how recently a session must have been written to for a restart to resume it, 0 never resumes
+	grace time.Duration
+	// how long a session may receive nothing before it is aborted, 0 never aborts
+	idle time.Duration
+	// write sessions at once, see reserve; 0 is unlimited
+	limit int
+	// sessions admitted by reserve and not released yet
+	reserved int
+}
+
+func newUploadSessionManager(journal string, grace, idle time.Duration, limit int) *UploadSessionManager {
+	return &UploadSessionManager{
+		sessions: make(map[string]*uploadSession),
+		journal:  journal,
+		grace:    grace,
+		idle:     idle,
+		limit:    limit,
+	}
+}
+
+/*
+reserve admits a write about to start, an upload session, a stream or a
+replication, unless the sessions kept and the writes in progress reach the
+limit, in which case it returns false and their number. The returned release
+ends the reservation once the call returns; an upload session keeps counting
+until it ends
+*/
+func (m *UploadSessionManager) reserve() (func(), int, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if inProgress := len(m.sessions) + m.reserved; m.limit > 0 && inProgress >= m.limit {
+		return nil, inProgress, false
+	}
+	m.reserved++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mutex.Lock()
+			m.reserved--
+			m.mutex.Unlock()
+		})
+	}, 0, true
+}
+
+// add starts tracking a session whose staged file was just created
+func (m *UploadSessionManager) add(session *uploadSession) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	session.activity = time.Now()
+	m.sessions[session.id] = session
+	m.writeJournal()
+}
+
+/*
+lookup returns the session a chunk or end request belongs to and records the
+activity. Clients present the session ID BeginUploadFile returned; requests
+without one, from clients predating session IDs, go to the newest session of
+their file name
+*/
+func (m *UploadSessionManager) lookup(sessionID, fileName string) (*uploadSession, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	session, err := m.find(sessionID, fileName)
+	if err != nil {
+		return nil, err
+	}
+	session.activity = time.Now()
+	return session, nil
+}
+
+// peek is lookup without recording activity, a session only watched still goes idle; it returns the last activity too
+func (m *UploadSessionManager) peek(sessionID, fileName string) (*uploadSession, time.Time, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	session, err := m.find(sessionID, fileName)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return session, session.activity, nil
+}
+
+// find returns the session of sessionID, or the newest of fileName without one; called with the mutex held
+func (m *UploadSessionManager) find(sessionID, fileName string) (*uploadSession, error) {
+	var session *uploadSession
+	if sessionID != "" {
+		session = m.sessions[sessionID]
+		if session == nil {
+			return nil, status.Errorf(codes.NotFound, "no active upload session %s", sessionID)
+		}
+		if fileName != "" && fileName != session.fileName {
+			return nil, status.Errorf(codes.InvalidArgument, "upload session %s is for %s, not %s", sessionID, session.fileName, fileName)
+		}
+	} else {
+		for _, candidate := range m.sessions {
+			if candidate.fileName == fileName && (session == nil || candidate.started.After(session.started)) {
+				session = candidate
+			}
+		}
+		if session == nil {
+			return nil, fmt.Errorf("file not found in active uploads: %s", fileName)
+		}
+	}
+	return session, nil
+}
+
+// remove stops tracking a session, returning false when another call already did
+func (m *UploadSessionManager) remove(session *uploadSession) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.sessions[session.id] != session {
+		return false
+	}
+	delete(m.sessions, session.id)
+	m.writeJournal()
+	return true
+}
+
+// uploading returns how many sessions are uploading fileName
+func (m *UploadSessionManager) uploading(fileName string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	count := 0
+	for _, session := range m.sessions {
+		if session.fileName == fileName {
+			count++
+		}
+	}
+	return count
+}
+
+// abort drops every session uploading fileName along with its staged file, returning how many there were
+func (m *UploadSessionManager) abort(fileName string) int {
+	var aborted []*uploadSession
+	m.mutex.Lock()
+	for _, session := range m.sessions {
+		if session.fileName == fileName {
+			aborted = append(aborted, session)
+			delete(m.sessions, session.id)
+		}
+	}
+	if len(aborted) > 0 {
+		m.writeJournal()
+	}
+	m.mutex.Unlock()
+
+	for _, session := range aborted {
+		m.discard(session)
+	}
+	return len(aborted)
+}
+
+// discard closes and removes the staged file of a session no longer tracked
+func (m *UploadSessionManager) discard(session *uploadSession) {
+	// wait for a chunk being written, later ones no longer find the session
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	// Windows can't remove a file that is still open
+	session.file.Close()
+	os.Remove(session.file.Name())
+}
+
+/*
+close ends the sessions still open when the DataNode shuts down. With a grace
+period they are synced, closed and left in the journal, so the restarted
+node resumes them; otherwise, and for parallel uploads a restart never
+resumes, they are aborted and their staged files removed
+*/
+func (m *UploadSessionManager) close() {
+	var kept, aborted []*uploadSession
+	m.mutex.Lock()
+	for _, session := range m.sessions {
+		if m.grace > 0 && session.parallel == nil {
+			kept = append(kept, session)
+			continue
+		}
+		aborted = append(aborted, session)
+		delete(m.sessions, session.id)
+	}
+	m.writeJournal()
+	m.mutex.Unlock()
+
+	for _, session := range kept {
+		session.mutex.Lock()
+		if err := session.file.Sync(); err != nil {
+			log.Printf("syncing upload session %s of %s fail %v", session.id, session.fileName, err)
+		}
+		session.file.Close()
+		session.mutex.Unlock()
+	}
+	for _, session := range aborted {
+		m.discard(session)
+	}
+	if len(kept)+len(aborted) > 0 {
+		log.Printf("upload sessions at shutdown: %d kept to resume after the restart, %d aborted", len(kept), len(aborted))
+	}
+}
+
+// count returns the number of sessions in progress
+func (m *UploadSessionManager) count() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.sessions)
+}
+
+/*
+reapIdle aborts sessions that received nothing for the idle timeout, closing
+and removing their staged files, so a client that vanished mid-upload doesn't
+hold them forever. It returns once stopped is closed
+*/
+func (m *UploadSessionManager) reapIdle(stopped <-chan struct{}) {
+	if m.idle == 0 {
+		return
+	}
+	ticker := time.NewTicker(min(m.idle/2, 10*time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-ticker.C:
+		}
+		var expired []*uploadSession
+		m.mutex.Lock()
+		for _, session := range m.sessions {
+			if time.Since(session.activity) > m.idle {
+				expired = append(expired, session)
+				delete(m.sessions, session.id)
+			}
+		}
+		if len(expired) > 0 {
+			m.writeJournal()
+		}
+		m.mutex.Unlock()
+
+		for _, session := range expired {
+			log.Printf("upload session %s of %s idle for more than %v, aborting it", session.id, session.fileName, m.idle)
+			m.discard(session)
+		}
+	}
+}
+
+// journalEntry is the record of an upload session in the journal
+type journalEntry struct {
+	ID       string      `json:"ID"`
+	FileName string      `json:"FileName"`
+	Path     string      `json:"Path"`
+	Encoding string      `json:"Encoding,omitempty"`
+	Parallel bool        `json:"Parallel,omitempty"`
+	Base     *appendBase `json:"Base,omitempty"`
+	Sync     bool        `json:"Sync,omitempty"`
+	Expected int64       `json:"Expected,omitempty"`
+}
+
+// writeJournal records the sessions in progress, called with the mutex held
+func (m *UploadSessionManager) writeJournal() {
+	entries := make([]journalEntry, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		entries = append(entries, journalEntry{
+			ID:       session.id,
+			FileName: session.fileName,
+			Path:     session.file.Name(),
+			Encoding: session.encoding,
+			Parallel: session.parallel != nil,
+			Base:     session.base,
+			Sync:     session.sync,
+			Expected: session.expected,
+		})
+	}
+	content, err := json.Marshal(entries)
+	if err != nil {
+		log.Printf("encoding upload sessions fail %v", err)
+		return
+	}
+	// a crash never leaves a truncated journal
+	if err := fsutil.WriteFileAtomic(m.journal, content, 0644); err != nil {
+		log.Printf("saving upload sessions fail %v", err)
+	}
+}
+
+/*
+recover goes over the sessions the journal left by the previous process
+lists. A staged file written to within the grace period is reopened at its
+end and accepts UpdateUploadFile and EndUploadFile again under the same
+session ID; older ones, and parallel uploads whose received ranges aren't
+recorded, were interrupted and are removed, as is any staged file under
+data directory the journal doesn't list
+*/
+func (m *UploadSessionManager) recover(dirs []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var entries []journalEntry
+	if content, err := os.ReadFile(m.journal); err == nil {
+		if err := json.Unmarshal(content, &entries); err != nil {
+			log.Printf("bad upload sessions journal %s: %v", m.journal, err)
+		}
+	}
+	for _, entry := range entries {
+		// a journal edited by hand must not make the node open or remove files outside the root
+		if !insideStaged(dirs, entry.Path) {
+			log.Printf("upload session %s of %s has a staged file %q outside %v, ignoring it", entry.ID, entry.FileName, entry.Path, dirs)
+			continue
+		}
+		info, err := os.Stat(entry.Path)
+		if err != nil {
+			continue
+		}
+		if entry.Parallel || time.Since(info.ModTime()) > m.grace {
+			log.Printf("upload session %s of %s was interrupted, removing the staged file", entry.ID, entry.FileName)
+			os.Remove(entry.Path)
+			continue
+		}
+		file, err := os.OpenFile(entry.Path, os.O_RDWR, 0)
+		if err != nil {
+			log.Printf("reopening upload session %s of %s fail %v", entry.ID, entry.FileName, err)
+			continue
+		}
+		file.Seek(0, 2)
+		m.sessions[entry.ID] = &uploadSession{
+			id:       entry.ID,
+			fileName: entry.FileName,
+			file:     file,
+			encoding: entry.Encoding,
+			base:     entry.Base,
+			sync:     entry.Sync,
+			expected: entry.Expected,
+			started:  info.ModTime(),
+			activity: time.Now(),
+		}
+		log.Printf("resumed upload session %s of %s at %d bytes", entry.ID, entry.FileName, info.Size())
+	}
+
+	// staged files created just before a crash, the journal never listed them
+	resumed := make(map[string]bool)
+	for _, session := range m.sessions {
+		resumed[filepath.Clean(session.file.Name())] = true
+	}
+	for _, dir := range dirs {
+		filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+			if err == nil && !entry.IsDir() && stagedFile.MatchString(path) && !resumed[filepath.Clean(path)] {
+				log.Printf("removing the staged file %s of an interrupted upload", path)
+				os.Remove(path)
+			}
+			return nil
+		})
+	}
+	m.writeJournal()
+}
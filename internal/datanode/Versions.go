@@ -0,0 +1,176 @@
+package datanode
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	pb "proj/Services"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// directory of every data directory holding the previous contents of overwritten files, a reserved name
+const versionDir = ".dfs-versions"
+
+/*
+versionName is the name the version of fileName with the generation stamp
+generation is kept under, relative to the data directory. It's also the key
+of its encoding
+*/
+func versionName(fileName string, generation int64) string {
+	return versionDir + "/" + fileName + ".v" + strconv.FormatInt(generation, 10)
+}
+
+// isVersionPath tells whether the relative path lies in the version directory
+func isVersionPath(relative string) bool {
+	first, _, _ := strings.Cut(filepath.ToSlash(relative), "/")
+	return first == versionDir
+}
+
+// versionsOf returns the generations of the versions of fileName kept in the data directory root, newest first
+func versionsOf(root, fileName string) []int64 {
+	prefix := filepath.Base(filepath.FromSlash(fileName)) + ".v"
+	entries, err := os.ReadDir(filepath.Dir(filepath.Join(root, filepath.FromSlash(versionName(fileName, 0)))))
+	if err != nil {
+		return nil
+	}
+	var generations []int64
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), prefix) || entry.IsDir() {
+			continue
+		}
+		if generation, err := strconv.ParseInt(strings.TrimPrefix(entry.Name(), prefix), 10, 64); err == nil {
+			generations = append(generations, generation)
+		}
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i] > generations[j] })
+	return generations
+}
+
+/*
+keepVersion is called before new content replaces the stored file at
+savePath. While the master asks for versions, the content being replaced,
+known by its generation stamp, is linked under its version name so the
+replacement leaves it in place; the oldest versions beyond what the master
+keeps are removed. Must be called with blobMutex held
+*/
+func (d *DataNodeServer) keepVersion(savePath, fileName string, previous replicaInfo, encoding string) {
+	keep := int(d.keepVersions.Load())
+	if keep <= 0 || previous.Generation == 0 {
+		return
+	}
+	if _, err := os.Lstat(savePath); err != nil {
+		return
+	}
+	root := d.volumeRoot(savePath)
+	name := versionName(fileName, previous.Generation)
+	path := filepath.Join(root, filepath.FromSlash(name))
+	if err := d.mkdirStored(filepath.Dir(path)); err != nil {
+		log.Printf("error creating version dir: %v", err)
+		return
+	}
+	if err := d.replaceStored(path, func() error { return os.Link(savePath, path) }); err != nil && !os.IsExist(err) {
+		log.Printf("keeping version %d of %s failed: %v", previous.Generation, fileName, err)
+		return
+	}
+	d.setEncoding(name, encoding)
+	if kept := versionsOf(root, fileName); len(kept) > keep {
+		for _, generation := range kept[keep:] {
+			d.removeVersion(root, fileName, generation)
+		}
+	}
+}
+
+// removeVersion removes a kept version of fileName from the data directory root
+func (d *DataNodeServer) removeVersion(root, fileName string, generation int64) {
+	name := versionName(fileName, generation)
+	path := filepath.Join(root, filepath.FromSlash(name))
+	if err := d.replaceStored(path, func() error { return os.Remove(path) }); err != nil && !os.IsNotExist(err) {
+		log.Printf("removing version %d of %s failed: %v", generation, fileName, err)
+		return
+	}
+	d.setEncoding(name, "")
+	d.pruneEmptyDirs(path)
+}
+
+// dropVersions removes every version kept of fileName
+func (d *DataNodeServer) dropVersions(fileName string) {
+	for _, root := range d.volumeDirs() {
+		for _, generation := range versionsOf(root, fileName) {
+			d.removeVersion(root, fileName, generation)
+		}
+	}
+}
+
+// moveVersions keeps the versions of a renamed file under its new name
+func (d *DataNodeServer) moveVersions(from, to string) {
+	for _, root := range d.volumeDirs() {
+		for _, generation := range versionsOf(root, from) {
+			oldName, newName := versionName(from, generation), versionName(to, generation)
+			oldPath, newPath := filepath.Join(root, filepath.FromSlash(oldName)), filepath.Join(root, filepath.FromSlash(newName))
+			if err := d.mkdirStored(filepath.Dir(newPath)); err != nil {
+				log.Printf("error creating version dir: %v", err)
+				continue
+			}
+			if err := d.moveStored(oldPath, newPath); err != nil {
+				log.Printf("moving version %d of %s failed: %v", generation, from, err)
+				continue
+			}
+			d.setEncoding(newName, d.storedEncoding(oldName))
+			d.setEncoding(oldName, "")
+			d.pruneEmptyDirs(oldPath)
+		}
+	}
+}
+
+/*
+DownloadVersion returns an earlier content of a file, kept when an upload
+replaced it, by its generation stamp as listed by the master's ListVersions.
+The content is sent decoded, in one message like DownloadFile
+*/
+func (d *DataNodeServer) DownloadVersion(ctx context.Context, in *pb.DownloadVersionRequest) (*pb.FileDownloadResponse, error) {
+	log.Printf("DownloadVersion %s version %d", in.FileName, in.Generation)
+	if _, err := d.storagePath(in.FileName); err != nil {
+		return nil, err
+	}
+	d.activeTransfers.Add(1)
+	defer d.activeTransfers.Add(-1)
+	d.activeDownloads.Add(1)
+	defer d.activeDownloads.Add(-1)
+	name := versionName(in.FileName, in.Generation)
+	var path string
+	for _, root := range d.volumeDirs() {
+		candidate := filepath.Join(root, filepath.FromSlash(name))
+		if _, err := os.Lstat(candidate); err == nil {
+			path = candidate
+			break
+		}
+	}
+	if path == "" {
+		return nil, status.Errorf(codes.NotFound, "version %d of %s not found", in.Generation, in.FileName)
+	}
+	reader, _, err := d.openEncoded(path, in.FileName, d.storedEncoding(name), "")
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	limit := d.MaxMessageBytes - messageOverhead
+	class := d.trafficClassOf(ctx)
+	fileContent, tooLarge, err := readMessage(slottedReader{Reader: reader, ctx: ctx, class: class, traffic: d.traffic},
+		expectedSize(reader, 0, 0), limit)
+	if err != nil {
+		return nil, fmt.Errorf("ReadFile fail %v", err)
+	}
+	if tooLarge {
+		return nil, status.Errorf(codes.ResourceExhausted,
+			"version %d of %s is larger than the %d byte message limit", in.Generation, in.FileName, d.MaxMessageBytes)
+	}
+	return &pb.FileDownloadResponse{FileContent: fileContent}, nil
+}
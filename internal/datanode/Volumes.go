@@ -0,0 +1,242 @@
+package datanode
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	pb "proj/Services"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// how often the data directories of a DataNode with several are probed
+const volumeCheckInterval = 10 * time.Second
+
+/*
+volume is one data directory of a DataNode configured with several
+(DataDirs), normally a disk of its own. A volume failing its probe is taken
+out of service alone: the replicas it held are reported bad to the master,
+which re-replicates them, while the other volumes keep serving
+*/
+type volume struct {
+	dir    string
+	failed atomic.Bool
+}
+
+/*
+setUpVolumes creates the configured data directories. One that can't be
+created starts out failed, the DataNode only refuses to start when none can
+*/
+func (d *DataNodeServer) setUpVolumes() error {
+	if len(d.DataDirs) == 0 {
+		d.volumes = []*volume{{dir: filepath.Clean(d.storageDir())}}
+		return nil
+	}
+	healthy := 0
+	for _, dir := range d.DataDirs {
+		v := &volume{dir: filepath.Clean(dir)}
+		d.volumes = append(d.volumes, v)
+		if err := d.mkdirStored(v.dir); err != nil {
+			log.Printf("data directory %s unusable, leaving it out: %v", v.dir, err)
+			v.failed.Store(true)
+			continue
+		}
+		healthy++
+	}
+	if healthy == 0 {
+		return fmt.Errorf("none of the data directories %v is usable", d.DataDirs)
+	}
+	return nil
+}
+
+// volumeDirs returns the directories of the volumes in service
+func (d *DataNodeServer) volumeDirs() []string {
+	if len(d.volumes) == 0 {
+		return []string{d.storageDir()}
+	}
+	var dirs []string
+	for _, v := range d.volumes {
+		if !v.failed.Load() {
+			dirs = append(dirs, v.dir)
+		}
+	}
+	return dirs
+}
+
+/*
+locate maps a relative path to the volume holding it. A path no volume
+holds is placed on the volume in service with the most free space, where a
+new file gets created
+*/
+func (d *DataNodeServer) locate(relative string) (string, error) {
+	if len(d.volumes) == 0 {
+		return filepath.Join(d.storageDir(), relative), nil
+	}
+	if len(d.volumes) == 1 {
+		return filepath.Join(d.volumes[0].dir, relative), nil
+	}
+	for _, v := range d.volumes {
+		path := filepath.Join(v.dir, relative)
+		if _, err := os.Lstat(path); err == nil && !v.failed.Load() {
+			return path, nil
+		}
+	}
+	best, bestFree := "", int64(-2)
+	for _, v := range d.volumes {
+		if v.failed.Load() {
+			continue
+		}
+		if free := d.volumeFree(v.dir); free > bestFree {
+			best, bestFree = filepath.Join(v.dir, relative), free
+		}
+	}
+	if best == "" {
+		return "", status.Errorf(codes.Unavailable, "every data directory of DataNode %d failed", d.nodeID())
+	}
+	return best, nil
+}
+
+// volumeRoot returns the data directory path lies in
+func (d *DataNodeServer) volumeRoot(path string) string {
+	for _, v := range d.volumes {
+		if relative, err := filepath.Rel(v.dir, path); err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			return v.dir
+		}
+	}
+	return filepath.Clean(d.storageDir())
+}
+
+// removeOtherCopies removes the copies of fileName on the other volumes than the one of savePath
+func (d *DataNodeServer) removeOtherCopies(savePath, fileName string) {
+	if len(d.volumes) < 2 {
+		return
+	}
+	root := d.volumeRoot(savePath)
+	for _, dir := range d.volumeDirs() {
+		if dir == root {
+			continue
+		}
+		other := filepath.Join(dir, filepath.FromSlash(fileName))
+		if err := d.replaceStored(other, func() error { return os.Remove(other) }); err == nil {
+			log.Printf("removed the copy of %s on %s, %s replaces it", fileName, dir, savePath)
+			d.checksums.forget(other)
+			d.readCache.forget(other)
+			d.pruneEmptyDirs(other)
+		}
+	}
+}
+
+/*
+volumeFree returns the bytes left on the volume of dir above its
+reservation, the larger of ReservedBytes and ReservedPercent of the volume.
+-1 when unknown
+*/
+func (d *DataNodeServer) volumeFree(dir string) int64 {
+	// the storage dir may not exist before the first upload, its volume is the working dir's
+	if _, err := os.Stat(dir); err != nil {
+		dir = "."
+	}
+	free, total, ok := diskSpace(dir)
+	if !ok {
+		return -1
+	}
+	reserved := max(d.ReservedBytes, int64(float64(total)*d.ReservedPercent/100))
+	return max(free-reserved, 0)
+}
+
+// watchVolumes probes the data directories, taking out of service the ones that fail
+func (d *DataNodeServer) watchVolumes() {
+	if len(d.DataDirs) == 0 {
+		return
+	}
+	for d.sleep(volumeCheckInterval) {
+		for _, v := range d.volumes {
+			if v.failed.Load() {
+				continue
+			}
+			if err := probeVolume(v.dir); err != nil {
+				d.failVolume(v, err)
+			}
+		}
+	}
+}
+
+/*
+probeVolume writes, syncs and removes a small file in dir, the operations a
+failing disk refuses first. It's named like a staged upload, so listings
+skip it and a restart removes one left behind
+*/
+func probeVolume(dir string) error {
+	path := stagedPath(filepath.Join(dir, ".volume-probe"), newSessionID())
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write([]byte("probe"))
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if removeErr := os.Remove(path); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+/*
+failVolume takes v out of service and reports to the master the replicas no
+volume in service holds anymore, so they get re-replicated elsewhere
+*/
+func (d *DataNodeServer) failVolume(v *volume, cause error) {
+	if !v.failed.CompareAndSwap(false, true) {
+		return
+	}
+	log.Printf("data directory %s failed, taking it out of service: %v", v.dir, cause)
+	reason := fmt.Sprintf("data directory %s of DataNode %d failed", v.dir, d.nodeID())
+	var lost []string
+	for _, fileName := range d.replicaIndex.names() {
+		if path, err := d.storagePath(fileName); err == nil {
+			if _, err := os.Stat(path); err == nil {
+				continue
+			}
+		}
+		d.replicaIndex.set(fileName, nil)
+		d.forgetBlob(fileName)
+		lost = append(lost, fileName)
+	}
+	if len(lost) == 0 {
+		return
+	}
+	d.reportBadReplicas(lost, reason)
+	log.Printf("reported %d replica(s) lost with %s", len(lost), v.dir)
+}
+
+// reportBadReplicas tells the master the replicas of fileNames here are bad, so it re-replicates them
+func (d *DataNodeServer) reportBadReplicas(fileNames []string, reason string) {
+	conn, err := d.dialMaster()
+	if err != nil {
+		log.Printf("could not report %d bad replica(s): %v", len(fileNames), err)
+		return
+	}
+	defer conn.Close()
+	client := pb.NewFileServiceClient(conn)
+	for _, fileName := range fileNames {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err := client.ReportBadReplica(d.withClusterSecret(ctx), &pb.ReportBadReplicaRequest{
+			FileName: fileName,
+			DataNode: d.nodeID(),
+			Reason:   reason,
+		})
+		cancel()
+		if err != nil {
+			log.Printf("reporting the bad replica of %s fail %v", fileName, err)
+		}
+	}
+}
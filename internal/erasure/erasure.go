@@ -0,0 +1,213 @@
+// Package erasure implements the Reed-Solomon code erasure-6-3 files are
+// stored with: every stripe of six data shards gets three parity shards, and
+// any six of the nine rebuild the other three.
+package erasure
+
+import "errors"
+
+const (
+	// DataShards is the number of data shards in a stripe.
+	DataShards = 6
+	// ParityShards is the number of parity shards in a stripe.
+	ParityShards = 3
+	// Shards is the number of shards in a stripe, data first, then parity.
+	Shards = DataShards + ParityShards
+)
+
+// ErrTooFewShards is returned when fewer than DataShards shards are left.
+var ErrTooFewShards = errors.New("erasure: too few shards to rebuild the stripe")
+
+// ErrShardSize is returned when the shards given aren't all the same length.
+var ErrShardSize = errors.New("erasure: shards differ in length")
+
+// The arithmetic is over GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1.
+var (
+	expTable [510]byte
+	logTable [256]int
+)
+
+// parity holds the rows of the encoding matrix below the identity, a Cauchy
+// matrix, so every square matrix taken from the rows of the whole matrix is
+// invertible and any DataShards shards are enough.
+var parity [ParityShards][DataShards]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := range parity {
+		for j := range parity[i] {
+			parity[i][j] = inverse(byte(DataShards+i) ^ byte(j))
+		}
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[logTable[a]+logTable[b]]
+}
+
+func inverse(a byte) byte {
+	return expTable[255-logTable[a]]
+}
+
+// mulAdd adds c times data to out
+func mulAdd(out []byte, c byte, data []byte) {
+	if c == 0 {
+		return
+	}
+	logC := logTable[c]
+	for i, b := range data {
+		if b != 0 {
+			out[i] ^= expTable[logC+logTable[b]]
+		}
+	}
+}
+
+// row returns the row of the encoding matrix producing shard
+func row(shard int) [DataShards]byte {
+	if shard < DataShards {
+		var r [DataShards]byte
+		r[shard] = 1
+		return r
+	}
+	return parity[shard-DataShards]
+}
+
+// AddData adds data, found at offset in data shard shard, to the
+// ParityShards parity buffers. Starting from zeroed buffers and adding every
+// byte of a stripe's data shards leaves the buffers holding its parity, so
+// a writer streaming the data shards doesn't have to keep them.
+func AddData(parityShards [][]byte, shard int, offset int, data []byte) {
+	for i, out := range parityShards {
+		mulAdd(out[offset:offset+len(data)], parity[i][shard], data)
+	}
+}
+
+// Encode fills the parity shards of shards, which holds Shards slices of the
+// same length, from its data shards.
+func Encode(shards [][]byte) error {
+	if len(shards) != Shards {
+		return ErrShardSize
+	}
+	size := len(shards[0])
+	for _, shard := range shards {
+		if len(shard) != size {
+			return ErrShardSize
+		}
+	}
+	for _, out := range shards[DataShards:] {
+		clear(out)
+	}
+	for shard, data := range shards[:DataShards] {
+		AddData(shards[DataShards:], shard, 0, data)
+	}
+	return nil
+}
+
+// Reconstruct fills in the nil shards of shards, which holds Shards slices,
+// from the others. At least DataShards of them must be there, all the same
+// length.
+func Reconstruct(shards [][]byte) error {
+	if len(shards) != Shards {
+		return ErrShardSize
+	}
+	var present []int
+	size := -1
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return ErrShardSize
+		}
+		size = len(shard)
+		present = append(present, i)
+	}
+	if len(present) < DataShards {
+		return ErrTooFewShards
+	}
+	if len(present) == Shards {
+		return nil
+	}
+	present = present[:DataShards]
+
+	// the rows of the shards used, inverted, turn them back into the data
+	var m [DataShards][DataShards]byte
+	for i, shard := range present {
+		m[i] = row(shard)
+	}
+	decode, err := invert(m)
+	if err != nil {
+		return err
+	}
+	data := make([][]byte, DataShards)
+	for i := range data {
+		if shards[i] != nil {
+			data[i] = shards[i]
+			continue
+		}
+		data[i] = make([]byte, size)
+		for j, shard := range present {
+			mulAdd(data[i], decode[i][j], shards[shard])
+		}
+	}
+	for i := range shards {
+		if shards[i] != nil {
+			continue
+		}
+		if i < DataShards {
+			shards[i] = data[i]
+			continue
+		}
+		shards[i] = make([]byte, size)
+		for j := range data {
+			mulAdd(shards[i], parity[i-DataShards][j], data[j])
+		}
+	}
+	return nil
+}
+
+// invert returns the inverse of m by Gauss-Jordan elimination
+func invert(m [DataShards][DataShards]byte) ([DataShards][DataShards]byte, error) {
+	var inv [DataShards][DataShards]byte
+	for i := range inv {
+		inv[i][i] = 1
+	}
+	for col := 0; col < DataShards; col++ {
+		pivot := col
+		for pivot < DataShards && m[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == DataShards {
+			return inv, errors.New("erasure: singular matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		scale := inverse(m[col][col])
+		for j := 0; j < DataShards; j++ {
+			m[col][j] = mul(m[col][j], scale)
+			inv[col][j] = mul(inv[col][j], scale)
+		}
+		for r := 0; r < DataShards; r++ {
+			if r == col || m[r][col] == 0 {
+				continue
+			}
+			factor := m[r][col]
+			for j := 0; j < DataShards; j++ {
+				m[r][j] ^= mul(factor, m[col][j])
+				inv[r][j] ^= mul(factor, inv[col][j])
+			}
+		}
+	}
+	return inv, nil
+}
@@ -0,0 +1,84 @@
+package erasure
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func stripe(size int) [][]byte {
+	random := rand.New(rand.NewSource(1))
+	shards := make([][]byte, Shards)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < DataShards {
+			random.Read(shards[i])
+		}
+	}
+	return shards
+}
+
+func TestReconstructAnyThreeLost(t *testing.T) {
+	shards := stripe(1000)
+	if err := Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+	for a := 0; a < Shards; a++ {
+		for b := a + 1; b < Shards; b++ {
+			for c := b + 1; c < Shards; c++ {
+				damaged := make([][]byte, Shards)
+				copy(damaged, shards)
+				damaged[a], damaged[b], damaged[c] = nil, nil, nil
+				if err := Reconstruct(damaged); err != nil {
+					t.Fatalf("losing %d, %d and %d: %v", a, b, c, err)
+				}
+				for i := range shards {
+					if !bytes.Equal(damaged[i], shards[i]) {
+						t.Errorf("losing %d, %d and %d rebuilt shard %d wrong", a, b, c, i)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestReconstructTooFew(t *testing.T) {
+	shards := stripe(10)
+	Encode(shards)
+	shards[0], shards[4], shards[6], shards[8] = nil, nil, nil, nil
+	if err := Reconstruct(shards); err != ErrTooFewShards {
+		t.Errorf("Reconstruct with 5 shards = %v, want %v", err, ErrTooFewShards)
+	}
+}
+
+func TestReconstructShardSize(t *testing.T) {
+	shards := stripe(10)
+	shards[0] = nil
+	shards[3] = shards[3][:5]
+	if err := Reconstruct(shards); err != ErrShardSize {
+		t.Errorf("Reconstruct with a short shard = %v, want %v", err, ErrShardSize)
+	}
+}
+
+func TestAddDataMatchesEncode(t *testing.T) {
+	shards := stripe(300)
+	if err := Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+	parityShards := make([][]byte, ParityShards)
+	for i := range parityShards {
+		parityShards[i] = make([]byte, 300)
+	}
+	// the shards come in pieces, as a writer sends them
+	for shard, data := range shards[:DataShards] {
+		for offset := 0; offset < len(data); offset += 70 {
+			end := min(offset+70, len(data))
+			AddData(parityShards, shard, offset, data[offset:end])
+		}
+	}
+	for i, p := range parityShards {
+		if !bytes.Equal(p, shards[DataShards+i]) {
+			t.Errorf("parity shard %d built with AddData differs from Encode", i)
+		}
+	}
+}
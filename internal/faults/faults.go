@@ -0,0 +1,150 @@
+// Package faults injects failures into the master and the DataNodes, so
+// failure handling can be exercised reproducibly. It is meant for test
+// clusters only: leave "Faults" out of production configs.
+package faults
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Config is the "Faults" section of a master or DataNode config.
+type Config struct {
+	// seed of the fault decisions, the same seed and call order give the same faults
+	Seed int64 `json:"Seed"`
+	// delay added to every RPC, plus up to LatencyJitterMs at random
+	LatencyMs       int `json:"LatencyMs"`
+	LatencyJitterMs int `json:"LatencyJitterMs"`
+	// method name ("UpdateUploadFile") -> fraction of its calls failing with Unavailable
+	FailRates map[string]float64 `json:"FailRates"`
+	// fraction of upload chunks acknowledged but not written, DataNodes only
+	DropChunkRate float64 `json:"DropChunkRate"`
+	// fraction of fsyncs of stored files that fail, DataNodes only
+	FsyncFailRate float64 `json:"FsyncFailRate"`
+	// play dead from DeadAfterSeconds after start for DeadForSeconds (0 is
+	// forever): RPCs fail with Unavailable and a DataNode's heartbeats stop
+	DeadAfterSeconds int `json:"DeadAfterSeconds"`
+	DeadForSeconds   int `json:"DeadForSeconds"`
+}
+
+// Injector makes the fault decisions. All its methods are no-ops on a nil
+// Injector, which New returns without a config.
+type Injector struct {
+	config Config
+	start  time.Time
+	mutex  sync.Mutex
+	random *rand.Rand
+}
+
+// New returns the injector of config, nil when config is nil.
+func New(config *Config) *Injector {
+	if config == nil {
+		return nil
+	}
+	log.Printf("FAULT INJECTION ENABLED: %+v", *config)
+	return &Injector{config: *config, start: time.Now(), random: rand.New(rand.NewSource(config.Seed))}
+}
+
+// chance returns true with probability rate.
+func (f *Injector) chance(rate float64) bool {
+	if f == nil || rate <= 0 {
+		return false
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.random.Float64() < rate
+}
+
+// Dead reports whether the node is playing dead at now.
+func (f *Injector) Dead(now time.Time) bool {
+	if f == nil || (f.config.DeadAfterSeconds == 0 && f.config.DeadForSeconds == 0) {
+		return false
+	}
+	deadFrom := f.start.Add(time.Duration(f.config.DeadAfterSeconds) * time.Second)
+	if now.Before(deadFrom) {
+		return false
+	}
+	return f.config.DeadForSeconds == 0 || now.Before(deadFrom.Add(time.Duration(f.config.DeadForSeconds)*time.Second))
+}
+
+func (f *Injector) delay() time.Duration {
+	if f == nil {
+		return 0
+	}
+	delay := time.Duration(f.config.LatencyMs) * time.Millisecond
+	if f.config.LatencyJitterMs > 0 {
+		f.mutex.Lock()
+		delay += time.Duration(f.random.Intn(f.config.LatencyJitterMs)) * time.Millisecond
+		f.mutex.Unlock()
+	}
+	return delay
+}
+
+// before is run ahead of every RPC, returning the error to fail it with.
+func (f *Injector) before(ctx context.Context, fullMethod string) error {
+	if f == nil {
+		return nil
+	}
+	if f.Dead(time.Now()) {
+		return status.Error(codes.Unavailable, "fault injection: node down")
+	}
+	if delay := f.delay(); delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	if f.chance(f.config.FailRates[method]) {
+		return status.Errorf(codes.Unavailable, "fault injection: %s failed", method)
+	}
+	return nil
+}
+
+// UnaryInterceptor delays or fails unary RPCs.
+func (f *Injector) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := f.before(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// StreamInterceptor delays or fails streaming RPCs.
+func (f *Injector) StreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := f.before(stream.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+// ServerOptions installs the interceptors, none without fault injection.
+func (f *Injector) ServerOptions() []grpc.ServerOption {
+	if f == nil {
+		return nil
+	}
+	return []grpc.ServerOption{grpc.UnaryInterceptor(f.UnaryInterceptor), grpc.StreamInterceptor(f.StreamInterceptor)}
+}
+
+// DropChunk decides whether an upload chunk is silently discarded.
+func (f *Injector) DropChunk() bool {
+	return f != nil && f.chance(f.config.DropChunkRate)
+}
+
+// SyncFile flushes a stored file, unless an injected fsync failure is due.
+func (f *Injector) SyncFile(file *os.File) error {
+	if f != nil && f.chance(f.config.FsyncFailRate) {
+		return errors.New("fault injection: fsync failed")
+	}
+	return file.Sync()
+}
@@ -0,0 +1,68 @@
+package faults
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNilInjector(t *testing.T) {
+	f := New(nil)
+	if f.Dead(time.Now()) || f.DropChunk() || f.ServerOptions() != nil {
+		t.Error("injector without a config injects faults")
+	}
+	if err := f.before(context.Background(), "/FileService/UpdateUploadFile"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDead(t *testing.T) {
+	f := New(&Config{DeadAfterSeconds: 60, DeadForSeconds: 30})
+	tests := []struct {
+		after time.Duration
+		dead  bool
+	}{
+		{0, false},
+		{59 * time.Second, false},
+		{60 * time.Second, true},
+		{89 * time.Second, true},
+		{90 * time.Second, false},
+	}
+	for _, test := range tests {
+		if dead := f.Dead(f.start.Add(test.after)); dead != test.dead {
+			t.Errorf("Dead %v after start = %v, want %v", test.after, dead, test.dead)
+		}
+	}
+	forever := New(&Config{DeadAfterSeconds: 1})
+	if !forever.Dead(forever.start.Add(time.Hour)) {
+		t.Error("DeadForSeconds 0 came back to life")
+	}
+}
+
+// the same seed fails the same calls
+func TestFailRatesReplay(t *testing.T) {
+	failures := func() []bool {
+		f := New(&Config{Seed: 42, FailRates: map[string]float64{"UpdateUploadFile": 0.5}})
+		var failed []bool
+		for i := 0; i < 20; i++ {
+			err := f.before(context.Background(), "/FileService/UpdateUploadFile")
+			if err != nil && status.Code(err) != codes.Unavailable {
+				t.Fatalf("injected %v, want Unavailable", err)
+			}
+			failed = append(failed, err != nil)
+		}
+		if err := f.before(context.Background(), "/FileService/DownloadFile"); err != nil {
+			t.Errorf("method without a rate failed: %v", err)
+		}
+		return failed
+	}
+	first, second := failures(), failures()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("call %d failed %v with the seed, then %v", i, first[i], second[i])
+		}
+	}
+}
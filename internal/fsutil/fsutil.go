@@ -0,0 +1,49 @@
+// Package fsutil holds the file handling the master and the DataNodes share.
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// WriteFileAtomic replaces the file at path with content. The content goes
+// to a temporary file, which is synced and renamed over path, then the
+// directory is synced, so a crash or power loss leaves either the old
+// content or the new one, never a truncated file.
+func WriteFileAtomic(path string, content []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes the entries of dir durable. Windows can't open a directory
+// for syncing, and commits a rename with the file system's own journal.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -0,0 +1,48 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	for _, content := range []string{`{"a":1}`, `{}`} {
+		if err := WriteFileAtomic(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		read, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(read) != content {
+			t.Errorf("read %s, want %s", read, content)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
+
+func TestWriteFileAtomicKeepsOldContent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "index.json")
+	if err := WriteFileAtomic(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the temporary file can't be created, path keeps its content
+	if err := os.Mkdir(path+".tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(path, []byte("new"), 0644); err == nil {
+		t.Fatal("write through a directory in the way succeeded")
+	}
+	read, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(read) != "old" {
+		t.Errorf("read %s after a failed write, want old", read)
+	}
+}
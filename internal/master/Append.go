@@ -0,0 +1,102 @@
+package master
+
+import (
+	"fmt"
+	"log"
+	pb "proj/Services"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+prepareAppend accepts appending in.FileSize bytes to a stored file. The data
+goes to a DataNode already holding it, which copies its replica and appends
+to the copy. Must be called with the mutex held, after the hold check
+*/
+func (s *server) prepareAppend(in *pb.PrepareUploadRequest) (*pb.PrepareUploadResponse, error) {
+	record, ok := s.fileRecords[in.FileName]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "%s not found, there is nothing to append to", in.FileName)
+	}
+	if !record.hasOwnReplicas() {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is stored in blocks or packed, it can't be appended to", in.FileName)
+	}
+	// plain data appended to a gzip file is compressed by the DataNodes
+	if in.ContentEncoding != record.ContentEncoding && !(record.ContentEncoding == "gzip" && in.ContentEncoding == "") {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is stored with encoding %q, appended data must have the same encoding, not %q", in.FileName, record.ContentEncoding, in.ContentEncoding)
+	}
+	if err := s.checkFileSize(record.Size + in.FileSize); err != nil {
+		return nil, err
+	}
+	// the file grows, usageUnder leaves its current size out
+	warnings, err := s.checkQuota(in.FileName, record.Size+in.FileSize)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range warnings {
+		log.Printf("WARNING append to %s: %s", in.FileName, warning)
+	}
+
+	now := time.Now()
+	response := &pb.PrepareUploadResponse{Warnings: warnings}
+	for _, nodeID := range record.DataNodes {
+		machine := s.machineRecords[nodeID]
+		if !machine.Liveness || machine.inMaintenance(now) || machine.Draining || record.isCorruptOn(nodeID) || !machine.hasRoomFor(record.Size+in.FileSize) {
+			continue
+		}
+		response.Targets = append(response.Targets, &pb.UploadTarget{
+			IpAddress:  machine.IPAddress,
+			PortNumber: machine.ClientNodePort,
+			DataNode:   nodeID,
+		})
+	}
+	if len(response.Targets) == 0 {
+		return nil, status.Errorf(codes.Unavailable, "no DataNode holding %s can take the append", in.FileName)
+	}
+
+	for token, pending := range s.pendingUploads {
+		if now.After(pending.Expires) {
+			delete(s.pendingUploads, token)
+		}
+	}
+	response.UploadToken = newUploadToken()
+	s.pendingUploads[response.UploadToken] = &pendingUpload{
+		FileName:     in.FileName,
+		Size:         in.FileSize,
+		Constraints:  record.Constraints,
+		StorageClass: record.StorageClass,
+		Expires:      now.Add(uploadTokenTTL),
+	}
+	s.recordEvent(in.FileName, stageUploadPrepared, response.Targets[0].DataNode, fmt.Sprintf("append of %d bytes", in.FileSize))
+	return response, nil
+}
+
+/*
+refreshAppended records an append committed on in.DataNode: the file takes
+its new size, checksum and a new generation, and the replicas elsewhere,
+still holding the content the append started from, are dropped. They are
+replaced by copies of the new content, a stale replica not chosen for one is
+deleted. The content the append started from is kept as a version, see
+retireReplaced. Must be called with the mutex held
+*/
+func (s *server) refreshAppended(record *FileRecord, in *pb.NotifyUploadedRequest) {
+	delete(s.pendingUploads, in.UploadToken)
+	old := *record
+
+	delete(s.checksumIndex[record.Checksum], in.FileName)
+	record.DataNodes = []int32{in.DataNode}
+	record.FilePaths = []string{in.FilePath}
+	record.Size = in.FileSize
+	record.Checksum = in.Checksum
+	record.CorruptReplicas = nil
+	record.Generation = s.nextGeneration()
+	s.indexChecksum(in.FileName, in.Checksum)
+	s.recordEvent(in.FileName, stageAppended, in.DataNode, fmt.Sprintf("%d bytes, %s", in.FileSize, s.sinceRequested(in.FileName, in.DataNode)))
+	log.Printf("%s appended to on DataNode %d, now %d bytes", in.FileName, in.DataNode, in.FileSize)
+
+	// the copies not being refreshed are stale
+	s.retireReplaced(old, append(s.startReplication(record, in.FilePath, in.DataNode), in.DataNode))
+	s.PrintFileRecords()
+}
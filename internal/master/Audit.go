@@ -0,0 +1,59 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultAuditLogPath = "MasterNode_audit.log"
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Path   string    `json:"path"`
+	Caller string    `json:"caller"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// guards appends to the audit log, independent of the server mutex
+var auditMutex sync.Mutex
+
+/*
+Appends an entry to the audit log, one JSON object per line, for actions that
+must be traceable: hold changes and the operations they rejected
+*/
+func (s *server) audit(ctx context.Context, action, path, detail string) {
+	entry := auditEntry{
+		Time:   time.Now().UTC(),
+		Action: action,
+		Path:   path,
+		Caller: clientHost(ctx),
+		Detail: detail,
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("audit encode fail %v", err)
+		return
+	}
+	logPath := s.config.AuditLogPath
+	if logPath == "" {
+		logPath = defaultAuditLogPath
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("AUDIT %s (log unavailable: %v)", line, err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Printf("AUDIT %s (write fail: %v)", line, err)
+	}
+}
@@ -0,0 +1,458 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	pb "proj/Services"
+	"proj/internal/erasure"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// names the blocks of files stored in blocks are kept under, reserved to the master
+	blockPrefix = ".dfs-blocks/"
+	// size of the blocks when BlockBytes is 0
+	defaultBlockBytes = 64 * 1024 * 1024
+	// most blocks a file is split into, a larger block size is needed beyond
+	maxBlocksPerFile = 100000
+)
+
+// fileBlock is the part of a file stored in blocks from Offset, kept as the file Name on the DataNodes
+type fileBlock struct {
+	Name   string
+	Offset int64
+	Length int64
+	// 1 to 3 for the parity blocks of an erasure-6-3 file, which follow the
+	// data blocks of their stripe and have its Offset, see stripes
+	Parity int32 `json:",omitempty"`
+	// DataNodes planned for the block's upload, until it is committed
+	Targets []int32 `json:"-"`
+}
+
+// blockClaim identifies a file whose blocks DataNodes reported, see claimBlock
+type blockClaim struct {
+	FileName   string
+	Generation int64
+}
+
+func isBlockName(fileName string) bool {
+	return strings.HasPrefix(fileName, blockPrefix)
+}
+
+func (s *server) blockBytes() int64 {
+	if s.config.BlockBytes > 0 {
+		return s.config.BlockBytes
+	}
+	return defaultBlockBytes
+}
+
+// newBlockName names a block randomly like upload tokens, so names stay unique across master restarts
+func newBlockName() string {
+	return blockPrefix + newUploadToken()
+}
+
+/*
+prepareBlocks plans the upload of a file split in blocks of blockBytes.
+Each block is uploaded as a file of its own with targets of its own, the
+blocks starting on the DataNodes in turn, so a file too large to copy whole
+to each replica is spread over the cluster. An erasure-6-3 file gets three
+parity blocks after every six data blocks, and after the last ones, the
+client computing them as it writes. Must be called with the mutex held
+*/
+func (s *server) prepareBlocks(in *pb.PrepareUploadRequest, blockBytes int64, pending *pendingUpload, warnings []string) (*pb.PrepareUploadResponse, error) {
+	if in.ContentEncoding != "" {
+		return nil, status.Error(codes.InvalidArgument, "files stored in blocks can't have a content encoding")
+	}
+	if (in.FileSize+blockBytes-1)/blockBytes > maxBlocksPerFile {
+		return nil, status.Errorf(codes.InvalidArgument, "%d bytes in blocks of %d is over %d blocks, use larger blocks", in.FileSize, blockBytes, maxBlocksPerFile)
+	}
+	candidates, err := s.eligibleUploadTargets(pending.Constraints, blockBytes)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	response := &pb.PrepareUploadResponse{Warnings: warnings}
+	first := rand.Intn(len(candidates))
+	plan := func(block fileBlock) {
+		primary := candidates[(first+len(pending.Blocks))%len(candidates)]
+		planned := &FileRecord{FileName: block.Name, DataNodes: []int32{primary}, Size: block.Length, Constraints: pending.Constraints, StorageClass: pending.StorageClass}
+		_, _, replicaIDs := s.selectReplicaTargets(planned, primary, 1)
+		block.Targets = append([]int32{primary}, replicaIDs...)
+		pending.Blocks = append(pending.Blocks, block)
+		response.Blocks = append(response.Blocks, &pb.UploadBlock{
+			FileName: block.Name,
+			Offset:   block.Offset,
+			Length:   block.Length,
+			Targets:  s.uploadTargets(block.Targets),
+			Parity:   block.Parity,
+		})
+	}
+	erasureCoded := storageClasses[pending.StorageClass].erasure
+	for offset := int64(0); offset < in.FileSize; offset += blockBytes {
+		plan(fileBlock{Name: newBlockName(), Offset: offset, Length: min(blockBytes, in.FileSize-offset)})
+		// the stripe's first block is the longest, the parity blocks are as long
+		stripeStart := offset - offset%(erasure.DataShards*blockBytes)
+		if erasureCoded && (offset+blockBytes == stripeStart+erasure.DataShards*blockBytes || offset+blockBytes >= in.FileSize) {
+			for parity := int32(1); parity <= erasure.ParityShards; parity++ {
+				plan(fileBlock{Name: newBlockName(), Offset: stripeStart, Length: min(blockBytes, in.FileSize-stripeStart), Parity: parity})
+			}
+		}
+	}
+	pending.Committed = make(map[string]bool)
+	response.UploadToken = s.addPendingUpload(pending)
+
+	s.recordEvent(in.FileName, stageUploadPrepared, noDataNode, fmt.Sprintf("%d bytes in %d blocks of %d, %s", in.FileSize, len(pending.Blocks), blockBytes, pending.StorageClass))
+	return response, nil
+}
+
+/*
+commitBlock records a block of an upload prepared by prepareBlocks once its
+first copy is stored, and has it replicated like a file. The file is
+committed with its last block. Must be called with the mutex held
+*/
+func (s *server) commitBlock(in *pb.NotifyUploadedRequest, pending *pendingUpload) (*pb.NotifyUploadedResponse, error) {
+	var block *fileBlock
+	for i := range pending.Blocks {
+		if pending.Blocks[i].Name == in.FileName {
+			block = &pending.Blocks[i]
+		}
+	}
+	if block == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%s isn't a block of the upload of %s", in.FileName, pending.FileName)
+	}
+	if in.FileSize != block.Length {
+		s.deleteReplica(in.DataNode, &pb.FileDeleteRequest{FileName: in.FileName})
+		s.recordEvent(pending.FileName, stageReplicationFailed, in.DataNode, fmt.Sprintf("block at offset %d has %d bytes instead of %d", block.Offset, in.FileSize, block.Length))
+		return nil, status.Errorf(codes.InvalidArgument, "block %s has %d bytes instead of %d", in.FileName, in.FileSize, block.Length)
+	}
+
+	record := &FileRecord{
+		FileName:     in.FileName,
+		FilePaths:    []string{in.FilePath},
+		DataNodes:    []int32{in.DataNode},
+		Size:         in.FileSize,
+		Checksum:     in.Checksum,
+		Constraints:  pending.Constraints,
+		Generation:   s.nextGeneration(),
+		StorageClass: pending.StorageClass,
+	}
+	s.fileRecords[in.FileName] = record
+	s.recordEvent(in.FileName, stageCommitted, in.DataNode, fmt.Sprintf("block of %s at offset %d, %d bytes", pending.FileName, block.Offset, in.FileSize))
+	s.startReplication(record, in.FilePath, in.DataNode, block.Targets...)
+	block.Targets = nil
+
+	pending.Committed[in.FileName] = true
+	// large files take long, the token lasts as long as blocks keep coming
+	pending.Expires = time.Now().Add(uploadTokenTTL)
+	if len(pending.Committed) == len(pending.Blocks) {
+		delete(s.pendingUploads, in.UploadToken)
+		// the quota may have filled up since the upload was prepared
+		if _, err := s.checkQuota(pending.FileName, pending.Size); err != nil {
+			log.Printf("upload of %s refused: %v", pending.FileName, err)
+			s.recordEvent(pending.FileName, stageCommitRefused, noDataNode, status.Convert(err).Message())
+			s.dropBlocks(&FileRecord{Blocks: pending.Blocks})
+			return nil, err
+		}
+		s.commitBlocked(pending)
+	}
+	return &pb.NotifyUploadedResponse{Generation: record.Generation}, nil
+}
+
+// commitBlocked records a file whose blocks are all stored, replacing the file stored under its name, must be called with the mutex held
+func (s *server) commitBlocked(pending *pendingUpload) {
+	if old, ok := s.fileRecords[pending.FileName]; ok {
+		s.replaceFile(old)
+		s.retireReplaced(*old, nil)
+		s.releaseStorage(old)
+	}
+	record := &FileRecord{
+		FileName:     pending.FileName,
+		Size:         pending.Size,
+		Constraints:  pending.Constraints,
+		Generation:   s.nextGeneration(),
+		Tags:         tagSet(s.pendingTags[pending.FileName]),
+		StorageClass: pending.StorageClass,
+		Blocks:       pending.Blocks,
+	}
+	delete(s.pendingTags, pending.FileName)
+	if pending.TTL > 0 {
+		record.ExpiresAt = time.Now().Add(pending.TTL)
+	}
+	s.fileRecords[pending.FileName] = record
+	s.indexBlocks(record)
+	s.recordEvent(pending.FileName, stageCommitted, noDataNode, fmt.Sprintf("%d bytes in %d blocks", record.Size, len(record.Blocks)))
+
+	warnings, _ := s.checkQuota(pending.FileName, pending.Size)
+	for _, warning := range warnings {
+		log.Printf("WARNING %s stored: %s", pending.FileName, warning)
+	}
+	s.PrintFileRecords()
+}
+
+// readBlocks lists the blocks of record with their replicas best first for a reader at host, must be called with the mutex held
+func (s *server) readBlocks(record *FileRecord, host string) []*pb.ReadBlock {
+	blocks := make([]*pb.ReadBlock, 0, len(record.Blocks))
+	for _, block := range record.Blocks {
+		readBlock := &pb.ReadBlock{FileName: block.Name, Offset: block.Offset, Length: block.Length, Parity: block.Parity}
+		// a block lost with all its replicas has none left to list
+		if blockRecord, ok := s.fileRecords[block.Name]; ok {
+			readBlock.Replicas = s.replicaLocations(blockRecord, host)
+		}
+		blocks = append(blocks, readBlock)
+	}
+	return blocks
+}
+
+// dropBlocks forgets the blocks of a deleted or replaced file and has their replicas deleted, must be called with the mutex held
+func (s *server) dropBlocks(record *FileRecord) {
+	for _, block := range record.Blocks {
+		delete(s.blockFiles, block.Name)
+		blockRecord, ok := s.fileRecords[block.Name]
+		if !ok {
+			continue
+		}
+		s.forgetFile(blockRecord)
+		for _, node := range blockRecord.DataNodes {
+			s.deleteReplica(node, &pb.FileDeleteRequest{FileName: block.Name, DropVersions: true})
+		}
+	}
+}
+
+// renameRecord moves the record of a file stored in blocks or packed to newName, must be called with the mutex held
+func (s *server) renameRecord(record *FileRecord, newName string) {
+	oldName := record.FileName
+	delete(s.fileRecords, oldName)
+	record.FileName = newName
+	record.Generation = s.nextGeneration()
+	s.fileRecords[newName] = record
+	s.indexBlocks(record)
+	if record.Packed != nil {
+		members := s.packFiles[record.Packed.Container]
+		delete(members, oldName)
+		members[newName] = true
+	}
+	if versions, ok := s.versions[oldName]; ok {
+		s.versions[newName] = versions
+		delete(s.versions, oldName)
+	}
+	s.recordEvent(oldName, stageRenamed, noDataNode, "to "+newName)
+	s.endTimeline(oldName)
+	s.recordEvent(newName, stageRenamed, noDataNode, "from "+oldName)
+	log.Printf("%s renamed to %s, its bytes stay where they are", oldName, newName)
+}
+
+/*
+DeleteFile deletes a file stored in blocks or packed in a container. No
+DataNode holds such a file to clear its delete with NotifyDeleted, clients
+ask the master instead. Its blocks are deleted outright, as is its container
+with the last file packed in it; the file skips the trash
+*/
+func (s *server) DeleteFile(ctx context.Context, in *pb.FileDeleteRequest) (*pb.FileDeleteResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.renaming[in.FileName] {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is being renamed", in.FileName)
+	}
+	if err := s.checkHold(in.FileName); err != nil {
+		s.audit(ctx, "delete-denied", in.FileName, status.Convert(err).Message())
+		return nil, err
+	}
+	record, ok := s.fileRecords[in.FileName]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "No such filename exist")
+	}
+	if record.hasOwnReplicas() {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is stored whole, delete it through a DataNode holding it", in.FileName)
+	}
+	s.forgetFile(record)
+	s.releaseStorage(record)
+	s.nextGeneration()
+	s.recordEvent(in.FileName, stageDeleted, noDataNode, fmt.Sprintf("%d bytes", record.Size))
+	log.Printf("%s deleted", in.FileName)
+	s.PrintFileRecords()
+	return &pb.FileDeleteResponse{}, nil
+}
+
+// blockOwner describes the file record to the DataNodes holding blockName, one of its blocks
+func (r *FileRecord) blockOwner(blockName string) *pb.BlockOwner {
+	for _, block := range r.Blocks {
+		if block.Name == blockName {
+			return &pb.BlockOwner{
+				BlockName:     blockName,
+				FileName:      r.FileName,
+				Generation:    r.Generation,
+				Offset:        block.Offset,
+				FileSize:      r.Size,
+				BlockCount:    int32(len(r.Blocks)),
+				StorageClass:  r.StorageClass,
+				ExpiresUnixMs: r.expiresUnixMs(),
+				Parity:        block.Parity,
+			}
+		}
+	}
+	return nil
+}
+
+// ownerOf returns the owner of blockName, nil when it belongs to no recorded file; must be called with the mutex held
+func (s *server) ownerOf(blockName string) *pb.BlockOwner {
+	record, ok := s.fileRecords[s.blockFiles[blockName]]
+	if !ok {
+		return nil
+	}
+	return record.blockOwner(blockName)
+}
+
+/*
+indexBlocks records which file the blocks of record belong to and has the
+DataNodes holding them told with their next heartbeat, once the file is
+committed and whenever it's renamed. Must be called with the mutex held
+*/
+func (s *server) indexBlocks(record *FileRecord) {
+	for _, block := range record.Blocks {
+		s.blockFiles[block.Name] = record.FileName
+		if blockRecord, ok := s.fileRecords[block.Name]; ok {
+			owner := record.blockOwner(block.Name)
+			for _, node := range blockRecord.DataNodes {
+				s.pushBlockOwner(node, owner)
+			}
+		}
+	}
+}
+
+// pushBlockOwner queues owner for nodeID's next heartbeat, must be called with the mutex held
+func (s *server) pushBlockOwner(nodeID int32, owner *pb.BlockOwner) {
+	if int(nodeID) >= len(s.machineRecords) {
+		return
+	}
+	machine := s.machineRecords[nodeID]
+	if machine.BlockOwners == nil {
+		machine.BlockOwners = make(map[string]*pb.BlockOwner)
+	}
+	machine.BlockOwners[owner.BlockName] = owner
+}
+
+// takeBlockOwners returns the owners queued for nodeID, must be called with the mutex held
+func (s *server) takeBlockOwners(nodeID int) []*pb.BlockOwner {
+	machine := s.machineRecords[nodeID]
+	owners := make([]*pb.BlockOwner, 0, len(machine.BlockOwners))
+	for _, owner := range machine.BlockOwners {
+		owners = append(owners, owner)
+	}
+	machine.BlockOwners = nil
+	return owners
+}
+
+/*
+reconcileBlockOwner checks the owner a DataNode reported with a block. The
+owner of a block of a recorded file is sent back when the DataNode has it
+wrong, one of a file the master lost is a claim towards rebuilding the file.
+Must be called with the mutex held
+*/
+func (s *server) reconcileBlockOwner(file *pb.LocalFile, response *pb.ReportFilesResponse) {
+	if owner := s.ownerOf(file.FileName); owner != nil {
+		if !proto.Equal(owner, file.BlockOwner) {
+			response.BlockOwners = append(response.BlockOwners, owner)
+		}
+		return
+	}
+	if file.BlockOwner != nil && file.BlockOwner.BlockName == file.FileName {
+		s.claimBlock(file.BlockOwner, response)
+	}
+}
+
+/*
+claimBlock collects the owners the DataNodes report for the blocks of a file
+the master has no record of, as after a restart, and records the file again
+once every block is claimed. Blocks of a file since replaced or deleted are
+dropped. Must be called with the mutex held
+*/
+func (s *server) claimBlock(owner *pb.BlockOwner, response *pb.ReportFilesResponse) {
+	s.generation = max(s.generation, owner.Generation)
+	if record, ok := s.fileRecords[owner.FileName]; ok && record.Generation > owner.Generation {
+		s.dropBlocks(&FileRecord{Blocks: []fileBlock{{Name: owner.BlockName}}})
+		response.Stale++
+		return
+	}
+	if trashed, ok := s.trash[owner.FileName]; ok && trashed.Record.Generation >= owner.Generation {
+		s.dropBlocks(&FileRecord{Blocks: []fileBlock{{Name: owner.BlockName}}})
+		response.Stale++
+		return
+	}
+	// the blocks keep the durability of their file
+	if blockRecord, ok := s.fileRecords[owner.BlockName]; ok && owner.StorageClass != "" {
+		blockRecord.StorageClass = owner.StorageClass
+	}
+	key := blockClaim{FileName: owner.FileName, Generation: owner.Generation}
+	if s.blockClaims[key] == nil {
+		s.blockClaims[key] = make(map[string]*pb.BlockOwner)
+	}
+	s.blockClaims[key][owner.BlockName] = owner
+	if len(s.blockClaims[key]) < int(owner.BlockCount) {
+		return
+	}
+
+	claims := s.blockClaims[key]
+	delete(s.blockClaims, key)
+	blocks := make([]fileBlock, 0, len(claims))
+	var parity []fileBlock
+	for _, claim := range claims {
+		block := fileBlock{Name: claim.BlockName, Offset: claim.Offset, Parity: claim.Parity}
+		if block.Parity > 0 {
+			parity = append(parity, block)
+		} else {
+			blocks = append(blocks, block)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Offset < blocks[j].Offset })
+	for i := range blocks {
+		end := owner.FileSize
+		if i+1 < len(blocks) {
+			end = blocks[i+1].Offset
+		}
+		blocks[i].Length = end - blocks[i].Offset
+		if (i == 0 && blocks[i].Offset != 0) || blocks[i].Length <= 0 {
+			log.Printf("blocks reported for %s of generation %d don't make up the file, not recorded", owner.FileName, owner.Generation)
+			return
+		}
+	}
+	if len(parity) > 0 {
+		var ok bool
+		if blocks, ok = withParity(blocks, parity); !ok {
+			log.Printf("parity blocks reported for %s of generation %d don't match its stripes, not recorded", owner.FileName, owner.Generation)
+			return
+		}
+	}
+	if old, ok := s.fileRecords[owner.FileName]; ok {
+		s.replaceFile(old)
+		s.retireReplaced(*old, nil)
+		s.releaseStorage(old)
+	}
+	class := owner.StorageClass
+	if class == "" {
+		class = defaultStorageClass
+	}
+	record := &FileRecord{
+		FileName:     owner.FileName,
+		Size:         owner.FileSize,
+		Generation:   owner.Generation,
+		Constraints:  s.placementConstraintsFor(owner.FileName, nil),
+		StorageClass: class,
+		Blocks:       blocks,
+	}
+	if owner.ExpiresUnixMs != 0 {
+		record.ExpiresAt = time.UnixMilli(owner.ExpiresUnixMs)
+	}
+	s.fileRecords[owner.FileName] = record
+	s.indexBlocks(record)
+	s.recordEvent(owner.FileName, stageReported, noDataNode, fmt.Sprintf("recorded again from the owners of its %d blocks the DataNodes reported", len(blocks)))
+	response.Recovered++
+}
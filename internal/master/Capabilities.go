@@ -0,0 +1,77 @@
+package master
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	pb "proj/Services"
+	"proj/internal/apiversion"
+)
+
+const (
+	// gRPC's default receive limit, MaxMessageBytes when 0
+	defaultMaxMessageBytes = 4 * 1024 * 1024
+	// chunk size advertised to clients, ChunkBytes when 0
+	defaultChunkBytes = 1024 * 1024
+	// room kept in every message for the file name and other fields
+	messageOverhead = 64 * 1024
+)
+
+// optional features of the master, clients only use those listed
+var masterCapabilities = []string{
+	"prepare-upload",
+	"read-locations",
+	"find-by-checksum",
+	"holds",
+	"tags",
+	"timelines",
+	"scoped-tokens",
+	"storage-classes",
+	"append",
+	"rename",
+	"trash",
+	"versions",
+	"ttl",
+	"blocks",
+	"pack",
+}
+
+/*
+checkLimits fills in the default message and chunk sizes and makes sure a
+chunk, with the other fields of its message, fits in a message
+*/
+func (config *MasterConfig) checkLimits() error {
+	if config.MaxMessageBytes == 0 {
+		config.MaxMessageBytes = defaultMaxMessageBytes
+	}
+	if config.ChunkBytes == 0 {
+		config.ChunkBytes = defaultChunkBytes
+	}
+	if config.ChunkBytes < 0 || config.MaxMessageBytes < 0 {
+		return errors.New("MaxMessageBytes and ChunkBytes can't be negative")
+	}
+	if int64(config.ChunkBytes)+messageOverhead > config.MaxMessageBytes {
+		return fmt.Errorf("ChunkBytes %d doesn't fit in MaxMessageBytes %d, which must be at least %d bytes larger",
+			config.ChunkBytes, config.MaxMessageBytes, messageOverhead)
+	}
+	if config.MaxMessageBytes > math.MaxInt32 {
+		return fmt.Errorf("MaxMessageBytes %d is over gRPC's 2GB limit", config.MaxMessageBytes)
+	}
+	return nil
+}
+
+// GetCapabilities is a client's first call on a connection, telling it which API it can use
+func (s *server) GetCapabilities(ctx context.Context, in *pb.GetCapabilitiesRequest) (*pb.GetCapabilitiesResponse, error) {
+	if err := apiversion.Check(in.ApiVersion); err != nil {
+		return nil, err
+	}
+	return &pb.GetCapabilitiesResponse{
+		ApiVersion:      apiversion.Current,
+		MinApiVersion:   apiversion.Min,
+		Capabilities:    masterCapabilities,
+		MaxMessageBytes: s.config.MaxMessageBytes,
+		ChunkBytes:      int32(s.config.ChunkBytes),
+		MaxFileBytes:    s.config.MaxFileBytes,
+	}, nil
+}
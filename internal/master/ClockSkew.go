@@ -0,0 +1,48 @@
+package master
+
+import (
+	"log"
+	pb "proj/Services"
+	"time"
+)
+
+// DataNode clocks may diverge this much from the master's before being flagged
+const defaultMaxClockSkew = time.Second
+
+func (s *server) maxClockSkew() time.Duration {
+	if s.config.MaxClockSkewMs > 0 {
+		return time.Duration(s.config.MaxClockSkewMs) * time.Millisecond
+	}
+	return defaultMaxClockSkew
+}
+
+/*
+checkClockSkew records how far the clock of DataNode nodeID is from the
+master's and flags it when beyond maxClockSkew, since lease expiry, TTLs and
+snapshots all assume roughly synchronized clocks. The DataNode measures the
+offset from the round trip of its previous heartbeat; on the first one the
+send time is compared, which also counts the network delay. Called with
+s.mutex held, returns whether the node is flagged
+*/
+func (s *server) checkClockSkew(nodeID int, in *pb.KeepAliveRequest) bool {
+	record := s.machineRecords[nodeID]
+	switch {
+	case in.ClockOffsetMs != nil:
+		record.ClockSkew = time.Duration(*in.ClockOffsetMs) * time.Millisecond
+	case in.SentUnixMs != 0:
+		record.ClockSkew = time.UnixMilli(in.SentUnixMs).Sub(time.Now())
+	default:
+		// DataNodes predating clock checks don't report their time
+		return false
+	}
+	skewed := record.ClockSkew.Abs() > s.maxClockSkew()
+	if skewed != record.ClockSkewed {
+		if skewed {
+			log.Printf("DataNode %d clock is off by %v, more than %v: check its time synchronization", nodeID, record.ClockSkew, s.maxClockSkew())
+		} else {
+			log.Printf("DataNode %d clock is back in sync (off by %v)", nodeID, record.ClockSkew)
+		}
+		record.ClockSkewed = skewed
+	}
+	return skewed
+}
@@ -0,0 +1,42 @@
+package master
+
+import "time"
+
+/*
+undrainedFiles counts the files on the draining DataNode nodeID still short
+of their replicas on other nodes, must be called with the mutex held.
+Replicas elsewhere count as they do for the repair pass, which copies the
+files away from the draining node. Scratch data is never repaired, losing
+its node loses it, so it doesn't hold the drain back, and a file can't want
+more replicas than there are other nodes, though it wants one. The DataNode is safe to shut down
+once none are left
+*/
+func (s *server) undrainedFiles(nodeID int32) int {
+	now := time.Now()
+	nodes := 0
+	for _, machine := range s.machineRecords {
+		if !machine.Draining && (machine.Liveness || machine.inMaintenance(now)) {
+			nodes++
+		}
+	}
+	undrained := 0
+	for _, record := range s.fileRecords {
+		if !record.hasOwnReplicas() || record.class().scratch || !record.isStoredOn(nodeID) {
+			continue
+		}
+		elsewhere := 0
+		for _, other := range record.DataNodes {
+			machine := s.machineRecords[other]
+			if other == nodeID || machine.Draining || record.isCorruptOn(other) || !record.mayBeStoredOn(other) {
+				continue
+			}
+			if machine.Liveness || machine.inMaintenance(now) {
+				elsewhere++
+			}
+		}
+		if elsewhere < max(min(record.wantedReplicas(), nodes), 1) {
+			undrained++
+		}
+	}
+	return undrained
+}
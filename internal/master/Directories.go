@@ -0,0 +1,44 @@
+package master
+
+import (
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+checkPathConflict keeps the namespace a tree, as the DataNodes store it: a
+file can't be named like a directory holding other files, nor be stored
+below a name that is a file. Called with the mutex held
+*/
+func (s *server) checkPathConflict(fileName string) error {
+	for i := range fileName {
+		if fileName[i] != '/' {
+			continue
+		}
+		if _, ok := s.fileRecords[fileName[:i]]; ok {
+			return status.Errorf(codes.FailedPrecondition, "%s is a file, %s can't be stored below it", fileName[:i], fileName)
+		}
+	}
+	directory := fileName + "/"
+	for other := range s.fileRecords {
+		if strings.HasPrefix(other, directory) {
+			return status.Errorf(codes.FailedPrecondition, "%s is a directory holding %s", fileName, other)
+		}
+	}
+	return nil
+}
+
+/*
+directoryOf returns the subdirectory of prefix fileName lies in, "" when it
+lies directly under prefix. Names under a directory prefix end in "/",
+logs/2024/05/a.log is in logs/2024/ under logs/
+*/
+func directoryOf(prefix, fileName string) string {
+	rest := strings.TrimPrefix(fileName, prefix)
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		return prefix + rest[:i+1]
+	}
+	return ""
+}
@@ -0,0 +1,56 @@
+package master
+
+import (
+	"log"
+	"net"
+	"strings"
+)
+
+const (
+	// UDP port the master answers discovery broadcasts on
+	discoveryPort     = ":50070"
+	discoveryRequest  = "DFS-DISCOVER"
+	discoveryResponse = "DFS-MASTER "
+)
+
+/*
+Answers DataNodes looking for the master on the LAN: a broadcast
+"DFS-DISCOVER" datagram gets a unicast "DFS-MASTER <port>" reply naming the
+port DataNodes talk to, the DataNode takes the IP from the reply's source.
+The socket is dual-stack, answering IPv4 broadcasts and requests sent to the
+IPv6 all-nodes group alike
+*/
+func (s *server) answerDiscovery() {
+	conn, err := net.ListenPacket("udp", discoveryPort)
+	if err != nil {
+		log.Printf("discovery disabled, udp listen fail: %v", err)
+		return
+	}
+	defer conn.Close()
+	log.Printf("answering discovery on udp %s", discoveryPort)
+	// a stopped master frees the port
+	go func() {
+		<-s.stopped
+		conn.Close()
+	}()
+
+	buf := make([]byte, 64)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.stopped:
+				return
+			default:
+			}
+			log.Printf("discovery read fail: %v", err)
+			continue
+		}
+		if strings.TrimSpace(string(buf[:n])) != discoveryRequest {
+			continue
+		}
+		if _, err := conn.WriteTo([]byte(discoveryResponse+s.config.DataNodePort), addr); err != nil {
+			log.Printf("discovery reply to %s fail: %v", addr, err)
+		}
+	}
+}
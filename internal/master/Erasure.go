@@ -0,0 +1,180 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"log"
+	pb "proj/Services"
+	"proj/internal/erasure"
+	"slices"
+	"sort"
+	"time"
+)
+
+// stripe is the blocks of a stripe of an erasure-6-3 file indexed as shards, nil for the data blocks a short last stripe lacks
+type stripe [erasure.Shards]*fileBlock
+
+/*
+stripes splits the blocks of an erasure-6-3 file into its stripes: up to
+six data blocks, then the three parity blocks computed from them
+*/
+func stripes(blocks []fileBlock) []stripe {
+	var all []stripe
+	data := erasure.DataShards
+	for i := range blocks {
+		block := &blocks[i]
+		if block.Parity > 0 {
+			if len(all) > 0 {
+				all[len(all)-1][erasure.DataShards+int(block.Parity)-1] = block
+			}
+			// the next data block starts a stripe
+			data = erasure.DataShards
+			continue
+		}
+		if data == erasure.DataShards {
+			all = append(all, stripe{})
+			data = 0
+		}
+		all[len(all)-1][data] = block
+		data++
+	}
+	return all
+}
+
+/*
+withParity puts the parity blocks DataNodes reported for a file after the
+data blocks of their stripe, giving them the length of its first block. It
+reports false unless every stripe has its three
+*/
+func withParity(data, parity []fileBlock) ([]fileBlock, bool) {
+	sort.Slice(parity, func(i, j int) bool {
+		if parity[i].Offset != parity[j].Offset {
+			return parity[i].Offset < parity[j].Offset
+		}
+		return parity[i].Parity < parity[j].Parity
+	})
+	blocks := make([]fileBlock, 0, len(data)+len(parity))
+	for start := 0; start < len(data); start += erasure.DataShards {
+		stripeData := data[start:min(start+erasure.DataShards, len(data))]
+		blocks = append(blocks, stripeData...)
+		for i := int32(1); i <= erasure.ParityShards; i++ {
+			if len(parity) == 0 || parity[0].Offset != stripeData[0].Offset || parity[0].Parity != i {
+				return nil, false
+			}
+			parity[0].Length = stripeData[0].Length
+			blocks = append(blocks, parity[0])
+			parity = parity[1:]
+		}
+	}
+	return blocks, len(parity) == 0
+}
+
+/*
+rebuildBlock has a DataNode rebuild a block of an erasure-6-3 file that has
+no healthy copy left on a live DataNode, from six other blocks of its
+stripe. The target is one holding no other block of the stripe when there
+is one, and counts as retrying the block until it reports it like a
+replica. A stripe that lost more than three blocks can't be rebuilt. Must
+be called with the mutex held
+*/
+func (s *server) rebuildBlock(record *FileRecord, now time.Time) {
+	owner, ok := s.fileRecords[s.blockFiles[record.FileName]]
+	if !ok {
+		return
+	}
+	var blocks stripe
+	shard := -1
+	for _, candidate := range stripes(owner.Blocks) {
+		for i, block := range candidate {
+			if block != nil && block.Name == record.FileName {
+				blocks, shard = candidate, i
+			}
+		}
+	}
+	if shard < 0 {
+		return
+	}
+
+	request := &pb.RebuildBlockRequest{
+		FileName:   record.FileName,
+		Shard:      int32(shard),
+		Length:     record.Size,
+		Checksum:   record.Checksum,
+		ShardBytes: blocks[0].Length,
+		ClusterId:  s.clusterID,
+	}
+	for _, block := range blocks[:erasure.DataShards] {
+		if block != nil {
+			request.DataBlocks++
+		}
+	}
+	// the data blocks a short stripe lacks count without being sent
+	needed := int(request.DataBlocks)
+	var holders []int32
+	for i, block := range blocks {
+		if block == nil || i == shard {
+			continue
+		}
+		blockRecord, ok := s.fileRecords[block.Name]
+		if !ok {
+			continue
+		}
+		holders = append(holders, blockRecord.DataNodes...)
+		if len(request.Sources) == needed {
+			continue
+		}
+		for _, node := range blockRecord.DataNodes {
+			machine := s.machineRecords[node]
+			if machine.Liveness && !blockRecord.isCorruptOn(node) {
+				request.Sources = append(request.Sources, &pb.BlockShard{
+					FileName:   block.Name,
+					Shard:      int32(i),
+					Length:     block.Length,
+					IpAddress:  machine.IPAddress,
+					PortNumber: machine.DataNodePort,
+				})
+				break
+			}
+		}
+	}
+	if len(request.Sources) < needed {
+		return
+	}
+	candidates, err := s.eligibleUploadTargets(record.Constraints, record.Size)
+	if err != nil {
+		return
+	}
+	target := int32(-1)
+	for _, candidate := range candidates {
+		if record.isStoredOn(candidate) {
+			continue
+		}
+		if target < 0 || (slices.Contains(holders, target) && !slices.Contains(holders, candidate)) {
+			target = candidate
+		}
+	}
+	if target < 0 {
+		return
+	}
+
+	if s.retryingReplicas[record.FileName] == nil {
+		s.retryingReplicas[record.FileName] = make(map[int32]time.Time)
+	}
+	s.retryingReplicas[record.FileName][target] = now
+	s.recordEvent(record.FileName, stageRepairRequested, target, fmt.Sprintf("rebuilt from %d blocks of its stripe", len(request.Sources)))
+	addr := s.machineRecords[target].masterAddr()
+	go func() {
+		conn, err := s.dialDataNode(addr)
+		if err == nil {
+			defer conn.Close()
+			_, err = pb.NewFileServiceClient(conn).RebuildBlock(context.Background(), request)
+		}
+		if err != nil {
+			log.Printf("RebuildBlock of %s on DataNode %d fail %v", request.FileName, target, err)
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			s.retryDone(request.FileName, target)
+			s.recordEvent(request.FileName, stageReplicationFailed, target, err.Error())
+		}
+	}()
+}
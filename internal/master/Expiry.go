@@ -0,0 +1,49 @@
+package master
+
+import (
+	"fmt"
+	"log"
+	pb "proj/Services"
+	"time"
+)
+
+// time between looks for expired files
+const expiryInterval = time.Minute
+
+// expiresUnixMs is when the file expires in Unix milliseconds, 0 when it doesn't
+func (r *FileRecord) expiresUnixMs() int64 {
+	if r.ExpiresAt.IsZero() {
+		return 0
+	}
+	return r.ExpiresAt.UnixMilli()
+}
+
+/*
+expireFiles deletes the files uploaded with a TTL once it has passed, with
+their replicas and versions; expired files skip the trash. A file under a
+hold is kept until the hold is released. The DataNodes also expire their
+replicas on their own, in case the master lost track of a file
+*/
+func (s *server) expireFiles() {
+	for s.sleep(expiryInterval) {
+		s.mutex.Lock()
+		now := time.Now()
+		for name, record := range s.fileRecords {
+			if record.ExpiresAt.IsZero() || now.Before(record.ExpiresAt) || s.renaming[name] {
+				continue
+			}
+			if s.checkHold(name) != nil {
+				continue
+			}
+			s.forgetFile(record)
+			s.releaseStorage(record)
+			s.nextGeneration()
+			s.recordEvent(name, stageExpired, noDataNode, fmt.Sprintf("%d bytes", record.Size))
+			log.Printf("%s expired", name)
+			for _, node := range record.DataNodes {
+				s.deleteReplica(node, &pb.FileDeleteRequest{FileName: name, DropVersions: true})
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
@@ -0,0 +1,180 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"log"
+	pb "proj/Services"
+	"slices"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+ReportFiles takes the inventory a DataNode sends once it starts, again when
+the master asks for it, which a master does after it restarted since it
+only keeps its records in memory, and periodically. Every file reported
+without a record is recorded again, the copy with the newest generation
+winning; copies of a recorded file are added to its replicas when they hold
+its content and dropped when they hold an older one. Replicas recorded on
+the DataNode it didn't report, removed by hand or lost with a disk, are
+forgotten so repair copies them again. Incremental reports, sent between
+full ones, carry the files the DataNode added and removed since its last
+report
+*/
+func (s *server) ReportFiles(ctx context.Context, in *pb.ReportFilesRequest) (*pb.ReportFilesResponse, error) {
+	if !s.authorizedDataNode(ctx) {
+		return nil, status.Error(codes.PermissionDenied, "wrong cluster secret")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if in.DataNode < 0 || int(in.DataNode) >= len(s.machineRecords) {
+		return nil, status.Errorf(codes.FailedPrecondition, "unknown DataNode %d, it must send a heartbeat first", in.DataNode)
+	}
+	response := &pb.ReportFilesResponse{}
+	reported := make(map[string]bool)
+	for _, file := range in.Files {
+		reported[file.FileName] = true
+		// renamed or restored meanwhile, the DataNode's next report catches up
+		if s.renaming[file.FileName] {
+			continue
+		}
+		// records are only lost with a restart, which a full report follows; a file
+		// added without one, such as a copy made by gossip, was deleted since
+		if _, ok := s.fileRecords[file.FileName]; !ok && in.Incremental {
+			continue
+		}
+		s.reconcileReported(in.DataNode, file, response)
+		if isBlockName(file.FileName) {
+			s.reconcileBlockOwner(file, response)
+		}
+	}
+	if in.Incremental {
+		for _, name := range in.Removed {
+			s.forgetReplica(in.DataNode, name, response)
+		}
+		if response.Recovered+response.Added+response.Missing > 0 {
+			log.Printf("DataNode %d reported %d files changed and %d removed: %d recovered, %d replicas added, %d stale, %d missing",
+				in.DataNode, len(in.Files), len(in.Removed), response.Recovered, response.Added, response.Stale, response.Missing)
+			s.PrintFileRecords()
+		}
+		return response, nil
+	}
+	for name := range s.fileRecords {
+		if !reported[name] {
+			s.forgetReplica(in.DataNode, name, response)
+		}
+	}
+	s.machineRecords[in.DataNode].Reported = true
+	log.Printf("DataNode %d reported %d files: %d recovered, %d replicas added, %d stale, %d missing",
+		in.DataNode, len(in.Files), response.Recovered, response.Added, response.Stale, response.Missing)
+	if response.Recovered+response.Added+response.Missing > 0 {
+		s.PrintFileRecords()
+	}
+	return response, nil
+}
+
+// reconcileReported reconciles the records with a file nodeID reported, must be called with the mutex held
+func (s *server) reconcileReported(nodeID int32, file *pb.LocalFile, response *pb.ReportFilesResponse) {
+	s.generation = max(s.generation, file.Generation)
+	record, ok := s.fileRecords[file.FileName]
+	if !ok {
+		// a copy of content deleted while the DataNode was away
+		if trashed, ok := s.trash[file.FileName]; ok && file.Generation != 0 && file.Generation <= trashed.Record.Generation {
+			s.deleteReplica(nodeID, &pb.FileDeleteRequest{FileName: file.FileName})
+			response.Stale++
+			return
+		}
+		s.recoverFile(nodeID, file)
+		response.Recovered++
+		return
+	}
+	i := slices.Index(record.DataNodes, nodeID)
+	switch {
+	case file.Checksum != "" && file.Checksum == record.Checksum:
+		if i >= 0 {
+			return
+		}
+		record.DataNodes = append(record.DataNodes, nodeID)
+		record.FilePaths = append(record.FilePaths, file.FilePath)
+		s.recordEvent(file.FileName, stageReported, nodeID, "replica found on the DataNode")
+		response.Added++
+	case file.Generation > record.Generation:
+		// the record is of an older content, the first reported since the master restarted
+		if i >= 0 {
+			s.dropReplica(record, i)
+		}
+		delete(s.pendingMoves, file.FileName)
+		delete(s.checksumIndex[record.Checksum], file.FileName)
+		s.recoverFile(nodeID, file)
+		s.retireReplaced(*record, nil)
+		response.Recovered++
+	case file.Generation != 0 && file.Generation < record.Generation:
+		if i >= 0 {
+			s.dropReplica(record, i)
+		}
+		s.deleteReplica(nodeID, &pb.FileDeleteRequest{FileName: file.FileName})
+		s.recordEvent(file.FileName, stageReported, nodeID, fmt.Sprintf("stale copy of generation %d dropped", file.Generation))
+		response.Stale++
+	default:
+		// unconfirmed copy of other content, left alone but not read from
+		if i >= 0 && file.Checksum != "" {
+			s.dropReplica(record, i)
+		}
+		log.Printf("DataNode %d holds %s with checksum %s, recorded as %s: not counted as a replica", nodeID, file.FileName, file.Checksum, record.Checksum)
+	}
+}
+
+/*
+recoverFile records a file the master lost from a copy nodeID reported. What
+the DataNodes don't keep, tags and storage class, is back to the defaults
+until a namespace import restores it. Must be called with the mutex held
+*/
+func (s *server) recoverFile(nodeID int32, file *pb.LocalFile) {
+	generation := file.Generation
+	if generation == 0 {
+		generation = s.nextGeneration()
+	}
+	record := &FileRecord{
+		FileName:        file.FileName,
+		FilePaths:       []string{file.FilePath},
+		DataNodes:       []int32{nodeID},
+		Size:            file.Size,
+		Checksum:        file.Checksum,
+		ContentEncoding: file.ContentEncoding,
+		Generation:      generation,
+		Constraints:     s.placementConstraintsFor(file.FileName, nil),
+		StorageClass:    defaultStorageClass,
+	}
+	if file.ExpiresUnixMs != 0 {
+		record.ExpiresAt = time.UnixMilli(file.ExpiresUnixMs)
+	}
+	s.fileRecords[file.FileName] = record
+	s.indexChecksum(file.FileName, file.Checksum)
+	s.recordEvent(file.FileName, stageReported, nodeID, fmt.Sprintf("recorded again from the DataNode's inventory, %d bytes", file.Size))
+}
+
+// forgetReplica forgets the replica of fileName nodeID no longer holds, must be called with the mutex held
+func (s *server) forgetReplica(nodeID int32, fileName string, response *pb.ReportFilesResponse) {
+	record, ok := s.fileRecords[fileName]
+	if !ok || s.renaming[fileName] {
+		return
+	}
+	if i := slices.Index(record.DataNodes, nodeID); i >= 0 {
+		s.dropReplica(record, i)
+		s.recordEvent(fileName, stageReported, nodeID, "replica missing from the DataNode")
+		response.Missing++
+	}
+}
+
+// dropReplica forgets the i-th replica of record, must be called with the mutex held
+func (s *server) dropReplica(record *FileRecord, i int) {
+	delete(record.CorruptReplicas, record.DataNodes[i])
+	record.DataNodes = slices.Delete(record.DataNodes, i, i+1)
+	if i < len(record.FilePaths) {
+		record.FilePaths = slices.Delete(record.FilePaths, i, i+1)
+	}
+}
@@ -0,0 +1,1936 @@
+package master
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	pb "proj/Services"
+	"proj/internal/apiversion"
+	"proj/internal/faults"
+	"proj/internal/paths"
+	"proj/internal/tlsconfig"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	portClient       = ":50060"
+	portDataNode     = ":50061"
+	keepAliveTimeout = 2 * time.Second
+	// number of DataNodes every file should be stored on
+	replicationFactor = 3
+	// how long a PrepareUpload token waits for the upload to land
+	uploadTokenTTL = time.Hour
+	// how long repair counts on a DataNode retrying a replica, past its default backoff
+	retryingReplicaTimeout = 3 * time.Hour
+)
+
+// MasterConfig is read from the optional JSON file passed on the command line
+type MasterConfig struct {
+	// rebalance when the spread of used bytes between live DataNodes, as a
+	// percentage of the mean, exceeds this value; 0 disables rebalancing
+	RebalanceThresholdPercent float64 `json:"RebalanceThresholdPercent"`
+	RebalanceIntervalSeconds  int     `json:"RebalanceIntervalSeconds"`
+	// cap on the bytes scheduled for moving in one round, 0 means no cap
+	RebalanceMaxBytesPerRound int64 `json:"RebalanceMaxBytesPerRound"`
+	// daily "HH:MM" window in which rebalancing may run, empty means any time
+	RebalanceWindowStart string `json:"RebalanceWindowStart"`
+	RebalanceWindowEnd   string `json:"RebalanceWindowEnd"`
+	// answer DataNodes' LAN discovery broadcasts
+	Discoverable bool `json:"Discoverable"`
+	// token of the compliance role managing holds, empty lets anyone manage them
+	ComplianceToken string `json:"ComplianceToken"`
+	// where hold changes and the operations they rejected are recorded
+	AuditLogPath string `json:"AuditLogPath"`
+	// file keeping the holds across restarts, defaultHoldsPath when empty
+	HoldsPath string `json:"HoldsPath"`
+	// test-only fault injection, see faults.Config
+	Faults *faults.Config `json:"Faults"`
+	// listen addresses for clients and DataNodes, portClient and portDataNode when empty
+	ClientPort   string `json:"ClientPort"`
+	DataNodePort string `json:"DataNodePort"`
+	// mutual TLS for every connection, plaintext when absent
+	TLS *tlsconfig.Config `json:"TLS"`
+	// secret DataNodes must present to join, empty accepts any DataNode
+	ClusterSecret string `json:"ClusterSecret"`
+	// largest gRPC message accepted, and the chunk size clients use unless
+	// they set their own; defaultMaxMessageBytes and defaultChunkBytes when 0
+	MaxMessageBytes int64 `json:"MaxMessageBytes"`
+	ChunkBytes      int   `json:"ChunkBytes"`
+	// largest file accepted, 0 means no limit
+	MaxFileBytes int64 `json:"MaxFileBytes"`
+	// how long deleted files stay restorable, 0 deletes them at once
+	TrashRetentionSeconds int64 `json:"TrashRetentionSeconds"`
+	// previous contents kept of every overwritten file, 0 keeps none
+	KeepVersions int `json:"KeepVersions"`
+	// DataNodes whose clocks diverge more are flagged, defaultMaxClockSkew when 0
+	MaxClockSkewMs int64 `json:"MaxClockSkewMs"`
+	// full access for clients, once set every client call needs it or a scoped token
+	AdminToken string `json:"AdminToken"`
+	// key signing scoped tokens, shared with the DataNodes; empty disables them
+	TokenSecret string `json:"TokenSecret"`
+	// size of the blocks of files stored in blocks, unless the upload picks
+	// one; defaultBlockBytes when 0
+	BlockBytes int64 `json:"BlockBytes"`
+	// file keeping the cluster ID, defaultClusterIDPath when empty
+	ClusterIDPath string `json:"ClusterIDPath"`
+	// longest a call to a DataNode or a client may run, and a replication the
+	// master orders; defaultRPCTimeout and defaultReplicateTimeout when 0, -1 disables
+	RPCTimeoutSeconds       int `json:"RPCTimeoutSeconds"`
+	ReplicateTimeoutSeconds int `json:"ReplicateTimeoutSeconds"`
+}
+
+type FileRecord struct {
+	FileName  string
+	FilePaths []string
+	DataNodes []int32
+	Size      int64
+	// hex SHA-256 of the content as reported by the first DataNode storing it
+	Checksum string
+	// "gzip" when the stored bytes are compressed, DataNodes decode them for
+	// readers that don't accept the encoding
+	ContentEncoding string
+	// generation stamp of the file's creation or last append, incremental
+	// backups copy the files stamped after their previous run
+	Generation int64
+	// labels a DataNode must carry to hold a replica of this file
+	Constraints map[string]string
+	// when set, replicas may only live on these DataNodes and the file is
+	// left alone by rebalancing
+	PinnedNodes []int32
+	// DataNode -> reason, replicas reported bad that must not be read or counted
+	CorruptReplicas map[int32]string
+	// searchable labels, see AddTags
+	Tags map[string]bool
+	// durability chosen at upload, see storageClasses
+	StorageClass string
+	// when the file is deleted, see expireFiles; zero keeps it
+	ExpiresAt time.Time
+	// for a file stored in blocks, its blocks in order, each recorded as a
+	// file of its own; such a file has no replicas itself
+	Blocks []fileBlock
+	// for a small file packed in a container, where it lies; such a file
+	// has no replicas itself either
+	Packed *packedRange
+}
+
+// pendingUpload is an upload intent accepted by PrepareUpload
+type pendingUpload struct {
+	FileName string
+	// declared size, 0 when unknown, and encoding
+	Size            int64
+	ContentEncoding string
+	Constraints     map[string]string
+	StorageClass    string
+	// DataNodes returned as targets, the replicas go to them at commit
+	Targets []int32
+	Expires time.Time
+	// how long the uploaded file lives, 0 forever
+	TTL time.Duration
+	// for a file stored in blocks, its blocks and those committed so far
+	Blocks    []fileBlock
+	Committed map[string]bool
+	// for a container, the small files packed in it
+	Packed []*pb.PackedFile
+}
+
+type MachineRecord struct {
+	// identity of the DataNode that registered, empty for one known by address
+	NodeUUID        string
+	IPAddress       string
+	MasterNodePort  int32
+	ClientNodePort  int32
+	DataNodePort    int32
+	Liveness        bool
+	Labels          map[string]string
+	UsedBytes       int64
+	ActiveTransfers int32
+	// free space left for DFS data after reserved space and caps, -1 when unlimited
+	AvailableBytes int64
+	// size of the node's volumes, -1 when unknown
+	CapacityBytes   int64
+	ActiveUploads   int32
+	ActiveDownloads int32
+	// load average per CPU and share of CPU time waiting on disk, -1 when unknown
+	CPULoad float64
+	IOLoad  float64
+	// time between the node's heartbeats, keepAliveTimeout allows a second when 0
+	HeartbeatInterval time.Duration
+	// the node refused a replica for lack of space, it gets no new data until then
+	FullUntil time.Time
+	// planned downtime, no new writes go to the node and its replicas still count
+	MaintenanceStart time.Time
+	MaintenanceEnd   time.Time
+	// message and chunk sizes the DataNode advertised when registering
+	MaxMessageBytes int64
+	ChunkBytes      int32
+	// DataNode clock minus master clock, flagged when beyond MaxClockSkewMs
+	ClockSkew   time.Duration
+	ClockSkewed bool
+	// the DataNode sent its inventory since the master started, see ReportFiles
+	Reported bool
+	// block name -> owner of a block on the DataNode, sent with the next heartbeat
+	BlockOwners map[string]*pb.BlockOwner
+	// downloads the DataNode served from its read cache and from disk
+	ReadCacheHits   int64
+	ReadCacheMisses int64
+	// the DataNode is being decommissioned: it gets no new data and its replicas don't count, see undrainedFiles
+	Draining bool
+}
+
+type server struct {
+	fileRecords      map[string]*FileRecord
+	machineRecords   []*MachineRecord
+	lastKeepAliveMap map[int]time.Time
+	// constraints declared with an upload intent, applied once the upload lands
+	pendingConstraints map[string]map[string]string
+	// tags of imported files, applied once their data is uploaded
+	pendingTags map[string][]string
+	// storage classes of HandleUploadFile intents and imported files
+	pendingStorageClasses map[string]string
+	// upload token -> intent accepted by PrepareUpload
+	pendingUploads map[string]*pendingUpload
+	// directory (path prefix) -> constraints inherited by files below it
+	placementRules map[string]map[string]string
+	// replicas being moved by the rebalancer, keyed by file name
+	pendingMoves map[string]replicaMove
+	// file name -> targets a DataNode is retrying to copy it to and since when, see noteReplicateResponse
+	retryingReplicas map[string]map[int32]time.Time
+	// old and new names of the files being renamed, see RenameFile
+	renaming map[string]bool
+	// name -> deleted file still restorable, see RestoreFile
+	trash map[string]*trashedFile
+	// upload IDs recorded lately, see NotifyUploaded
+	notifiedUploads notifiedUploads
+	// name -> earlier contents of the file, oldest first, see ListVersions
+	versions map[string][]*fileVersion
+	// block name -> name of the file stored in blocks it belongs to
+	blockFiles map[string]string
+	// owners DataNodes reported for blocks of files not recorded, see claimBlock
+	blockClaims map[blockClaim]map[string]*pb.BlockOwner
+	// container name -> names of the files packed in it
+	packFiles map[string]map[string]bool
+	// directory (path prefix) -> storage quota
+	quotas map[string]*Quota
+	// content checksum -> names of the files holding those bytes
+	checksumIndex map[string]map[string]bool
+	// file or directory prefix -> retention or legal hold
+	holds map[string]*Hold
+	// file name -> stages of its life, see GetFileTimeline
+	timelines map[string][]TimelineEvent
+	// names whose timeline ended, oldest first, see endTimeline
+	endedTimelines []string
+	// last generation stamp handed out, one per file created
+	generation int64
+	config     MasterConfig
+	rpcMetrics *rpcMetrics
+	// credentials for dialing DataNodes, TLS when the config enables it
+	dialCredentials credentials.TransportCredentials
+	// generated when the master first started, see loadClusterID
+	clusterID string
+	// closed by Stop, ending the background work
+	stopped chan struct{}
+	mutex   sync.Mutex
+	pb.UnimplementedFileServiceServer
+}
+
+func (s *server) PrintMachineRecords() {
+	fmt.Println("Machine Records:")
+	for i, record := range s.machineRecords {
+		AvailablePorts := []int32{record.MasterNodePort, record.ClientNodePort, record.DataNodePort}
+		fmt.Printf("Machine %d:\n  IP: %s\n  Alive: %t\n  Ports: %v\n", i, record.IPAddress, record.Liveness, AvailablePorts)
+	}
+}
+
+func (s *server) PrintFileRecords() {
+	fmt.Println("File Records:")
+	for filename, record := range s.fileRecords {
+		fmt.Printf("File: %s\n  Paths: %v\n  Nodes: %v\n", filename, record.FilePaths, record.DataNodes)
+	}
+}
+
+// satisfies reports whether the machine carries every label in constraints
+func (m *MachineRecord) satisfies(constraints map[string]string) bool {
+	for key, value := range constraints {
+		if m.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// hasRoomFor reports whether the node's last heartbeat left room for size bytes
+func (m *MachineRecord) hasRoomFor(size int64) bool {
+	if time.Now().Before(m.FullUntil) {
+		return false
+	}
+	// DataNodes admit even an upload of unknown size only with a byte to spare
+	return m.AvailableBytes < 0 || max(size, 1) <= m.AvailableBytes
+}
+
+// checkFileSize refuses a file of size bytes when it is over MaxFileBytes
+func (s *server) checkFileSize(size int64) error {
+	if s.config.MaxFileBytes > 0 && size > s.config.MaxFileBytes {
+		return status.Errorf(codes.ResourceExhausted, "a file of %d bytes is over the %d byte file size limit", size, s.config.MaxFileBytes)
+	}
+	return nil
+}
+
+// how long a DataNode that refused a replica for lack of space gets no new data
+const fullBackoff = 30 * time.Second
+
+/*
+markFull keeps new data off the DataNodes a replication of fileName found
+out of space, their heartbeats may not show it yet. Called with the mutex
+held
+*/
+func (s *server) markFull(fileName string, sourceID int32, full []int32) {
+	for _, id := range full {
+		if id < 0 || int(id) >= len(s.machineRecords) {
+			continue
+		}
+		s.machineRecords[id].FullUntil = time.Now().Add(fullBackoff)
+		s.recordEvent(fileName, stageReplicationFailed, id, fmt.Sprintf("DataNode %d out of space, from DataNode %d", id, sourceID))
+		log.Printf("DataNode %d out of space for %s, placing no new data on it for %v", id, fileName, fullBackoff)
+	}
+}
+
+/*
+noteReplicateResponse records the outcome of a replication of fileName from
+sourceID for each target: the full ones are left out of placement for a
+while, the failures go on the file's timeline and the targets the source
+retries are remembered, so repair doesn't send the file elsewhere meanwhile,
+for retryingReplicaTimeout at most. Must be called with the mutex held
+*/
+func (s *server) noteReplicateResponse(fileName string, sourceID int32, response *pb.ReplicateResponse) {
+	s.markFull(fileName, sourceID, response.Full)
+	for _, result := range response.Results {
+		if result.Success || slices.Contains(response.Full, result.Id) {
+			continue
+		}
+		detail := fmt.Sprintf("to %s from DataNode %d: %s", result.Address, sourceID, result.Error)
+		if result.Retrying {
+			detail += ", retrying"
+			if s.retryingReplicas[fileName] == nil {
+				s.retryingReplicas[fileName] = make(map[int32]time.Time)
+			}
+			if _, ok := s.retryingReplicas[fileName][result.Id]; !ok {
+				s.retryingReplicas[fileName][result.Id] = time.Now()
+			}
+		}
+		s.recordEvent(fileName, stageReplicationFailed, result.Id, detail)
+	}
+}
+
+// retryingReplicasOf counts the fresh targets a DataNode retries copying fileName to, must be called with the mutex held
+func (s *server) retryingReplicasOf(fileName string, now time.Time) int {
+	count := 0
+	for _, since := range s.retryingReplicas[fileName] {
+		if now.Sub(since) < retryingReplicaTimeout {
+			count++
+		}
+	}
+	return count
+}
+
+// retryDone forgets that a DataNode retries copying fileName to nodeID, must be called with the mutex held
+func (s *server) retryDone(fileName string, nodeID int32) {
+	delete(s.retryingReplicas[fileName], nodeID)
+	if len(s.retryingReplicas[fileName]) == 0 {
+		delete(s.retryingReplicas, fileName)
+	}
+}
+
+// masterAddr is the host:port the master dials the DataNode on, IPv6 hosts bracketed
+func (m *MachineRecord) masterAddr() string {
+	return net.JoinHostPort(m.IPAddress, strconv.Itoa(int(m.MasterNodePort)))
+}
+
+func (m *MachineRecord) inMaintenance(now time.Time) bool {
+	return !now.Before(m.MaintenanceStart) && now.Before(m.MaintenanceEnd)
+}
+
+func (f *FileRecord) isCorruptOn(nodeID int32) bool {
+	_, corrupt := f.CorruptReplicas[nodeID]
+	return corrupt
+}
+
+func (f *FileRecord) isStoredOn(nodeID int32) bool {
+	for _, node := range f.DataNodes {
+		if node == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// mayBeStoredOn reports whether a pinned file allows a replica on nodeID
+func (f *FileRecord) mayBeStoredOn(nodeID int32) bool {
+	if len(f.PinnedNodes) == 0 {
+		return true
+	}
+	for _, node := range f.PinnedNodes {
+		if node == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// wantedReplicas is the storage class's replica count, capped by the size of the pinned set
+func (f *FileRecord) wantedReplicas() int {
+	replicas := f.class().replicas
+	if len(f.PinnedNodes) > 0 && len(f.PinnedNodes) < replicas {
+		return len(f.PinnedNodes)
+	}
+	return replicas
+}
+
+/*
+Merges the constraints of every directory containing fileName, deeper
+directories overriding their parents, then the file's own constraints on top
+*/
+func (s *server) placementConstraintsFor(fileName string, fileConstraints map[string]string) map[string]string {
+	prefixes := make([]string, 0, len(s.placementRules))
+	for prefix := range s.placementRules {
+		if paths.Under(fileName, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) < len(prefixes[j]) })
+
+	constraints := make(map[string]string)
+	for _, prefix := range prefixes {
+		for key, value := range s.placementRules[prefix] {
+			constraints[key] = value
+		}
+	}
+	for key, value := range fileConstraints {
+		constraints[key] = value
+	}
+	return constraints
+}
+
+/*
+Walks the ring of DataNodes starting after sourceID and picks live machines
+that don't hold the file yet and satisfy its placement constraints and pins,
+until the file would reach its wanted number of replicas. The preferred
+machines, planned earlier, are tried before the ring
+*/
+func (s *server) selectReplicaTargets(record *FileRecord, sourceID int32, liveReplicas int, preferred ...int32) ([]string, []int32, []int32) {
+	var replicateIPs []string
+	var replicatePorts []int32
+	var replicateIds []int32
+
+	now := time.Now()
+	machineCount := int32(len(s.machineRecords))
+	candidates := make([]int32, 0, len(preferred)+int(machineCount))
+	for _, id := range preferred {
+		if id >= 0 && id < machineCount && id != sourceID {
+			candidates = append(candidates, id)
+		}
+	}
+	for i := int32(1); i < machineCount; i++ {
+		candidates = append(candidates, (sourceID+i)%machineCount)
+	}
+	for _, replicateId := range candidates {
+		if liveReplicas+len(replicateIds) >= record.wantedReplicas() {
+			break
+		}
+		machine := s.machineRecords[replicateId]
+		if !machine.Liveness {
+			log.Printf("machine %s not alive.", machine.IPAddress)
+			continue
+		}
+		if slices.Contains(replicateIds, replicateId) || machine.inMaintenance(now) || machine.Draining || record.isStoredOn(replicateId) || !record.mayBeStoredOn(replicateId) || !machine.satisfies(record.Constraints) || !machine.hasRoomFor(record.Size) {
+			continue
+		}
+		// From my machines take the IP, PORT, ID to send the file to
+		replicateIPs = append(replicateIPs, machine.IPAddress)
+		replicatePorts = append(replicatePorts, machine.DataNodePort)
+		replicateIds = append(replicateIds, replicateId)
+	}
+	return replicateIPs, replicatePorts, replicateIds
+}
+
+// eligibleUploadTargets lists live DataNodes outside maintenance satisfying constraints with room for size bytes
+func (s *server) eligibleUploadTargets(constraints map[string]string, size int64) ([]int32, error) {
+	var eligible []int32
+	var full int
+	now := time.Now()
+	for i, machine := range s.machineRecords {
+		if machine.Liveness && !machine.inMaintenance(now) && !machine.Draining && machine.satisfies(constraints) {
+			if !machine.hasRoomFor(size) {
+				full++
+				continue
+			}
+			eligible = append(eligible, int32(i))
+		}
+	}
+	// we can't accept upload requests right now since no datanodes online
+	if len(eligible) == 0 {
+		if full > 0 {
+			return nil, fmt.Errorf("no alive DataNode has room for %d bytes", size)
+		}
+		if len(constraints) > 0 {
+			return nil, fmt.Errorf("no alive DataNode satisfies placement constraints %v", constraints)
+		}
+		return nil, errors.New("no aliveMachines")
+	}
+	return eligible, nil
+}
+
+/*
+Rejects names that can't be stored safely: empty, absolute, or with empty,
+"." or ".." path components or control characters
+*/
+func validateFileName(fileName string) error {
+	if fileName == "" {
+		return status.Error(codes.InvalidArgument, "empty file name")
+	}
+	if strings.HasPrefix(fileName, "/") {
+		return status.Errorf(codes.InvalidArgument, "file name %q must be relative", fileName)
+	}
+	// DataNodes refuse them too, Windows ones would read them as separators
+	if strings.Contains(fileName, "\\") {
+		return status.Errorf(codes.InvalidArgument, "backslash in file name %q", fileName)
+	}
+	for _, component := range strings.Split(fileName, "/") {
+		if component == "" || component == "." || component == ".." {
+			return status.Errorf(codes.InvalidArgument, "invalid path component in %q", fileName)
+		}
+	}
+	for _, c := range fileName {
+		if c < 0x20 || c == 0x7f {
+			return status.Errorf(codes.InvalidArgument, "control character in file name %q", fileName)
+		}
+	}
+	if fileName+"/" == blockPrefix || isBlockName(fileName) {
+		return status.Errorf(codes.InvalidArgument, "%q is reserved for blocks", blockPrefix)
+	}
+	if fileName+"/" == packPrefix || isPackName(fileName) {
+		return status.Errorf(codes.InvalidArgument, "%q is reserved for containers of packed files", packPrefix)
+	}
+	return nil
+}
+
+func newUploadToken() string {
+	token := make([]byte, 16)
+	cryptorand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+/*
+Validates an upload, checks quotas and picks its DataNodes: the first target
+receives the data from the client, the following ones are where it will be
+replicated. The returned token ties the DataNode's NotifyUploaded back to
+this intent
+*/
+func (s *server) PrepareUpload(ctx context.Context, in *pb.PrepareUploadRequest) (*pb.PrepareUploadResponse, error) {
+	if len(in.Packed) > 0 {
+		return s.preparePack(ctx, in)
+	}
+	if err := validateFileName(in.FileName); err != nil {
+		return nil, err
+	}
+	if in.FileSize < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "negative file size %d", in.FileSize)
+	}
+	if in.TtlSeconds < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "negative TTL %d", in.TtlSeconds)
+	}
+	if in.BlockBytes < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "negative block size %d", in.BlockBytes)
+	}
+	if err := s.checkFileSize(in.FileSize); err != nil {
+		return nil, err
+	}
+	if in.ContentEncoding != "" && in.ContentEncoding != "gzip" {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported content encoding %q", in.ContentEncoding)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.renaming[in.FileName] {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is being renamed", in.FileName)
+	}
+	// overwriting a stored file is a modification holds forbid
+	if _, exists := s.fileRecords[in.FileName]; exists {
+		if err := s.checkHold(in.FileName); err != nil {
+			s.audit(ctx, "overwrite-denied", in.FileName, status.Convert(err).Message())
+			return nil, err
+		}
+	} else if err := s.checkPathConflict(in.FileName); err != nil {
+		return nil, err
+	}
+	if in.Append {
+		return s.prepareAppend(in)
+	}
+	constraints := s.placementConstraintsFor(in.FileName, in.Constraints)
+	class, err := checkStorageClass(in.StorageClass)
+	if err != nil {
+		return nil, err
+	}
+
+	warnings, err := s.checkQuota(in.FileName, in.FileSize)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range warnings {
+		log.Printf("WARNING upload of %s: %s", in.FileName, warning)
+	}
+	pending := &pendingUpload{
+		FileName:        in.FileName,
+		Size:            in.FileSize,
+		ContentEncoding: in.ContentEncoding,
+		Constraints:     constraints,
+		StorageClass:    class,
+		TTL:             time.Duration(in.TtlSeconds) * time.Second,
+	}
+	blockBytes := in.BlockBytes
+	if blockBytes == 0 && in.Blocks {
+		blockBytes = s.blockBytes()
+	}
+	// erasure coding works on blocks, a file no larger than one is a stripe of one
+	if storageClasses[class].erasure {
+		if blockBytes == 0 || in.FileSize <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "%s files are stored in blocks, set blocks or block_bytes and the file size", class)
+		}
+		return s.prepareBlocks(in, blockBytes, pending, warnings)
+	}
+	// a file no larger than a block is stored whole
+	if blockBytes > 0 && in.FileSize > blockBytes {
+		return s.prepareBlocks(in, blockBytes, pending, warnings)
+	}
+
+	candidates, err := s.eligibleUploadTargets(constraints, in.FileSize)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	primary := s.pickUploadTarget(candidates)
+	planned := &FileRecord{FileName: in.FileName, DataNodes: []int32{primary}, Size: in.FileSize, Constraints: constraints, StorageClass: class}
+	_, _, replicaIDs := s.selectReplicaTargets(planned, primary, 1)
+	pending.Targets = append([]int32{primary}, replicaIDs...)
+
+	token := s.addPendingUpload(pending)
+	s.recordEvent(in.FileName, stageUploadPrepared, primary, fmt.Sprintf("%d bytes, %s, replicas planned on %v", in.FileSize, class, replicaIDs))
+
+	response := &pb.PrepareUploadResponse{UploadToken: token, Warnings: warnings}
+	response.Targets = s.uploadTargets(pending.Targets)
+	return response, nil
+}
+
+/*
+addPendingUpload records an upload intent under a new token, dropping the
+expired ones with the blocks they committed, which no file will use. Must
+be called with the mutex held
+*/
+func (s *server) addPendingUpload(pending *pendingUpload) string {
+	now := time.Now()
+	for token, pending := range s.pendingUploads {
+		if now.After(pending.Expires) {
+			delete(s.pendingUploads, token)
+			s.dropBlocks(&FileRecord{Blocks: pending.Blocks})
+		}
+	}
+	token := newUploadToken()
+	pending.Expires = now.Add(uploadTokenTTL)
+	s.pendingUploads[token] = pending
+	return token
+}
+
+// uploadTargets returns where clients reach the given DataNodes
+func (s *server) uploadTargets(nodeIDs []int32) []*pb.UploadTarget {
+	targets := make([]*pb.UploadTarget, 0, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		machine := s.machineRecords[nodeID]
+		targets = append(targets, &pb.UploadTarget{
+			IpAddress:  machine.IPAddress,
+			PortNumber: machine.ClientNodePort,
+			DataNode:   nodeID,
+		})
+	}
+	return targets
+}
+
+/*
+Client Initialization intent to upload file
+*/
+func (s *server) HandleUploadFile(ctx context.Context, in *pb.HandleUploadFileRequest) (*pb.HandleUploadFileResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.renaming[in.Filename] {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is being renamed", in.Filename)
+	}
+	if _, exists := s.fileRecords[in.Filename]; exists {
+		if err := s.checkHold(in.Filename); err != nil {
+			s.audit(ctx, "overwrite-denied", in.Filename, status.Convert(err).Message())
+			return nil, err
+		}
+	} else if in.Filename != "" {
+		if err := s.checkPathConflict(in.Filename); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.checkFileSize(in.FileSize); err != nil {
+		return nil, err
+	}
+	constraints := s.placementConstraintsFor(in.Filename, in.Constraints)
+	class, err := checkStorageClass(in.StorageClass)
+	if err != nil {
+		return nil, err
+	}
+
+	warnings, err := s.checkQuota(in.Filename, in.FileSize)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range warnings {
+		log.Printf("WARNING upload of %s: %s", in.Filename, warning)
+	}
+
+	// the alive machines from the present DataNodes registered to our system
+	aliveMachines, err := s.eligibleUploadTargets(constraints, in.FileSize)
+	if err != nil {
+		return nil, err
+	}
+	if in.Filename != "" {
+		s.pendingConstraints[in.Filename] = constraints
+		s.pendingStorageClasses[in.Filename] = class
+	}
+
+	selectedID := s.pickUploadTarget(aliveMachines)
+	selectedMachine := s.machineRecords[selectedID]
+	if in.Filename != "" {
+		s.recordEvent(in.Filename, stageUploadPrepared, selectedID, fmt.Sprintf("%d bytes", in.FileSize))
+	}
+
+	selectedPort := selectedMachine.ClientNodePort
+	selectedIP := selectedMachine.IPAddress
+
+	response := &pb.HandleUploadFileResponse{
+		PortNumber: selectedPort,
+		IpAddress:  selectedIP,
+	}
+
+	return response, nil
+}
+
+/*
+Client Initialization intent to download file
+*/
+func (s *server) HandleDownloadFile(ctx context.Context, in *pb.HandleDownloadFileRequest) (*pb.HandleDownloadFileResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fileRecord, ok := s.fileRecords[in.FileName]
+	if !ok {
+		return nil, errors.New("No such filename exist")
+	}
+
+	var ipAddresses []string
+	var portNumbers []int32
+
+	for i, nodeID := range fileRecord.DataNodes {
+		if s.machineRecords[nodeID].Liveness && !fileRecord.isCorruptOn(nodeID) {
+			datanode := s.machineRecords[fileRecord.DataNodes[i]]
+			ipAddresses = append(ipAddresses, datanode.IPAddress)
+			portNumbers = append(portNumbers, datanode.ClientNodePort)
+		}
+	}
+
+	response := &pb.HandleDownloadFileResponse{
+		IpAddress:   ipAddresses,
+		PortNumbers: portNumbers,
+	}
+
+	return response, nil
+}
+
+// clientHost is the address of the caller, from the client-ip metadata or the connection
+func clientHost(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ips := md.Get("client-ip"); len(ips) > 0 && ips[0] != "" {
+			return ips[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+	}
+	return ""
+}
+
+/*
+sameHost reports whether two addresses name the same host, comparing IPs by
+value so "::ffff:10.0.0.5" (an IPv4 client on a dual-stack listener) matches
+"10.0.0.5" and the spellings of one IPv6 address match. Hostnames compare as
+written
+*/
+func sameHost(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return strings.EqualFold(a, b)
+	}
+	return ipA.Equal(ipB)
+}
+
+/*
+Lists every replica of a file best first: healthy (alive, not stale or corrupt)
+before unhealthy, then local to the caller, then least loaded, then freshest
+heartbeat. Unhealthy replicas are flagged so clients can skip them. A file
+stored in blocks is listed block by block, with the replicas of each, a
+packed file with the replicas of its container
+*/
+func (s *server) GetReadLocations(ctx context.Context, in *pb.GetReadLocationsRequest) (*pb.GetReadLocationsResponse, error) {
+	host := clientHost(ctx)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, ok := s.fileRecords[in.FileName]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "No such filename exist")
+	}
+	if len(record.Blocks) > 0 {
+		return &pb.GetReadLocationsResponse{Blocks: s.readBlocks(record, host)}, nil
+	}
+	if record.Packed != nil {
+		return &pb.GetReadLocationsResponse{Packed: s.readPacked(record, host)}, nil
+	}
+	return &pb.GetReadLocationsResponse{Replicas: s.replicaLocations(record, host)}, nil
+}
+
+// replicaLocations lists the replicas of record best first for a reader at host, must be called with the mutex held
+func (s *server) replicaLocations(record *FileRecord, host string) []*pb.ReplicaLocation {
+	now := time.Now()
+	replicas := make([]*pb.ReplicaLocation, 0, len(record.DataNodes))
+	for _, nodeID := range record.DataNodes {
+		machine := s.machineRecords[nodeID]
+		move, moving := s.pendingMoves[record.FileName]
+		replicas = append(replicas, &pb.ReplicaLocation{
+			IpAddress:  machine.IPAddress,
+			PortNumber: machine.ClientNodePort,
+			DataNode:   nodeID,
+			Alive:      machine.Liveness,
+			// the rebalancer is about to delete this copy
+			Stale:           moving && move.From == nodeID,
+			Corrupt:         record.isCorruptOn(nodeID),
+			Local:           host != "" && sameHost(machine.IPAddress, host),
+			ActiveTransfers: machine.ActiveTransfers,
+			HeartbeatAgeMs:  now.Sub(s.lastKeepAliveMap[int(nodeID)]).Milliseconds(),
+			DataNodePort:    machine.DataNodePort,
+		})
+	}
+
+	healthy := func(r *pb.ReplicaLocation) bool { return r.Alive && !r.Stale && !r.Corrupt }
+	sort.SliceStable(replicas, func(i, j int) bool {
+		a, b := replicas[i], replicas[j]
+		if healthy(a) != healthy(b) {
+			return healthy(a)
+		}
+		if a.Local != b.Local {
+			return a.Local
+		}
+		if a.ActiveTransfers != b.ActiveTransfers {
+			return a.ActiveTransfers < b.ActiveTransfers
+		}
+		return a.HeartbeatAgeMs < b.HeartbeatAgeMs
+	})
+	return replicas
+}
+
+/*
+Marks a replica as corrupt so reads avoid it and the replication scheduler
+stops counting it, which gets the file re-replicated from a healthy copy
+*/
+func (s *server) ReportBadReplica(ctx context.Context, in *pb.ReportBadReplicaRequest) (*pb.ReportBadReplicaResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, ok := s.fileRecords[in.FileName]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "No such filename exist")
+	}
+	if !record.isStoredOn(in.DataNode) {
+		return nil, status.Errorf(codes.NotFound, "DataNode %d holds no replica of %s", in.DataNode, in.FileName)
+	}
+	if record.CorruptReplicas == nil {
+		record.CorruptReplicas = make(map[int32]string)
+	}
+	record.CorruptReplicas[in.DataNode] = in.Reason
+	s.recordEvent(in.FileName, stageReplicaReportedBad, in.DataNode, in.Reason)
+	log.Printf("replica of %s on DataNode %d reported bad: %s", in.FileName, in.DataNode, in.Reason)
+	return &pb.ReportBadReplicaResponse{}, nil
+}
+
+/*
+dropCorruptReplicas has the corrupt replicas of record deleted once a
+healthy copy is live, and forgets them so repair may copy the file back to
+their nodes. Replicas on nodes that are down stay flagged until they return.
+Reports whether any was dropped. Must be called with the mutex held
+*/
+func (s *server) dropCorruptReplicas(record *FileRecord) bool {
+	healthy := slices.ContainsFunc(record.DataNodes, func(nodeID int32) bool {
+		return s.machineRecords[nodeID].Liveness && !record.isCorruptOn(nodeID)
+	})
+	if !healthy {
+		return false
+	}
+	dropped := false
+	for i := len(record.DataNodes) - 1; i >= 0; i-- {
+		nodeID := record.DataNodes[i]
+		if !record.isCorruptOn(nodeID) || !s.machineRecords[nodeID].Liveness {
+			continue
+		}
+		s.deleteReplica(nodeID, &pb.FileDeleteRequest{FileName: record.FileName})
+		s.dropReplica(record, i)
+		s.recordEvent(record.FileName, stageCorruptDeleted, nodeID, "a healthy copy is live")
+		dropped = true
+	}
+	return dropped
+}
+
+/*
+A DataNode reports a replica it gave up making after retrying it. The
+failure goes on the file's timeline; the repair pass still finds the file
+short of replicas and has it copied again, to whichever nodes are eligible
+*/
+func (s *server) ReportReplicationFailure(ctx context.Context, in *pb.ReportReplicationFailureRequest) (*pb.ReportReplicationFailureResponse, error) {
+	if !s.authorizedDataNode(ctx) {
+		return nil, status.Error(codes.PermissionDenied, "wrong cluster secret")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.fileRecords[in.FileName]; !ok {
+		return nil, status.Error(codes.NotFound, "No such filename exist")
+	}
+	s.retryDone(in.FileName, in.Target)
+	// a move to the target won't complete
+	if move, ok := s.pendingMoves[in.FileName]; ok && move.To == in.Target {
+		delete(s.pendingMoves, in.FileName)
+	}
+	s.recordEvent(in.FileName, stageReplicationFailed, in.Target,
+		fmt.Sprintf("given up by DataNode %d after %d attempts: %s", in.DataNode, in.Attempts, in.Error))
+	log.Printf("DataNode %d gave up replicating %s to DataNode %d after %d attempts: %s", in.DataNode, in.FileName, in.Target, in.Attempts, in.Error)
+	return &pb.ReportReplicationFailureResponse{}, nil
+}
+
+// nextGeneration stamps a namespace change, must be called with the mutex held
+func (s *server) nextGeneration() int64 {
+	s.generation++
+	return s.generation
+}
+
+func (s *server) indexChecksum(fileName, checksum string) {
+	if checksum == "" {
+		return
+	}
+	if s.checksumIndex[checksum] == nil {
+		s.checksumIndex[checksum] = make(map[string]bool)
+	}
+	s.checksumIndex[checksum][fileName] = true
+}
+
+/*
+Looks up files by content checksum, so a client can skip uploading bytes the
+cluster already holds and operators can trace where some content lives
+*/
+func (s *server) FindByChecksum(ctx context.Context, in *pb.FindByChecksumRequest) (*pb.FindByChecksumResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	response := &pb.FindByChecksumResponse{}
+	for fileName := range s.checksumIndex[strings.ToLower(in.Checksum)] {
+		record, ok := s.fileRecords[fileName]
+		if !ok || record.Checksum != strings.ToLower(in.Checksum) || isHiddenName(fileName) {
+			continue
+		}
+		response.Files = append(response.Files, &pb.NamespaceFile{
+			FileName:        fileName,
+			FileSize:        record.Size,
+			Constraints:     record.Constraints,
+			Checksum:        record.Checksum,
+			ContentEncoding: record.ContentEncoding,
+			StorageClass:    record.StorageClass,
+			ExpiresUnixMs:   record.expiresUnixMs(),
+		})
+	}
+	sort.Slice(response.Files, func(i, j int) bool { return response.Files[i].FileName < response.Files[j].FileName })
+	return response, nil
+}
+
+/*
+NotifyUploaded records an upload a DataNode stored. DataNodes retry the
+notification until the master acknowledges it, so it may arrive more than
+once: an upload ID already recorded gets the first answer again, and a
+DataNode already holding the file isn't added to it twice
+*/
+func (s *server) NotifyUploaded(ctx context.Context, in *pb.NotifyUploadedRequest) (*pb.NotifyUploadedResponse, error) {
+	if !s.authorizedDataNode(ctx) {
+		return nil, status.Error(codes.PermissionDenied, "wrong cluster secret")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if response, ok := s.notifiedUploads.get(in.UploadId); ok {
+		log.Printf("upload %s of %s on DataNode %d notified again, recorded already", in.UploadId, in.FileName, in.DataNode)
+		return response, nil
+	}
+	response, err := s.recordUpload(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	response.Acknowledged = true
+	s.notifiedUploads.add(in.UploadId, response, time.Now())
+	return response, nil
+}
+
+/*
+checkSize refuses an upload whose stored size isn't the declared one. A
+file the DataNode compressed on its own is smaller and an append declares
+only what it adds, their sizes aren't checked
+*/
+func (pending *pendingUpload) checkSize(in *pb.NotifyUploadedRequest) error {
+	if pending.Size > 0 && !in.Appended && in.ContentEncoding == pending.ContentEncoding && in.FileSize != pending.Size {
+		return status.Errorf(codes.InvalidArgument, "%s has %d bytes instead of the %d declared", in.FileName, in.FileSize, pending.Size)
+	}
+	return nil
+}
+
+/*
+refuseCommit turns down the upload of a NotifyUploaded with err: the upload
+intent is dropped and the DataNode has its copy deleted. A copy that
+overwrote a replica of the stored file no longer is one, repair replaces
+it. Must be called with the mutex held
+*/
+func (s *server) refuseCommit(in *pb.NotifyUploadedRequest, err error) error {
+	log.Printf("upload of %s on DataNode %d refused: %v", in.FileName, in.DataNode, err)
+	s.recordEvent(in.FileName, stageCommitRefused, in.DataNode, status.Convert(err).Message())
+	if pending, ok := s.pendingUploads[in.UploadToken]; ok && pending.FileName == in.FileName {
+		delete(s.pendingUploads, in.UploadToken)
+	}
+	if record, ok := s.fileRecords[in.FileName]; ok {
+		if i := slices.Index(record.DataNodes, in.DataNode); i >= 0 {
+			s.dropReplica(record, i)
+		}
+	}
+	s.deleteReplica(in.DataNode, &pb.FileDeleteRequest{FileName: in.FileName})
+	return err
+}
+
+// recordUpload adds the upload of a NotifyUploaded to the metadata, must be called with the mutex held
+func (s *server) recordUpload(ctx context.Context, in *pb.NotifyUploadedRequest) (*pb.NotifyUploadedResponse, error) {
+	rand.Seed(time.Now().UnixNano())
+
+	// blocks are committed as they arrive, their file with the last one
+	if pending, ok := s.pendingUploads[in.UploadToken]; ok && pending.Blocks != nil && !pending.Committed[in.FileName] {
+		return s.commitBlock(in, pending)
+	}
+	if record, ok := s.fileRecords[in.FileName]; ok && in.Appended {
+		s.refreshAppended(record, in)
+		return &pb.NotifyUploadedResponse{Generation: record.Generation, ExpiresUnixMs: record.expiresUnixMs()}, nil
+	}
+	if pending, ok := s.pendingUploads[in.UploadToken]; ok && pending.FileName == in.FileName {
+		if err := pending.checkSize(in); err != nil {
+			return nil, s.refuseCommit(in, err)
+		}
+	}
+	// the hard quota holds against the stored size, the declared one may be 0
+	if _, known := s.fileRecords[in.FileName]; (!known || s.isNewUpload(in)) && !isHiddenName(in.FileName) {
+		if _, err := s.checkQuota(in.FileName, in.FileSize); err != nil {
+			return nil, s.refuseCommit(in, err)
+		}
+	}
+	// an upload over a stored file replaces it rather than adding a replica
+	var replaced *FileRecord
+	if record, ok := s.fileRecords[in.FileName]; ok && s.isNewUpload(in) {
+		replaced = record
+		s.replaceFile(record)
+	}
+	if record, ok := s.fileRecords[in.FileName]; ok {
+		// told twice, by a retry or a file report, the replica is known already
+		if record.isStoredOn(in.DataNode) {
+			return &pb.NotifyUploadedResponse{Generation: record.Generation, ExpiresUnixMs: record.expiresUnixMs()}, nil
+		}
+		record.DataNodes = append(record.DataNodes, in.DataNode)
+		record.FilePaths = append(record.FilePaths, in.FilePath)
+		s.recordEvent(in.FileName, stageReplicaCompleted, in.DataNode, s.sinceRequested(in.FileName, in.DataNode))
+		s.retryDone(in.FileName, in.DataNode)
+		s.completeMove(record, in.DataNode)
+		// the DataNode keeps which file a block it holds belongs to
+		if owner := s.ownerOf(in.FileName); owner != nil {
+			s.pushBlockOwner(in.DataNode, owner)
+		}
+
+		s.PrintFileRecords()
+		return &pb.NotifyUploadedResponse{Generation: record.Generation, ExpiresUnixMs: record.expiresUnixMs()}, nil
+	}
+
+	constraints, ok := s.pendingConstraints[in.FileName]
+	class, classOK := s.pendingStorageClasses[in.FileName]
+	var expiresAt time.Time
+	var container *pendingUpload
+	var planned []int32
+	if pending, found := s.pendingUploads[in.UploadToken]; found && pending.FileName == in.FileName {
+		planned = pending.Targets
+		constraints, ok = pending.Constraints, true
+		class, classOK = pending.StorageClass, true
+		if pending.Packed != nil {
+			container = pending
+		} else if pending.TTL > 0 {
+			expiresAt = time.Now().Add(pending.TTL)
+		}
+		delete(s.pendingUploads, in.UploadToken)
+	}
+	if !classOK {
+		class = defaultStorageClass
+	}
+	delete(s.pendingStorageClasses, in.FileName)
+	if !ok {
+		constraints = s.placementConstraintsFor(in.FileName, nil)
+	}
+	delete(s.pendingConstraints, in.FileName)
+	tags := tagSet(s.pendingTags[in.FileName])
+	delete(s.pendingTags, in.FileName)
+
+	s.fileRecords[in.FileName] = &FileRecord{
+		FileName:        in.FileName,
+		FilePaths:       []string{in.FilePath},
+		DataNodes:       []int32{in.DataNode},
+		Size:            in.FileSize,
+		Checksum:        in.Checksum,
+		Constraints:     constraints,
+		ContentEncoding: in.ContentEncoding,
+		Generation:      s.nextGeneration(),
+		Tags:            tags,
+		StorageClass:    class,
+		ExpiresAt:       expiresAt,
+	}
+	s.indexChecksum(in.FileName, in.Checksum)
+	s.recordEvent(in.FileName, stageCommitted, in.DataNode, fmt.Sprintf("%d bytes, %s", in.FileSize, s.sinceRequested(in.FileName, in.DataNode)))
+
+	// soft quota warnings are delivered along with the upload notification
+	notification := "File Upload Finish"
+	warnings, _ := s.checkQuota(in.FileName, in.FileSize)
+	for _, warning := range warnings {
+		log.Printf("WARNING %s stored: %s", in.FileName, warning)
+		notification += " (warning: " + warning + ")"
+	}
+
+	// Get client metadata
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		log.Println("No metadata found in the context")
+	}
+	clientIP := md.Get("client-ip")
+	clientPort := md.Get("client-port")
+
+	fmt.Printf("Client IP: %s | Port: %s\n", clientIP, clientPort)
+
+	// Notify client asynchronously
+	go func() {
+		clientAddr := net.JoinHostPort(clientIP[0], clientPort[0])
+		conn, err := grpc.Dial(clientAddr, grpc.WithInsecure())
+		if err != nil {
+			log.Printf("Dial client fail %v", err)
+			return
+		}
+		defer conn.Close()
+
+		client := pb.NewFileServiceClient(conn)
+
+		ctx, cancel := withDeadline(context.Background(), s.callTimeout("SendNotification"))
+		defer cancel()
+		useless, err := client.SendNotification(ctx, &pb.SendNotificationRequest{
+			Message: notification,
+		})
+		if err != nil {
+			log.Printf("SendNotification to client fail %v", err)
+		}
+		fmt.Printf(useless.String())
+	}()
+
+	// Trigger replication
+	holders := append(s.startReplication(s.fileRecords[in.FileName], in.FilePath, in.DataNode, planned...), in.DataNode)
+	if replaced != nil {
+		s.retireReplaced(*replaced, holders)
+		s.releaseStorage(replaced)
+	}
+	if container != nil {
+		s.commitPacked(s.fileRecords[in.FileName], container)
+	}
+	s.PrintFileRecords()
+	return &pb.NotifyUploadedResponse{Generation: s.fileRecords[in.FileName].Generation, ExpiresUnixMs: s.fileRecords[in.FileName].expiresUnixMs()}, nil
+}
+
+/*
+startReplication has sourceID copy record's file, stored at filePath, to the
+DataNodes it still needs and returns them, the planned ones first when they
+still qualify. Must be called with the mutex held
+*/
+func (s *server) startReplication(record *FileRecord, filePath string, sourceID int32, planned ...int32) []int32 {
+	replicateIPs, replicatePorts, replicateIds := s.selectReplicaTargets(record, sourceID, 1, planned...)
+	replicateRequest := &pb.ReplicateRequest{
+		FileName:    record.FileName,
+		FilePath:    filePath,
+		IpAddresses: replicateIPs,
+		PortNumbers: replicatePorts,
+		Ids:         replicateIds,
+		ClusterId:   s.clusterID,
+	}
+	for _, id := range replicateIds {
+		s.recordEvent(record.FileName, stageReplicationRequested, id, fmt.Sprintf("from DataNode %d", sourceID))
+	}
+
+	if s.machineRecords[sourceID].Liveness {
+		go func() {
+			clientAddress := s.machineRecords[sourceID].masterAddr()
+			conn, err := s.dialDataNode(clientAddress)
+			if err != nil {
+				log.Printf("Dial source data node fail %v", err)
+				return
+			}
+			defer conn.Close()
+
+			sourceClient := pb.NewFileServiceClient(conn)
+
+			response, err := sourceClient.Replicate(context.Background(), replicateRequest)
+			if err != nil {
+				log.Printf("Replicate fail on source Datanode machine %v", err)
+				s.lockAndRecordEvent(replicateRequest.FileName, stageReplicationFailed, sourceID, err.Error())
+				return
+			}
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			s.noteReplicateResponse(record.FileName, sourceID, response)
+			// again on other nodes, the full ones are left out now
+			if len(response.Full) > 0 && s.fileRecords[record.FileName] == record {
+				s.startReplication(record, filePath, sourceID)
+			}
+		}()
+	}
+	return replicateIds
+}
+
+/*
+A DataNode asks before deleting a file on a client's request, or once it
+expired. Unless a hold forbids it the file leaves the namespace and the
+other replicas are deleted too, the asking DataNode removes its own copy
+once this returns
+*/
+func (s *server) NotifyDeleted(ctx context.Context, in *pb.NotifyDeletedRequest) (*pb.NotifyDeletedResponse, error) {
+	if !s.authorizedDataNode(ctx) {
+		return nil, status.Error(codes.PermissionDenied, "wrong cluster secret")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.renaming[in.FileName] {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is being renamed", in.FileName)
+	}
+	if err := s.checkHold(in.FileName); err != nil {
+		s.audit(ctx, "delete-denied", in.FileName, status.Convert(err).Message())
+		return nil, err
+	}
+	record, ok := s.fileRecords[in.FileName]
+	if !ok {
+		// nothing recorded, e.g. a copy the master never heard of
+		return &pb.NotifyDeletedResponse{}, nil
+	}
+	// blocks and containers go with their files
+	if isHiddenName(in.FileName) && !in.Expired {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is stored for other files, delete those", in.FileName)
+	}
+	// the DataNode's copy may predate an upload without a TTL
+	if in.Expired && (record.ExpiresAt.IsZero() || time.Now().Before(record.ExpiresAt)) {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s hasn't expired", in.FileName)
+	}
+	s.forgetFile(record)
+	response := &pb.NotifyDeletedResponse{}
+	detail := fmt.Sprintf("%d bytes", record.Size)
+	generation := s.nextGeneration()
+	// an expired file is meant to go, it skips the trash
+	if in.Expired {
+		s.recordEvent(in.FileName, stageExpired, in.DataNode, detail)
+		log.Printf("%s expired on DataNode %d", in.FileName, in.DataNode)
+	} else {
+		if trashed := s.trashFile(record, generation); trashed != nil {
+			response.TrashId, response.PurgeUnixMs = trashed.ID, trashed.Purge.UnixMilli()
+			detail += ", restorable until " + trashed.Purge.Format(time.RFC3339)
+		}
+		s.recordEvent(in.FileName, stageDeleted, in.DataNode, detail)
+		log.Printf("%s deleted through DataNode %d", in.FileName, in.DataNode)
+	}
+
+	for _, node := range record.DataNodes {
+		if node != in.DataNode {
+			s.deleteReplica(node, &pb.FileDeleteRequest{FileName: in.FileName, TrashId: response.TrashId, PurgeUnixMs: response.PurgeUnixMs, DropVersions: true})
+		}
+	}
+	s.PrintFileRecords()
+	return response, nil
+}
+
+// forgetFile drops a deleted file from the namespace, must be called with the mutex held
+func (s *server) forgetFile(record *FileRecord) {
+	delete(s.fileRecords, record.FileName)
+	delete(s.pendingMoves, record.FileName)
+	delete(s.retryingReplicas, record.FileName)
+	delete(s.checksumIndex[record.Checksum], record.FileName)
+	delete(s.versions, record.FileName)
+	s.endTimeline(record.FileName)
+}
+
+// deleteReplica has nodeID drop its copy of a file in the background, must be called with the mutex held
+func (s *server) deleteReplica(nodeID int32, request *pb.FileDeleteRequest) {
+	if int(nodeID) >= len(s.machineRecords) {
+		return
+	}
+	addr := s.machineRecords[nodeID].masterAddr()
+	go func() {
+		conn, err := s.dialDataNode(addr)
+		if err != nil {
+			log.Printf("Dial data node %d fail %v", nodeID, err)
+			return
+		}
+		defer conn.Close()
+
+		_, err = pb.NewFileServiceClient(conn).DeleteFile(context.Background(), request)
+		if err != nil {
+			log.Printf("DeleteFile of %s on DataNode %d fail %v", request.FileName, nodeID, err)
+		}
+	}()
+}
+
+// =======================
+// Background Processes
+// =======================
+
+// sleep waits for d, false when the master stops meanwhile
+func (s *server) sleep(d time.Duration) bool {
+	select {
+	case <-s.stopped:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (s *server) replicationScheduler() {
+	for {
+
+		if !s.sleep(10 * time.Second) {
+			return
+		}
+		s.mutex.Lock()
+
+		now := time.Now()
+		for _, fileRecord := range s.fileRecords {
+			// scratch files keep the copies they got at upload
+			if fileRecord.class().scratch {
+				continue
+			}
+			// blocks and containers are repaired as files of their own
+			if !fileRecord.hasOwnReplicas() {
+				continue
+			}
+			// repaired on the next pass, once the deletes are done
+			if s.dropCorruptReplicas(fileRecord) {
+				continue
+			}
+			var liveNodeIndexes []int
+			// replicas outside a pinned set can serve as sources but don't count,
+			// replicas on nodes down for planned maintenance count but can't serve,
+			// replicas on draining nodes don't count and are the first sources
+			liveReplicas := 0
+			draining := -1
+			for i, datanode := range fileRecord.DataNodes {
+				machine := s.machineRecords[datanode]
+				if fileRecord.isCorruptOn(datanode) {
+					continue
+				}
+				if machine.Liveness {
+					liveNodeIndexes = append(liveNodeIndexes, i)
+					if machine.Draining {
+						draining = i
+						continue
+					}
+				}
+				if (machine.Liveness || machine.inMaintenance(now)) && fileRecord.mayBeStoredOn(datanode) {
+					liveReplicas++
+				}
+			}
+			// replicas a DataNode is retrying to make are on their way
+			retrying := s.retryingReplicasOf(fileRecord.FileName, now)
+			// a block of an erasure-6-3 file has a single copy, a lost one is rebuilt from its stripe
+			if fileRecord.class().erasure && liveReplicas+retrying == 0 && len(liveNodeIndexes) == 0 {
+				s.rebuildBlock(fileRecord, now)
+				continue
+			}
+			if liveReplicas+retrying < fileRecord.wantedReplicas() && len(liveNodeIndexes) > 0 {
+
+				randomIndex := rand.Intn(len(liveNodeIndexes))
+				chosenNodeIndex := liveNodeIndexes[randomIndex]
+				if draining >= 0 {
+					chosenNodeIndex = draining
+				}
+				sourceID := fileRecord.DataNodes[chosenNodeIndex]
+
+				replicateIPs, replicatePorts, replicateIds := s.selectReplicaTargets(fileRecord, sourceID, liveReplicas+retrying)
+				if len(replicateIds) == 0 {
+					continue
+				}
+				replicateRequest := &pb.ReplicateRequest{
+					FileName:    fileRecord.FileName,
+					FilePath:    fileRecord.FilePaths[chosenNodeIndex],
+					IpAddresses: replicateIPs,
+					PortNumbers: replicatePorts,
+					Ids:         replicateIds,
+					ClusterId:   s.clusterID,
+				}
+				for _, id := range replicateIds {
+					s.recordEvent(fileRecord.FileName, stageRepairRequested, id,
+						fmt.Sprintf("from DataNode %d, %d of %d replicas live", sourceID, liveReplicas, fileRecord.wantedReplicas()))
+				}
+				if s.machineRecords[sourceID].Liveness {
+
+					addr := s.machineRecords[sourceID].masterAddr()
+
+					conn, err := s.dialDataNode(addr)
+					if err != nil {
+						log.Printf("Dial source data node fail %v", err)
+						continue
+					}
+					defer conn.Close()
+
+					sourceClient := pb.NewFileServiceClient(conn)
+
+					response, err := sourceClient.Replicate(context.Background(), replicateRequest)
+					if err != nil {
+						log.Printf("Replicate fail on source Datanode machine %v", err)
+						s.recordEvent(fileRecord.FileName, stageReplicationFailed, sourceID, err.Error())
+						continue
+					}
+					// the next pass picks other nodes
+					s.noteReplicateResponse(fileRecord.FileName, sourceID, response)
+				}
+			}
+		}
+
+		s.mutex.Unlock()
+	}
+}
+
+// keepAliveTimeout is how long the node may go without a heartbeat before it is taken for dead, two of its intervals
+func (m *MachineRecord) keepAliveTimeout() time.Duration {
+	return max(keepAliveTimeout, 2*m.HeartbeatInterval)
+}
+
+func (s *server) monitorKeepAlive() {
+	ticker := time.NewTicker(keepAliveTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopped:
+			return
+		case <-ticker.C:
+			s.mutex.Lock()
+			for nodeID, lastTime := range s.lastKeepAliveMap {
+
+				machine := s.machineRecords[nodeID]
+				active := time.Since(lastTime) < machine.keepAliveTimeout()
+				if machine.Liveness && !active {
+					if machine.inMaintenance(time.Now()) {
+						log.Printf("DataNode #%d went offline during its maintenance window", nodeID)
+					} else {
+						log.Printf("DataNode #%d is dead, no heartbeat for %v", nodeID, time.Since(lastTime))
+					}
+				}
+				machine.Liveness = active
+
+				// log.Printf("DataNode #%d Active: %t", nodeID, active)
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
+func (s *server) AddDataNodeMachine(DataNode_IP string, PortNumbers []string) {
+	// Order of ports : []string{d.PortForMaster, d.PortForClient, d.PortForDN},
+	var DataNodePorts []int32
+	for _, port := range PortNumbers {
+		nodePortNum, err := portNumber(port)
+		DataNodePorts = append(DataNodePorts, nodePortNum)
+		if err != nil {
+			log.Fatalf("couldn't extract port number exiting %s", port)
+		}
+	}
+
+	s.machineRecords = append(s.machineRecords, &MachineRecord{
+		IPAddress:      DataNode_IP,
+		MasterNodePort: DataNodePorts[0],
+		ClientNodePort: DataNodePorts[1],
+		DataNodePort:   DataNodePorts[2],
+		Liveness:       true,
+	})
+}
+func (s *server) KeepAlive(ctx context.Context, in *pb.KeepAliveRequest) (*pb.KeepAliveResponse, error) {
+	if !s.authorizedDataNode(ctx) {
+		log.Printf("rejected heartbeat from %s: wrong cluster secret", clientHost(ctx))
+		return nil, status.Error(codes.PermissionDenied, "wrong cluster secret")
+	}
+	if in.ClusterId != "" && in.ClusterId != s.clusterID {
+		log.Printf("rejected heartbeat from %s: DataNode of cluster %s", clientHost(ctx), in.ClusterId)
+		return nil, status.Errorf(codes.FailedPrecondition, "the DataNode belongs to cluster %s, this master runs cluster %s", in.ClusterId, s.clusterID)
+	}
+	var nodeID int
+	nodeIP := in.DataNode_IP
+	s.mutex.Lock()
+	isExist := false
+
+	// a registered DataNode sends its ID, the master may have restarted since
+	if in.DataNode != nil {
+		nodeID = int(*in.DataNode)
+		if nodeID < 0 || nodeID >= len(s.machineRecords) || s.machineRecords[nodeID].NodeUUID != in.NodeUuid {
+			s.mutex.Unlock()
+			return &pb.KeepAliveResponse{MasterUnixMs: time.Now().UnixMilli(), Register: true}, nil
+		}
+		isExist = true
+	} else {
+		masterPort, _ := portNumber(in.PortNumber[0])
+		for i, machinerecord := range s.machineRecords {
+			if sameHost(machinerecord.IPAddress, in.DataNode_IP) &&
+				machinerecord.MasterNodePort == masterPort {
+				// we found the datanode that sent the heartbeat
+				// && seems like it went off then on
+				isExist = true
+				nodeID = i
+				break
+			}
+		}
+	}
+	// a DataNode shutting down says so with its last heartbeat, it's offline at once
+	if !in.IsAlive {
+		if isExist {
+			log.Printf("DataNode #%d is going offline", nodeID)
+			s.machineRecords[nodeID].Liveness = false
+			delete(s.lastKeepAliveMap, nodeID)
+		}
+		s.mutex.Unlock()
+		return &pb.KeepAliveResponse{MasterUnixMs: time.Now().UnixMilli()}, nil
+	}
+	if !isExist {
+		nodeID = len(s.machineRecords)
+		s.AddDataNodeMachine(nodeIP, in.PortNumber)
+	}
+	// log.Printf("Data node with ID %d KeepAlive sent", nodeID)
+
+	s.lastKeepAliveMap[nodeID] = time.Now()
+	// a registered DataNode is live from its first heartbeat, not the next liveness check
+	s.machineRecords[nodeID].Liveness = true
+	s.machineRecords[nodeID].Labels = in.Labels
+	s.machineRecords[nodeID].UsedBytes = in.UsedBytes
+	s.machineRecords[nodeID].ActiveTransfers = in.ActiveTransfers
+	s.machineRecords[nodeID].AvailableBytes = in.AvailableBytes
+	s.machineRecords[nodeID].CapacityBytes = in.CapacityBytes
+	s.machineRecords[nodeID].ActiveUploads = in.ActiveUploads
+	s.machineRecords[nodeID].ActiveDownloads = in.ActiveDownloads
+	s.machineRecords[nodeID].CPULoad = in.CpuLoad
+	s.machineRecords[nodeID].IOLoad = in.IoLoad
+	s.machineRecords[nodeID].HeartbeatInterval = time.Duration(in.HeartbeatIntervalMs) * time.Millisecond
+	s.machineRecords[nodeID].ReadCacheHits = in.ReadCacheHits
+	s.machineRecords[nodeID].ReadCacheMisses = in.ReadCacheMisses
+	if record := s.machineRecords[nodeID]; record.Draining != in.Draining {
+		if in.Draining {
+			log.Printf("DataNode %d is draining, its files are copied to other nodes", nodeID)
+		} else {
+			log.Printf("DataNode %d left drain mode", nodeID)
+		}
+		record.Draining = in.Draining
+	}
+	if record := s.machineRecords[nodeID]; record.MaxMessageBytes != in.MaxMessageBytes || record.ChunkBytes != in.ChunkBytes {
+		log.Printf("DataNode %d takes messages up to %d bytes and %d byte chunks", nodeID, in.MaxMessageBytes, in.ChunkBytes)
+		record.MaxMessageBytes, record.ChunkBytes = in.MaxMessageBytes, in.ChunkBytes
+	}
+	skewed := s.checkClockSkew(nodeID, in)
+	var peers []string
+	for i, machine := range s.machineRecords {
+		if i != nodeID && machine.Liveness {
+			peers = append(peers, net.JoinHostPort(machine.IPAddress, strconv.Itoa(int(machine.DataNodePort))))
+		}
+	}
+
+	defer s.mutex.Unlock()
+	response := &pb.KeepAliveResponse{
+		MasterUnixMs: time.Now().UnixMilli(),
+		ClockSkewed:  skewed,
+		Peers:        peers,
+		KeepVersions: int32(s.config.KeepVersions),
+		ReportFiles:  !s.machineRecords[nodeID].Reported,
+		BlockOwners:  s.takeBlockOwners(nodeID),
+	}
+	if in.Draining {
+		response.UndrainedFiles = int32(s.undrainedFiles(int32(nodeID)))
+		response.Drained = response.UndrainedFiles == 0 && s.machineRecords[nodeID].Reported
+	}
+	return response, nil
+}
+
+/*
+Declares the labels DataNodes must carry to store a file or, when the path
+isn't a known file, every file under that directory prefix
+*/
+func (s *server) SetPlacementConstraints(ctx context.Context, in *pb.SetPlacementConstraintsRequest) (*pb.SetPlacementConstraintsResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if record, ok := s.fileRecords[in.Path]; ok {
+		record.Constraints = in.Constraints
+		log.Printf("placement constraints of %s set to %v", in.Path, in.Constraints)
+		return &pb.SetPlacementConstraintsResponse{}, nil
+	}
+
+	if len(in.Constraints) == 0 {
+		delete(s.placementRules, in.Path)
+	} else {
+		s.placementRules[in.Path] = in.Constraints
+	}
+	// existing files under the directory follow the new rule on their next repair
+	for fileName, record := range s.fileRecords {
+		if strings.HasPrefix(fileName, in.Path) {
+			record.Constraints = s.placementConstraintsFor(fileName, nil)
+		}
+	}
+	log.Printf("placement constraints of directory %s set to %v", in.Path, in.Constraints)
+	return &pb.SetPlacementConstraintsResponse{}, nil
+}
+
+/*
+Pins a file's replicas to the given DataNodes, an empty list removes the pin.
+The replication scheduler then only repairs the file onto pinned nodes
+*/
+func (s *server) PinFile(ctx context.Context, in *pb.PinFileRequest) (*pb.PinFileResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, ok := s.fileRecords[in.FileName]
+	if !ok {
+		return nil, errors.New("No such filename exist")
+	}
+	for _, nodeID := range in.DataNodes {
+		if nodeID < 0 || int(nodeID) >= len(s.machineRecords) {
+			return nil, fmt.Errorf("unknown DataNode %d", nodeID)
+		}
+	}
+
+	record.PinnedNodes = in.DataNodes
+	log.Printf("file %s pinned to DataNodes %v", in.FileName, in.DataNodes)
+	return &pb.PinFileResponse{}, nil
+}
+
+/*
+Schedules a maintenance window for a DataNode, an end time not after the start
+cancels any scheduled window
+*/
+func (s *server) ScheduleMaintenance(ctx context.Context, in *pb.ScheduleMaintenanceRequest) (*pb.ScheduleMaintenanceResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if in.DataNode < 0 || int(in.DataNode) >= len(s.machineRecords) {
+		return nil, fmt.Errorf("unknown DataNode %d", in.DataNode)
+	}
+	machine := s.machineRecords[in.DataNode]
+	if in.EndTime <= in.StartTime {
+		machine.MaintenanceStart = time.Time{}
+		machine.MaintenanceEnd = time.Time{}
+		log.Printf("maintenance window of DataNode #%d cancelled", in.DataNode)
+		return &pb.ScheduleMaintenanceResponse{}, nil
+	}
+
+	machine.MaintenanceStart = time.Unix(in.StartTime, 0)
+	machine.MaintenanceEnd = time.Unix(in.EndTime, 0)
+	log.Printf("DataNode #%d in maintenance from %v to %v", in.DataNode, machine.MaintenanceStart, machine.MaintenanceEnd)
+	return &pb.ScheduleMaintenanceResponse{}, nil
+}
+
+/*
+Dumps the namespace metadata (files, sizes, placement constraints and
+directory rules) without replica locations, which mean nothing to another cluster
+*/
+func (s *server) ExportNamespace(ctx context.Context, in *pb.ExportNamespaceRequest) (*pb.NamespaceDump, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	dump := &pb.NamespaceDump{Generation: s.generation}
+	for fileName, record := range s.fileRecords {
+		// blocks and containers are stored anew with their files
+		if isHiddenName(fileName) {
+			continue
+		}
+		dump.Files = append(dump.Files, &pb.NamespaceFile{
+			FileName:        fileName,
+			FileSize:        record.Size,
+			Constraints:     record.Constraints,
+			Checksum:        record.Checksum,
+			ContentEncoding: record.ContentEncoding,
+			Generation:      record.Generation,
+			Tags:            sortedTags(record.Tags),
+			StorageClass:    record.StorageClass,
+			ExpiresUnixMs:   record.expiresUnixMs(),
+		})
+	}
+	directories := make(map[string]*pb.NamespaceDirectory)
+	for path, constraints := range s.placementRules {
+		directories[path] = &pb.NamespaceDirectory{Path: path, Constraints: constraints}
+	}
+	for path, quota := range s.quotas {
+		if _, ok := directories[path]; !ok {
+			directories[path] = &pb.NamespaceDirectory{Path: path}
+		}
+		directories[path].SoftQuotaBytes = quota.SoftBytes
+		directories[path].HardQuotaBytes = quota.HardBytes
+	}
+	for _, directory := range directories {
+		dump.Directories = append(dump.Directories, directory)
+	}
+	sort.Slice(dump.Files, func(i, j int) bool { return dump.Files[i].FileName < dump.Files[j].FileName })
+	sort.Slice(dump.Directories, func(i, j int) bool { return dump.Directories[i].Path < dump.Directories[j].Path })
+	return dump, nil
+}
+
+/*
+Loads a namespace dump. Directory rules are installed as is, file metadata is
+applied to files already stored here and kept pending for the others until
+their data is uploaded
+*/
+func (s *server) ImportNamespace(ctx context.Context, in *pb.NamespaceDump) (*pb.ImportNamespaceResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, directory := range in.Directories {
+		if len(directory.Constraints) > 0 {
+			s.placementRules[directory.Path] = directory.Constraints
+		}
+		if directory.SoftQuotaBytes > 0 || directory.HardQuotaBytes > 0 {
+			s.quotas[directory.Path] = &Quota{SoftBytes: directory.SoftQuotaBytes, HardBytes: directory.HardQuotaBytes}
+		}
+	}
+
+	response := &pb.ImportNamespaceResponse{}
+	for _, file := range in.Files {
+		// dumps taken before storage classes have none, their files get the default
+		class, err := checkStorageClass(file.StorageClass)
+		if err != nil {
+			log.Printf("import of %s: %v, using %s", file.FileName, err, defaultStorageClass)
+			class = defaultStorageClass
+		}
+		if record, ok := s.fileRecords[file.FileName]; ok {
+			record.Constraints = file.Constraints
+			record.Tags = tagSet(file.Tags)
+			record.StorageClass = class
+			if file.ExpiresUnixMs > 0 {
+				record.ExpiresAt = time.UnixMilli(file.ExpiresUnixMs)
+			}
+			response.FilesApplied++
+			continue
+		}
+		s.pendingConstraints[file.FileName] = file.Constraints
+		s.pendingStorageClasses[file.FileName] = class
+		if len(file.Tags) > 0 {
+			s.pendingTags[file.FileName] = file.Tags
+		}
+		response.FilesPending++
+	}
+	log.Printf("namespace imported: %d directories, %d files applied, %d pending upload",
+		len(in.Directories), response.FilesApplied, response.FilesPending)
+	return response, nil
+}
+
+/*
+Main runs a master with the config file named on the command line, if any,
+until the process is killed
+*/
+func Main() {
+	var config MasterConfig
+	configDir := ""
+	// the config file is optional, defaults leave rebalancing disabled
+	if len(os.Args) > 1 {
+		content, err := os.ReadFile(os.Args[1])
+		if err != nil {
+			log.Fatalf("couldn't read the file specified")
+		}
+		if err := json.Unmarshal(content, &config); err != nil {
+			log.Fatalf("couldn't parse config file")
+		}
+		configDir = filepath.Dir(os.Args[1])
+	}
+	config.setDefaultPorts()
+
+	lisC, err := net.Listen("tcp", config.ClientPort)
+	if err != nil {
+		log.Fatalf("tcp listen fail: %v", err)
+	}
+	// clients and DataNodes may share one port
+	lisD := lisC
+	if config.DataNodePort != config.ClientPort {
+		if lisD, err = net.Listen("tcp", config.DataNodePort); err != nil {
+			log.Fatalf("tcp listen fail: %v", err)
+		}
+	}
+	if _, err := Start(config, configDir, lisC, lisD); err != nil {
+		log.Fatal(err)
+	}
+
+	// Wait for both servers to be running
+	select {} // This will keep the main goroutine alive, allowing the servers to keep running
+
+}
+
+// setDefaultPorts fills in the ports the config leaves empty
+func (config *MasterConfig) setDefaultPorts() {
+	if config.ClientPort == "" {
+		config.ClientPort = portClient
+	}
+	if config.DataNodePort == "" {
+		config.DataNodePort = portDataNode
+	}
+}
+
+// Master is a master started by Start
+type Master struct {
+	server     *server
+	grpcServer *grpc.Server
+}
+
+/*
+Start starts a master with config, serving clients on clientListener and
+DataNodes on dataNodeListener, which may be the same listener, until Stop.
+Relative paths of the config's TLS files are resolved against configDir
+*/
+func Start(config MasterConfig, configDir string, clientListener, dataNodeListener net.Listener) (*Master, error) {
+	config.setDefaultPorts()
+	if err := config.checkLimits(); err != nil {
+		return nil, fmt.Errorf("couldn't parse config file: %v", err)
+	}
+	if err := config.checkSecrets(); err != nil {
+		return nil, fmt.Errorf("couldn't parse config file: %v", err)
+	}
+	if config.TLS != nil && configDir != "" {
+		config.TLS.ResolvePaths(configDir)
+	}
+	serverCredentials, dialCredentials, err := tlsconfig.Credentials(config.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't set up TLS: %v", err)
+	}
+	clusterID, err := loadClusterID(config.ClusterIDPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load the cluster ID: %v", err)
+	}
+	log.Printf("cluster %s", clusterID)
+	holds, err := loadHolds(config.holdsPath())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load the holds: %v", err)
+	}
+	server := &server{
+		fileRecords:           make(map[string]*FileRecord),
+		machineRecords:        []*MachineRecord{},
+		lastKeepAliveMap:      make(map[int]time.Time),
+		pendingConstraints:    make(map[string]map[string]string),
+		pendingTags:           make(map[string][]string),
+		pendingStorageClasses: make(map[string]string),
+		pendingUploads:        make(map[string]*pendingUpload),
+		placementRules:        make(map[string]map[string]string),
+		pendingMoves:          make(map[string]replicaMove),
+		retryingReplicas:      make(map[string]map[int32]time.Time),
+		renaming:              make(map[string]bool),
+		trash:                 make(map[string]*trashedFile),
+		versions:              make(map[string][]*fileVersion),
+		blockFiles:            make(map[string]string),
+		blockClaims:           make(map[blockClaim]map[string]*pb.BlockOwner),
+		packFiles:             make(map[string]map[string]bool),
+		quotas:                make(map[string]*Quota),
+		checksumIndex:         make(map[string]map[string]bool),
+		holds:                 holds,
+		timelines:             make(map[string][]TimelineEvent),
+		config:                config,
+		rpcMetrics:            newRPCMetrics(),
+		dialCredentials:       dialCredentials,
+		clusterID:             clusterID,
+		stopped:               make(chan struct{}),
+	}
+	// injected faults are counted in the metrics like real errors
+	options := []grpc.ServerOption{grpc.Creds(serverCredentials), grpc.MaxRecvMsgSize(int(config.MaxMessageBytes))}
+	interceptors := []grpc.UnaryServerInterceptor{server.rpcMetrics.interceptor, apiversion.UnaryInterceptor, server.tokenInterceptor}
+	if injector := faults.New(config.Faults); injector != nil {
+		interceptors = append(interceptors, injector.UnaryInterceptor)
+		options = append(options, grpc.StreamInterceptor(injector.StreamInterceptor))
+	}
+	grpcServer := grpc.NewServer(append(options, grpc.ChainUnaryInterceptor(interceptors...))...)
+
+	go server.monitorKeepAlive()
+
+	go server.replicationScheduler()
+
+	go server.rebalanceScheduler()
+
+	go server.purgeTrash()
+
+	go server.expireFiles()
+
+	if config.Discoverable {
+		go server.answerDiscovery()
+	}
+
+	pb.RegisterFileServiceServer(grpcServer, server)
+
+	listeners := []net.Listener{clientListener}
+	if dataNodeListener != clientListener {
+		listeners = append(listeners, dataNodeListener)
+	}
+	for _, lis := range listeners {
+		go func() {
+			log.Printf("listening on %s", lis.Addr())
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Printf("s.Serve fail %v", err)
+			}
+		}()
+	}
+	return &Master{server: server, grpcServer: grpcServer}, nil
+}
+
+/*
+Stop stops the master at once, as if its process was killed: its listeners
+are closed, calls in progress cut off and the background work ends
+*/
+func (m *Master) Stop() {
+	close(m.server.stopped)
+	m.grpcServer.Stop()
+}
+
+// Server : Master/DataNode -> listen on port () <-
+// go routine : <-
+// Server/ master
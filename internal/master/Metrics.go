@@ -0,0 +1,160 @@
+package master
+
+import (
+	"context"
+	pb "proj/Services"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// QPS is averaged over this many one-second buckets
+const rpcRateWindow = 60
+
+type rpcCounter struct {
+	calls  int64
+	errors int64
+	// calls per second for the last rpcRateWindow seconds, indexed by unix second
+	buckets       [rpcRateWindow]int64
+	bucketSeconds [rpcRateWindow]int64
+}
+
+// rpcMetrics counts calls and errors per RPC, guarded by its own mutex so the
+// interceptor never contends with the server mutex
+type rpcMetrics struct {
+	mutex   sync.Mutex
+	methods map[string]*rpcCounter
+}
+
+func newRPCMetrics() *rpcMetrics {
+	return &rpcMetrics{methods: make(map[string]*rpcCounter)}
+}
+
+func (m *rpcMetrics) record(method string, failed bool, now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	counter, ok := m.methods[method]
+	if !ok {
+		counter = &rpcCounter{}
+		m.methods[method] = counter
+	}
+	counter.calls++
+	if failed {
+		counter.errors++
+	}
+	second := now.Unix()
+	bucket := second % rpcRateWindow
+	if counter.bucketSeconds[bucket] != second {
+		counter.bucketSeconds[bucket] = second
+		counter.buckets[bucket] = 0
+	}
+	counter.buckets[bucket]++
+}
+
+// interceptor is installed on the master's gRPC server to count every unary call
+func (m *rpcMetrics) interceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	// "/WL_Project.FileService/KeepAlive" -> "KeepAlive"
+	method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+	m.record(method, err != nil, time.Now())
+	return resp, err
+}
+
+func (m *rpcMetrics) snapshot(now time.Time) []*pb.RpcMetric {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	oldest := now.Unix() - rpcRateWindow
+	metrics := make([]*pb.RpcMetric, 0, len(m.methods))
+	for method, counter := range m.methods {
+		var recent int64
+		for i, second := range counter.bucketSeconds {
+			if second > oldest {
+				recent += counter.buckets[i]
+			}
+		}
+		metric := &pb.RpcMetric{
+			Method: method,
+			Calls:  counter.calls,
+			Errors: counter.errors,
+			Qps:    float64(recent) / rpcRateWindow,
+		}
+		if counter.calls > 0 {
+			metric.ErrorRate = float64(counter.errors) / float64(counter.calls)
+		}
+		metrics = append(metrics, metric)
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Method < metrics[j].Method })
+	return metrics
+}
+
+/*
+Rough size of the namespace held in memory: the strings and slices of every
+record plus a fixed per-record overhead for the struct and map entry
+*/
+func (s *server) metadataBytes() int64 {
+	const recordOverhead = 128
+	var total int64
+	for fileName, record := range s.fileRecords {
+		total += recordOverhead + int64(len(fileName))
+		for _, path := range record.FilePaths {
+			total += int64(len(path)) + 16
+		}
+		total += int64(4 * (len(record.DataNodes) + len(record.PinnedNodes)))
+		for key, value := range record.Constraints {
+			total += int64(len(key) + len(value))
+		}
+	}
+	return total
+}
+
+// directoryCount counts the distinct directories implied by "/" separated file names
+func (s *server) directoryCount() int64 {
+	directories := make(map[string]bool)
+	for fileName := range s.fileRecords {
+		if isHiddenName(fileName) {
+			continue
+		}
+		for i, c := range fileName {
+			if c == '/' {
+				directories[fileName[:i+1]] = true
+			}
+		}
+	}
+	for path := range s.placementRules {
+		directories[path] = true
+	}
+	return int64(len(directories))
+}
+
+func (s *server) GetMasterMetrics(ctx context.Context, in *pb.GetMasterMetricsRequest) (*pb.GetMasterMetricsResponse, error) {
+	s.mutex.Lock()
+	response := &pb.GetMasterMetricsResponse{
+		Files:         int64(len(s.fileRecords)),
+		Directories:   s.directoryCount(),
+		MetadataBytes: s.metadataBytes(),
+		DataNodes:     int64(len(s.machineRecords)),
+	}
+	for _, machine := range s.machineRecords {
+		if machine.Liveness {
+			response.LiveDataNodes++
+		}
+		if machine.ClockSkewed {
+			response.ClockSkewedDataNodes++
+		}
+		response.ReadCacheHits += machine.ReadCacheHits
+		response.ReadCacheMisses += machine.ReadCacheMisses
+	}
+	s.mutex.Unlock()
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	response.HeapAllocBytes = memStats.HeapAlloc
+	response.Rpcs = s.rpcMetrics.snapshot(time.Now())
+	return response, nil
+}
@@ -0,0 +1,224 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"log"
+	pb "proj/Services"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// names the containers of packed files are kept under, reserved to the master
+const packPrefix = ".dfs-packs/"
+
+// packedRange is where a packed file lies: Length bytes from Offset in the Container file
+type packedRange struct {
+	Container string
+	Offset    int64
+	Length    int64
+}
+
+func isPackName(fileName string) bool {
+	return strings.HasPrefix(fileName, packPrefix)
+}
+
+// isHiddenName tells whether fileName is a block or a container, stored for files rather than as one
+func isHiddenName(fileName string) bool {
+	return isBlockName(fileName) || isPackName(fileName)
+}
+
+// newPackName names a container randomly like blocks
+func newPackName() string {
+	return packPrefix + newUploadToken()
+}
+
+// hasOwnReplicas tells whether the record's bytes are in replicas of its own, not in blocks or a container
+func (r *FileRecord) hasOwnReplicas() bool {
+	return len(r.Blocks) == 0 && r.Packed == nil
+}
+
+/*
+preparePack plans the upload of a container holding many small files, so
+they take a single file on the DataNodes. The master names the container,
+which is uploaded like a file; the small files are recorded with it, each
+pointing at its bytes in it
+*/
+func (s *server) preparePack(ctx context.Context, in *pb.PrepareUploadRequest) (*pb.PrepareUploadResponse, error) {
+	if in.FileName != "" {
+		return nil, status.Error(codes.InvalidArgument, "the master names containers, file_name must be empty")
+	}
+	if in.Append || in.BlockBytes > 0 || in.Blocks || in.ContentEncoding != "" {
+		return nil, status.Error(codes.InvalidArgument, "packed files can't be appended, stored in blocks or encoded")
+	}
+	if in.FileSize < 0 || in.TtlSeconds < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "negative size %d or TTL %d", in.FileSize, in.TtlSeconds)
+	}
+	if err := s.checkFileSize(in.FileSize); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(in.Packed))
+	for _, file := range in.Packed {
+		if err := validateFileName(file.FileName); err != nil {
+			return nil, err
+		}
+		if names[file.FileName] {
+			return nil, status.Errorf(codes.InvalidArgument, "%s is packed twice", file.FileName)
+		}
+		names[file.FileName] = true
+		if file.Offset < 0 || file.Length < 0 || file.Offset+file.Length > in.FileSize {
+			return nil, status.Errorf(codes.InvalidArgument, "%s lies outside the %d bytes of the container", file.FileName, in.FileSize)
+		}
+		if file.Checksum == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "%s has no checksum", file.FileName)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	constraints := make(map[string]string)
+	var warnings []string
+	for _, file := range in.Packed {
+		if s.renaming[file.FileName] {
+			return nil, status.Errorf(codes.FailedPrecondition, "%s is being renamed", file.FileName)
+		}
+		if _, exists := s.fileRecords[file.FileName]; exists {
+			if err := s.checkHold(file.FileName); err != nil {
+				s.audit(ctx, "overwrite-denied", file.FileName, status.Convert(err).Message())
+				return nil, err
+			}
+		} else if err := s.checkPathConflict(file.FileName); err != nil {
+			return nil, err
+		}
+		fileWarnings, err := s.checkQuota(file.FileName, file.Length)
+		if err != nil {
+			return nil, err
+		}
+		warnings = append(warnings, fileWarnings...)
+		// the container is placed to suit every file in it
+		for key, value := range s.placementConstraintsFor(file.FileName, in.Constraints) {
+			if other, ok := constraints[key]; ok && other != value {
+				return nil, status.Errorf(codes.InvalidArgument, "%s is placed with %s=%s and another file with %s=%s, they can't share a container", file.FileName, key, value, key, other)
+			}
+			constraints[key] = value
+		}
+	}
+	for _, warning := range warnings {
+		log.Printf("WARNING packed upload: %s", warning)
+	}
+	class, err := checkStorageClass(in.StorageClass)
+	if err != nil {
+		return nil, err
+	}
+	if storageClasses[class].erasure {
+		return nil, status.Errorf(codes.InvalidArgument, "containers are stored whole, they can't be %s", class)
+	}
+
+	candidates, err := s.eligibleUploadTargets(constraints, in.FileSize)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	container := newPackName()
+	primary := s.pickUploadTarget(candidates)
+	planned := &FileRecord{FileName: container, DataNodes: []int32{primary}, Size: in.FileSize, Constraints: constraints, StorageClass: class}
+	_, _, replicaIDs := s.selectReplicaTargets(planned, primary, 1)
+	targets := append([]int32{primary}, replicaIDs...)
+
+	// the TTL is that of the packed files, the container goes with the last of them
+	token := s.addPendingUpload(&pendingUpload{
+		FileName:     container,
+		Size:         in.FileSize,
+		Constraints:  constraints,
+		StorageClass: class,
+		Targets:      targets,
+		TTL:          time.Duration(in.TtlSeconds) * time.Second,
+		Packed:       in.Packed,
+	})
+	s.recordEvent(container, stageUploadPrepared, primary, fmt.Sprintf("%d files in %d bytes, %s, replicas planned on %v", len(in.Packed), in.FileSize, class, replicaIDs))
+
+	return &pb.PrepareUploadResponse{
+		UploadToken: token,
+		Targets:     s.uploadTargets(targets),
+		Warnings:    warnings,
+		FileName:    container,
+	}, nil
+}
+
+/*
+commitPacked records the files packed in container once it's stored,
+replacing the files stored under their names. Must be called with the mutex
+held
+*/
+func (s *server) commitPacked(container *FileRecord, pending *pendingUpload) {
+	members := make(map[string]bool, len(pending.Packed))
+	s.packFiles[container.FileName] = members
+	for _, file := range pending.Packed {
+		if old, ok := s.fileRecords[file.FileName]; ok {
+			s.replaceFile(old)
+			s.retireReplaced(*old, nil)
+			s.releaseStorage(old)
+		}
+		record := &FileRecord{
+			FileName:     file.FileName,
+			Size:         file.Length,
+			Checksum:     strings.ToLower(file.Checksum),
+			Constraints:  s.placementConstraintsFor(file.FileName, nil),
+			Generation:   s.nextGeneration(),
+			Tags:         tagSet(s.pendingTags[file.FileName]),
+			StorageClass: container.StorageClass,
+			Packed:       &packedRange{Container: container.FileName, Offset: file.Offset, Length: file.Length},
+		}
+		delete(s.pendingTags, file.FileName)
+		if pending.TTL > 0 {
+			record.ExpiresAt = time.Now().Add(pending.TTL)
+		}
+		s.fileRecords[file.FileName] = record
+		members[file.FileName] = true
+		s.recordEvent(file.FileName, stageCommitted, noDataNode, fmt.Sprintf("%d bytes packed in %s", file.Length, container.FileName))
+	}
+	log.Printf("%d files packed in %s", len(members), container.FileName)
+}
+
+// readPacked locates the bytes of a packed file in its container for a reader at host, must be called with the mutex held
+func (s *server) readPacked(record *FileRecord, host string) *pb.PackedLocation {
+	location := &pb.PackedLocation{
+		Container: record.Packed.Container,
+		Offset:    record.Packed.Offset,
+		Length:    record.Packed.Length,
+		Checksum:  record.Checksum,
+	}
+	if container, ok := s.fileRecords[record.Packed.Container]; ok {
+		location.Replicas = s.replicaLocations(container, host)
+	}
+	return location
+}
+
+/*
+releaseStorage frees what a deleted or replaced file was stored in besides
+its replicas: its blocks, or its place in a container, the container being
+deleted with the last file packed in it. Must be called with the mutex held
+*/
+func (s *server) releaseStorage(record *FileRecord) {
+	s.dropBlocks(record)
+	if record.Packed == nil {
+		return
+	}
+	members := s.packFiles[record.Packed.Container]
+	delete(members, record.FileName)
+	if len(members) > 0 {
+		return
+	}
+	delete(s.packFiles, record.Packed.Container)
+	container, ok := s.fileRecords[record.Packed.Container]
+	if !ok {
+		return
+	}
+	s.forgetFile(container)
+	for _, node := range container.DataNodes {
+		s.deleteReplica(node, &pb.FileDeleteRequest{FileName: container.FileName, DropVersions: true})
+	}
+	log.Printf("%s deleted with the last file packed in it", container.FileName)
+}
@@ -0,0 +1,52 @@
+package master
+
+import "math/rand"
+
+// a node whose last heartbeat found it beyond either is busy, new data goes elsewhere first
+const (
+	// load average per CPU
+	busyCPULoad = 1.0
+	// share of CPU time waiting on disk
+	busyIOLoad = 0.5
+)
+
+// busy reports whether the node's last heartbeat found its CPUs or its disk saturated
+func (m *MachineRecord) busy() bool {
+	return m.CPULoad >= busyCPULoad || m.IOLoad >= busyIOLoad
+}
+
+// freeShare is the share of the node's capacity still free, 1 when unknown
+func (m *MachineRecord) freeShare() float64 {
+	if m.AvailableBytes < 0 || m.CapacityBytes <= 0 {
+		return 1
+	}
+	return float64(m.AvailableBytes) / float64(m.CapacityBytes)
+}
+
+// lessLoaded reports whether new data is better placed on m than on other
+func (m *MachineRecord) lessLoaded(other *MachineRecord) bool {
+	if m.busy() != other.busy() {
+		return !m.busy()
+	}
+	if m.ActiveTransfers != other.ActiveTransfers {
+		return m.ActiveTransfers < other.ActiveTransfers
+	}
+	return m.freeShare() > other.freeShare()
+}
+
+/*
+pickUploadTarget chooses among candidates the DataNode an upload goes to: of
+two picked at random, the less loaded as its heartbeats tell, idle before
+busy, then with fewer transfers in progress, then with more of its capacity
+free. Comparing two rather than taking the least loaded keeps the uploads
+prepared between two heartbeats from all landing on the same node. Must be
+called with the mutex held
+*/
+func (s *server) pickUploadTarget(candidates []int32) int32 {
+	a := candidates[rand.Intn(len(candidates))]
+	b := candidates[rand.Intn(len(candidates))]
+	if s.machineRecords[b].lessLoaded(s.machineRecords[a]) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,88 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"log"
+	pb "proj/Services"
+	"proj/internal/paths"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Quota limits the bytes stored under a directory, matched on whole path components. Crossing
+// the soft limit only raises warnings, the hard limit rejects new uploads. 0 means unlimited
+type Quota struct {
+	SoftBytes int64
+	HardBytes int64
+}
+
+// usageUnder sums the sizes of files under path, skipping exclude
+func (s *server) usageUnder(path, exclude string) int64 {
+	var used int64
+	for fileName, record := range s.fileRecords {
+		// blocks and containers count through their files
+		if fileName != exclude && paths.Under(fileName, path) && !isHiddenName(fileName) {
+			used += record.Size
+		}
+	}
+	return used
+}
+
+/*
+Checks storing size bytes as fileName against the quota of every directory
+containing it, a file being overwritten doesn't count twice. Returns the soft
+limit warnings, or a ResourceExhausted error when a hard limit would be crossed
+*/
+func (s *server) checkQuota(fileName string, size int64) ([]string, error) {
+	var warnings []string
+	for path, quota := range s.quotas {
+		if !paths.Under(fileName, path) {
+			continue
+		}
+		used := s.usageUnder(path, fileName) + size
+		if quota.HardBytes > 0 && used > quota.HardBytes {
+			return nil, status.Errorf(codes.ResourceExhausted, "hard quota of %s exceeded: %d of %d bytes", path, used, quota.HardBytes)
+		}
+		if quota.SoftBytes > 0 && used > quota.SoftBytes {
+			warnings = append(warnings, fmt.Sprintf("soft quota of %s exceeded: %d of %d bytes", path, used, quota.SoftBytes))
+		}
+	}
+	return warnings, nil
+}
+
+func (s *server) SetQuota(ctx context.Context, in *pb.SetQuotaRequest) (*pb.SetQuotaResponse, error) {
+	if in.SoftBytes < 0 || in.HardBytes < 0 || (in.HardBytes > 0 && in.SoftBytes > in.HardBytes) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid quota soft %d hard %d", in.SoftBytes, in.HardBytes)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if in.SoftBytes == 0 && in.HardBytes == 0 {
+		delete(s.quotas, in.Path)
+		log.Printf("quota of %s removed", in.Path)
+		return &pb.SetQuotaResponse{}, nil
+	}
+	s.quotas[in.Path] = &Quota{SoftBytes: in.SoftBytes, HardBytes: in.HardBytes}
+	log.Printf("quota of %s set to soft %d hard %d bytes", in.Path, in.SoftBytes, in.HardBytes)
+	return &pb.SetQuotaResponse{}, nil
+}
+
+// GetQuotaUsage lets tenants check how close a directory is to its limits
+func (s *server) GetQuotaUsage(ctx context.Context, in *pb.GetQuotaUsageRequest) (*pb.GetQuotaUsageResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	response := &pb.GetQuotaUsageResponse{
+		Path:      in.Path,
+		UsedBytes: s.usageUnder(in.Path, ""),
+	}
+	if quota, ok := s.quotas[in.Path]; ok {
+		response.SoftBytes = quota.SoftBytes
+		response.HardBytes = quota.HardBytes
+		response.SoftExceeded = quota.SoftBytes > 0 && response.UsedBytes > quota.SoftBytes
+		response.HardExceeded = quota.HardBytes > 0 && response.UsedBytes > quota.HardBytes
+	}
+	return response, nil
+}
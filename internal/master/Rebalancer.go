@@ -0,0 +1,234 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"log"
+	pb "proj/Services"
+	"time"
+)
+
+const defaultRebalanceInterval = 5 * time.Minute
+
+// replicaMove is a replica the rebalancer copies to To, dropping it from From
+// once the new copy is reported through NotifyUploaded
+type replicaMove struct {
+	From int32
+	To   int32
+}
+
+/*
+Periodically moves replicas from the fullest to the emptiest live DataNode
+while the spread of used bytes exceeds the configured threshold
+*/
+func (s *server) rebalanceScheduler() {
+	if s.config.RebalanceThresholdPercent <= 0 {
+		return
+	}
+	windowStart, windowEnd, err := parseRebalanceWindow(s.config.RebalanceWindowStart, s.config.RebalanceWindowEnd)
+	if err != nil {
+		log.Printf("rebalancing disabled: %v", err)
+		return
+	}
+
+	interval := time.Duration(s.config.RebalanceIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultRebalanceInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopped:
+			return
+		case <-ticker.C:
+		}
+		if !inWindow(time.Now(), windowStart, windowEnd) {
+			continue
+		}
+		s.mutex.Lock()
+		s.rebalance()
+		s.mutex.Unlock()
+	}
+}
+
+// parseRebalanceWindow turns "HH:MM" bounds into minutes since midnight, -1 when unset
+func parseRebalanceWindow(start, end string) (int, int, error) {
+	if start == "" || end == "" {
+		return -1, -1, nil
+	}
+	startTime, err := time.Parse("15:04", start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad RebalanceWindowStart %q", start)
+	}
+	endTime, err := time.Parse("15:04", end)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad RebalanceWindowEnd %q", end)
+	}
+	return startTime.Hour()*60 + startTime.Minute(), endTime.Hour()*60 + endTime.Minute(), nil
+}
+
+func inWindow(now time.Time, start, end int) bool {
+	if start < 0 {
+		return true
+	}
+	minutes := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return minutes >= start && minutes < end
+	}
+	// the window wraps past midnight, e.g. 22:00 - 04:00
+	return minutes >= start || minutes < end
+}
+
+// spreadPercent is the gap between the fullest and emptiest node relative to the mean
+func spreadPercent(used map[int32]int64) (float64, int32, int32) {
+	var total int64
+	var fullest, emptiest int32 = -1, -1
+	for nodeID, bytes := range used {
+		total += bytes
+		if fullest < 0 || bytes > used[fullest] {
+			fullest = nodeID
+		}
+		if emptiest < 0 || bytes < used[emptiest] {
+			emptiest = nodeID
+		}
+	}
+	if total == 0 {
+		return 0, fullest, emptiest
+	}
+	mean := float64(total) / float64(len(used))
+	return float64(used[fullest]-used[emptiest]) / mean * 100, fullest, emptiest
+}
+
+/*
+One rebalancing round, must be called with the mutex held. Moves are planned
+against projected usage so a round doesn't overshoot before heartbeats catch up
+*/
+func (s *server) rebalance() {
+	used := make(map[int32]int64)
+	now := time.Now()
+	for i, machine := range s.machineRecords {
+		if machine.Liveness && !machine.inMaintenance(now) && !machine.Draining {
+			used[int32(i)] = machine.UsedBytes
+		}
+	}
+	if len(used) < 2 {
+		return
+	}
+
+	var scheduled int64
+	for {
+		spread, fullest, emptiest := spreadPercent(used)
+		if spread <= s.config.RebalanceThresholdPercent {
+			return
+		}
+
+		maxSize := (used[fullest] - used[emptiest]) / 2
+		if limit := s.config.RebalanceMaxBytesPerRound; limit > 0 && limit-scheduled < maxSize {
+			maxSize = limit - scheduled
+		}
+		record := s.pickFileToMove(fullest, emptiest, maxSize)
+		if record == nil {
+			return
+		}
+
+		s.startMove(record, fullest, emptiest)
+		used[fullest] -= record.Size
+		used[emptiest] += record.Size
+		scheduled += record.Size
+	}
+}
+
+// pickFileToMove returns the largest movable file on from that fits in maxSize
+func (s *server) pickFileToMove(from, to int32, maxSize int64) *FileRecord {
+	var best *FileRecord
+	for fileName, record := range s.fileRecords {
+		if _, moving := s.pendingMoves[fileName]; moving {
+			continue
+		}
+		// pinned files are placed by the operator, never by the rebalancer
+		if len(record.PinnedNodes) > 0 {
+			continue
+		}
+		// scratch data isn't worth the bandwidth, it stays where it was written
+		if record.class().scratch {
+			continue
+		}
+		if !record.isStoredOn(from) || record.isStoredOn(to) || !s.machineRecords[to].satisfies(record.Constraints) || !s.machineRecords[to].hasRoomFor(record.Size) {
+			continue
+		}
+		if record.Size <= 0 || record.Size > maxSize {
+			continue
+		}
+		if best == nil || record.Size > best.Size {
+			best = record
+		}
+	}
+	return best
+}
+
+func (s *server) startMove(record *FileRecord, from, to int32) {
+	var filePath string
+	for i, node := range record.DataNodes {
+		if node == from {
+			filePath = record.FilePaths[i]
+		}
+	}
+	s.pendingMoves[record.FileName] = replicaMove{From: from, To: to}
+	log.Printf("rebalancing %s (%d bytes) from DataNode %d to %d", record.FileName, record.Size, from, to)
+	s.recordEvent(record.FileName, stageMoveStarted, to, fmt.Sprintf("from DataNode %d", from))
+
+	replicateRequest := &pb.ReplicateRequest{
+		FileName:    record.FileName,
+		FilePath:    filePath,
+		IpAddresses: []string{s.machineRecords[to].IPAddress},
+		PortNumbers: []int32{s.machineRecords[to].DataNodePort},
+		Ids:         []int32{to},
+		ClusterId:   s.clusterID,
+	}
+	addr := s.machineRecords[from].masterAddr()
+
+	go func() {
+		conn, err := s.dialDataNode(addr)
+		if err == nil {
+			defer conn.Close()
+			var response *pb.ReplicateResponse
+			response, err = pb.NewFileServiceClient(conn).Replicate(context.Background(), replicateRequest)
+			// the target failing for good ends the move, the source keeps its replica;
+			// one being retried completes it once it lands
+			if result := response.GetResults(); err == nil && len(result) == 1 && !result[0].Success && !result[0].Retrying {
+				err = fmt.Errorf("replica on DataNode %d failed: %s", to, result[0].Error)
+			}
+		}
+		if err != nil {
+			log.Printf("Rebalance replicate fail on source Datanode machine %v", err)
+			s.mutex.Lock()
+			delete(s.pendingMoves, record.FileName)
+			s.recordEvent(record.FileName, stageReplicationFailed, from, err.Error())
+			s.mutex.Unlock()
+		}
+	}()
+}
+
+/*
+Called with the mutex held when a new replica of record lands on nodeID. If it
+completes a move, the source replica is dropped from the record and deleted
+*/
+func (s *server) completeMove(record *FileRecord, nodeID int32) {
+	move, ok := s.pendingMoves[record.FileName]
+	if !ok || move.To != nodeID {
+		return
+	}
+	delete(s.pendingMoves, record.FileName)
+	s.recordEvent(record.FileName, stageMoveCompleted, nodeID, fmt.Sprintf("replica on DataNode %d dropped", move.From))
+
+	for i, node := range record.DataNodes {
+		if node == move.From {
+			record.DataNodes = append(record.DataNodes[:i], record.DataNodes[i+1:]...)
+			record.FilePaths = append(record.FilePaths[:i], record.FilePaths[i+1:]...)
+			break
+		}
+	}
+
+	s.deleteReplica(move.From, &pb.FileDeleteRequest{FileName: record.FileName})
+}
@@ -0,0 +1,165 @@
+package master
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	pb "proj/Services"
+	"proj/internal/fsutil"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const defaultClusterIDPath = "MasterNode_cluster_id"
+
+/*
+how far past the highest known ID a DataNode may claim one: after a master
+restart the DataNodes register in any order, the IDs below wait as
+placeholders, but a bad config mustn't make the master allocate millions
+*/
+const maxClaimedIDGap = 1024
+
+/*
+loadClusterID returns the ID of the master's cluster, generated and written
+to path the first time the master starts. DataNodes keep the ID of the
+cluster they joined and a master of another cluster refuses them, so a
+DataNode pointed at the wrong master can't mix its files into another
+namespace
+*/
+func loadClusterID(path string) (string, error) {
+	if path == "" {
+		path = defaultClusterIDPath
+	}
+	content, err := os.ReadFile(path)
+	if err == nil {
+		if clusterID := strings.TrimSpace(string(content)); clusterID != "" {
+			return clusterID, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	clusterID := hex.EncodeToString(id)
+	if err := fsutil.WriteFileAtomic(path, []byte(clusterID+"\n"), 0644); err != nil {
+		return "", err
+	}
+	log.Printf("new cluster %s, its ID is kept in %s", clusterID, path)
+	return clusterID, nil
+}
+
+// dataNodePorts parses the ports a DataNode announces, in the order master, client, DataNode
+func dataNodePorts(ports []string) ([]int32, error) {
+	if len(ports) != 3 {
+		return nil, fmt.Errorf("%d ports announced instead of 3", len(ports))
+	}
+	parsed := make([]int32, 0, len(ports))
+	for _, port := range ports {
+		number, err := portNumber(port)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, number)
+	}
+	return parsed, nil
+}
+
+// portNumber is the number of a port a DataNode announces: ":50052", or with a host, "[2001:db8::1]:50052"
+func portNumber(port string) (int32, error) {
+	if _, p, err := net.SplitHostPort(port); err == nil {
+		port = p
+	}
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad port %q", port)
+	}
+	return int32(number), nil
+}
+
+// heldByOther reports whether another DataNode than the one at ip and masterPort holds the ID of the record
+func (m *MachineRecord) heldByOther(ip string, masterPort int32) bool {
+	if m.NodeUUID != "" {
+		return true
+	}
+	// a DataNode known by its address alone, from its heartbeats
+	return m.Liveness && (!sameHost(m.IPAddress, ip) || m.MasterNodePort != masterPort)
+}
+
+/*
+RegisterDataNode assigns a DataNode its ID, the index of its machine record.
+A DataNode is known by the identity it generated once, so it keeps its ID
+when its address changes. A DataNode claiming the ID it was assigned before
+a master restart, or one set in its config, gets it back unless another
+DataNode holds it; the IDs below it wait for their DataNodes to register.
+New DataNodes get the next free ID. Only DataNodes presenting the cluster
+secret and of the master's cluster may join
+*/
+func (s *server) RegisterDataNode(ctx context.Context, in *pb.RegisterDataNodeRequest) (*pb.RegisterDataNodeResponse, error) {
+	if !s.authorizedDataNode(ctx) {
+		log.Printf("rejected registration from %s: wrong cluster secret", clientHost(ctx))
+		return nil, status.Error(codes.PermissionDenied, "wrong cluster secret")
+	}
+	if in.NodeUuid == "" {
+		return nil, status.Error(codes.InvalidArgument, "no node identity")
+	}
+	if in.ClusterId != "" && in.ClusterId != s.clusterID {
+		log.Printf("rejected registration from %s: DataNode of cluster %s", clientHost(ctx), in.ClusterId)
+		return nil, status.Errorf(codes.FailedPrecondition, "the DataNode belongs to cluster %s, this master runs cluster %s", in.ClusterId, s.clusterID)
+	}
+	ports, err := dataNodePorts(in.PortNumber)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	nodeID := -1
+	for i, machine := range s.machineRecords {
+		if machine.NodeUUID == in.NodeUuid {
+			nodeID = i
+			break
+		}
+	}
+	if nodeID < 0 && in.DataNode != nil {
+		claimed := int(*in.DataNode)
+		switch {
+		case claimed < 0:
+			return nil, status.Errorf(codes.InvalidArgument, "bad DataNode ID %d", claimed)
+		case claimed >= len(s.machineRecords)+maxClaimedIDGap:
+			log.Printf("rejected registration from %s: DataNode ID %d is past the %d known", clientHost(ctx), claimed, len(s.machineRecords))
+			return nil, status.Errorf(codes.InvalidArgument, "DataNode ID %d is too far past the %d DataNodes known", claimed, len(s.machineRecords))
+		case claimed < len(s.machineRecords) && s.machineRecords[claimed].heldByOther(in.DataNode_IP, ports[0]):
+			return nil, status.Errorf(codes.AlreadyExists, "DataNode ID %d is registered to another DataNode", claimed)
+		}
+		for len(s.machineRecords) <= claimed {
+			s.machineRecords = append(s.machineRecords, &MachineRecord{})
+		}
+		nodeID = claimed
+	}
+	if nodeID < 0 {
+		nodeID = len(s.machineRecords)
+		s.machineRecords = append(s.machineRecords, &MachineRecord{})
+	}
+	if in.DataNode != nil && int(*in.DataNode) != nodeID {
+		return nil, status.Errorf(codes.AlreadyExists, "this DataNode is registered as DataNode %d, not %d", nodeID, *in.DataNode)
+	}
+
+	machine := s.machineRecords[nodeID]
+	if machine.NodeUUID != in.NodeUuid || machine.IPAddress != in.DataNode_IP || machine.MasterNodePort != ports[0] {
+		log.Printf("DataNode %d registered from %s", nodeID, in.DataNode_IP)
+	}
+	machine.NodeUUID = in.NodeUuid
+	machine.IPAddress = in.DataNode_IP
+	machine.MasterNodePort, machine.ClientNodePort, machine.DataNodePort = ports[0], ports[1], ports[2]
+	return &pb.RegisterDataNodeResponse{DataNode: int32(nodeID), ClusterId: s.clusterID}, nil
+}
@@ -0,0 +1,153 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"log"
+	pb "proj/Services"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+RenameFile moves a stored file to a new name. Every live DataNode holding it
+renames its replica; if one fails, those already renamed are renamed back
+and the file keeps its name. Only once all succeeded does the record move to
+the new name, so readers find the file under one name or the other. Replicas
+on DataNodes that are down are dropped, repair copies the file again.
+Uploads and deletes of either name are refused meanwhile
+*/
+func (s *server) RenameFile(ctx context.Context, in *pb.RenameFileRequest) (*pb.RenameFileResponse, error) {
+	if err := validateFileName(in.NewName); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	record, ok := s.fileRecords[in.FileName]
+	if !ok {
+		s.mutex.Unlock()
+		return nil, status.Error(codes.NotFound, "No such filename exist")
+	}
+	if in.NewName == in.FileName {
+		s.mutex.Unlock()
+		return nil, status.Errorf(codes.InvalidArgument, "%s is already named so", in.FileName)
+	}
+	if _, exists := s.fileRecords[in.NewName]; exists || s.renaming[in.NewName] {
+		s.mutex.Unlock()
+		return nil, status.Errorf(codes.AlreadyExists, "%s already exists", in.NewName)
+	}
+	if s.renaming[in.FileName] {
+		s.mutex.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is being renamed", in.FileName)
+	}
+	if err := s.checkPathConflict(in.NewName); err != nil {
+		s.mutex.Unlock()
+		return nil, err
+	}
+	// the old name disappears, a modification holds forbid
+	if err := s.checkHold(in.FileName); err != nil {
+		s.audit(ctx, "rename-denied", in.FileName, status.Convert(err).Message())
+		s.mutex.Unlock()
+		return nil, err
+	}
+	if _, err := s.checkQuota(in.NewName, record.Size); err != nil {
+		s.mutex.Unlock()
+		return nil, err
+	}
+	// blocks and containers are named apart from their files, only the record moves
+	if !record.hasOwnReplicas() {
+		s.renameRecord(record, in.NewName)
+		s.mutex.Unlock()
+		return &pb.RenameFileResponse{}, nil
+	}
+	addrs := make(map[int32]string)
+	for _, node := range record.DataNodes {
+		if machine := s.machineRecords[node]; machine.Liveness {
+			addrs[node] = machine.masterAddr()
+		}
+	}
+	if len(addrs) == 0 {
+		s.mutex.Unlock()
+		return nil, status.Errorf(codes.Unavailable, "no DataNode holding %s is alive", in.FileName)
+	}
+	generation := s.nextGeneration()
+	previous := record.Generation
+	s.renaming[in.FileName] = true
+	s.renaming[in.NewName] = true
+	s.mutex.Unlock()
+
+	// the DataNodes are called without the mutex, the names are reserved instead
+	paths := make(map[int32]string)
+	var err error
+	for node, addr := range addrs {
+		var path string
+		path, err = s.renameReplica(ctx, addr, &pb.RenameFileRequest{FileName: in.FileName, NewName: in.NewName, Generation: generation})
+		if err != nil {
+			err = fmt.Errorf("renaming %s on DataNode %d failed: %v", in.FileName, node, err)
+			break
+		}
+		paths[node] = path
+	}
+	if err != nil {
+		for node := range paths {
+			if _, undoErr := s.renameReplica(context.Background(), addrs[node], &pb.RenameFileRequest{FileName: in.NewName, NewName: in.FileName, Generation: previous}); undoErr != nil {
+				log.Printf("renaming %s back on DataNode %d failed: %v", in.NewName, node, undoErr)
+			}
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.renaming, in.FileName)
+	delete(s.renaming, in.NewName)
+	if err != nil {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	if s.fileRecords[in.FileName] != record {
+		return nil, status.Errorf(codes.Aborted, "%s was replaced while being renamed", in.FileName)
+	}
+
+	delete(s.fileRecords, in.FileName)
+	delete(s.pendingMoves, in.FileName)
+	delete(s.checksumIndex[record.Checksum], in.FileName)
+	record.FileName = in.NewName
+	record.DataNodes = nil
+	record.FilePaths = nil
+	for node, path := range paths {
+		record.DataNodes = append(record.DataNodes, node)
+		record.FilePaths = append(record.FilePaths, path)
+	}
+	for node := range record.CorruptReplicas {
+		if _, ok := paths[node]; !ok {
+			delete(record.CorruptReplicas, node)
+		}
+	}
+	record.Generation = generation
+	s.fileRecords[in.NewName] = record
+	if versions, ok := s.versions[in.FileName]; ok {
+		s.versions[in.NewName] = versions
+		delete(s.versions, in.FileName)
+	}
+	s.indexChecksum(in.NewName, record.Checksum)
+	s.recordEvent(in.FileName, stageRenamed, noDataNode, "to "+in.NewName)
+	s.endTimeline(in.FileName)
+	s.recordEvent(in.NewName, stageRenamed, noDataNode, "from "+in.FileName)
+	log.Printf("%s renamed to %s on DataNodes %v", in.FileName, in.NewName, record.DataNodes)
+	s.PrintFileRecords()
+	return &pb.RenameFileResponse{}, nil
+}
+
+// renameReplica asks the DataNode at addr, its master port, to rename its replica and returns the new path
+func (s *server) renameReplica(ctx context.Context, addr string, request *pb.RenameFileRequest) (string, error) {
+	conn, err := s.dialDataNode(addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	response, err := pb.NewFileServiceClient(conn).RenameFile(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	return response.FilePath, nil
+}
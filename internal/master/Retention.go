@@ -0,0 +1,203 @@
+package master
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	pb "proj/Services"
+	"proj/internal/fsutil"
+	"proj/internal/paths"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const defaultHoldsPath = "MasterNode_holds.json"
+
+// Hold protects a file, or every file under a directory prefix, from deletion
+// and overwrite until RetainUntil or, for a legal hold, until it is released
+type Hold struct {
+	RetainUntil time.Time
+	LegalHold   bool
+	Reason      string
+}
+
+func (h *Hold) active(now time.Time) bool {
+	return h.LegalHold || now.Before(h.RetainUntil)
+}
+
+func (config *MasterConfig) holdsPath() string {
+	if config.HoldsPath == "" {
+		return defaultHoldsPath
+	}
+	return config.HoldsPath
+}
+
+/*
+loadHolds reads the holds kept in path, none when the file doesn't exist
+yet. Unlike the namespace, holds aren't rebuilt from the DataNodes after a
+restart, so they are kept on the master's disk
+*/
+func loadHolds(path string) (map[string]*Hold, error) {
+	holds := make(map[string]*Hold)
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return holds, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &holds); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return holds, nil
+}
+
+// saveHolds writes the holds to the holds file, must be called with the mutex held
+func (s *server) saveHolds() error {
+	content, err := json.MarshalIndent(s.holds, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(s.config.holdsPath(), content, 0600)
+}
+
+/*
+checkHold returns a FailedPrecondition error when a hold on fileName or one
+of its directories forbids deleting or overwriting it. A hold on "a" covers
+"a/b" but not "ab". Must be called with the mutex held
+*/
+func (s *server) checkHold(fileName string) error {
+	now := time.Now()
+	for path, hold := range s.holds {
+		if !paths.Under(fileName, path) || !hold.active(now) {
+			continue
+		}
+		if hold.LegalHold {
+			return status.Errorf(codes.FailedPrecondition, "%s is under legal hold (%s)", fileName, path)
+		}
+		return status.Errorf(codes.FailedPrecondition, "%s is retained until %s (%s)", fileName, hold.RetainUntil.Format(time.RFC3339), path)
+	}
+	return nil
+}
+
+/*
+Hold changes need the compliance role: "authorization" metadata carrying
+ComplianceToken, bare or as "Bearer <token>". Without a configured token
+anyone may manage holds
+*/
+func (s *server) authorizedCompliance(ctx context.Context) bool {
+	if s.config.ComplianceToken == "" {
+		return true
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		token := strings.TrimPrefix(value, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.config.ComplianceToken)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Places or extends a hold. Retention can only be lengthened, never shortened,
+so a retained path stays protected until its date; a legal hold lasts until
+ReleaseHold
+*/
+func (s *server) SetHold(ctx context.Context, in *pb.SetHoldRequest) (*pb.SetHoldResponse, error) {
+	if in.Path == "" || (in.RetainUntil <= 0 && !in.LegalHold) {
+		return nil, status.Error(codes.InvalidArgument, "a hold needs a path and a retention date or legal hold")
+	}
+	if !s.authorizedCompliance(ctx) {
+		s.audit(ctx, "set-hold-denied", in.Path, "unauthorized")
+		return nil, status.Error(codes.PermissionDenied, "setting holds needs the compliance token")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	hold, ok := s.holds[in.Path]
+	if !ok {
+		hold = &Hold{}
+		s.holds[in.Path] = hold
+	}
+	if retainUntil := time.Unix(in.RetainUntil, 0); in.RetainUntil > 0 && retainUntil.After(hold.RetainUntil) {
+		hold.RetainUntil = retainUntil
+	}
+	hold.LegalHold = hold.LegalHold || in.LegalHold
+	if in.Reason != "" {
+		hold.Reason = in.Reason
+	}
+	detail := fmt.Sprintf("legal hold %t", hold.LegalHold)
+	if !hold.RetainUntil.IsZero() {
+		detail += ", retain until " + hold.RetainUntil.UTC().Format(time.RFC3339)
+	}
+	s.audit(ctx, "set-hold", in.Path, detail+": "+in.Reason)
+	if err := s.saveHolds(); err != nil {
+		log.Printf("saving holds fail %v", err)
+		return nil, status.Errorf(codes.Internal, "the hold is in force but wasn't saved, a master restart loses it: %v", err)
+	}
+	return &pb.SetHoldResponse{}, nil
+}
+
+// ReleaseHold lifts a legal hold, retention stays in force until its date
+func (s *server) ReleaseHold(ctx context.Context, in *pb.ReleaseHoldRequest) (*pb.ReleaseHoldResponse, error) {
+	if !s.authorizedCompliance(ctx) {
+		s.audit(ctx, "release-hold-denied", in.Path, "unauthorized")
+		return nil, status.Error(codes.PermissionDenied, "releasing holds needs the compliance token")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	hold, ok := s.holds[in.Path]
+	if !ok || !hold.LegalHold {
+		return nil, status.Errorf(codes.NotFound, "no legal hold on %s", in.Path)
+	}
+	hold.LegalHold = false
+	if !hold.active(time.Now()) {
+		delete(s.holds, in.Path)
+	}
+	s.audit(ctx, "release-hold", in.Path, in.Reason)
+	if err := s.saveHolds(); err != nil {
+		log.Printf("saving holds fail %v", err)
+		return nil, status.Errorf(codes.Internal, "the hold is released but wasn't saved, a master restart places it again: %v", err)
+	}
+	return &pb.ReleaseHoldResponse{}, nil
+}
+
+func (s *server) ListHolds(ctx context.Context, in *pb.ListHoldsRequest) (*pb.ListHoldsResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	response := &pb.ListHoldsResponse{}
+	lapsed := false
+	for path, hold := range s.holds {
+		if !hold.active(now) {
+			// lapsed retention
+			delete(s.holds, path)
+			lapsed = true
+			continue
+		}
+		entry := &pb.Hold{Path: path, LegalHold: hold.LegalHold, Reason: hold.Reason}
+		if !hold.RetainUntil.IsZero() {
+			entry.RetainUntil = hold.RetainUntil.Unix()
+		}
+		response.Holds = append(response.Holds, entry)
+	}
+	sort.Slice(response.Holds, func(i, j int) bool { return response.Holds[i].Path < response.Holds[j].Path })
+	// a lapsed hold left in the file is dropped again after a restart
+	if lapsed {
+		if err := s.saveHolds(); err != nil {
+			log.Printf("saving holds fail %v", err)
+		}
+	}
+	return response, nil
+}
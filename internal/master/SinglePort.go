@@ -0,0 +1,45 @@
+package master
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+/*
+dialDataNode connects to a DataNode. The calls say they come from the
+master, with the cluster secret and the cluster ID, so a DataNode serving
+every role on one port tells them from client calls. Calls without a
+deadline get one, see callTimeout
+*/
+func (s *server) dialDataNode(addr string) (*grpc.ClientConn, error) {
+	return grpc.Dial(addr, grpc.WithTransportCredentials(s.dialCredentials),
+		grpc.WithChainUnaryInterceptor(s.dataNodeInterceptor),
+		grpc.WithChainStreamInterceptor(s.dataNodeStreamInterceptor))
+}
+
+// asMaster marks an outgoing call as coming from the master of the cluster
+func (s *server) asMaster(ctx context.Context) context.Context {
+	ctx = metadata.AppendToOutgoingContext(ctx, "dfs-role", "master", "cluster-id", s.clusterID)
+	if s.config.ClusterSecret != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "cluster-secret", s.config.ClusterSecret)
+	}
+	return ctx
+}
+
+func (s *server) dataNodeInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, cancel := withDeadline(ctx, s.callTimeout(method))
+	defer cancel()
+	return invoker(s.asMaster(ctx), method, req, reply, cc, opts...)
+}
+
+func (s *server) dataNodeStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx, cancel := withDeadline(ctx, s.callTimeout(method))
+	stream, err := streamer(s.asMaster(ctx), desc, cc, method, opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &cancelingStream{ClientStream: stream, cancel: cancel, serverStreams: desc.ServerStreams}, nil
+}
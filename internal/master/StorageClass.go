@@ -0,0 +1,57 @@
+package master
+
+import (
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// class of the files uploaded without one, and of files stored before classes existed
+const defaultStorageClass = "replicated-3"
+
+/*
+storageClass trades durability against space: how many replicas placement
+and repair aim for, and whether lost replicas are repaired and the file
+moved by rebalancing at all
+*/
+type storageClass struct {
+	replicas int
+	// scratch data is neither repaired nor rebalanced, losing its node loses it
+	scratch bool
+	// erasure files are stored in blocks, three parity blocks for every six,
+	// each block stored once and rebuilt from six others of its stripe when lost
+	erasure bool
+}
+
+var storageClasses = map[string]storageClass{
+	"replicated-3":        {replicas: replicationFactor},
+	"replicated-2":        {replicas: 2},
+	"single-copy-scratch": {replicas: 1, scratch: true},
+	"erasure-6-3":         {replicas: 1, erasure: true},
+}
+
+// checkStorageClass validates a requested class, returning its name with the default filled in
+func checkStorageClass(name string) (string, error) {
+	if name == "" {
+		return defaultStorageClass, nil
+	}
+	if _, ok := storageClasses[name]; ok {
+		return name, nil
+	}
+	names := make([]string, 0, len(storageClasses))
+	for known := range storageClasses {
+		names = append(names, known)
+	}
+	sort.Strings(names)
+	return "", status.Errorf(codes.InvalidArgument, "unknown storage class %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// class returns the file's storage class, the default for files recorded without one
+func (f *FileRecord) class() storageClass {
+	if class, ok := storageClasses[f.StorageClass]; ok {
+		return class
+	}
+	return storageClasses[defaultStorageClass]
+}
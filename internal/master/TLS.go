@@ -0,0 +1,23 @@
+package master
+
+import (
+	"context"
+	"crypto/subtle"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+/*
+DataNode to master calls (heartbeats, upload notifications) must carry the
+cluster secret as "cluster-secret" metadata when the master has one, so only
+DataNodes of this cluster can join it
+*/
+func (s *server) authorizedDataNode(ctx context.Context) bool {
+	if s.config.ClusterSecret == "" {
+		return true
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	secret := strings.Join(md.Get("cluster-secret"), "")
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(s.config.ClusterSecret)) == 1
+}
@@ -0,0 +1,136 @@
+package master
+
+import (
+	"context"
+	pb "proj/Services"
+	"sort"
+	"strings"
+	"unicode"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const maxTagLength = 128
+
+// validTag rejects empty, overlong and whitespace or comma carrying tags, so
+// tags stay usable as filters on the command line
+func validTag(tag string) error {
+	if tag == "" || len(tag) > maxTagLength {
+		return status.Errorf(codes.InvalidArgument, "tags must be 1 to %d bytes", maxTagLength)
+	}
+	if strings.ContainsFunc(tag, func(r rune) bool { return unicode.IsSpace(r) || r == ',' }) {
+		return status.Errorf(codes.InvalidArgument, "tag %q contains whitespace or a comma", tag)
+	}
+	return nil
+}
+
+// sortedTags returns a tag set as a sorted list, nil when empty
+func sortedTags(tags map[string]bool) []string {
+	var list []string
+	for tag := range tags {
+		list = append(list, tag)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// tagSet turns a tag list into a set, nil when empty
+func tagSet(list []string) map[string]bool {
+	if len(list) == 0 {
+		return nil
+	}
+	tags := make(map[string]bool)
+	for _, tag := range list {
+		tags[tag] = true
+	}
+	return tags
+}
+
+// hasTags reports whether the record carries every tag in filter
+func (record *FileRecord) hasTags(filter []string) bool {
+	for _, tag := range filter {
+		if !record.Tags[tag] {
+			return false
+		}
+	}
+	return true
+}
+
+// AddTags attaches tags to a stored file, tags it already has are kept
+func (s *server) AddTags(ctx context.Context, in *pb.AddTagsRequest) (*pb.AddTagsResponse, error) {
+	for _, tag := range in.Tags {
+		if err := validTag(tag); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record, ok := s.fileRecords[in.FileName]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "No such filename exist")
+	}
+	if record.Tags == nil {
+		record.Tags = make(map[string]bool)
+	}
+	for _, tag := range in.Tags {
+		record.Tags[tag] = true
+	}
+	return &pb.AddTagsResponse{Tags: sortedTags(record.Tags)}, nil
+}
+
+// RemoveTags detaches tags from a stored file, tags it doesn't have are ignored
+func (s *server) RemoveTags(ctx context.Context, in *pb.RemoveTagsRequest) (*pb.RemoveTagsResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record, ok := s.fileRecords[in.FileName]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "No such filename exist")
+	}
+	for _, tag := range in.Tags {
+		delete(record.Tags, tag)
+	}
+	return &pb.RemoveTagsResponse{Tags: sortedTags(record.Tags)}, nil
+}
+
+/*
+Lists the stored files whose names start with prefix and that carry every
+tag in the request, sorted by name. A shallow listing stops at the next "/":
+the files deeper down are rolled up into their subdirectory of prefix
+*/
+func (s *server) ListFiles(ctx context.Context, in *pb.ListFilesRequest) (*pb.ListFilesResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	response := &pb.ListFilesResponse{}
+	directories := make(map[string]bool)
+	for fileName, record := range s.fileRecords {
+		if !strings.HasPrefix(fileName, in.Prefix) || !record.hasTags(in.Tags) || isHiddenName(fileName) {
+			continue
+		}
+		if in.Shallow {
+			if directory := directoryOf(in.Prefix, fileName); directory != "" {
+				directories[directory] = true
+				continue
+			}
+		}
+		response.Files = append(response.Files, &pb.NamespaceFile{
+			FileName:        fileName,
+			FileSize:        record.Size,
+			Constraints:     record.Constraints,
+			Checksum:        record.Checksum,
+			ContentEncoding: record.ContentEncoding,
+			Generation:      record.Generation,
+			Tags:            sortedTags(record.Tags),
+			StorageClass:    record.StorageClass,
+			ExpiresUnixMs:   record.expiresUnixMs(),
+		})
+	}
+	sort.Slice(response.Files, func(i, j int) bool { return response.Files[i].FileName < response.Files[j].FileName })
+	for directory := range directories {
+		response.Directories = append(response.Directories, directory)
+	}
+	sort.Strings(response.Directories)
+	return response, nil
+}
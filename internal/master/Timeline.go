@@ -0,0 +1,140 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	pb "proj/Services"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// events kept per file, the oldest are dropped past it
+const maxTimelineEvents = 200
+
+// timelines of files deleted or renamed away kept, the oldest are dropped past it
+const maxEndedTimelines = 1000
+
+// noDataNode marks timeline events not tied to a DataNode
+const noDataNode = -1
+
+// Stages of a file's life recorded in its timeline
+const (
+	stageUploadPrepared       = "upload-prepared"
+	stageCommitted            = "committed"
+	stageCommitRefused        = "commit-refused"
+	stageReplicationRequested = "replication-requested"
+	stageReplicationFailed    = "replication-failed"
+	stageReplicaCompleted     = "replica-completed"
+	stageRepairRequested      = "repair-requested"
+	stageReplicaReportedBad   = "replica-reported-bad"
+	stageCorruptDeleted       = "corrupt-deleted"
+	stageMoveStarted          = "move-started"
+	stageMoveCompleted        = "move-completed"
+	stageDeleted              = "deleted"
+	stageAppended             = "appended"
+	stageRenamed              = "renamed"
+	stageRestored             = "restored"
+	stageExpired              = "expired"
+	stageReported             = "reported"
+)
+
+// TimelineEvent is one stage in the life of a file
+type TimelineEvent struct {
+	Time     time.Time
+	Stage    string
+	DataNode int32
+	Detail   string
+}
+
+/*
+Appends an event to fileName's timeline, must be called with the mutex held.
+Timelines are kept by name, so the upload intent is recorded before the file
+exists
+*/
+func (s *server) recordEvent(fileName, stage string, dataNode int32, detail string) {
+	events := append(s.timelines[fileName], TimelineEvent{
+		Time:     time.Now(),
+		Stage:    stage,
+		DataNode: dataNode,
+		Detail:   detail,
+	})
+	if len(events) > maxTimelineEvents {
+		events = events[len(events)-maxTimelineEvents:]
+	}
+	s.timelines[fileName] = events
+}
+
+/*
+endTimeline notes that fileName left the namespace, deleted, expired or
+renamed away. Its timeline stays readable, so what became of the file can be
+looked up, until maxEndedTimelines others have ended after it; it is dropped
+then unless the name is in use again. Must be called with the mutex held
+*/
+func (s *server) endTimeline(fileName string) {
+	s.endedTimelines = append(s.endedTimelines, fileName)
+	if len(s.endedTimelines) <= maxEndedTimelines {
+		return
+	}
+	oldest := s.endedTimelines[0]
+	s.endedTimelines = s.endedTimelines[1:]
+	if _, ok := s.fileRecords[oldest]; !ok {
+		delete(s.timelines, oldest)
+	}
+}
+
+/*
+Describes how long ago the latest request for a replica on dataNode (upload
+intent, replication, repair or move) was recorded, e.g. "2m30s after
+replication-requested"
+*/
+func (s *server) sinceRequested(fileName string, dataNode int32) string {
+	events := s.timelines[fileName]
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		if event.DataNode != dataNode {
+			continue
+		}
+		switch event.Stage {
+		case stageUploadPrepared, stageReplicationRequested, stageRepairRequested, stageMoveStarted:
+			return fmt.Sprintf("%s after %s", time.Since(event.Time).Round(time.Millisecond), event.Stage)
+		}
+	}
+	return "not requested by the master"
+}
+
+// lockAndRecordEvent is recordEvent for goroutines not holding the mutex
+func (s *server) lockAndRecordEvent(fileName, stage string, dataNode int32, detail string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.recordEvent(fileName, stage, dataNode, detail)
+}
+
+/*
+Returns the recorded stages of a file's life: upload intent, commit, every
+replica completed, repairs and moves, oldest first
+*/
+func (s *server) GetFileTimeline(ctx context.Context, in *pb.GetFileTimelineRequest) (*pb.GetFileTimelineResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	events, ok := s.timelines[in.FileName]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "No such filename exist")
+	}
+	response := &pb.GetFileTimelineResponse{}
+	for _, event := range events {
+		entry := &pb.TimelineEvent{
+			TimeUnixMs: event.Time.UnixMilli(),
+			Stage:      event.Stage,
+			Detail:     event.Detail,
+		}
+		if event.DataNode != noDataNode {
+			dataNode := event.DataNode
+			entry.DataNode = &dataNode
+		}
+		response.Events = append(response.Events, entry)
+	}
+	return response, nil
+}
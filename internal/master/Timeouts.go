@@ -0,0 +1,62 @@
+package master
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// limits on the master's outbound calls when the config leaves them at 0, -1 disables one
+const (
+	defaultRPCTimeout       = 30 * time.Second
+	defaultReplicateTimeout = time.Hour
+)
+
+// configTimeout turns a config value in seconds into a limit, 0 for none
+func configTimeout(seconds int, fallback time.Duration) time.Duration {
+	switch {
+	case seconds < 0:
+		return 0
+	case seconds == 0:
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+/*
+withDeadline bounds a call by limit unless its context has a deadline
+already, the caller's own wins. The cancel func is a no-op when no deadline
+was added
+*/
+func withDeadline(ctx context.Context, limit time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || limit == 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, limit)
+}
+
+// callTimeout is the longest a call of the gRPC method to a DataNode or client may run, 0 when unlimited
+func (s *server) callTimeout(fullMethod string) time.Duration {
+	if method := path.Base(fullMethod); method == "Replicate" || method == "RebuildBlock" {
+		return configTimeout(s.config.ReplicateTimeoutSeconds, defaultReplicateTimeout)
+	}
+	return configTimeout(s.config.RPCTimeoutSeconds, defaultRPCTimeout)
+}
+
+// cancelingStream releases the deadline of a client stream once it ends
+type cancelingStream struct {
+	grpc.ClientStream
+	cancel context.CancelFunc
+	// the server sends a stream of replies, only an error or io.EOF ends it
+	serverStreams bool
+}
+
+func (s *cancelingStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil || !s.serverStreams {
+		s.cancel()
+	}
+	return err
+}
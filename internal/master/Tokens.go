@@ -0,0 +1,174 @@
+package master
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"path"
+	pb "proj/Services"
+	"proj/internal/paths"
+	"proj/internal/token"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// lifetime of a scoped token minted without one
+const defaultTokenTTL = 24 * time.Hour
+
+/*
+checkSecrets refuses tokens without a cluster secret: DataNodes would then
+take a client naming itself the master for the master and skip its token
+checks, and anyone could call the master as a DataNode
+*/
+func (config *MasterConfig) checkSecrets() error {
+	if (config.AdminToken != "" || config.TokenSecret != "") && config.ClusterSecret == "" {
+		return errors.New("AdminToken and TokenSecret need a ClusterSecret")
+	}
+	return nil
+}
+
+/*
+authorizeScoped checks a call made with a scoped token. Only calls on files
+are allowed; a listing above the token's directory is narrowed to it
+*/
+func authorizeScoped(c *token.Claims, req interface{}) error {
+	var operation, fileName string
+	switch in := req.(type) {
+	case *pb.HandleDownloadFileRequest:
+		operation, fileName = "read", in.FileName
+	case *pb.GetReadLocationsRequest:
+		operation, fileName = "read", in.FileName
+	case *pb.GetFileTimelineRequest:
+		operation, fileName = "read", in.FileName
+	case *pb.ListVersionsRequest:
+		operation, fileName = "read", in.FileName
+	case *pb.ReportBadReplicaRequest:
+		operation, fileName = "read", in.FileName
+	case *pb.HandleUploadFileRequest:
+		operation, fileName = "write", in.Filename
+	case *pb.PrepareUploadRequest:
+		operation, fileName = "write", in.FileName
+	case *pb.AddTagsRequest:
+		operation, fileName = "write", in.FileName
+	case *pb.RemoveTagsRequest:
+		operation, fileName = "write", in.FileName
+	case *pb.FileDeleteRequest:
+		operation, fileName = "delete", in.FileName
+	case *pb.RenameFileRequest:
+		// the file is written under its new name
+		if !c.Allows("write", in.NewName) {
+			return status.Errorf(codes.PermissionDenied, "token doesn't allow write on %q", in.NewName)
+		}
+		operation, fileName = "write", in.FileName
+	case *pb.RestoreFileRequest:
+		operation, fileName = "write", in.FileName
+	case *pb.ListTrashRequest:
+		in.Prefix = c.Narrow(in.Prefix)
+		operation, fileName = "list", in.Prefix
+	case *pb.ListFilesRequest:
+		in.Prefix = c.Narrow(in.Prefix)
+		operation, fileName = "list", in.Prefix
+	default:
+		return status.Error(codes.PermissionDenied, "scoped tokens can't make this call")
+	}
+	if !c.Allows(operation, fileName) {
+		return status.Errorf(codes.PermissionDenied, "token doesn't allow %s on %q", operation, fileName)
+	}
+	return nil
+}
+
+/*
+authorizeCall checks the "authorization" metadata of a client call. A scoped
+token limits the call to its prefix and operations; otherwise, once the
+master has an AdminToken, calls need it, and hold calls the compliance token
+*/
+func (s *server) authorizeCall(ctx context.Context, fullMethod string, req interface{}) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	admin := s.config.AdminToken == ""
+	for _, value := range md.Get("authorization") {
+		bearer := strings.TrimPrefix(value, "Bearer ")
+		if strings.HasPrefix(bearer, token.Version) {
+			claims, err := token.Parse(s.config.TokenSecret, bearer)
+			if err != nil {
+				return err
+			}
+			return authorizeScoped(claims, req)
+		}
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(s.config.AdminToken)) == 1 {
+			admin = true
+		}
+	}
+	switch path.Base(fullMethod) {
+	case "SetHold", "ReleaseHold", "ListHolds":
+		admin = admin || (s.config.ComplianceToken != "" && s.authorizedCompliance(ctx))
+	}
+	if !admin {
+		return status.Error(codes.Unauthenticated, "calls need the admin token or a scoped token")
+	}
+	return nil
+}
+
+func (s *server) tokenInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	switch path.Base(info.FullMethod) {
+	// DataNodes present the cluster secret, capabilities are public
+	case "KeepAlive", "RegisterDataNode", "NotifyUploaded", "NotifyDeleted", "ReportFiles", "ReportReplicationFailure", "GetCapabilities":
+		return handler(ctx, req)
+	// clients and DataNodes that lost a data directory report bad replicas,
+	// DataNodes restoring a lost replica look up the others
+	case "ReportBadReplica", "GetReadLocations":
+		if s.config.ClusterSecret != "" && s.authorizedDataNode(ctx) {
+			return handler(ctx, req)
+		}
+	}
+	if err := s.authorizeCall(ctx, info.FullMethod, req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+/*
+MintToken signs a token granting operations on the files under a prefix,
+to share with parties that must not get the admin token. Once the master
+has an AdminToken only its holders may mint
+*/
+func (s *server) MintToken(ctx context.Context, in *pb.MintTokenRequest) (*pb.MintTokenResponse, error) {
+	if s.config.TokenSecret == "" {
+		return nil, status.Error(codes.FailedPrecondition, "scoped tokens need a TokenSecret in the master config")
+	}
+	if len(in.Operations) == 0 || in.TtlSeconds < 0 {
+		return nil, status.Error(codes.InvalidArgument, "a token needs operations and a positive lifetime")
+	}
+	var operations []string
+	for _, operation := range in.Operations {
+		if !slices.Contains(token.Operations, operation) {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown operation %q, expected one of %s", operation, strings.Join(token.Operations, ", "))
+		}
+		if !slices.Contains(operations, operation) {
+			operations = append(operations, operation)
+		}
+	}
+	ttl := defaultTokenTTL
+	if in.TtlSeconds > 0 {
+		ttl = time.Duration(in.TtlSeconds) * time.Second
+	}
+	// the prefix is a directory, a token for "reports" doesn't reach "reports-private"
+	claims := token.Claims{
+		Prefix:     paths.Dir(in.Prefix),
+		Operations: operations,
+		Expires:    time.Now().Add(ttl).Unix(),
+	}
+	signed, err := token.Sign(s.config.TokenSecret, claims)
+	if err != nil {
+		return nil, fmt.Errorf("signing token: %v", err)
+	}
+	s.audit(ctx, "mint-token", claims.Prefix, fmt.Sprintf("%s until %s", strings.Join(operations, ","),
+		time.Unix(claims.Expires, 0).UTC().Format(time.RFC3339)))
+	return &pb.MintTokenResponse{Token: signed, ExpiresUnix: claims.Expires}, nil
+}
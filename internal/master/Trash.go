@@ -0,0 +1,193 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"log"
+	pb "proj/Services"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// time between looks for trashed files past their purge time
+const trashPurgeInterval = time.Minute
+
+/*
+trashedFile is a deleted file still restorable. The DataNodes that held it
+keep their copies in their trash under ID until Purge and remove them on
+their own afterwards
+*/
+type trashedFile struct {
+	Record  *FileRecord
+	ID      int64
+	Deleted time.Time
+	Purge   time.Time
+}
+
+/*
+trashFile keeps the record of a deleted file restorable under id for
+TrashRetentionSeconds, nil when it's 0. A name deleted again is restorable
+to its last content only, the older copies are left to be purged. Must be
+called with the mutex held
+*/
+func (s *server) trashFile(record *FileRecord, id int64) *trashedFile {
+	if s.config.TrashRetentionSeconds <= 0 {
+		return nil
+	}
+	now := time.Now()
+	trashed := &trashedFile{
+		Record:  record,
+		ID:      id,
+		Deleted: now,
+		Purge:   now.Add(time.Duration(s.config.TrashRetentionSeconds) * time.Second),
+	}
+	s.trash[record.FileName] = trashed
+	return trashed
+}
+
+/*
+RestoreFile brings a deleted file back from the trash under its name, which
+must be free. Every live DataNode that held it moves its copy back; the file
+is restored with those that succeeded and repair copies it again if they are
+too few. The name is reserved like a rename's meanwhile
+*/
+func (s *server) RestoreFile(ctx context.Context, in *pb.RestoreFileRequest) (*pb.RestoreFileResponse, error) {
+	s.mutex.Lock()
+	trashed, ok := s.trash[in.FileName]
+	if !ok {
+		s.mutex.Unlock()
+		return nil, status.Errorf(codes.NotFound, "%s isn't in the trash", in.FileName)
+	}
+	if _, exists := s.fileRecords[in.FileName]; exists || s.renaming[in.FileName] {
+		s.mutex.Unlock()
+		return nil, status.Errorf(codes.AlreadyExists, "%s exists, rename or delete it first", in.FileName)
+	}
+	if err := s.checkPathConflict(in.FileName); err != nil {
+		s.mutex.Unlock()
+		return nil, err
+	}
+	record := trashed.Record
+	if _, err := s.checkQuota(in.FileName, record.Size); err != nil {
+		s.mutex.Unlock()
+		return nil, err
+	}
+	addrs := make(map[int32]string)
+	for _, node := range record.DataNodes {
+		if machine := s.machineRecords[node]; machine.Liveness {
+			addrs[node] = machine.masterAddr()
+		}
+	}
+	if len(addrs) == 0 {
+		s.mutex.Unlock()
+		return nil, status.Errorf(codes.Unavailable, "no DataNode holding %s is alive", in.FileName)
+	}
+	generation := s.nextGeneration()
+	delete(s.trash, in.FileName)
+	s.renaming[in.FileName] = true
+	s.mutex.Unlock()
+
+	// the DataNodes are called without the mutex, the name is reserved instead
+	paths := make(map[int32]string)
+	var err error
+	for node, addr := range addrs {
+		path, restoreErr := s.restoreReplica(ctx, addr, &pb.RestoreFileRequest{
+			FileName:        in.FileName,
+			TrashId:         trashed.ID,
+			ContentEncoding: record.ContentEncoding,
+			Checksum:        record.Checksum,
+			Generation:      generation,
+		})
+		if restoreErr != nil {
+			err = fmt.Errorf("restoring %s on DataNode %d failed: %v", in.FileName, node, restoreErr)
+			log.Print(err)
+			continue
+		}
+		paths[node] = path
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.renaming, in.FileName)
+	if len(paths) == 0 {
+		// nothing moved, the file stays restorable unless deleted again meanwhile
+		if _, ok := s.trash[in.FileName]; !ok {
+			s.trash[in.FileName] = trashed
+		}
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+
+	record.DataNodes = nil
+	record.FilePaths = nil
+	for node, path := range paths {
+		record.DataNodes = append(record.DataNodes, node)
+		record.FilePaths = append(record.FilePaths, path)
+	}
+	for node := range record.CorruptReplicas {
+		if _, ok := paths[node]; !ok {
+			delete(record.CorruptReplicas, node)
+		}
+	}
+	record.Generation = generation
+	s.fileRecords[in.FileName] = record
+	s.indexChecksum(in.FileName, record.Checksum)
+	s.recordEvent(in.FileName, stageRestored, noDataNode, fmt.Sprintf("from the trash, on DataNodes %v", record.DataNodes))
+	log.Printf("%s restored on DataNodes %v", in.FileName, record.DataNodes)
+	s.PrintFileRecords()
+	return &pb.RestoreFileResponse{}, nil
+}
+
+// restoreReplica asks the DataNode at addr, its master port, to restore its trashed copy and returns its path
+func (s *server) restoreReplica(ctx context.Context, addr string, request *pb.RestoreFileRequest) (string, error) {
+	conn, err := s.dialDataNode(addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	response, err := pb.NewFileServiceClient(conn).RestoreFile(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	return response.FilePath, nil
+}
+
+// ListTrash lists the deleted files below prefix still restorable, by name
+func (s *server) ListTrash(ctx context.Context, in *pb.ListTrashRequest) (*pb.ListTrashResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	response := &pb.ListTrashResponse{}
+	for name, trashed := range s.trash {
+		if !strings.HasPrefix(name, in.Prefix) {
+			continue
+		}
+		response.Files = append(response.Files, &pb.TrashedFile{
+			FileName:      name,
+			Size:          trashed.Record.Size,
+			DeletedUnixMs: trashed.Deleted.UnixMilli(),
+			PurgeUnixMs:   trashed.Purge.UnixMilli(),
+		})
+	}
+	sort.Slice(response.Files, func(i, j int) bool {
+		return response.Files[i].FileName < response.Files[j].FileName
+	})
+	return response, nil
+}
+
+// purgeTrash forgets the trashed files past their purge time
+func (s *server) purgeTrash() {
+	for s.sleep(trashPurgeInterval) {
+		s.mutex.Lock()
+		now := time.Now()
+		for name, trashed := range s.trash {
+			if now.After(trashed.Purge) {
+				delete(s.trash, name)
+				log.Printf("%s purged from the trash", name)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
@@ -0,0 +1,57 @@
+package master
+
+import (
+	pb "proj/Services"
+	"time"
+)
+
+// how long the master remembers the upload IDs it recorded, DataNodes retry a notification well within it
+const notifiedUploadRetention = 24 * time.Hour
+
+// notifiedUpload is an upload recorded by NotifyUploaded and the answer it got
+type notifiedUpload struct {
+	id       string
+	at       time.Time
+	response *pb.NotifyUploadedResponse
+}
+
+/*
+notifiedUploads remembers the uploads recorded in the last
+notifiedUploadRetention by ID, oldest first, so a notification sent again
+is answered without recording its upload twice
+*/
+type notifiedUploads struct {
+	byID  map[string]*notifiedUpload
+	order []*notifiedUpload
+}
+
+// get is the answer to send again to the notification of upload id, marked duplicate
+func (n *notifiedUploads) get(id string) (*pb.NotifyUploadedResponse, bool) {
+	upload, ok := n.byID[id]
+	if id == "" || !ok {
+		return nil, false
+	}
+	return &pb.NotifyUploadedResponse{
+		Generation:    upload.response.Generation,
+		ExpiresUnixMs: upload.response.ExpiresUnixMs,
+		Acknowledged:  true,
+		Duplicate:     true,
+	}, true
+}
+
+// add remembers upload id recorded with response, forgetting those past the retention
+func (n *notifiedUploads) add(id string, response *pb.NotifyUploadedResponse, now time.Time) {
+	for len(n.order) > 0 && now.Sub(n.order[0].at) > notifiedUploadRetention {
+		delete(n.byID, n.order[0].id)
+		n.order = n.order[1:]
+	}
+	if id == "" {
+		return
+	}
+	if n.byID == nil {
+		n.byID = make(map[string]*notifiedUpload)
+	}
+	upload := &notifiedUpload{id: id, at: now, response: response}
+	n.byID[id] = upload
+	n.order = append(n.order, upload)
+}
@@ -0,0 +1,106 @@
+package master
+
+import (
+	"context"
+	"log"
+	pb "proj/Services"
+	"slices"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fileVersion is an earlier content of a file, kept by the DataNodes that held it when it was replaced
+type fileVersion struct {
+	Record   FileRecord
+	Replaced time.Time
+}
+
+/*
+keepVersion records the content of record, replaced by an upload or an
+append, in the file's version history. Only the last KeepVersions are kept,
+like on the DataNodes. Must be called with the mutex held
+*/
+func (s *server) keepVersion(record *FileRecord) {
+	if s.config.KeepVersions <= 0 {
+		return
+	}
+	versions := append(s.versions[record.FileName], &fileVersion{Record: *record, Replaced: time.Now()})
+	if len(versions) > s.config.KeepVersions {
+		versions = versions[len(versions)-s.config.KeepVersions:]
+	}
+	s.versions[record.FileName] = versions
+}
+
+// replaceFile drops the record of a stored file a new upload replaces, must be called with the mutex held
+func (s *server) replaceFile(record *FileRecord) {
+	delete(s.fileRecords, record.FileName)
+	delete(s.pendingMoves, record.FileName)
+	delete(s.retryingReplicas, record.FileName)
+	delete(s.checksumIndex[record.Checksum], record.FileName)
+	log.Printf("%s is being replaced by a new upload", record.FileName)
+}
+
+/*
+retireReplaced is called once the content of old is replaced and the new
+content is on its way to holders, the DataNode that committed it among
+them. Those that held old keep it as a version as they get the new content,
+the others drop their stale copy. Must be called with the mutex held
+*/
+func (s *server) retireReplaced(old FileRecord, holders []int32) {
+	version := old
+	version.DataNodes, version.FilePaths = nil, nil
+	for i, node := range old.DataNodes {
+		if !slices.Contains(holders, node) {
+			s.deleteReplica(node, &pb.FileDeleteRequest{FileName: old.FileName})
+			continue
+		}
+		version.DataNodes = append(version.DataNodes, node)
+		if i < len(old.FilePaths) {
+			version.FilePaths = append(version.FilePaths, old.FilePaths[i])
+		}
+	}
+	if len(version.DataNodes) > 0 {
+		s.keepVersion(&version)
+	}
+}
+
+// isNewUpload tells whether in is the commit of an upload prepared by PrepareUpload rather than a replica
+func (s *server) isNewUpload(in *pb.NotifyUploadedRequest) bool {
+	pending, found := s.pendingUploads[in.UploadToken]
+	return found && pending.FileName == in.FileName
+}
+
+// ListVersions lists the earlier contents kept of a file, oldest first, and where to download them with DownloadVersion
+func (s *server) ListVersions(ctx context.Context, in *pb.ListVersionsRequest) (*pb.ListVersionsResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	versions, ok := s.versions[in.FileName]
+	if !ok {
+		if _, exists := s.fileRecords[in.FileName]; !exists {
+			return nil, status.Error(codes.NotFound, "No such filename exist")
+		}
+	}
+	response := &pb.ListVersionsResponse{}
+	for _, version := range versions {
+		listed := &pb.FileVersion{
+			Generation:     version.Record.Generation,
+			Size:           version.Record.Size,
+			Checksum:       version.Record.Checksum,
+			ReplacedUnixMs: version.Replaced.UnixMilli(),
+		}
+		for _, nodeID := range version.Record.DataNodes {
+			machine := s.machineRecords[nodeID]
+			listed.Replicas = append(listed.Replicas, &pb.ReplicaLocation{
+				IpAddress:  machine.IPAddress,
+				PortNumber: machine.ClientNodePort,
+				DataNode:   nodeID,
+				Alive:      machine.Liveness,
+			})
+		}
+		response.Versions = append(response.Versions, listed)
+	}
+	return response, nil
+}
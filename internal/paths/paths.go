@@ -0,0 +1,23 @@
+// Package paths matches file names of the cluster against the directories
+// quotas, holds, placement rules and scoped tokens are set on.
+package paths
+
+import "strings"
+
+// Under reports whether name is dir or lies under it, comparing whole path
+// components: "logs" covers "logs/a" but not "logs2/a". The empty dir covers
+// every name.
+func Under(name, dir string) bool {
+	dir = strings.TrimSuffix(dir, "/")
+	return dir == "" || name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// Dir returns dir without a leading "/" and ending in one, "" for the root,
+// so a plain prefix match on it stops at a path component.
+func Dir(dir string) string {
+	dir = strings.Trim(dir, "/")
+	if dir == "" {
+		return ""
+	}
+	return dir + "/"
+}
@@ -0,0 +1,41 @@
+package paths
+
+import "testing"
+
+func TestUnder(t *testing.T) {
+	tests := []struct {
+		name, dir string
+		under     bool
+	}{
+		{"logs/a", "logs", true},
+		{"logs/a", "logs/", true},
+		{"logs", "logs", true},
+		{"logs/2024/a", "logs", true},
+		{"logs2/a", "logs", false},
+		{"logs-private/a", "logs", false},
+		{"log", "logs", false},
+		{"anything", "", true},
+		{"fin/a", "finance", false},
+		{"finance2/a", "fin", false},
+	}
+	for _, test := range tests {
+		if under := Under(test.name, test.dir); under != test.under {
+			t.Errorf("Under(%q, %q) = %v, want %v", test.name, test.dir, under, test.under)
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	tests := map[string]string{
+		"":                "",
+		"/":               "",
+		"public/reports":  "public/reports/",
+		"/public/reports": "public/reports/",
+		"public/reports/": "public/reports/",
+	}
+	for dir, want := range tests {
+		if got := Dir(dir); got != want {
+			t.Errorf("Dir(%q) = %q, want %q", dir, got, want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Package tlsconfig loads the certificates of the cluster's mutual TLS, as
+// generated by dfsctl init, for the master, the DataNodes and the SDK.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Config is the "TLS" section of a master or DataNode config: PEM files
+// issued by the cluster CA. Relative paths are relative to the config file,
+// see ResolvePaths.
+type Config struct {
+	CertFile string `json:"CertFile"`
+	KeyFile  string `json:"KeyFile"`
+	CAFile   string `json:"CAFile"`
+}
+
+// ResolvePaths makes relative file paths relative to configDir.
+func (c *Config) ResolvePaths(configDir string) {
+	for _, path := range []*string{&c.CertFile, &c.KeyFile, &c.CAFile} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(configDir, *path)
+		}
+	}
+}
+
+// load reads the node certificate and the cluster CA.
+func load(certFile, keyFile, caFile string) (tls.Certificate, *x509.CertPool, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("loading certificate: %v", err)
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("loading CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return tls.Certificate{}, nil, fmt.Errorf("no certificate in %s", caFile)
+	}
+	return certificate, pool, nil
+}
+
+// Credentials returns the transport credentials of a node. The server side
+// requires callers to present a certificate issued by the CA, the client
+// side verifies peers against it and presents the node certificate. Without
+// a config both sides are plaintext.
+func Credentials(config *Config) (server, client credentials.TransportCredentials, err error) {
+	if config == nil {
+		return insecure.NewCredentials(), insecure.NewCredentials(), nil
+	}
+	certificate, pool, err := load(config.CertFile, config.KeyFile, config.CAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	server = credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	})
+	return server, clientCredentials(certificate, pool), nil
+}
+
+// ClientCredentials returns the credentials of a client presenting the
+// certificate in certFile and keyFile and verifying the nodes against the
+// CA in caFile.
+func ClientCredentials(certFile, keyFile, caFile string) (credentials.TransportCredentials, error) {
+	certificate, pool, err := load(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+	return clientCredentials(certificate, pool), nil
+}
+
+func clientCredentials(certificate tls.Certificate, pool *x509.CertPool) credentials.TransportCredentials {
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	})
+}
@@ -0,0 +1,88 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolvePaths(t *testing.T) {
+	config := &Config{CertFile: "node.crt", KeyFile: "/etc/dfs/node.key"}
+	config.ResolvePaths("/srv/dfs")
+	want := Config{CertFile: filepath.Join("/srv/dfs", "node.crt"), KeyFile: "/etc/dfs/node.key"}
+	if *config != want {
+		t.Errorf("resolved %+v, want %+v", *config, want)
+	}
+}
+
+// writePEM writes a self-signed certificate and its key to dir, returning their paths
+func writePEM(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dfs test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestCredentials(t *testing.T) {
+	server, client, err := Credentials(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Info().SecurityProtocol != "insecure" || client.Info().SecurityProtocol != "insecure" {
+		t.Errorf("no config gave %s and %s, want plaintext", server.Info().SecurityProtocol, client.Info().SecurityProtocol)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := writePEM(t, dir)
+	server, client, err = Credentials(&Config{CertFile: certFile, KeyFile: keyFile, CAFile: certFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Info().SecurityProtocol != "tls" || client.Info().SecurityProtocol != "tls" {
+		t.Errorf("config gave %s and %s, want tls", server.Info().SecurityProtocol, client.Info().SecurityProtocol)
+	}
+	if _, err := ClientCredentials(certFile, keyFile, certFile); err != nil {
+		t.Error(err)
+	}
+
+	// the key file isn't a CA
+	if _, err := ClientCredentials(certFile, keyFile, keyFile); err == nil {
+		t.Error("loaded a CA without a certificate")
+	}
+	if _, _, err := Credentials(&Config{CertFile: certFile, KeyFile: filepath.Join(dir, "missing.key"), CAFile: certFile}); err == nil {
+		t.Error("loaded a certificate without its key")
+	}
+}
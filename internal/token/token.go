@@ -0,0 +1,87 @@
+// Package token signs and checks the scoped tokens the master mints. The
+// master and the DataNodes share the TokenSecret, so each checks them on its
+// own.
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"proj/internal/paths"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Version starts every scoped token, telling it from the admin token.
+const Version = "dfs1."
+
+// Operations a scoped token may grant.
+var Operations = []string{"read", "write", "delete", "list"}
+
+// Claims is what a scoped token grants: the operations on the files under
+// the directory Prefix, until Expires.
+type Claims struct {
+	Prefix     string   `json:"p"`
+	Operations []string `json:"o"`
+	Expires    int64    `json:"e"`
+}
+
+func signature(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(Version + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign encodes claims as "dfs1.<claims>.<signature>".
+func Sign(secret string, claims Claims) (string, error) {
+	content, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(content)
+	return Version + payload + "." + signature(secret, payload), nil
+}
+
+// Parse verifies a scoped token's signature and expiry, failing with
+// Unauthenticated.
+func Parse(secret, token string) (*Claims, error) {
+	if secret == "" {
+		return nil, status.Error(codes.Unauthenticated, "scoped tokens aren't enabled, there is no TokenSecret")
+	}
+	payload, sig, ok := strings.Cut(strings.TrimPrefix(token, Version), ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(signature(secret, payload))) {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	content, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	var claims Claims
+	if err := json.Unmarshal(content, &claims); err != nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return nil, status.Error(codes.Unauthenticated, "token expired")
+	}
+	return &claims, nil
+}
+
+// Allows reports whether the token grants operation on fileName, which must
+// be under its directory.
+func (c *Claims) Allows(operation, fileName string) bool {
+	return slices.Contains(c.Operations, operation) && paths.Under(fileName, c.Prefix)
+}
+
+// Narrow returns the prefix a listing of prefix made with the token covers:
+// the token's directory when the listing is above it.
+func (c *Claims) Narrow(prefix string) string {
+	if strings.HasPrefix(c.Prefix, prefix) {
+		return paths.Dir(c.Prefix)
+	}
+	return prefix
+}
@@ -0,0 +1,76 @@
+package token
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignAndParse(t *testing.T) {
+	claims := Claims{Prefix: "public/reports/", Operations: []string{"read"}, Expires: time.Now().Add(time.Hour).Unix()}
+	signed, err := Sign("secret", claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Parse("secret", signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Prefix != claims.Prefix || parsed.Expires != claims.Expires {
+		t.Errorf("parsed %+v, want %+v", parsed, claims)
+	}
+	if _, err := Parse("other secret", signed); err == nil {
+		t.Error("a token signed with another secret was accepted")
+	}
+	if _, err := Parse("", signed); err == nil {
+		t.Error("a token was accepted without a secret")
+	}
+	if _, err := Parse("secret", signed+"x"); err == nil {
+		t.Error("a token with a changed signature was accepted")
+	}
+	claims.Expires = time.Now().Add(-time.Second).Unix()
+	expired, err := Sign("secret", claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Parse("secret", expired); err == nil {
+		t.Error("an expired token was accepted")
+	}
+}
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		prefix, operation, fileName string
+		allowed                     bool
+	}{
+		{"public/reports/", "read", "public/reports/q1.pdf", true},
+		{"public/reports", "read", "public/reports/q1.pdf", true},
+		{"public/reports", "read", "public/reports-private/q1.pdf", false},
+		{"public/reports/", "read", "public/reports-private/q1.pdf", false},
+		{"public/reports/", "write", "public/reports/q1.pdf", false},
+		{"", "read", "anything", true},
+	}
+	for _, test := range tests {
+		claims := Claims{Prefix: test.prefix, Operations: []string{"read", "list"}}
+		if allowed := claims.Allows(test.operation, test.fileName); allowed != test.allowed {
+			t.Errorf("token on %q: Allows(%q, %q) = %v, want %v", test.prefix, test.operation, test.fileName, allowed, test.allowed)
+		}
+	}
+}
+
+func TestNarrow(t *testing.T) {
+	tests := []struct {
+		prefix, listing, want string
+	}{
+		{"public/reports/", "", "public/reports/"},
+		{"public/reports/", "public/rep", "public/reports/"},
+		{"public/reports", "public/reports", "public/reports/"},
+		{"public/reports/", "public/reports/2024", "public/reports/2024"},
+		{"public/reports/", "private/", "private/"},
+	}
+	for _, test := range tests {
+		claims := Claims{Prefix: test.prefix}
+		if got := claims.Narrow(test.listing); got != test.want {
+			t.Errorf("token on %q: Narrow(%q) = %q, want %q", test.prefix, test.listing, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+import "proj/internal/master"
+
+func main() {
+	master.Main()
+}
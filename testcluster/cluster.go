@@ -0,0 +1,292 @@
+// Package testcluster runs a real master and DataNodes on localhost for
+// end-to-end tests of uploads, replication, failures and repair.
+//
+// The master and the DataNodes run in the test process, each serving on
+// localhost ports held open for the cluster's life, with its files under a
+// temporary directory. Stopping a node stops its servers at once without
+// telling the others, which is how a crash looks to the rest of the
+// cluster; the node's ports refuse nothing but close every connection until
+// it restarts on them.
+//
+//	cluster, err := testcluster.Start(testcluster.Options{DataNodes: 3})
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer cluster.Close()
+//	client, err := cluster.Client()
+package testcluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"proj/dfs"
+	"proj/internal/datanode"
+	"proj/internal/master"
+	"sync"
+	"time"
+)
+
+// how long nodes get to come up
+const startTimeout = 30 * time.Second
+
+// Options configures a test cluster.
+type Options struct {
+	// number of DataNodes, started in order so DataNode i gets ID i
+	DataNodes int
+	// extra fields of the master config, e.g. "RebalanceThresholdPercent"
+	MasterConfig map[string]any
+	// extra fields of DataNode id's config, e.g. "Labels" or "Faults"; may be nil
+	DataNodeConfig func(id int) map[string]any
+}
+
+// Cluster is a running master with its DataNodes.
+type Cluster struct {
+	// temporary directory holding configs and storage, removed by Close
+	Dir       string
+	DataNodes []*Node
+
+	master     *Node
+	masterAddr string
+	ports      []*port
+}
+
+// Node is the master or a DataNode.
+type Node struct {
+	// DataNode ID, -1 for the master
+	ID int32
+	// address clients dial: the master's client port or the DataNode's client port
+	Addr string
+	// the DataNode's storage root, empty for the master
+	StorageDir string
+
+	// starts the node serving on listeners, returning how to stop it
+	start func(listeners []net.Listener) (stop func(), err error)
+	ports []*port
+	mutex sync.Mutex
+	stop  func()
+}
+
+/*
+Start starts the master then the DataNodes, returning once every DataNode
+is registered and alive
+*/
+func Start(options Options) (*Cluster, error) {
+	dir, err := os.MkdirTemp("", "testcluster-")
+	if err != nil {
+		return nil, err
+	}
+	c := &Cluster{Dir: dir}
+
+	masterPorts, err := c.listen(2)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.masterAddr = masterPorts[0].addr()
+	masterConfig := map[string]any{
+		"ClientPort":    fmt.Sprintf(":%d", masterPorts[0].number()),
+		"DataNodePort":  fmt.Sprintf(":%d", masterPorts[1].number()),
+		"AuditLogPath":  filepath.Join(dir, "audit.log"),
+		"HoldsPath":     filepath.Join(dir, "holds.json"),
+		"ClusterIDPath": filepath.Join(dir, "cluster_id"),
+	}
+	for key, value := range options.MasterConfig {
+		masterConfig[key] = value
+	}
+	content, err := json.Marshal(masterConfig)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.master = &Node{ID: -1, Addr: c.masterAddr, ports: masterPorts}
+	c.master.start = func(listeners []net.Listener) (func(), error) {
+		// a fresh config each start, as a restarted process would read it
+		var config master.MasterConfig
+		if err := json.Unmarshal(content, &config); err != nil {
+			return nil, err
+		}
+		m, err := master.Start(config, dir, listeners[0], listeners[1])
+		if err != nil {
+			return nil, err
+		}
+		return m.Stop, nil
+	}
+	if err := c.master.Restart(); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("master did not start: %v", err)
+	}
+
+	client, err := c.Client()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+
+	for id := 0; id < options.DataNodes; id++ {
+		// ports for the master, the clients and the other DataNodes
+		ports, err := c.listen(3)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		storageDir := filepath.Join(dir, fmt.Sprintf("datanode-%d", id))
+		config := map[string]any{
+			"IP":             "127.0.0.1",
+			"ID":             id,
+			"MasterNodePort": fmt.Sprintf(":%d", ports[0].number()),
+			"ClientNodePort": fmt.Sprintf(":%d", ports[1].number()),
+			"DataNodePort":   fmt.Sprintf(":%d", ports[2].number()),
+			"MasterAddress":  masterPorts[1].addr(),
+			"DataDir":        storageDir,
+		}
+		if options.DataNodeConfig != nil {
+			for key, value := range options.DataNodeConfig(id) {
+				config[key] = value
+			}
+		}
+		content, err := json.Marshal(config)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		node := &Node{ID: int32(id), Addr: ports[1].addr(), StorageDir: storageDir, ports: ports}
+		node.start = func(listeners []net.Listener) (func(), error) {
+			d, err := datanode.Start(content, dir, datanode.Listeners{Master: listeners[0], Client: listeners[1], DataNode: listeners[2]})
+			if err != nil {
+				return nil, err
+			}
+			return d.Stop, nil
+		}
+		if err := node.Restart(); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("datanode-%d did not start: %v", id, err)
+		}
+		c.DataNodes = append(c.DataNodes, node)
+		// the master numbers DataNodes in registration order, wait for this
+		// one before starting the next so the IDs match
+		if err := c.waitForDataNodes(ctx, client, id+1); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("datanode-%d did not register: %v", id, err)
+		}
+	}
+	return c, nil
+}
+
+// listen holds count localhost ports open until Close
+func (c *Cluster) listen(count int) ([]*port, error) {
+	var ports []*port
+	for range count {
+		p, err := listenPort()
+		if err != nil {
+			return nil, err
+		}
+		c.ports = append(c.ports, p)
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+// waitForDataNodes polls the master until count DataNodes are registered and live
+func (c *Cluster) waitForDataNodes(ctx context.Context, client *dfs.Client, count int) error {
+	for {
+		metrics, err := client.MasterMetrics(ctx)
+		if err == nil && int(metrics.DataNodes) >= count && int(metrics.LiveDataNodes) >= count {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// WaitForLiveDataNodes blocks until the master counts count DataNodes as live,
+// e.g. after restarting stopped ones.
+func (c *Cluster) WaitForLiveDataNodes(ctx context.Context, count int) error {
+	client, err := c.Client()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return c.waitForDataNodes(ctx, client, count)
+}
+
+// MasterAddr is the address to pass to dfs.Dial.
+func (c *Cluster) MasterAddr() string {
+	return c.masterAddr
+}
+
+// Master is the master process.
+func (c *Cluster) Master() *Node {
+	return c.master
+}
+
+// Client dials the master with the real SDK client.
+func (c *Cluster) Client() (*dfs.Client, error) {
+	return dfs.Dial(c.masterAddr)
+}
+
+// Close stops every node, releases their ports and removes the cluster's directory.
+func (c *Cluster) Close() {
+	for _, node := range c.DataNodes {
+		node.Stop()
+	}
+	if c.master != nil {
+		c.master.Stop()
+	}
+	for _, p := range c.ports {
+		p.close()
+	}
+	os.RemoveAll(c.Dir)
+}
+
+// Running reports whether the node is serving, started and not stopped since.
+func (n *Node) Running() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.stop != nil
+}
+
+// Stop stops the node at once, as a crash would: calls in progress are cut
+// off and its ports close every connection until it restarts.
+func (n *Node) Stop() error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.stop == nil {
+		return nil
+	}
+	n.stop()
+	n.stop = nil
+	return nil
+}
+
+// Restart starts a stopped node again with the same config, ports and storage.
+func (n *Node) Restart() error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.stop != nil {
+		return errors.New("node is running")
+	}
+	listeners := make([]net.Listener, len(n.ports))
+	for i, p := range n.ports {
+		listeners[i] = p.serve()
+	}
+	stop, err := n.start(listeners)
+	if err != nil {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		return err
+	}
+	n.stop = stop
+	return nil
+}
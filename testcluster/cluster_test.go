@@ -0,0 +1,270 @@
+package testcluster
+
+import (
+	"bytes"
+	"context"
+	"io"
+	pb "proj/Services"
+	"proj/dfs"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// holders returns the running DataNodes storing fileName
+func holders(ctx context.Context, t *testing.T, cluster *Cluster, fileName string) []*Node {
+	client, err := cluster.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var nodes []*Node
+	for _, node := range cluster.DataNodes {
+		if !node.Running() {
+			continue
+		}
+		files, err := client.ListLocalFiles(ctx, node.Addr, fileName, false)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if file.FileName == fileName {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+	return nodes
+}
+
+// waitForHolders polls until count running DataNodes store fileName
+func waitForHolders(ctx context.Context, t *testing.T, cluster *Cluster, fileName string, count int) []*Node {
+	for {
+		nodes := holders(ctx, t, cluster, fileName)
+		if len(nodes) >= count {
+			return nodes
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("%s is on %d running DataNode(s), want %d", fileName, len(nodes), count)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// missing returns the first of all not in nodes
+func missing(all, nodes []*Node) *Node {
+	for _, node := range all {
+		if !containsNode(nodes, node) {
+			return node
+		}
+	}
+	return nil
+}
+
+func containsNode(nodes []*Node, node *Node) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReplicationAfterDataNodeStops(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a master and four DataNodes")
+	}
+	cluster, err := Start(Options{DataNodes: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	client, err := cluster.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	const fileName = "replicated.txt"
+	content := bytes.Repeat([]byte("replicated by the master\n"), 1000)
+	if err := client.Upload(ctx, fileName, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	nodes := waitForHolders(ctx, t, cluster, fileName, 3)
+
+	stopped := nodes[0]
+	if err := stopped.Stop(); err != nil {
+		t.Logf("stopping datanode-%d: %v", stopped.ID, err)
+	}
+	// the master repairs the file on the DataNode that didn't have it
+	repaired := waitForHolders(ctx, t, cluster, fileName, 3)
+	if !containsNode(repaired, missing(cluster.DataNodes, nodes)) {
+		t.Errorf("%s wasn't copied to the DataNode lacking it", fileName)
+	}
+
+	reader, err := client.Open(ctx, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	read, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, content) {
+		t.Errorf("read %d bytes after repair, want the %d uploaded", len(read), len(content))
+	}
+}
+
+// waitFor polls until done reports true
+func waitFor(ctx context.Context, t *testing.T, what string, done func() bool) {
+	for !done() {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %s", what)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+func TestHardQuotaAtCommit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a master and a DataNode")
+	}
+	cluster, err := Start(Options{DataNodes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	client, err := cluster.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := client.SetQuota(ctx, "quota", 0, 1000); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("over the quota\n"), 300)
+	// without a declared size the upload gets past PrepareUpload
+	const refused = "quota/large.txt"
+	if err := client.Upload(ctx, refused, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	// a quota on "quota" doesn't cover "quota2"
+	const accepted = "quota2/large.txt"
+	if err := client.Upload(ctx, accepted, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(ctx, t, "the commit to be refused", func() bool {
+		events, err := client.FileTimeline(ctx, refused)
+		if err != nil {
+			return false
+		}
+		for _, event := range events {
+			if event.Stage == "commit-refused" {
+				return true
+			}
+		}
+		return false
+	})
+	waitFor(ctx, t, "the refused copy to be deleted", func() bool {
+		return len(holders(ctx, t, cluster, refused)) == 0
+	})
+	files, err := client.ListFiles(ctx, "quota/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) > 0 {
+		t.Errorf("%s is listed after its commit was refused", files[0].FileName)
+	}
+	waitForHolders(ctx, t, cluster, accepted, 1)
+}
+
+// blockLocation asks the master for the block of fileName at offset, returning its name and the DataNode holding it
+func blockLocation(ctx context.Context, t *testing.T, cluster *Cluster, fileName string, offset int64) (string, *Node) {
+	conn, err := grpc.Dial(cluster.masterAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	locations, err := pb.NewFileServiceClient(conn).GetReadLocations(ctx, &pb.GetReadLocationsRequest{FileName: fileName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range locations.Blocks {
+		if block.Offset == offset && block.Parity == 0 && len(block.Replicas) > 0 {
+			return block.FileName, cluster.DataNodes[block.Replicas[0].DataNode]
+		}
+	}
+	t.Fatalf("%s has no block at offset %d", fileName, offset)
+	return "", nil
+}
+
+func TestErasureCodedBlockRebuilt(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a master and ten DataNodes")
+	}
+	cluster, err := Start(Options{DataNodes: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	client, err := cluster.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	// a stripe of six blocks and a short one of two
+	const fileName = "erasure.bin"
+	content := bytes.Repeat([]byte("six data blocks and three parity\n"), 230)[:7500]
+	writer, err := client.Create(ctx, fileName, dfs.WithStorageClass("erasure-6-3"), dfs.WithBlockSize(1000), dfs.WithSize(int64(len(content))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	blockName, stopped := blockLocation(ctx, t, cluster, fileName, 1000)
+	if err := stopped.Stop(); err != nil {
+		t.Logf("stopping datanode-%d: %v", stopped.ID, err)
+	}
+	// the block is decoded from the others of its stripe until it is rebuilt
+	read := func() []byte {
+		reader, err := client.Open(ctx, fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		read, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return read
+	}
+	if got := read(); !bytes.Equal(got, content) {
+		t.Errorf("read %d bytes with a block lost, want the %d uploaded", len(got), len(content))
+	}
+
+	rebuilt := waitForHolders(ctx, t, cluster, blockName, 1)
+	if rebuilt[0] == stopped {
+		t.Errorf("%s is back on the stopped DataNode", blockName)
+	}
+	if got := read(); !bytes.Equal(got, content) {
+		t.Errorf("read %d bytes after the rebuild, want the %d uploaded", len(got), len(content))
+	}
+}
@@ -0,0 +1,108 @@
+package testcluster
+
+import (
+	"net"
+	"sync"
+)
+
+/*
+port is a localhost port held open for the cluster's life, so a stopped
+node restarts on the same port without another process taking it in
+between. The connections it accepts go to the node serving on it, and are
+closed while none is
+*/
+type port struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	served   *servedListener
+}
+
+func listenPort() (*port, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &port{listener: listener}
+	go p.accept()
+	return p, nil
+}
+
+func (p *port) accept() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.mutex.Lock()
+		served := p.served
+		p.mutex.Unlock()
+		if served == nil || !served.deliver(conn) {
+			conn.Close()
+		}
+	}
+}
+
+// addr is the address to dial the port on
+func (p *port) addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *port) number() int {
+	return p.listener.Addr().(*net.TCPAddr).Port
+}
+
+// serve returns the listener a node serves the port on, until it closes it
+func (p *port) serve() net.Listener {
+	served := &servedListener{port: p, conns: make(chan net.Conn), done: make(chan struct{})}
+	p.mutex.Lock()
+	p.served = served
+	p.mutex.Unlock()
+	return served
+}
+
+func (p *port) close() {
+	p.listener.Close()
+}
+
+// servedListener hands a node the connections its port accepts
+type servedListener struct {
+	port      *port
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// deliver waits for the node to accept conn, false once the listener is closed
+func (l *servedListener) deliver(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *servedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *servedListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.port.mutex.Lock()
+		if l.port.served == l {
+			l.port.served = nil
+		}
+		l.port.mutex.Unlock()
+	})
+	return nil
+}
+
+func (l *servedListener) Addr() net.Addr {
+	return l.port.listener.Addr()
+}